@@ -1,3 +1,17 @@
 module keepo
 
-require golang.org/x/crypto v0.0.0-20190123085648-057139ce5d2b
+go 1.25.0
+
+require (
+	github.com/hanwen/go-fuse/v2 v2.9.0
+	golang.org/x/crypto v0.50.0
+	golang.org/x/sys v0.43.0
+	google.golang.org/grpc v1.82.1
+	google.golang.org/protobuf v1.36.11
+)
+
+require (
+	golang.org/x/net v0.53.0 // indirect
+	golang.org/x/text v0.36.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20260414002931-afd174a4e478 // indirect
+)
@@ -0,0 +1,5 @@
+// Package api holds the keepo gRPC service, generated from keepo.proto, which needs protoc with
+// protoc-gen-go and protoc-gen-go-grpc to regenerate
+package api
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative keepo.proto
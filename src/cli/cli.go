@@ -0,0 +1,265 @@
+package cli
+
+import (
+	"sort"
+	"strings"
+)
+
+// Flag is an option, it is boolean unless a Value placeholder is given
+type Flag struct {
+	Long  string
+	Short string
+	Value string
+	Usage string
+	// Complete offers candidates for the flag's value
+	Complete func() []string
+}
+
+func (f *Flag) TakesValue() bool {
+	return len(f.Value) > 0
+}
+
+type Command struct {
+	Name    string
+	Args    string
+	Summary string
+	Help    string
+	MinArgs int
+	// MaxArgs below zero accepts any number of arguments
+	MaxArgs int
+	Flags   []Flag
+	// Complete offers candidates for the positional argument at index
+	Complete func(index int, current string) []string
+	Run      func(context *Context)
+}
+
+type App struct {
+	Name     string
+	Summary  string
+	Version  string
+	Flags    []Flag
+	Commands []*Command
+	// Before runs once arguments are parsed and before the command
+	Before func(context *Context)
+}
+
+type Context struct {
+	Command   *Command
+	Arguments []string
+	options   map[string]string
+}
+
+func (c *Context) Bool(long string) bool {
+	return c.Has(long)
+}
+
+// Has reports whether the option was given at all, with or without a value
+func (c *Context) Has(long string) bool {
+	_, ok := c.options[long]
+	return ok
+}
+
+func (c *Context) String(long string) string {
+	return c.options[long]
+}
+
+type UsageError struct {
+	Command *Command
+	message string
+}
+
+func (e *UsageError) Error() string {
+	return e.message
+}
+
+var helpFlag = Flag{Long: "help", Short: "h", Usage: "show help for the command"}
+
+// Execute parses the arguments and runs the selected command, help and usage are handled here
+func (a *App) Execute(arguments []string) error {
+	context, err := a.Parse(arguments)
+	if a.Before != nil {
+		a.Before(context)
+	}
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case context.Command == nil:
+		a.PrintUsage()
+	case context.Command.Name == "help" && len(context.Arguments) > 0:
+		command := a.Lookup(context.Arguments[0])
+		if command == nil {
+			return &UsageError{nil, "unknown command '" + context.Arguments[0] + "'"}
+		}
+		a.PrintCommandUsage(command)
+	case context.Command.Name == "help":
+		a.PrintUsage()
+	case context.Bool("help"):
+		a.PrintCommandUsage(context.Command)
+	default:
+		context.Command.Run(context)
+	}
+	return nil
+}
+
+// Lookup finds a command by name, including the built in help command
+func (a *App) Lookup(name string) *Command {
+	for _, command := range a.allCommands() {
+		if command.Name == name {
+			return command
+		}
+	}
+	return nil
+}
+
+func (a *App) allCommands() []*Command {
+	help := &Command{Name: "help", Args: "[command]", Summary: "show help for a command", MaxArgs: 1,
+		Complete: func(index int, current string) []string {
+			return a.commandNames()
+		}}
+	return append(append([]*Command{}, a.Commands...), help)
+}
+
+func (a *App) commandNames() []string {
+	names := make([]string, 0, len(a.Commands)+1)
+	for _, command := range a.allCommands() {
+		if !strings.HasPrefix(command.Name, "_") {
+			names = append(names, command.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Parse splits arguments into the command, its options and positional arguments,
+// options may appear before or after the command and '--' ends option parsing
+func (a *App) Parse(arguments []string) (context *Context, err error) {
+	context = &Context{options: make(map[string]string)}
+	var pending []string
+
+	for index := 0; index < len(arguments); index++ {
+		argument := arguments[index]
+
+		if argument == "--" {
+			pending = append(pending, arguments[index+1:]...)
+			break
+		}
+
+		if !strings.HasPrefix(argument, "-") || argument == "-" {
+			if context.Command == nil {
+				context.Command = a.Lookup(argument)
+				if context.Command == nil {
+					return context, &UsageError{nil, "unknown command '" + argument + "'"}
+				}
+			} else {
+				pending = append(pending, argument)
+			}
+			continue
+		}
+
+		names, value, hasValue := splitOption(argument)
+		for position, name := range names {
+			flag := a.findFlag(context.Command, name)
+			if flag == nil {
+				return context, &UsageError{context.Command, "unknown option '" + argument + "'"}
+			}
+
+			if !flag.TakesValue() {
+				if hasValue {
+					return context, &UsageError{context.Command, "option '--" + flag.Long + "' does not take a value"}
+				}
+				context.options[flag.Long] = ""
+				continue
+			}
+
+			if position != len(names)-1 {
+				return context, &UsageError{context.Command, "option '-" + name + "' needs a value"}
+			}
+			if !hasValue {
+				if index+1 >= len(arguments) {
+					return context, &UsageError{context.Command, "option '" + argument + "' needs a " + flag.Value}
+				}
+				index++
+				value = arguments[index]
+			}
+			context.options[flag.Long] = value
+		}
+	}
+
+	context.Arguments = pending
+	if context.Command == nil {
+		if len(pending) > 0 {
+			return context, &UsageError{nil, "unknown command '" + pending[0] + "'"}
+		}
+		return context, nil
+	}
+
+	return context, a.checkContext(context)
+}
+
+// options given before the command are checked once the command is known
+func (a *App) checkContext(context *Context) error {
+	command := context.Command
+	for long := range context.options {
+		if a.findFlag(command, long) == nil {
+			return &UsageError{command, "option '--" + long + "' is not valid for '" + command.Name + "'"}
+		}
+	}
+
+	if context.Bool("help") {
+		return nil
+	}
+
+	count := len(context.Arguments)
+	if count < command.MinArgs {
+		return &UsageError{command, "'" + command.Name + "' needs " + command.Args}
+	}
+	if command.MaxArgs >= 0 && count > command.MaxArgs {
+		return &UsageError{command, "too many arguments for '" + command.Name + "'"}
+	}
+	return nil
+}
+
+// splitOption returns the flag names in an argument, short flags may be grouped as in '-sc'
+func splitOption(argument string) (names []string, value string, hasValue bool) {
+	if strings.HasPrefix(argument, "--") {
+		name := argument[2:]
+		if separator := strings.Index(name, "="); separator >= 0 {
+			return []string{name[:separator]}, name[separator+1:], true
+		}
+		return []string{name}, "", false
+	}
+
+	for _, short := range argument[1:] {
+		names = append(names, string(short))
+	}
+	return names, "", false
+}
+
+// findFlag searches the global options then the command's, before a command is known only the
+// global options are, so a command's short options never stand for another command's and global
+// options mean the same everywhere
+func (a *App) findFlag(command *Command, name string) *Flag {
+	if flag := matchFlag(a.Flags, name); flag != nil {
+		return flag
+	}
+	if command != nil {
+		if flag := matchFlag(command.Flags, name); flag != nil {
+			return flag
+		}
+	}
+	if name == helpFlag.Long || name == helpFlag.Short {
+		return &helpFlag
+	}
+	return nil
+}
+
+func matchFlag(flags []Flag, name string) *Flag {
+	for index := range flags {
+		if flags[index].Long == name || (len(flags[index].Short) > 0 && flags[index].Short == name) {
+			return &flags[index]
+		}
+	}
+	return nil
+}
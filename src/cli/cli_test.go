@@ -0,0 +1,97 @@
+package cli
+
+import (
+	"reflect"
+	"testing"
+)
+
+func testApp() *App {
+	return &App{
+		Name:  "test",
+		Flags: []Flag{{Long: "pass", Short: "p", Value: "passphrase"}},
+		Commands: []*Command{
+			{Name: "get", Args: "<key>", MinArgs: 1, MaxArgs: 1,
+				Flags:    []Flag{{Long: "show", Short: "s"}, {Long: "copy", Short: "c"}},
+				Complete: func(index int, current string) []string { return []string{"store:key", "other"} }},
+			{Name: "list", MaxArgs: 1},
+			{Name: "merge", MinArgs: 1, MaxArgs: 1, Flags: []Flag{{Long: "out", Value: "path"}}},
+		},
+	}
+}
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		in        []string
+		command   string
+		arguments []string
+		options   map[string]string
+	}{
+		{[]string{"get", "key", "-p", "secret"}, "get", []string{"key"}, map[string]string{"pass": "secret"}},
+		{[]string{"--pass=get", "get", "-s", "key"}, "get", []string{"key"}, map[string]string{"pass": "get", "show": ""}},
+		{[]string{"get", "-sc", "--", "-key"}, "get", []string{"-key"}, map[string]string{"show": "", "copy": ""}},
+		{[]string{"-p", "list", "list"}, "list", nil, map[string]string{"pass": "list"}},
+		{[]string{"merge", "base", "-p", "secret", "--out", "out"}, "merge", []string{"base"}, map[string]string{"pass": "secret", "out": "out"}},
+	}
+
+	app := testApp()
+	for _, c := range cases {
+		context, err := app.Parse(c.in)
+		if err != nil {
+			t.Errorf("Tried to parse %q but failed with %q", c.in, err)
+			continue
+		}
+		if context.Command.Name != c.command {
+			t.Errorf("Expected command %q, received %q", c.command, context.Command.Name)
+		}
+		if !reflect.DeepEqual(context.Arguments, c.arguments) {
+			t.Errorf("Expected arguments %q, received %q", c.arguments, context.Arguments)
+		}
+		if !reflect.DeepEqual(context.options, c.options) {
+			t.Errorf("Expected options %q, received %q", c.options, context.options)
+		}
+	}
+}
+
+func TestParseUsageErrors(t *testing.T) {
+	cases := [][]string{
+		{"get", "key", "-p"},
+		{"get"},
+		{"get", "one", "two"},
+		{"list", "--show"},
+		{"get", "key", "--unknown"},
+		{"-s", "get", "key"},
+		{"missing"},
+	}
+
+	app := testApp()
+	for _, c := range cases {
+		_, err := app.Parse(c)
+		if _, ok := err.(*UsageError); !ok {
+			t.Errorf("Expected a usage error for %q, received %v", c, err)
+		}
+	}
+}
+
+func TestComplete(t *testing.T) {
+	cases := []struct {
+		shell string
+		line  string
+		want  []string
+	}{
+		{"bash", "test g", []string{"get"}},
+		{"bash", "test get st", []string{"store:key"}},
+		{"bash", "test get store:k", []string{"key"}},
+		{"zsh", "test get store:k", []string{"store:key"}},
+		{"fish", "test get --s", []string{"--show"}},
+		{"fish", "test get key ", []string{}},
+		{"fish", "test help ", []string{"get", "help", "list", "merge"}},
+	}
+
+	app := testApp()
+	for _, c := range cases {
+		got := app.Complete(c.shell, c.line)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Expected %q for %q, received %q", c.want, c.line, got)
+		}
+	}
+}
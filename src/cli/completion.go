@@ -0,0 +1,151 @@
+package cli
+
+import (
+	"sort"
+	"strings"
+)
+
+// CompleteCommandName is the hidden command the generated scripts call back into
+const CompleteCommandName = "__complete"
+
+const bashScript = `# bash completion for {{name}}
+_{{name}}() {
+    local IFS=$'\n'
+    COMPREPLY=($({{name}} ` + CompleteCommandName + ` bash -- "${COMP_LINE:0:$COMP_POINT}" 2>/dev/null))
+    if [[ ${#COMPREPLY[@]} -eq 1 && ${COMPREPLY[0]} == *: ]]; then
+        compopt -o nospace
+    fi
+}
+complete -F _{{name}} {{name}}
+`
+
+const zshScript = `#compdef {{name}}
+# zsh completion for {{name}}
+_{{name}}() {
+    local -a candidates
+    candidates=("${(@f)$({{name}} ` + CompleteCommandName + ` zsh -- "${BUFFER[1,CURSOR]}" 2>/dev/null)}")
+    compadd -S '' -- ${(M)candidates:#*:}
+    compadd -- ${candidates:#*:}
+}
+compdef _{{name}} {{name}}
+`
+
+const fishScript = `# fish completion for {{name}}
+complete -c {{name}} -f -a '({{name}} ` + CompleteCommandName + ` fish -- (commandline -cp) 2>/dev/null)'
+`
+
+type ShellError string
+
+func (k ShellError) Error() string {
+	return "unsupported shell '" + string(k) + "' (expected bash, zsh or fish)"
+}
+
+// CompletionScript gives the script that wires the shell's completion up to the app
+func (a *App) CompletionScript(shell string) (string, error) {
+	var script string
+	switch shell {
+	case "bash":
+		script = bashScript
+	case "zsh":
+		script = zshScript
+	case "fish":
+		script = fishScript
+	default:
+		return "", ShellError(shell)
+	}
+	return strings.Replace(script, "{{name}}", a.Name, -1), nil
+}
+
+// Complete offers candidates for the last word of a partially typed command line
+func (a *App) Complete(shell, line string) []string {
+	words := strings.Fields(line)
+	current := ""
+	if len(words) > 0 && !strings.HasSuffix(line, " ") {
+		current = words[len(words)-1]
+		words = words[:len(words)-1]
+	}
+	if len(words) > 0 {
+		words = words[1:]
+	}
+
+	candidates := filterPrefix(a.candidates(words, current), current)
+
+	// bash splits words on colons, so only the part after the last one is replaced
+	if shell == "bash" {
+		if separator := strings.LastIndex(current, ":"); separator >= 0 {
+			for index, candidate := range candidates {
+				candidates[index] = candidate[separator+1:]
+			}
+		}
+	}
+	return candidates
+}
+
+func (a *App) candidates(words []string, current string) []string {
+	var command *Command
+	var positional []string
+	for index := 0; index < len(words); index++ {
+		word := words[index]
+		if word == "--" {
+			positional = append(positional, words[index+1:]...)
+			break
+		}
+		if strings.HasPrefix(word, "-") && len(word) > 1 {
+			names, _, hasValue := splitOption(word)
+			flag := a.findFlag(command, names[len(names)-1])
+			if flag != nil && flag.TakesValue() && !hasValue {
+				if index == len(words)-1 {
+					if flag.Complete != nil {
+						return flag.Complete()
+					}
+					return nil
+				}
+				index++
+			}
+			continue
+		}
+		if command == nil {
+			command = a.Lookup(word)
+			if command == nil {
+				return nil
+			}
+		} else {
+			positional = append(positional, word)
+		}
+	}
+
+	if strings.HasPrefix(current, "-") {
+		return a.flagNames(command)
+	}
+	if command == nil {
+		return a.commandNames()
+	}
+	if command.Complete != nil && (command.MaxArgs < 0 || len(positional) < command.MaxArgs) {
+		return command.Complete(len(positional), current)
+	}
+	return nil
+}
+
+func (a *App) flagNames(command *Command) []string {
+	flags := append(append([]Flag{}, a.Flags...), helpFlag)
+	if command != nil {
+		flags = append(flags, command.Flags...)
+	}
+
+	names := make([]string, 0, len(flags))
+	for _, flag := range flags {
+		names = append(names, "--"+flag.Long)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func filterPrefix(candidates []string, prefix string) []string {
+	filtered := make([]string, 0, len(candidates))
+	for _, candidate := range candidates {
+		if strings.HasPrefix(candidate, prefix) {
+			filtered = append(filtered, candidate)
+		}
+	}
+	return filtered
+}
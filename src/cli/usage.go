@@ -0,0 +1,65 @@
+package cli
+
+import (
+	"fmt"
+	"keepo/src/util"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+func (a *App) PrintUsage() {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "version: "+util.Bold(a.Version)+"\n")
+	fmt.Fprintln(writer, a.Summary+"\n")
+	fmt.Fprintln(writer, "usage: "+util.Bold(a.Name+" [options] <command>")+"\n")
+	fmt.Fprint(writer, "commands:\n\n")
+	for _, command := range a.allCommands() {
+		if strings.HasPrefix(command.Name, "_") {
+			continue
+		}
+		fmt.Fprintln(writer, "\t"+util.Bold(command.Name+"\t"+command.Args)+"\t"+command.Summary)
+	}
+	fmt.Fprint(writer, "\noptions:\n\n")
+	writeFlags(writer, append(append([]Flag{}, a.Flags...), helpFlag))
+	fmt.Fprintln(writer, "\nsee '"+a.Name+" help <command>' for the options of each command")
+	util.CheckError(writer.Flush(), "could not write usage")
+}
+
+func (a *App) PrintCommandUsage(command *Command) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "usage: "+util.Bold(a.Name+" "+command.Name+" [options] "+command.Args)+"\n")
+	fmt.Fprintln(writer, command.Summary)
+	if len(command.Help) > 0 {
+		fmt.Fprintln(writer, "\n"+command.Help)
+	}
+	if len(command.Flags) > 0 {
+		fmt.Fprint(writer, "\noptions:\n\n")
+		writeFlags(writer, command.Flags)
+	}
+	fmt.Fprint(writer, "\nglobal options:\n\n")
+	writeFlags(writer, append(append([]Flag{}, a.Flags...), helpFlag))
+	util.CheckError(writer.Flush(), "could not write usage")
+}
+
+// Hint points at the help for the command a usage error came from
+func (a *App) Hint(err *UsageError) string {
+	if err.Command != nil {
+		return "usage: " + a.Name + " " + err.Command.Name + " [options] " + err.Command.Args +
+			" (see '" + a.Name + " help " + err.Command.Name + "')"
+	}
+	return "see '" + a.Name + " help'"
+}
+
+func writeFlags(writer *tabwriter.Writer, flags []Flag) {
+	for _, flag := range flags {
+		names := "--" + flag.Long
+		if len(flag.Short) > 0 {
+			names = "-" + flag.Short + ", " + names
+		}
+		if flag.TakesValue() {
+			names += " <" + flag.Value + ">"
+		}
+		fmt.Fprintln(writer, "\t"+util.Bold(names)+"\t"+flag.Usage)
+	}
+}
@@ -0,0 +1,146 @@
+// Package client fetches and changes keepo values through a keepo gRPC server, so applications
+// read secrets with an API token and never link the store crypto themselves
+package client
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"keepo/src/api"
+	"net"
+	"time"
+)
+
+// Change names how a watched key changed
+type Change string
+
+const (
+	Added   Change = "added"
+	Changed Change = "changed"
+	Removed Change = "removed"
+)
+
+// Metadata is a value's metadata, Expires is zero and MaxAge none when they are not set
+type Metadata struct {
+	URL     string
+	Tags    []string
+	Notes   string
+	Expires time.Time
+	MaxAge  time.Duration
+}
+
+// Event is a key added, changed or removed, it never carries the value
+type Event struct {
+	Store  string
+	Key    string
+	Change Change
+}
+
+// Client calls a keepo server with an API token
+type Client struct {
+	connection *grpc.ClientConn
+	keepo      api.KeepoClient
+}
+
+// Dial connects to the server listening on the Unix socket, presenting the token on every call.
+// The socket's permissions keep it private, so the connection itself is not encrypted.
+func Dial(socket, token string) (*Client, error) {
+	connection, err := grpc.NewClient("passthrough:///"+socket,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithPerRPCCredentials(bearer(token)),
+		grpc.WithContextDialer(func(context context.Context, address string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(context, "unix", address)
+		}))
+	if err != nil {
+		return nil, err
+	}
+	return &Client{connection: connection, keepo: api.NewKeepoClient(connection)}, nil
+}
+
+// Close closes the connection to the server
+func (c *Client) Close() error {
+	return c.connection.Close()
+}
+
+// Get gets the value of a key and its metadata
+func (c *Client) Get(context context.Context, storeName, key string) ([]byte, Metadata, error) {
+	response, err := c.keepo.Get(context, &api.GetRequest{Store: storeName, Key: key})
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	var metadata Metadata
+	if m := response.GetMetadata(); m != nil {
+		metadata = Metadata{URL: m.Url, Tags: m.Tags, Notes: m.Notes, MaxAge: time.Duration(m.MaxAge) * time.Second}
+		if m.Expires != 0 {
+			metadata.Expires = time.Unix(m.Expires, 0)
+		}
+	}
+	return response.Value, metadata, nil
+}
+
+// Set sets the value of a key, keeping its metadata
+func (c *Client) Set(context context.Context, storeName, key string, value []byte) error {
+	_, err := c.keepo.Set(context, &api.SetRequest{Store: storeName, Key: key, Value: value})
+	return err
+}
+
+// Delete clears a key and its value
+func (c *Client) Delete(context context.Context, storeName, key string) error {
+	_, err := c.keepo.Delete(context, &api.DeleteRequest{Store: storeName, Key: key})
+	return err
+}
+
+// ListKeys lists the store's keys beneath the prefix that the token covers, all of them when the
+// prefix is empty
+func (c *Client) ListKeys(context context.Context, storeName, prefix string) ([]string, error) {
+	response, err := c.keepo.ListKeys(context, &api.ListKeysRequest{Store: storeName, Prefix: prefix})
+	if err != nil {
+		return nil, err
+	}
+	return response.Keys, nil
+}
+
+// Watch sends the changes to the store's keys beneath the prefix until the context is cancelled
+// or the server ends the watch, then closes events and returns why it ended
+func (c *Client) Watch(context context.Context, storeName, prefix string, events chan<- Event) error {
+	defer close(events)
+	stream, err := c.keepo.Watch(context, &api.WatchRequest{Store: storeName, Prefix: prefix})
+	if err != nil {
+		return err
+	}
+	changes := map[api.ChangeEvent_Change]Change{
+		api.ChangeEvent_ADDED:   Added,
+		api.ChangeEvent_CHANGED: Changed,
+		api.ChangeEvent_REMOVED: Removed,
+	}
+	for {
+		event, err := stream.Recv()
+		if status.Code(err) == codes.Canceled {
+			return context.Err()
+		}
+		if err != nil {
+			return err
+		}
+		events <- Event{Store: event.Store, Key: event.Key, Change: changes[event.Change]}
+	}
+}
+
+// IsNotFound reports whether the call failed as the key or store is absent, stores the token does
+// not cover are reported as absent
+func IsNotFound(err error) bool {
+	return status.Code(err) == codes.NotFound
+}
+
+// bearer presents the token on every call, the Unix socket needs no transport security
+type bearer string
+
+func (b bearer) GetRequestMetadata(context context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(b)}, nil
+}
+
+func (b bearer) RequireTransportSecurity() bool {
+	return false
+}
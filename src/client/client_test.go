@@ -0,0 +1,109 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"keepo/src/crypto"
+	"keepo/src/data/store"
+	"keepo/src/server"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestClient(t *testing.T) {
+
+	storeName := "client-test"
+	cleanup(storeName)
+	defer cleanup(storeName)
+	dir, err := ioutil.TempDir("", "keepo-client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	secret := func() *store.Secret {
+		passphrase, _ := crypto.NewBufferFrom([]byte("password01"))
+		return &store.Secret{Passphrase: passphrase}
+	}
+	if err := store.SetMapValue(storeName, "db/password", "correct horse battery staple", secret()); err != nil {
+		t.Fatalf("could not set map value '%q'", err)
+	}
+
+	tokensPath := filepath.Join(dir, server.TokensFile)
+	token, err := server.AddToken(tokensPath, "app", []string{storeName + ":db/*"}, true)
+	if err != nil {
+		t.Fatalf("could not add token '%q'", err)
+	}
+	tokens, _ := server.LoadTokens(tokensPath)
+
+	socket := filepath.Join(dir, "keepo.sock")
+	listener, err := server.Listen(server.UnixPrefix+socket, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keepo := server.NewGRPC(secret(), tokens)
+	go keepo.Serve(listener)
+	defer keepo.Stop()
+
+	client, err := Dial(socket, string(token.Bytes()))
+	if err != nil {
+		t.Fatalf("could not dial '%q'", err)
+	}
+	defer client.Close()
+	background := context.Background()
+
+	fmt.Println("test values the token covers are read")
+	value, _, err := client.Get(background, storeName, "db/password")
+	if err != nil || string(value) != "correct horse battery staple" {
+		t.Errorf("Expected %q, received %q '%q'", "correct horse battery staple", value, err)
+	}
+	if _, _, err = client.Get(background, "other", "db/password"); !IsNotFound(err) {
+		t.Errorf("expected a store the token does not cover to be absent, but got '%q'", err)
+	}
+
+	fmt.Println("test changes are watched and values set and cleared")
+	watching, cancel := context.WithCancel(background)
+	events, ended := make(chan Event, 4), make(chan error, 1)
+	go func() { ended <- client.Watch(watching, storeName, "db", events) }()
+	time.Sleep(100 * time.Millisecond)
+
+	if err = client.Set(background, storeName, "db/user", []byte("admin")); err != nil {
+		t.Errorf("could not set value '%q'", err)
+	}
+	if err = client.Set(background, storeName, "api/key", []byte("k3y")); err == nil {
+		t.Errorf("expected a key the token does not cover to be refused")
+	}
+	select {
+	case event := <-events:
+		if event.Key != "db/user" || event.Change != Added {
+			t.Errorf("Expected %q added, received %v", "db/user", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Expected %q added, received nothing", "db/user")
+	}
+	cancel()
+	if err = <-ended; err != context.Canceled {
+		t.Errorf("expected the watch to end cancelled, but got '%q'", err)
+	}
+
+	if err = client.Delete(background, storeName, "db/user"); err != nil {
+		t.Errorf("could not delete value '%q'", err)
+	}
+	if keys, err := client.ListKeys(background, storeName, ""); err != nil || len(keys) != 1 || keys[0] != "db/password" {
+		t.Errorf("Expected %q, received %q '%q'", "db/password", keys, err)
+	}
+}
+
+func cleanup(storeName string) {
+	storePath := store.GetStorePath(storeName)
+	_ = os.Remove(storePath)
+	backups := filepath.Join(filepath.Dir(storePath), store.BackupDirectory)
+	copies, _ := filepath.Glob(filepath.Join(backups, storeName+"-*"+store.Extension))
+	for _, path := range copies {
+		_ = os.Remove(path)
+	}
+	_ = os.Remove(backups)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"keepo/src/data/store"
+	"strings"
+)
+
+func completeStores() []string {
+	names, err := store.GetStoreNames()
+	if err != nil {
+		return nil
+	}
+	return names
+}
+
+// key names come from the unencrypted index so completion never asks for a passphrase
+func completeKeys(current string) (candidates []string) {
+	if storeName, _ := store.SplitAddress(current); storeName != store.DefaultStoreName || strings.HasPrefix(current, storeName+":") {
+		keys, _ := store.ListMapKeys(storeName)
+		for _, key := range keys {
+			candidates = append(candidates, store.JoinAddress(storeName, key))
+		}
+		return candidates
+	}
+
+	candidates, _ = store.ListMapKeys(store.DefaultStoreName)
+	for _, name := range completeStores() {
+		candidates = append(candidates, store.JoinAddress(name, ""))
+	}
+	return candidates
+}
@@ -0,0 +1,126 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/chacha20poly1305"
+	"io"
+	"strings"
+)
+
+/**
+ * Envelope layout:
+ *
+ * algorithm			- 1 byte algorithm id
+ * nonce				- the algorithm's nonce size in random bytes
+ * ciphertext			- the sealed plaintext followed by its tag
+ *
+ * Associated data is authenticated with the ciphertext but not carried in the envelope,
+ * so the same associated data must be given to open it.
+ */
+
+// Algorithm ids are written into envelopes and store headers, so they must never change
+type Algorithm byte
+
+const (
+	AES256GCM         Algorithm = 1
+	XChaCha20Poly1305 Algorithm = 2
+)
+
+var Algorithms = []Algorithm{AES256GCM, XChaCha20Poly1305}
+
+var EnvelopeAuthenticationFailed = errors.New("envelope failed authentication")
+var EnvelopeTooShort = errors.New("envelope too short")
+
+type AlgorithmError byte
+
+func (e AlgorithmError) Error() string {
+	return fmt.Sprintf("unknown algorithm id %d", byte(e))
+}
+
+func (a Algorithm) String() string {
+	switch a {
+	case AES256GCM:
+		return "aes-256-gcm"
+	case XChaCha20Poly1305:
+		return "xchacha20-poly1305"
+	}
+	return fmt.Sprintf("algorithm(%d)", byte(a))
+}
+
+// ParseAlgorithm reads an algorithm from its name, ignoring case
+func ParseAlgorithm(name string) (Algorithm, error) {
+	for _, algorithm := range Algorithms {
+		if strings.EqualFold(name, algorithm.String()) {
+			return algorithm, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown algorithm '%s'", name)
+}
+
+func (a Algorithm) aead(key *[SecretSize]byte) (cipher.AEAD, error) {
+	switch a {
+	case AES256GCM:
+		block, err := aes.NewCipher(key[:])
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case XChaCha20Poly1305:
+		return chacha20poly1305.NewX(key[:])
+	}
+	return nil, AlgorithmError(a)
+}
+
+// Seal encrypts and authenticates the plaintext and associated data, returning an envelope
+// naming the algorithm so Open needs only the key
+func Seal(algorithm Algorithm, key *[SecretSize]byte, plaintext, associatedData []byte) ([]byte, error) {
+	aead, err := algorithm.aead(key)
+	if err != nil {
+		return nil, err
+	}
+
+	envelope := make([]byte, 1+aead.NonceSize(), 1+aead.NonceSize()+len(plaintext)+aead.Overhead())
+	envelope[0] = byte(algorithm)
+	if _, err := io.ReadFull(rand.Reader, envelope[1:]); err != nil {
+		return nil, err
+	}
+	return aead.Seal(envelope, envelope[1:], plaintext, associatedData), nil
+}
+
+// Open authenticates and decrypts an envelope made by Seal with the same associated data
+func Open(key *[SecretSize]byte, envelope, associatedData []byte) ([]byte, error) {
+	if len(envelope) < 1 {
+		return nil, EnvelopeTooShort
+	}
+
+	aead, err := Algorithm(envelope[0]).aead(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(envelope) < 1+aead.NonceSize()+aead.Overhead() {
+		return nil, EnvelopeTooShort
+	}
+
+	nonce := envelope[1 : 1+aead.NonceSize()]
+	plaintext, err := aead.Open(nil, nonce, envelope[1+aead.NonceSize():], associatedData)
+	if err != nil {
+		return nil, EnvelopeAuthenticationFailed
+	}
+	return plaintext, nil
+}
+
+// EnvelopeAlgorithm reads which algorithm sealed an envelope
+func EnvelopeAlgorithm(envelope []byte) (Algorithm, error) {
+	if len(envelope) < 1 {
+		return 0, EnvelopeTooShort
+	}
+	algorithm := Algorithm(envelope[0])
+	if _, err := algorithm.aead(&[SecretSize]byte{}); err != nil {
+		return 0, err
+	}
+	return algorithm, nil
+}
@@ -0,0 +1,92 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	cases := []struct {
+		in             []byte
+		associatedData []byte
+	}{
+		{[]byte("Hello, world"), nil},
+		{[]byte(""), []byte("default:key")},
+		{make([]byte, 1000), []byte("header")},
+	}
+
+	key := GenerateSecret()
+	for _, algorithm := range Algorithms {
+		for _, c := range cases {
+			envelope, err := Seal(algorithm, &key, c.in, c.associatedData)
+			if err != nil {
+				t.Fatalf("Tried to seal with %s but failed with %q", algorithm, err)
+			}
+
+			sealedWith, err := EnvelopeAlgorithm(envelope)
+			if err != nil || sealedWith != algorithm {
+				t.Errorf("Expected %s, received %s", algorithm, sealedWith)
+			}
+
+			got, err := Open(&key, envelope, c.associatedData)
+			if err != nil {
+				t.Errorf("Tried to open with %s but failed with %q", algorithm, err)
+			}
+			if !bytes.Equal(got, c.in) {
+				t.Errorf("Expected %q, received %q", c.in, got)
+			}
+		}
+	}
+}
+
+func TestEnvelopeTampering(t *testing.T) {
+	key := GenerateSecret()
+	for _, algorithm := range Algorithms {
+		envelope, _ := Seal(algorithm, &key, []byte("Hello, world"), []byte("default:key"))
+
+		flipped := append([]byte{}, envelope...)
+		flipped[len(flipped)-1] ^= 1
+		otherKey := GenerateSecret()
+
+		cases := []struct {
+			name           string
+			key            [SecretSize]byte
+			envelope       []byte
+			associatedData []byte
+		}{
+			{"flipped ciphertext", key, flipped, []byte("default:key")},
+			{"other associated data", key, envelope, []byte("default:other")},
+			{"missing associated data", key, envelope, nil},
+			{"other key", otherKey, envelope, []byte("default:key")},
+		}
+		for _, c := range cases {
+			_, err := Open(&c.key, c.envelope, c.associatedData)
+			if err != EnvelopeAuthenticationFailed {
+				t.Errorf("Expected %q for %s with %s, received %q", EnvelopeAuthenticationFailed, c.name, algorithm, err)
+			}
+		}
+
+		_, err := Open(&key, envelope[:10], nil)
+		if err != EnvelopeTooShort {
+			t.Errorf("Expected %q, received %q", EnvelopeTooShort, err)
+		}
+	}
+
+	_, err := Open(&key, []byte{99, 1, 2, 3}, nil)
+	if _, ok := err.(AlgorithmError); !ok {
+		t.Errorf("Expected an algorithm error, received %q", err)
+	}
+}
+
+func TestParseAlgorithm(t *testing.T) {
+	for _, algorithm := range Algorithms {
+		parsed, err := ParseAlgorithm(algorithm.String())
+		if err != nil || parsed != algorithm {
+			t.Errorf("Expected %s, received %s", algorithm, parsed)
+		}
+	}
+
+	if _, err := ParseAlgorithm("aes-cfb"); err == nil {
+		t.Errorf("Expected an error for an unknown algorithm")
+	}
+}
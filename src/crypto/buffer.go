@@ -0,0 +1,128 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"golang.org/x/sys/unix"
+	"io"
+	"keepo/src/util"
+	"os"
+)
+
+/**
+ * Buffer layout:
+ *
+ * guard-page			- no access
+ * data-pages			- locked, the data ends at the last of them so overruns reach the guard
+ * guard-page			- no access
+ */
+
+// Buffer holds a secret outside the Go heap, in memory locked out of swap where the limit on
+// locked memory allows, and is wiped and unmapped by Destroy
+type Buffer struct {
+	memory []byte
+	data   []byte
+	locked bool
+}
+
+// NewBuffer maps a zeroed buffer of the given size
+func NewBuffer(size int) (*Buffer, error) {
+	pageSize := os.Getpagesize()
+	dataPages := (size + pageSize - 1) / pageSize
+	if dataPages == 0 {
+		dataPages = 1
+	}
+
+	memory, err := unix.Mmap(-1, 0, (dataPages+2)*pageSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANON)
+	if err != nil {
+		return nil, err
+	}
+
+	inner := memory[pageSize : (dataPages+1)*pageSize]
+	buffer := &Buffer{memory: memory, data: inner[len(inner)-size:]}
+	for _, guard := range [][]byte{memory[:pageSize], memory[(dataPages+1)*pageSize:]} {
+		if err = unix.Mprotect(guard, unix.PROT_NONE); err != nil {
+			_ = unix.Munmap(memory)
+			return nil, err
+		}
+	}
+
+	// the limit on locked memory may be small, an unlocked buffer is still wiped
+	buffer.locked = unix.Mlock(inner) == nil
+	return buffer, nil
+}
+
+// NewBufferFrom moves the source into a new buffer, wiping the source
+func NewBufferFrom(source []byte) (*Buffer, error) {
+	buffer, err := NewBuffer(len(source))
+	if err != nil {
+		return nil, err
+	}
+	copy(buffer.data, source)
+	Wipe(source)
+	return buffer, nil
+}
+
+// GenerateSecretBuffer makes a random secret in a new buffer
+func GenerateSecretBuffer() *Buffer {
+	buffer, err := NewBuffer(SecretSize)
+	util.CheckError(err, "could not allocate secret")
+	_, err = io.ReadFull(rand.Reader, buffer.data)
+	util.CheckError(err, "could not generate secret")
+	return buffer
+}
+
+// Bytes gives the buffer's memory, it must not be used after Destroy, a nil buffer is empty
+func (b *Buffer) Bytes() []byte {
+	if b == nil {
+		return nil
+	}
+	return b.data
+}
+
+func (b *Buffer) Len() int {
+	return len(b.Bytes())
+}
+
+// Truncate shortens the buffer to its first size bytes, wiping the rest
+func (b *Buffer) Truncate(size int) {
+	Wipe(b.data[size:])
+	b.data = b.data[:size]
+}
+
+// Key gives the buffer as a secret key, it must hold exactly SecretSize bytes
+func (b *Buffer) Key() *[SecretSize]byte {
+	util.CheckState(len(b.data) == SecretSize, "buffer was not of key length")
+	return (*[SecretSize]byte)(b.data)
+}
+
+func (b *Buffer) Locked() bool {
+	return b.locked
+}
+
+// WriteTo writes the secret without copying it out of the buffer
+func (b *Buffer) WriteTo(w io.Writer) (int64, error) {
+	written, err := w.Write(b.data)
+	return int64(written), err
+}
+
+// Destroy wipes and unmaps the buffer, it is safe to call more than once and on nil
+func (b *Buffer) Destroy() {
+	if b == nil || b.memory == nil {
+		return
+	}
+
+	Wipe(b.data)
+	if b.locked {
+		_ = unix.Munlock(b.memory[os.Getpagesize() : len(b.memory)-os.Getpagesize()])
+	}
+	err := unix.Munmap(b.memory)
+	util.CheckError(err, "could not release secret memory")
+	b.memory, b.data = nil, nil
+}
+
+// Wipe overwrites memory that held a secret with zeros
+func Wipe(secret []byte) {
+	for i := range secret {
+		secret[i] = 0
+	}
+}
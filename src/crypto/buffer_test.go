@@ -0,0 +1,54 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBuffer(t *testing.T) {
+	for _, size := range []int{0, 1, SecretSize, 4096, 5000} {
+		source := bytes.Repeat([]byte{7}, size)
+		buffer, err := NewBufferFrom(source)
+		if err != nil {
+			t.Fatalf("Tried to make a buffer of %d bytes but failed with %q", size, err)
+		}
+
+		if !bytes.Equal(buffer.Bytes(), bytes.Repeat([]byte{7}, size)) {
+			t.Errorf("Expected %d bytes of 7, received %v", size, buffer.Bytes())
+		}
+		if !bytes.Equal(source, make([]byte, size)) {
+			t.Errorf("Expected the source to be wiped, received %v", source)
+		}
+
+		buffer.Destroy()
+		buffer.Destroy()
+		if buffer.Bytes() != nil {
+			t.Errorf("Expected a destroyed buffer to be empty, received %v", buffer.Bytes())
+		}
+	}
+}
+
+func TestBufferTruncate(t *testing.T) {
+	buffer, _ := NewBufferFrom([]byte("passphrase\n"))
+	defer buffer.Destroy()
+
+	data := buffer.Bytes()
+	buffer.Truncate(10)
+	if string(buffer.Bytes()) != "passphrase" || data[10] != 0 {
+		t.Errorf("Expected %q, received %q", "passphrase", buffer.Bytes())
+	}
+}
+
+func TestSecretBuffer(t *testing.T) {
+	buffer := GenerateSecretBuffer()
+	defer buffer.Destroy()
+
+	key := buffer.Key()
+	key[0] ^= 1
+	if buffer.Bytes()[0] != key[0] {
+		t.Errorf("Expected the key to share the buffer's memory")
+	}
+
+	var nilBuffer *Buffer
+	nilBuffer.Destroy()
+}
@@ -38,6 +38,9 @@ func GetHash(content []byte) (hash [HashSize]byte) {
 	return hash
 }
 
+// EncryptCFB does not authenticate the ciphertext, so tampering goes undetected.
+//
+// Deprecated: use Seal, which authenticates the ciphertext and any associated data.
 func EncryptCFB(key, text []byte) ([]byte, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
@@ -58,6 +61,7 @@ func EncryptCFB(key, text []byte) ([]byte, error) {
 	return cipherText, nil
 }
 
+// Deprecated: use Open with envelopes made by Seal.
 func DecryptCFB(key, text []byte) ([]byte, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
@@ -0,0 +1,67 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+)
+
+/**
+ * Hybrid layout, as the sealed-secrets controller reads it:
+ *
+ * key length			- 2 bytes big endian, the length of the sealed session key
+ * sealed key			- the random session key, RSA-OAEP sealed with SHA-256 and the label
+ * ciphertext			- the plaintext sealed with AES-256-GCM under the session key and a zero nonce
+ *
+ * The session key seals one plaintext alone, so the zero nonce is never reused.
+ */
+
+var CertificateInvalid = errors.New("expected a PEM certificate with an RSA public key")
+
+// ParseCertificateKey reads the RSA public key of a PEM certificate
+func ParseCertificateKey(content []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(content)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, CertificateInvalid
+	}
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	public, ok := certificate.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, CertificateInvalid
+	}
+	return public, nil
+}
+
+// HybridSeal seals the plaintext to the holder of the public key's private key, the label binds
+// the sealed key to where it may be opened
+func HybridSeal(public *rsa.PublicKey, plaintext, label []byte) ([]byte, error) {
+	session := GenerateSecret()
+	defer Wipe(session[:])
+
+	block, err := aes.NewCipher(session[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	sealedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, public, session[:], label)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed := make([]byte, 2, 2+len(sealedKey)+len(plaintext)+aead.Overhead())
+	binary.BigEndian.PutUint16(sealed, uint16(len(sealedKey)))
+	sealed = append(sealed, sealedKey...)
+	return aead.Seal(sealed, make([]byte, aead.NonceSize()), plaintext, nil), nil
+}
@@ -0,0 +1,60 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestHybridSeal(t *testing.T) {
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "sealed-secret"},
+		NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &private.PublicKey, private)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	public, err := ParseCertificateKey(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	if err != nil {
+		t.Fatalf("Tried to read the certificate but failed with %q", err)
+	}
+	if _, err = ParseCertificateKey([]byte("not a certificate")); err != CertificateInvalid {
+		t.Errorf("Expected %q, received %q", CertificateInvalid, err)
+	}
+
+	plaintext, label := []byte("correct horse battery staple"), []byte("apps/app-secrets")
+	sealed, err := HybridSeal(public, plaintext, label)
+	if err != nil {
+		t.Fatalf("Tried to seal but failed with %q", err)
+	}
+
+	// open as the sealed-secrets controller would
+	length := int(binary.BigEndian.Uint16(sealed))
+	session, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, private, sealed[2:2+length], label)
+	if err != nil {
+		t.Fatalf("Tried to open the session key but failed with %q", err)
+	}
+	if _, err = rsa.DecryptOAEP(sha256.New(), rand.Reader, private, sealed[2:2+length], []byte("other/app-secrets")); err == nil {
+		t.Errorf("Expected the session key to open with its own label alone")
+	}
+	block, _ := aes.NewCipher(session)
+	aead, _ := cipher.NewGCM(block)
+	got, err := aead.Open(nil, make([]byte, aead.NonceSize()), sealed[2+length:], nil)
+	if err != nil || !bytes.Equal(got, plaintext) {
+		t.Errorf("Expected %q, received %q '%q'", plaintext, got, err)
+	}
+}
@@ -0,0 +1,178 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+/**
+ * Share text layout, base32 without padding in groups of five after the prefix:
+ *
+ * version				- 1 byte, shareVersion
+ * threshold			- 1 byte, shares needed to combine
+ * x					- 1 byte, the share's point, never zero
+ * y					- one byte per secret byte
+ * checksum				- first 4 bytes of the sha256 of the above
+ *
+ * Uppercase letters, digits and '-' are all in the QR alphanumeric set.
+ */
+
+const (
+	SharePrefix   = "KEEPO-SHARE-"
+	shareVersion  = 1
+	shareChecksum = 4
+	shareGroup    = 5
+)
+
+var ShareChecksumFailed = errors.New("share checksum does not match, it may be mistyped")
+var SharesMismatched = errors.New("shares are from different splits")
+
+// Share is one point of a Shamir split, Threshold shares recover the secret
+type Share struct {
+	Threshold int
+	X         byte
+	Y         []byte
+}
+
+// SplitSecret splits the secret into shares of which any threshold recover it, each byte is the
+// constant term of its own random polynomial over GF(256) of degree threshold-1
+func SplitSecret(secret []byte, shares, threshold int) ([]Share, error) {
+	if threshold < 2 || shares < threshold || shares > 255 {
+		return nil, fmt.Errorf("need a threshold of at least 2 and no more than 255 shares, given %d of %d", threshold, shares)
+	}
+
+	split := make([]Share, shares)
+	for i := range split {
+		split[i] = Share{Threshold: threshold, X: byte(i + 1), Y: make([]byte, len(secret))}
+	}
+
+	coefficients := make([]byte, threshold)
+	defer Wipe(coefficients)
+	for index, secretByte := range secret {
+		coefficients[0] = secretByte
+		if _, err := io.ReadFull(rand.Reader, coefficients[1:]); err != nil {
+			return nil, err
+		}
+
+		for i := range split {
+			// Horner's rule from the highest coefficient
+			var y byte
+			for degree := threshold - 1; degree >= 0; degree-- {
+				y = gfMultiply(y, split[i].X) ^ coefficients[degree]
+			}
+			split[i].Y[index] = y
+		}
+	}
+	return split, nil
+}
+
+// CombineShares recovers the secret by interpolating the shares at zero, it needs at least as
+// many shares as their threshold. Shares of another split give a wrong secret, not an error.
+func CombineShares(shares []Share) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, fmt.Errorf("no shares given")
+	}
+	threshold, length := shares[0].Threshold, len(shares[0].Y)
+	if len(shares) < threshold {
+		return nil, fmt.Errorf("need %d shares, given %d", threshold, len(shares))
+	}
+
+	seen := make(map[byte]bool)
+	for _, share := range shares {
+		if share.Threshold != threshold || len(share.Y) != length {
+			return nil, SharesMismatched
+		}
+		if share.X == 0 || seen[share.X] {
+			return nil, fmt.Errorf("share %d is given twice or is invalid", share.X)
+		}
+		seen[share.X] = true
+	}
+
+	secret := make([]byte, length)
+	for i, share := range shares {
+		// the Lagrange basis polynomial for this share evaluated at zero
+		numerator, denominator := byte(1), byte(1)
+		for j, other := range shares {
+			if i != j {
+				numerator = gfMultiply(numerator, other.X)
+				denominator = gfMultiply(denominator, share.X^other.X)
+			}
+		}
+		basis := gfMultiply(numerator, gfInverse(denominator))
+
+		for index := range secret {
+			secret[index] ^= gfMultiply(share.Y[index], basis)
+		}
+	}
+	return secret, nil
+}
+
+// EncodeShare writes a share as text to print or hand over
+func EncodeShare(share Share) string {
+	payload := append([]byte{shareVersion, byte(share.Threshold), share.X}, share.Y...)
+	checksum := sha256.Sum256(payload)
+	encoded := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(append(payload, checksum[:shareChecksum]...))
+	Wipe(payload)
+
+	var groups []string
+	for len(encoded) > shareGroup {
+		groups = append(groups, encoded[:shareGroup])
+		encoded = encoded[shareGroup:]
+	}
+	return SharePrefix + strings.Join(append(groups, encoded), "-")
+}
+
+// DecodeShare reads a share written by EncodeShare, ignoring case, spaces and dashes
+func DecodeShare(text string) (share Share, err error) {
+	text = strings.ToUpper(strings.TrimSpace(text))
+	if !strings.HasPrefix(text, SharePrefix) {
+		return share, fmt.Errorf("share does not start with %s", SharePrefix)
+	}
+	text = strings.NewReplacer("-", "", " ", "").Replace(strings.TrimPrefix(text, SharePrefix))
+
+	decoded, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(text)
+	if err != nil || len(decoded) < 3+shareChecksum {
+		return share, ShareChecksumFailed
+	}
+	defer Wipe(decoded)
+
+	payload := decoded[:len(decoded)-shareChecksum]
+	checksum := sha256.Sum256(payload)
+	if !bytes.Equal(checksum[:shareChecksum], decoded[len(payload):]) {
+		return share, ShareChecksumFailed
+	}
+	if payload[0] != shareVersion {
+		return share, fmt.Errorf("unknown share version %d", payload[0])
+	}
+
+	share = Share{Threshold: int(payload[1]), X: payload[2], Y: append([]byte{}, payload[3:]...)}
+	return share, nil
+}
+
+// gfMultiply multiplies in GF(256) with the AES polynomial, without branches or tables so its
+// timing does not depend on the secret
+func gfMultiply(a, b byte) (product byte) {
+	for i := 0; i < 8; i++ {
+		product ^= -(b & 1) & a
+		b >>= 1
+		carry := -(a >> 7)
+		a = (a << 1) ^ (0x1b & carry)
+	}
+	return product
+}
+
+// gfInverse raises to the power 254, the inverse of every non zero element
+func gfInverse(a byte) byte {
+	result := byte(1)
+	for i := 0; i < 7; i++ {
+		a = gfMultiply(a, a)
+		result = gfMultiply(result, a)
+	}
+	return result
+}
@@ -0,0 +1,74 @@
+package crypto
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestGaloisField(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		if product := gfMultiply(byte(a), gfInverse(byte(a))); product != 1 {
+			t.Errorf("Expected %d times its inverse to be 1, received %d", a, product)
+		}
+	}
+	if product := gfMultiply(0x57, 0x83); product != 0xc1 {
+		t.Errorf("Expected %d, received %d", 0xc1, product)
+	}
+}
+
+func TestShamirRoundTrip(t *testing.T) {
+	secret := GenerateSecret()
+	shares, err := SplitSecret(secret[:], 5, 3)
+	if err != nil {
+		t.Fatalf("Tried to split but failed with %q", err)
+	}
+
+	subsets := [][]int{{0, 1, 2}, {4, 2, 0}, {1, 3, 4}, {0, 1, 2, 3, 4}}
+	for _, subset := range subsets {
+		var chosen []Share
+		for _, index := range subset {
+			chosen = append(chosen, shares[index])
+		}
+		got, err := CombineShares(chosen)
+		if err != nil || !bytes.Equal(got, secret[:]) {
+			t.Errorf("Expected shares %v to recover the secret, received %x '%q'", subset, got, err)
+		}
+	}
+
+	got, err := CombineShares(shares[:2])
+	if err == nil {
+		t.Errorf("Expected too few shares to fail, received %x", got)
+	}
+	if _, err = CombineShares([]Share{shares[0], shares[0], shares[1]}); err == nil {
+		t.Errorf("Expected a repeated share to fail")
+	}
+	if _, err = SplitSecret(secret[:], 2, 3); err == nil {
+		t.Errorf("Expected a threshold above the share count to fail")
+	}
+}
+
+func TestShareText(t *testing.T) {
+	shares, _ := SplitSecret([]byte("a secret"), 3, 2)
+	text := EncodeShare(shares[1])
+	if !strings.HasPrefix(text, SharePrefix) || strings.ToUpper(text) != text {
+		t.Errorf("Expected an uppercase share starting %q, received %q", SharePrefix, text)
+	}
+
+	decoded, err := DecodeShare(" " + strings.ToLower(text) + "\n")
+	if err != nil || decoded.X != shares[1].X || decoded.Threshold != 2 || !bytes.Equal(decoded.Y, shares[1].Y) {
+		t.Errorf("Expected %v, received %v '%q'", shares[1], decoded, err)
+	}
+
+	// change one character of the payload
+	mistyped := []byte(text)
+	index := len(SharePrefix) + 3
+	if mistyped[index] == 'A' {
+		mistyped[index] = 'B'
+	} else {
+		mistyped[index] = 'A'
+	}
+	if _, err = DecodeShare(string(mistyped)); err != ShareChecksumFailed {
+		t.Errorf("Expected %q, received %q", ShareChecksumFailed, err)
+	}
+}
@@ -0,0 +1,182 @@
+package crypto
+
+import (
+	"encoding/binary"
+	"errors"
+	"golang.org/x/crypto/nacl/secretbox"
+	"io"
+)
+
+/**
+ * Stream layout:
+ *
+ * nonce-prefix		- 16 random bytes
+ * chunks			- ChunkSize bytes of plaintext sealed with secretbox, the last may be shorter
+ *
+ * Each chunk's nonce is the prefix, a big endian 7 byte chunk counter and a final flag byte,
+ * so chunks cannot be reordered and a stream cut at a chunk boundary fails to open because
+ * its new last chunk was not sealed as final. An empty stream still has one final chunk.
+ */
+
+const (
+	ChunkSize       = 64 * 1024
+	noncePrefixSize = 16
+	sealedChunkSize = ChunkSize + secretbox.Overhead
+	maxChunks       = 1 << 56
+)
+
+var StreamAuthenticationFailed = errors.New("stream chunk failed authentication")
+var StreamTooLong = errors.New("stream exceeds the maximum number of chunks")
+
+type streamWriter struct {
+	writer  io.Writer
+	key     *[SecretSize]byte
+	prefix  [noncePrefixSize]byte
+	counter uint64
+	buffer  []byte
+	closed  bool
+}
+
+// NewStreamWriter seals everything written to it into w, Close must be called to seal the final chunk
+func NewStreamWriter(w io.Writer, key *[SecretSize]byte) (io.WriteCloser, error) {
+	stream := &streamWriter{writer: w, key: key, buffer: make([]byte, 0, ChunkSize)}
+	nonce := GenerateNonce()
+	copy(stream.prefix[:], nonce[:noncePrefixSize])
+
+	_, err := w.Write(stream.prefix[:])
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+func (s *streamWriter) Write(p []byte) (written int, err error) {
+	for len(p) > 0 {
+		// a full buffer is only sealed once more data arrives, so the final chunk is never empty unless the stream is
+		if len(s.buffer) == ChunkSize {
+			err = s.seal(false)
+			if err != nil {
+				return written, err
+			}
+		}
+
+		count := copy(s.buffer[len(s.buffer):ChunkSize], p)
+		s.buffer = s.buffer[:len(s.buffer)+count]
+		p = p[count:]
+		written += count
+	}
+	return written, nil
+}
+
+func (s *streamWriter) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	err := s.seal(true)
+	Wipe(s.buffer[:cap(s.buffer)])
+	return err
+}
+
+func (s *streamWriter) seal(final bool) error {
+	if s.counter >= maxChunks {
+		return StreamTooLong
+	}
+
+	nonce := chunkNonce(s.prefix, s.counter, final)
+	_, err := s.writer.Write(secretbox.Seal(nil, s.buffer, &nonce, s.key))
+	s.counter++
+	Wipe(s.buffer)
+	s.buffer = s.buffer[:0]
+	return err
+}
+
+type streamReader struct {
+	reader  io.Reader
+	key     *[SecretSize]byte
+	prefix  [noncePrefixSize]byte
+	counter uint64
+	sealed  []byte
+	pending int
+	opened  []byte
+	chunk   []byte
+	done    bool
+}
+
+// NewStreamReader opens a stream sealed by NewStreamWriter, reads fail if it was altered or cut short
+func NewStreamReader(r io.Reader, key *[SecretSize]byte) (io.Reader, error) {
+	stream := &streamReader{reader: r, key: key, sealed: make([]byte, sealedChunkSize+1)}
+	_, err := io.ReadFull(r, stream.prefix[:])
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, StreamAuthenticationFailed
+	}
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	for len(s.opened) == 0 {
+		// the plaintext of a chunk is wiped once it has all been read
+		Wipe(s.chunk)
+		if s.done {
+			return 0, io.EOF
+		}
+		err := s.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	count := copy(p, s.opened)
+	s.opened = s.opened[count:]
+	return count, nil
+}
+
+// open reads one byte beyond a chunk to learn whether it is the final one
+func (s *streamReader) open() error {
+	count, err := io.ReadFull(s.reader, s.sealed[s.pending:])
+	count += s.pending
+	final := err == io.EOF || err == io.ErrUnexpectedEOF
+	if err != nil && !final {
+		return err
+	}
+
+	chunk := s.sealed[:count]
+	if !final {
+		chunk = s.sealed[:sealedChunkSize]
+	}
+	if len(chunk) < secretbox.Overhead || s.counter >= maxChunks {
+		return StreamAuthenticationFailed
+	}
+
+	nonce := chunkNonce(s.prefix, s.counter, final)
+	opened, ok := secretbox.Open(nil, chunk, &nonce, s.key)
+	if !ok {
+		return StreamAuthenticationFailed
+	}
+
+	s.counter++
+	s.opened = opened
+	s.chunk = opened
+	s.done = final
+	if !final {
+		// carry the extra byte over as the start of the next chunk
+		s.sealed[0] = s.sealed[sealedChunkSize]
+		s.pending = 1
+	}
+	return nil
+}
+
+func chunkNonce(prefix [noncePrefixSize]byte, counter uint64, final bool) (nonce [NonceSize]byte) {
+	var counterBytes [8]byte
+	binary.BigEndian.PutUint64(counterBytes[:], counter)
+
+	copy(nonce[:], prefix[:])
+	copy(nonce[noncePrefixSize:], counterBytes[1:])
+	if final {
+		nonce[NonceSize-1] = 1
+	}
+	return nonce
+}
@@ -0,0 +1,79 @@
+package crypto
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestStreamRoundTrip(t *testing.T) {
+	key := GenerateSecret()
+	for _, size := range []int{0, 1, ChunkSize - 1, ChunkSize, ChunkSize + 1, 3*ChunkSize + 17} {
+		plaintext := make([]byte, size)
+		for i := range plaintext {
+			plaintext[i] = byte(i * 7)
+		}
+
+		var sealed bytes.Buffer
+		writer, err := NewStreamWriter(&sealed, &key)
+		if err != nil {
+			t.Fatalf("Tried to start stream but failed with %q", err)
+		}
+		// uneven writes cross chunk boundaries
+		for offset := 0; offset < size; offset += 5000 {
+			end := offset + 5000
+			if end > size {
+				end = size
+			}
+			if _, err = writer.Write(plaintext[offset:end]); err != nil {
+				t.Errorf("Tried to write stream but failed with %q", err)
+			}
+		}
+		if err = writer.Close(); err != nil {
+			t.Errorf("Tried to close stream but failed with %q", err)
+		}
+
+		reader, err := NewStreamReader(bytes.NewReader(sealed.Bytes()), &key)
+		if err != nil {
+			t.Fatalf("Tried to open stream but failed with %q", err)
+		}
+		got, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Errorf("Tried to read stream of %d bytes but failed with %q", size, err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Errorf("Expected %d bytes back, received %d", size, len(got))
+		}
+	}
+}
+
+func TestStreamTampering(t *testing.T) {
+	key := GenerateSecret()
+	plaintext := make([]byte, 3*ChunkSize)
+
+	var sealed bytes.Buffer
+	writer, _ := NewStreamWriter(&sealed, &key)
+	_, _ = writer.Write(plaintext)
+	_ = writer.Close()
+	stream := sealed.Bytes()
+
+	flipped := append([]byte{}, stream...)
+	flipped[len(flipped)/2] ^= 1
+
+	cases := map[string][]byte{
+		"truncated at a chunk":  stream[:noncePrefixSize+2*sealedChunkSize],
+		"truncated mid chunk":   stream[:len(stream)-10],
+		"altered":               flipped,
+		"only the nonce prefix": stream[:noncePrefixSize],
+	}
+
+	for name, c := range cases {
+		reader, err := NewStreamReader(bytes.NewReader(c), &key)
+		if err == nil {
+			_, err = ioutil.ReadAll(reader)
+		}
+		if err != StreamAuthenticationFailed {
+			t.Errorf("Expected %s stream to fail authentication, received %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package gitsync
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+/**
+ * The store directory is kept as a git work tree holding the stores alone, audit logs and the
+ * executable beside them stay out of it. Stores are binary files git cannot merge, so they are
+ * given a merge driver, the keepo executable, which merges two copies entry by entry.
+ */
+
+// Branch is the one branch stores are synchronised on
+const Branch = "main"
+
+// Remote names the remote stores are pulled from and pushed to
+const Remote = "origin"
+
+// DriverName names the merge driver in the attributes and config of the repository
+const DriverName = "keepo"
+
+const ignored = `# only stores are synchronised, audit logs and the executable stay local
+/*
+!/*%s
+!/.gitignore
+!/.gitattributes
+`
+
+const attributes = "*%s -text -diff merge=" + DriverName + "\n"
+
+// Result is what a sync did
+type Result struct {
+	// Committed holds the stores changed in the commit made, none when nothing changed
+	Committed []string `json:"committed"`
+	Remote    string   `json:"remote,omitempty"`
+	Pulled    bool     `json:"pulled"`
+	Pushed    bool     `json:"pushed"`
+}
+
+// Options configure a sync, Driver is the command git runs to merge a store, given the base,
+// ours and theirs paths, and Extension the suffix of store files
+type Options struct {
+	Dir       string
+	Extension string
+	Driver    string
+	// RemoteURL replaces the configured remote when given
+	RemoteURL string
+}
+
+// Sync commits the changed stores, then with a remote configured merges in its changes and
+// pushes the result. A merge that fails is undone, leaving the committed stores as they were.
+func Sync(options Options) (result Result, err error) {
+	repository := &repository{dir: options.Dir}
+	if err = repository.prepare(options); err != nil {
+		return result, err
+	}
+
+	if result.Committed, err = repository.commit(); err != nil {
+		return result, err
+	}
+
+	if len(options.RemoteURL) > 0 {
+		if err = repository.setRemote(options.RemoteURL); err != nil {
+			return result, err
+		}
+	}
+	result.Remote, _ = repository.git("remote", "get-url", Remote)
+	if len(result.Remote) == 0 {
+		return result, nil
+	}
+
+	if result.Pulled, err = repository.pull(); err != nil {
+		return result, err
+	}
+	if !repository.born() {
+		return result, nil
+	}
+	if _, err = repository.git("push", "-q", Remote, "HEAD:refs/heads/"+Branch); err != nil {
+		return result, err
+	}
+	result.Pushed = true
+	return result, nil
+}
+
+type repository struct {
+	dir string
+}
+
+// GitError carries the output of a git command that failed
+type GitError struct {
+	Arguments []string
+	Output    string
+}
+
+func (e *GitError) Error() string {
+	return fmt.Sprintf("git %s failed: %s", strings.Join(e.Arguments, " "), e.Output)
+}
+
+// ReadRevision gives a store file as it was committed at the revision, e.g. HEAD~1, the name
+// is the file's within the store directory
+func ReadRevision(dir, revision, name string) ([]byte, error) {
+	repository := &repository{dir: dir}
+	var contents, errors bytes.Buffer
+	if err := repository.run(&contents, &errors, "cat-file", "blob", revision+":"+name); err != nil {
+		return nil, err
+	}
+	return contents.Bytes(), nil
+}
+
+// git runs a git command in the repository, giving its trimmed output
+func (r *repository) git(arguments ...string) (string, error) {
+	var output bytes.Buffer
+	err := r.run(&output, &output, arguments...)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(output.String()), nil
+}
+
+// run runs a git command, a command that fails gives what it wrote to stderr in its error
+func (r *repository) run(stdout, stderr *bytes.Buffer, arguments ...string) error {
+	command := exec.Command("git", arguments...)
+	command.Dir = r.dir
+	command.Stdout = stdout
+	command.Stderr = stderr
+	if err := command.Run(); err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			return err
+		}
+		return &GitError{arguments, strings.TrimSpace(stderr.String())}
+	}
+	return nil
+}
+
+// prepare starts the repository when the directory has none, and keeps the files and config
+// keepo relies on in place, the driver's path changes when the executable moves
+func (r *repository) prepare(options Options) error {
+	if _, err := os.Stat(filepath.Join(r.dir, ".git")); os.IsNotExist(err) {
+		if _, err = r.git("init", "-q"); err != nil {
+			return err
+		}
+		if _, err = r.git("symbolic-ref", "HEAD", "refs/heads/"+Branch); err != nil {
+			return err
+		}
+	}
+
+	for name, contents := range map[string]string{
+		".gitignore":     fmt.Sprintf(ignored, options.Extension),
+		".gitattributes": fmt.Sprintf(attributes, options.Extension),
+	} {
+		if err := ioutil.WriteFile(filepath.Join(r.dir, name), []byte(contents), 0644); err != nil {
+			return err
+		}
+	}
+
+	if _, err := r.git("config", "merge."+DriverName+".name", "keepo store merge"); err != nil {
+		return err
+	}
+	_, err := r.git("config", "merge."+DriverName+".driver", options.Driver+" %O %A %B")
+	return err
+}
+
+// commit commits every change to the stores, giving the stores changed
+func (r *repository) commit() (changed []string, err error) {
+	if _, err = r.git("add", "-A"); err != nil {
+		return nil, err
+	}
+	staged, err := r.git("diff", "--cached", "--name-only")
+	if err != nil || len(staged) == 0 {
+		return nil, err
+	}
+
+	for _, name := range strings.Split(staged, "\n") {
+		if !strings.HasPrefix(name, ".git") {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+
+	host, _ := os.Hostname()
+	message := "keepo sync from " + host
+	if len(changed) > 0 {
+		message += "\n\n" + strings.Join(changed, "\n")
+	}
+	_, err = r.git(append(r.identity(), "commit", "-q", "-m", message)...)
+	return changed, err
+}
+
+// identity gives a committer for repositories where git has none configured
+func (r *repository) identity() []string {
+	if email, _ := r.git("config", "user.email"); len(email) > 0 {
+		return nil
+	}
+	host, _ := os.Hostname()
+	return []string{"-c", "user.name=keepo", "-c", "user.email=keepo@" + host}
+}
+
+func (r *repository) setRemote(url string) error {
+	if _, err := r.git("remote", "get-url", Remote); err != nil {
+		_, err = r.git("remote", "add", Remote, url)
+		return err
+	}
+	_, err := r.git("remote", "set-url", Remote, url)
+	return err
+}
+
+// born tells whether the branch has a commit yet
+func (r *repository) born() bool {
+	_, err := r.git("rev-parse", "-q", "--verify", "HEAD")
+	return err == nil
+}
+
+// pull fetches the remote branch and merges it, an empty remote has nothing to pull
+func (r *repository) pull() (bool, error) {
+	if _, err := r.git("fetch", "-q", Remote); err != nil {
+		return false, err
+	}
+	remoteBranch := "refs/remotes/" + Remote + "/" + Branch
+	if _, err := r.git("rev-parse", "-q", "--verify", remoteBranch); err != nil {
+		return false, nil
+	}
+
+	if !r.born() {
+		_, err := r.git("checkout", "-q", "-B", Branch, remoteBranch)
+		return err == nil, err
+	}
+
+	merge := append(r.identity(), "merge", "-q", "--no-edit", "--allow-unrelated-histories", remoteBranch)
+	if _, err := r.git(merge...); err != nil {
+		_, _ = r.git("merge", "--abort")
+		return false, err
+	}
+	return true, nil
+}
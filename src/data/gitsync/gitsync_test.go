@@ -0,0 +1,78 @@
+package gitsync
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestSync(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir, err := ioutil.TempDir("", "gitsync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	remote, first, second := filepath.Join(dir, "remote.git"), filepath.Join(dir, "first"), filepath.Join(dir, "second")
+	if output, err := exec.Command("git", "init", "-q", "--bare", remote).CombinedOutput(); err != nil {
+		t.Fatalf("could not create remote '%s'", output)
+	}
+	for _, path := range []string{first, second} {
+		_ = os.Mkdir(path, 0700)
+		_ = ioutil.WriteFile(filepath.Join(path, "keepo"), []byte("executable"), 0700)
+	}
+
+	sync := func(path string, remoteURL string) Result {
+		result, err := Sync(Options{Dir: path, Extension: ".kpo", Driver: "false", RemoteURL: remoteURL})
+		if err != nil {
+			t.Fatalf("could not sync '%q'", err)
+		}
+		return result
+	}
+
+	_ = ioutil.WriteFile(filepath.Join(first, "a.kpo"), []byte("first store"), 0600)
+	result := sync(first, remote)
+	if len(result.Committed) != 1 || result.Committed[0] != "a.kpo" || !result.Pushed {
+		t.Errorf("Expected %q to be committed and pushed, received %v", "a.kpo", result)
+	}
+
+	_ = ioutil.WriteFile(filepath.Join(second, "b.kpo"), []byte("second store"), 0600)
+	result = sync(second, remote)
+	if !result.Pulled || !result.Pushed {
+		t.Errorf("Expected the remote to be pulled and pushed, received %v", result)
+	}
+
+	// the remote is kept once configured
+	result = sync(first, "")
+	if len(result.Committed) != 0 || !result.Pulled {
+		t.Errorf("Expected nothing to commit and the remote to be pulled, received %v", result)
+	}
+
+	for _, path := range []string{first, second} {
+		for _, name := range []string{"a.kpo", "b.kpo"} {
+			if _, err := os.Stat(filepath.Join(path, name)); err != nil {
+				t.Errorf("Expected %s in %s, received '%q'", name, path, err)
+			}
+		}
+	}
+	if output, _ := exec.Command("git", "-C", first, "ls-files", "keepo").Output(); len(output) > 0 {
+		t.Errorf("Expected the executable to stay out of the repository")
+	}
+
+	_ = ioutil.WriteFile(filepath.Join(first, "a.kpo"), []byte("first store changed"), 0600)
+	sync(first, "")
+	for revision, expected := range map[string]string{"HEAD": "first store changed", "HEAD~1": "first store"} {
+		contents, err := ReadRevision(first, revision, "a.kpo")
+		if err != nil || string(contents) != expected {
+			t.Errorf("Expected %q at %s, received %q (%v)", expected, revision, contents, err)
+		}
+	}
+	if _, err := ReadRevision(first, "HEAD", "missing.kpo"); err == nil {
+		t.Errorf("Expected a store absent from the revision to fail")
+	}
+}
@@ -0,0 +1,84 @@
+package input
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	matchScore       = 1
+	consecutiveBonus = 5
+	boundaryBonus    = 10
+	gapPenalty       = 1
+	maxGapPenalty    = 5
+)
+
+// FuzzyScore matches the pattern as a case insensitive subsequence of the candidate, favouring
+// runs of characters and characters starting a path segment or word
+func FuzzyScore(pattern, candidate string) (score int, ok bool) {
+	patternRunes := []rune(strings.ToLower(pattern))
+	candidateRunes := []rune(candidate)
+	if len(patternRunes) == 0 {
+		return 0, true
+	}
+
+	next := 0
+	previous := -1
+	for index, character := range candidateRunes {
+		if unicode.ToLower(character) != patternRunes[next] {
+			continue
+		}
+
+		score += matchScore
+		if previous >= 0 && previous == index-1 {
+			score += consecutiveBonus
+		}
+		if index == 0 || strings.ContainsRune("/:-_. ", candidateRunes[index-1]) {
+			score += boundaryBonus
+		}
+		if previous >= 0 {
+			gap := index - previous - 1
+			if gap > maxGapPenalty {
+				gap = maxGapPenalty
+			}
+			score -= gap * gapPenalty
+		}
+
+		previous = index
+		next++
+		if next == len(patternRunes) {
+			// shorter candidates are the closer match
+			return score*100 - len(candidateRunes), true
+		}
+	}
+	return 0, false
+}
+
+// FuzzyFilter gives the indexes of the candidates matching the pattern, best match first
+func FuzzyFilter(pattern string, candidates []string) []int {
+	type scored struct {
+		index int
+		score int
+	}
+
+	matches := make([]scored, 0, len(candidates))
+	for index, candidate := range candidates {
+		if score, ok := FuzzyScore(pattern, candidate); ok {
+			matches = append(matches, scored{index, score})
+		}
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].score != matches[j].score {
+			return matches[i].score > matches[j].score
+		}
+		return candidates[matches[i].index] < candidates[matches[j].index]
+	})
+
+	indexes := make([]int, len(matches))
+	for index, match := range matches {
+		indexes[index] = match.index
+	}
+	return indexes
+}
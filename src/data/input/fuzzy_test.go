@@ -0,0 +1,50 @@
+package input
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFuzzyScore(t *testing.T) {
+	cases := []struct {
+		pattern   string
+		candidate string
+		ok        bool
+	}{
+		{"", "anything", true},
+		{"dbu", "db/url", true},
+		{"DBU", "db/url", true},
+		{"udb", "db/url", false},
+		{"gh", "web/github", true},
+		{"xyz", "web/github", false},
+	}
+
+	for _, c := range cases {
+		if _, ok := FuzzyScore(c.pattern, c.candidate); ok != c.ok {
+			t.Errorf("Expected %q matching %q to be %v", c.pattern, c.candidate, c.ok)
+		}
+	}
+}
+
+func TestFuzzyFilter(t *testing.T) {
+	candidates := []string{"mail/personal", "prod:db/password", "db/primary", "web/github", "dbx"}
+
+	cases := []struct {
+		pattern string
+		want    []int
+	}{
+		// runs and segment starts outrank scattered characters
+		{"db", []int{4, 2, 1}},
+		{"dbp", []int{2, 1}},
+		{"gith", []int{3}},
+		{"pass", []int{1}},
+		{"", []int{2, 4, 0, 1, 3}},
+	}
+
+	for _, c := range cases {
+		got := FuzzyFilter(c.pattern, candidates)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Expected %v for %q, received %v", c.want, c.pattern, got)
+		}
+	}
+}
@@ -1,63 +1,104 @@
 package input
 
 import (
-	"bufio"
 	"fmt"
+	"io"
+	"keepo/src/crypto"
 	"os"
-	"strings"
-	"syscall"
 )
 
-// Use stty to disable echoing.
-func ReadPassword() string {
+// maxPasswordSize bounds the secure buffer a password is read into
+const maxPasswordSize = 4096
 
-	// Prompt for password
-	fmt.Println("password:")
+// Use stty to disable echoing, which is enabled again however the read ends. The password is read
+// into a secure buffer the caller destroys.
+func ReadPassword() (*crypto.Buffer, error) {
 
-	// Common settings and variables for both stty calls.
-	attrs := syscall.ProcAttr{
-		Dir:   "",
-		Env:   []string{},
-		Files: []uintptr{os.Stdin.Fd(), os.Stdout.Fd(), os.Stderr.Fd()},
-		Sys:   nil}
-	var ws syscall.WaitStatus
+	// Prompt for password
+	fmt.Fprintln(os.Stderr, "password:")
 
 	// Disable echoing.
-	pid, err := syscall.ForkExec(
-		"/bin/stty",
-		[]string{"stty", "-echo"},
-		&attrs)
-	if err != nil {
-		panic(err)
+	if err := stty("-echo"); err != nil {
+		return nil, err
 	}
 
-	// Wait for the stty process to complete.
-	_, err = syscall.Wait4(pid, &ws, 0, nil)
+	// Re-enable echo.
+	defer func() {
+		if err := stty("echo"); err != nil {
+			panic(err)
+		}
+	}()
+
+	// Echo is disabled, now grab the data, a byte at a time so no copy is left in a read buffer.
+	password, err := crypto.NewBuffer(maxPasswordSize)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	length, err := readLine(os.Stdin, password.Bytes())
+	if err != nil && err != io.EOF {
+		password.Destroy()
+		return nil, err
 	}
 
-	// Echo is disabled, now grab the data.
-	reader := bufio.NewReader(os.Stdin)
-	text, err := reader.ReadString('\n')
+	trimSpace(password, length)
+	return password, nil
+}
+
+// ReadLine reads a line from stdin into a secure buffer the caller destroys, a byte at a time so
+// nothing after the line is consumed, io.EOF is returned once the input is used up
+func ReadLine(maxSize int) (*crypto.Buffer, error) {
+	line, err := crypto.NewBuffer(maxSize)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-
-	// Re-enable echo.
-	pid, err = syscall.ForkExec(
-		"/bin/stty",
-		[]string{"stty", "echo"},
-		&attrs)
+	length, err := readLine(os.Stdin, line.Bytes())
 	if err != nil {
-		panic(err)
+		line.Destroy()
+		return nil, err
 	}
+	trimSpace(line, length)
+	return line, nil
+}
 
-	// Wait for the stty process to complete.
-	_, err = syscall.Wait4(pid, &ws, 0, nil)
-	if err != nil {
-		panic(err)
+// readLine reads up to a newline or the end of input into line, giving the length read, io.EOF
+// is only returned when the input ended before anything was read
+func readLine(reader io.Reader, line []byte) (length int, err error) {
+	character := make([]byte, 1)
+	defer crypto.Wipe(character)
+	for length < len(line) {
+		_, err = reader.Read(character)
+		if err == io.EOF && length == 0 {
+			return 0, io.EOF
+		}
+		if err == io.EOF {
+			return length, nil
+		}
+		if err != nil {
+			return length, err
+		}
+		if character[0] == '\n' {
+			return length, nil
+		}
+		line[length] = character[0]
+		length++
+	}
+	return length, fmt.Errorf("input is longer than %d bytes", len(line))
+}
+
+// trimSpace trims the first length bytes of the buffer in place, leaving the buffer at its result
+func trimSpace(buffer *crypto.Buffer, length int) {
+	data := buffer.Bytes()
+	start, end := 0, length
+	for start < end && isSpace(data[start]) {
+		start++
+	}
+	for end > start && isSpace(data[end-1]) {
+		end--
 	}
+	copy(data, data[start:end])
+	buffer.Truncate(end - start)
+}
 
-	return strings.TrimSpace(text)
+func isSpace(character byte) bool {
+	return character == ' ' || character == '\t' || character == '\r' || character == '\n'
 }
\ No newline at end of file
@@ -0,0 +1,46 @@
+package input
+
+import (
+	"io"
+	"keepo/src/crypto"
+	"strings"
+	"testing"
+)
+
+func TestReadLine(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"password01\n", "password01"},
+		{"  padded \r\nnext line\n", "padded"},
+		{"no newline", "no newline"},
+		{"\n", ""},
+	}
+
+	for _, c := range cases {
+		buffer, err := crypto.NewBuffer(32)
+		if err != nil {
+			t.Fatalf("Tried to make a buffer but failed with %q", err)
+		}
+
+		length, err := readLine(strings.NewReader(c.in), buffer.Bytes())
+		if err != nil {
+			t.Errorf("Tried to read %q but failed with %q", c.in, err)
+		}
+		trimSpace(buffer, length)
+		if string(buffer.Bytes()) != c.want {
+			t.Errorf("Expected %q, received %q", c.want, buffer.Bytes())
+		}
+		buffer.Destroy()
+	}
+
+	buffer, _ := crypto.NewBuffer(4)
+	defer buffer.Destroy()
+	if _, err := readLine(strings.NewReader(""), buffer.Bytes()); err != io.EOF {
+		t.Errorf("Expected %q, received %q", io.EOF, err)
+	}
+	if _, err := readLine(strings.NewReader("too long\n"), buffer.Bytes()); err == nil {
+		t.Errorf("Expected an error for a line longer than the buffer")
+	}
+}
@@ -0,0 +1,195 @@
+package input
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const pickerRows = 10
+
+// key codes read in raw mode
+const (
+	keyInterrupt = 3
+	keyEnter     = 13
+	keyEscape    = 27
+	keyBackspace = 127
+	keyDelete    = 8
+	keyClearLine = 21
+	keyNext      = 14
+	keyPrevious  = 16
+)
+
+var PickCancelled = errors.New("pick cancelled")
+
+type PickItem struct {
+	Label   string
+	Preview []string
+}
+
+type picker struct {
+	items    []PickItem
+	labels   []string
+	query    []rune
+	matches  []int
+	selected int
+	width    int
+	drawn    int
+}
+
+// Pick runs a fuzzy filter over the items on the terminal, drawn on stderr so stdout stays free
+// for the result, and returns the index of the chosen item
+func Pick(items []PickItem) (int, error) {
+	p := &picker{items: items, width: terminalWidth()}
+	for _, item := range items {
+		p.labels = append(p.labels, item.Label)
+	}
+	p.filter()
+
+	err := stty("raw", "-echo")
+	if err != nil {
+		return -1, err
+	}
+	defer func() {
+		p.clear()
+		if err := stty("-raw", "echo"); err != nil {
+			panic(err)
+		}
+	}()
+
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		p.draw()
+
+		character, _, err := reader.ReadRune()
+		if err != nil {
+			return -1, err
+		}
+
+		switch character {
+		case keyInterrupt:
+			return -1, PickCancelled
+		case keyEnter:
+			if len(p.matches) == 0 {
+				continue
+			}
+			return p.matches[p.selected], nil
+		case keyEscape:
+			// arrow keys arrive as escape sequences, a lone escape cancels
+			if reader.Buffered() == 0 {
+				return -1, PickCancelled
+			}
+			sequence := make([]byte, 2)
+			_, _ = reader.Read(sequence)
+			switch string(sequence) {
+			case "[A":
+				p.move(-1)
+			case "[B":
+				p.move(1)
+			}
+		case keyPrevious:
+			p.move(-1)
+		case keyNext:
+			p.move(1)
+		case keyBackspace, keyDelete:
+			if len(p.query) > 0 {
+				p.query = p.query[:len(p.query)-1]
+				p.filter()
+			}
+		case keyClearLine:
+			p.query = nil
+			p.filter()
+		default:
+			if character >= ' ' {
+				p.query = append(p.query, character)
+				p.filter()
+			}
+		}
+	}
+}
+
+func (p *picker) filter() {
+	p.matches = FuzzyFilter(string(p.query), p.labels)
+	p.selected = 0
+}
+
+func (p *picker) move(step int) {
+	if len(p.matches) == 0 {
+		return
+	}
+	p.selected = (p.selected + step + len(p.matches)) % len(p.matches)
+}
+
+func (p *picker) draw() {
+	var lines []string
+	lines = append(lines, fmt.Sprintf("%d/%d > %s", len(p.matches), len(p.items), string(p.query)))
+
+	// keep the selection in view
+	first := 0
+	if p.selected >= pickerRows {
+		first = p.selected - pickerRows + 1
+	}
+	for row := first; row < len(p.matches) && row < first+pickerRows; row++ {
+		label := p.truncate("  " + p.items[p.matches[row]].Label)
+		if row == p.selected {
+			label = "\033[7m" + p.truncate("> "+p.items[p.matches[row]].Label) + "\033[0m"
+		}
+		lines = append(lines, label)
+	}
+
+	if len(p.matches) > 0 {
+		lines = append(lines, p.truncate(strings.Repeat("-", p.width)))
+		for _, preview := range p.items[p.matches[p.selected]].Preview {
+			lines = append(lines, p.truncate("  "+preview))
+		}
+	}
+
+	p.clear()
+	// the prompt line is drawn last so the cursor is left after the query
+	if len(lines) > 1 {
+		fmt.Fprint(os.Stderr, "\r\n"+strings.Join(lines[1:], "\r\n"))
+		fmt.Fprintf(os.Stderr, "\033[%dA", len(lines)-1)
+	}
+	fmt.Fprint(os.Stderr, "\r"+lines[0])
+	p.drawn = len(lines)
+}
+
+// clear erases everything drawn, leaving the cursor where the picker started
+func (p *picker) clear() {
+	if p.drawn > 0 {
+		fmt.Fprint(os.Stderr, "\r\033[J")
+	}
+}
+
+func (p *picker) truncate(line string) string {
+	if utf8.RuneCountInString(line) <= p.width {
+		return line
+	}
+	return string([]rune(line)[:p.width])
+}
+
+func terminalWidth() int {
+	command := exec.Command("stty", "size")
+	command.Stdin = os.Stdin
+	size, err := command.Output()
+	if err == nil {
+		fields := strings.Fields(string(size))
+		if len(fields) == 2 {
+			if width, err := strconv.Atoi(fields[1]); err == nil && width > 0 {
+				return width - 1
+			}
+		}
+	}
+	return 79
+}
+
+func stty(arguments ...string) error {
+	command := exec.Command("stty", arguments...)
+	command.Stdin = os.Stdin
+	return command.Run()
+}
@@ -0,0 +1,81 @@
+package output
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+)
+
+type Format int
+
+const (
+	Text Format = iota
+	JSON
+	YAML
+)
+
+type FormatError string
+
+func (k FormatError) Error() string {
+	return "unknown output format '" + string(k) + "' (expected json, yaml or text)"
+}
+
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(name) {
+	case "text":
+		return Text, nil
+	case "json":
+		return JSON, nil
+	case "yaml", "yml":
+		return YAML, nil
+	}
+	return Text, FormatError(name)
+}
+
+func (f Format) String() string {
+	switch f {
+	case JSON:
+		return "json"
+	case YAML:
+		return "yaml"
+	}
+	return "text"
+}
+
+// Structured reports whether the format is intended for machines rather than people.
+func (f Format) Structured() bool {
+	return f == JSON || f == YAML
+}
+
+// Encode writes value to w as a single document in the given structured format,
+// values are described by their json tags for both json and yaml.
+func Encode(w io.Writer, format Format, value interface{}) error {
+	switch format {
+	case JSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(value)
+	case YAML:
+		generic, err := toGeneric(value)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(w, strings.Join(yamlLines(generic), "\n")+"\n")
+		return err
+	}
+	return FormatError(format.String())
+}
+
+// round trip through json so yaml output honours the same field names and omissions
+func toGeneric(value interface{}) (generic interface{}, err error) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.UseNumber()
+	err = decoder.Decode(&generic)
+	return generic, err
+}
@@ -0,0 +1,52 @@
+package output
+
+import (
+	"bytes"
+	"testing"
+)
+
+type formatEntry struct {
+	Name  string   `json:"name"`
+	Size  int64    `json:"size"`
+	Keys  []string `json:"keys"`
+	Empty *string  `json:"empty,omitempty"`
+}
+
+func TestEncode(t *testing.T) {
+	cases := []struct {
+		format Format
+		in     interface{}
+		want   string
+	}{
+		{JSON, formatEntry{"default", 12, []string{"a"}, nil},
+			"{\n  \"name\": \"default\",\n  \"size\": 12,\n  \"keys\": [\n    \"a\"\n  ]\n}\n"},
+		{YAML, formatEntry{"default", 12, []string{"a", "true", "b: c"}, nil},
+			"keys:\n  - a\n  - \"true\"\n  - \"b: c\"\nname: default\nsize: 12\n"},
+		{YAML, []formatEntry{{"one", 1, []string{}, nil}, {"two", 2, nil, nil}},
+			"- keys: []\n  name: one\n  size: 1\n- keys: null\n  name: two\n  size: 2\n"},
+		{YAML, map[string]interface{}{}, "{}\n"},
+	}
+
+	for _, c := range cases {
+		var buffer bytes.Buffer
+		err := Encode(&buffer, c.format, c.in)
+		if err != nil {
+			t.Errorf("Tried to encode %v but failed with %q", c.format, err)
+		}
+		if buffer.String() != c.want {
+			t.Errorf("Expected %q, received %q", c.want, buffer.String())
+		}
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	for _, name := range []string{"json", "YAML", "text"} {
+		if _, err := ParseFormat(name); err != nil {
+			t.Errorf("Expected %q to be a format but failed with %q", name, err)
+		}
+	}
+
+	if _, err := ParseFormat("xml"); err == nil {
+		t.Errorf("Expected xml to be rejected")
+	}
+}
@@ -0,0 +1,141 @@
+package output
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"regexp"
+	"strings"
+)
+
+var resourceName = regexp.MustCompile(`^[a-z0-9]([-a-z0-9.]{0,251}[a-z0-9])?$`)
+var secretDataKey = regexp.MustCompile(`[^-._a-zA-Z0-9]`)
+var envName = regexp.MustCompile(`[^A-Z0-9_]`)
+
+// NamedValue is a value with the name it is written under in a manifest or env file
+type NamedValue struct {
+	Name  string
+	Value []byte
+}
+
+type ManifestError string
+
+func (k ManifestError) Error() string {
+	return string(k)
+}
+
+// SecretDataKey names a key as a Secret data key, characters Kubernetes refuses becoming '_'
+func SecretDataKey(key string) string {
+	return secretDataKey.ReplaceAllString(key, "_")
+}
+
+// EnvName names a key as an environment variable, upper case with other characters becoming '_'
+func EnvName(key string) string {
+	name := envName.ReplaceAllString(strings.ToUpper(key), "_")
+	if len(name) == 0 || name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+// WriteKubernetesSecret writes an Opaque Secret manifest holding the values base64 encoded, the
+// namespace is left out when empty
+func WriteKubernetesSecret(w io.Writer, name, namespace string, values []NamedValue) error {
+	if err := checkResource(name, namespace); err != nil {
+		return err
+	}
+	manifest := &errorWriter{w: w}
+	manifest.WriteString("apiVersion: v1\nkind: Secret\n")
+	writeResourceMetadata(manifest, "", name, namespace)
+	manifest.WriteString("type: Opaque\ndata:\n")
+	writeData(manifest, "  ", values)
+	return manifest.err
+}
+
+// WriteSealedSecret writes a SealedSecret manifest for the sealed-secrets controller, the values
+// already sealed with its certificate for the name and namespace
+func WriteSealedSecret(w io.Writer, name, namespace string, values []NamedValue) error {
+	if err := checkResource(name, namespace); err != nil {
+		return err
+	}
+	if len(namespace) == 0 {
+		return ManifestError("a sealed secret needs a namespace")
+	}
+	manifest := &errorWriter{w: w}
+	manifest.WriteString("apiVersion: bitnami.com/v1alpha1\nkind: SealedSecret\n")
+	writeResourceMetadata(manifest, "", name, namespace)
+	manifest.WriteString("spec:\n  encryptedData:\n")
+	writeData(manifest, "    ", values)
+	manifest.WriteString("  template:\n")
+	writeResourceMetadata(manifest, "    ", name, namespace)
+	manifest.WriteString("    type: Opaque\n")
+	return manifest.err
+}
+
+// WriteEnvFile writes the values as NAME=value lines, which docker's --env-file reads literally,
+// so values holding a line break cannot be written
+func WriteEnvFile(w io.Writer, values []NamedValue) error {
+	for _, value := range values {
+		if bytes.ContainsAny(value.Value, "\n\r\x00") {
+			return ManifestError("the value of '" + value.Name + "' holds a line break, env files cannot hold it")
+		}
+	}
+	file := &errorWriter{w: w}
+	for _, value := range values {
+		file.WriteString(value.Name + "=")
+		file.Write(value.Value)
+		file.WriteString("\n")
+	}
+	return file.err
+}
+
+func checkResource(name, namespace string) error {
+	if !resourceName.MatchString(name) {
+		return ManifestError("'" + name + "' is not a valid resource name, use lower case letters, digits, '-' and '.'")
+	}
+	if len(namespace) > 0 && !resourceName.MatchString(namespace) {
+		return ManifestError("'" + namespace + "' is not a valid namespace")
+	}
+	return nil
+}
+
+func writeResourceMetadata(manifest *errorWriter, indent, name, namespace string) {
+	manifest.WriteString(indent + "metadata:\n")
+	manifest.WriteString(indent + "  name: " + yamlScalar(name) + "\n")
+	if len(namespace) > 0 {
+		manifest.WriteString(indent + "  namespace: " + yamlScalar(namespace) + "\n")
+	}
+}
+
+func writeData(manifest *errorWriter, indent string, values []NamedValue) {
+	for _, value := range values {
+		manifest.WriteString(indent + yamlScalar(value.Name) + ": ")
+		if len(value.Value) == 0 {
+			manifest.WriteString("\"\"\n")
+			continue
+		}
+		encoder := base64.NewEncoder(base64.StdEncoding, manifest)
+		_, _ = encoder.Write(value.Value)
+		_ = encoder.Close()
+		manifest.WriteString("\n")
+	}
+}
+
+// errorWriter keeps the first error writing, and writes nothing after it
+type errorWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (e *errorWriter) Write(p []byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+	var written int
+	written, e.err = e.w.Write(p)
+	return written, e.err
+}
+
+func (e *errorWriter) WriteString(text string) {
+	_, _ = e.Write([]byte(text))
+}
@@ -0,0 +1,69 @@
+package output
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNames(t *testing.T) {
+	cases := []struct {
+		key, dataKey, env string
+	}{
+		{"db/password", "db_password", "DB_PASSWORD"},
+		{"api-key.v2", "api-key.v2", "API_KEY_V2"},
+		{"2fa seed", "2fa_seed", "_2FA_SEED"},
+	}
+	for _, c := range cases {
+		if got := SecretDataKey(c.key); got != c.dataKey {
+			t.Errorf("Expected %q, received %q", c.dataKey, got)
+		}
+		if got := EnvName(c.key); got != c.env {
+			t.Errorf("Expected %q, received %q", c.env, got)
+		}
+	}
+}
+
+func TestWriteKubernetesSecret(t *testing.T) {
+	values := []NamedValue{{"db_password", []byte("hunter2")}, {"empty", []byte{}}}
+
+	var manifest bytes.Buffer
+	if err := WriteKubernetesSecret(&manifest, "app-secrets", "apps", values); err != nil {
+		t.Fatalf("Tried to write the manifest but failed with %q", err)
+	}
+	expected := "apiVersion: v1\nkind: Secret\nmetadata:\n  name: app-secrets\n  namespace: apps\n" +
+		"type: Opaque\ndata:\n  db_password: aHVudGVyMg==\n  empty: \"\"\n"
+	if manifest.String() != expected {
+		t.Errorf("Expected %q, received %q", expected, manifest.String())
+	}
+
+	manifest.Reset()
+	if err := WriteSealedSecret(&manifest, "app-secrets", "apps", values[:1]); err != nil {
+		t.Fatalf("Tried to write the manifest but failed with %q", err)
+	}
+	expected = "apiVersion: bitnami.com/v1alpha1\nkind: SealedSecret\nmetadata:\n  name: app-secrets\n  namespace: apps\n" +
+		"spec:\n  encryptedData:\n    db_password: aHVudGVyMg==\n  template:\n    metadata:\n      name: app-secrets\n" +
+		"      namespace: apps\n    type: Opaque\n"
+	if manifest.String() != expected {
+		t.Errorf("Expected %q, received %q", expected, manifest.String())
+	}
+
+	if err := WriteKubernetesSecret(&manifest, "App Secrets", "", values); err == nil {
+		t.Errorf("Expected an invalid name to be refused")
+	}
+	if err := WriteSealedSecret(&manifest, "app-secrets", "", values); err == nil {
+		t.Errorf("Expected a sealed secret without a namespace to be refused")
+	}
+}
+
+func TestWriteEnvFile(t *testing.T) {
+	var file bytes.Buffer
+	err := WriteEnvFile(&file, []NamedValue{{"DB_USER", []byte("admin")}, {"DB_PASSWORD", []byte("a b=\"c\"")}})
+	if expected := "DB_USER=admin\nDB_PASSWORD=a b=\"c\"\n"; err != nil || file.String() != expected {
+		t.Errorf("Expected %q, received %q '%q'", expected, file.String(), err)
+	}
+
+	file.Reset()
+	if err = WriteEnvFile(&file, []NamedValue{{"A", []byte("a")}, {"KEY", []byte("line\nbreak")}}); err == nil || file.Len() > 0 {
+		t.Errorf("Expected a value with a line break to be refused before writing, received %q", file.String())
+	}
+}
@@ -1,6 +1,7 @@
 package output
 
 import (
+	"io"
 	"os"
 	"os/exec"
 	"strconv"
@@ -12,7 +13,9 @@ func (k WriteError) Error() string {
 	return "only wrote portion of length '" + strconv.Itoa(int(k)) + "' to clipboard input"
 }
 
-func CopyToClipboard(input []byte) error {
+// CopyToClipboard writes the input straight to the clipboard, taking it as a writer so a
+// crypto.Buffer is copied without its secret leaving the buffer
+func CopyToClipboard(input io.WriterTo) error {
 
 	command := exec.Command("xsel", "--input", "--clipboard")
 	command.Stdout = os.Stdout
@@ -33,13 +36,9 @@ func CopyToClipboard(input []byte) error {
 		return err
 	}
 
-	written, err := inputPipe.Write(input)
-	if written != len(input) {
+	written, err := input.WriteTo(inputPipe)
+	if err != nil && written > 0 {
 		return WriteError(written)
 	}
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return err
 }
\ No newline at end of file
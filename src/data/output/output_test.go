@@ -1,12 +1,13 @@
 package output
 
 import (
+	"bytes"
 	"testing"
 )
 
 func TestCopyToClipboard(t *testing.T) {
 
-	err := CopyToClipboard([]byte("test"))
+	err := CopyToClipboard(bytes.NewReader([]byte("test")))
 	if err != nil {
 		t.Errorf("Tried to copy to clipboard but failed with %q", err)
 	}
@@ -0,0 +1,100 @@
+package output
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var plainScalar = regexp.MustCompile(`^[A-Za-z_./][A-Za-z0-9 _./@+-]*$`)
+
+// yamlLines renders json-shaped values (maps, slices, strings, numbers, booleans, nil) as block yaml
+func yamlLines(value interface{}) []string {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		if len(typed) == 0 {
+			return []string{"{}"}
+		}
+
+		keys := make([]string, 0, len(typed))
+		for key := range typed {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		lines := make([]string, 0, len(keys))
+		for _, key := range keys {
+			nested := yamlLines(typed[key])
+			if isCollection(typed[key]) {
+				lines = append(lines, yamlScalar(key)+":")
+				lines = append(lines, indent(nested, "  ", "  ")...)
+			} else {
+				lines = append(lines, yamlScalar(key)+": "+nested[0])
+			}
+		}
+		return lines
+
+	case []interface{}:
+		if len(typed) == 0 {
+			return []string{"[]"}
+		}
+
+		lines := make([]string, 0, len(typed))
+		for _, item := range typed {
+			lines = append(lines, indent(yamlLines(item), "- ", "  ")...)
+		}
+		return lines
+
+	case string:
+		return []string{yamlScalar(typed)}
+	case json.Number:
+		return []string{typed.String()}
+	case bool:
+		return []string{strconv.FormatBool(typed)}
+	case nil:
+		return []string{"null"}
+	}
+	return []string{yamlScalar(fmt.Sprint(value))}
+}
+
+// collections that render over several lines, empty ones are written inline
+func isCollection(value interface{}) bool {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		return len(typed) > 0
+	case []interface{}:
+		return len(typed) > 0
+	}
+	return false
+}
+
+func indent(lines []string, first, rest string) []string {
+	for index := range lines {
+		if index == 0 {
+			lines[index] = first + lines[index]
+		} else {
+			lines[index] = rest + lines[index]
+		}
+	}
+	return lines
+}
+
+// strings are left plain when yaml cannot mistake them for another type, otherwise double quoted
+func yamlScalar(value string) string {
+	if plainScalar.MatchString(value) && !strings.HasSuffix(value, " ") && !reservedScalar(value) {
+		return value
+	}
+	return strconv.Quote(value)
+}
+
+func reservedScalar(value string) bool {
+	switch strings.ToLower(value) {
+	case "true", "false", "yes", "no", "on", "off", "y", "n", "null", "~", ".inf", ".nan":
+		return true
+	}
+	_, err := strconv.ParseFloat(value, 64)
+	return err == nil
+}
@@ -0,0 +1,56 @@
+package store
+
+import (
+	"sort"
+	"strings"
+)
+
+// KeySeparator divides hierarchical key names into path segments
+const KeySeparator = "/"
+
+// SplitAddress divides a '[store:]key' address at its first unescaped colon, the key keeps any
+// further colons. Within the store part '\:' and '\\' stand for a colon and a backslash, so a
+// key containing a colon in the default store is addressed as 'db\:url'.
+func SplitAddress(address string) (storeName, key string) {
+	var name strings.Builder
+	for index := 0; index < len(address); index++ {
+		switch address[index] {
+		case '\\':
+			if index+1 < len(address) && (address[index+1] == ':' || address[index+1] == '\\') {
+				index++
+			}
+			name.WriteByte(address[index])
+		case ':':
+			return name.String(), address[index+1:]
+		default:
+			name.WriteByte(address[index])
+		}
+	}
+	return DefaultStoreName, name.String()
+}
+
+// JoinAddress is the inverse of SplitAddress, giving an address that can be passed back to it
+func JoinAddress(storeName, key string) string {
+	escaped := strings.Replace(storeName, "\\", "\\\\", -1)
+	escaped = strings.Replace(escaped, ":", "\\:", -1)
+	return escaped + ":" + key
+}
+
+// InSubtree reports whether key is the prefix itself or lies beneath it in the key hierarchy,
+// an empty prefix contains every key
+func InSubtree(key, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, KeySeparator)
+	return len(prefix) == 0 || key == prefix || strings.HasPrefix(key, prefix+KeySeparator)
+}
+
+// SubtreeKeys filters keys to those in the subtree at prefix, preserving order
+func SubtreeKeys(keys []string, prefix string) (subtree []string) {
+	subtree = make([]string, 0, len(keys))
+	for _, key := range keys {
+		if InSubtree(key, prefix) {
+			subtree = append(subtree, key)
+		}
+	}
+	sort.Strings(subtree)
+	return subtree
+}
@@ -0,0 +1,59 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitAddress(t *testing.T) {
+	cases := []struct {
+		in        string
+		wantStore string
+		wantKey   string
+	}{
+		{"key", DefaultStoreName, "key"},
+		{"db:url", "db", "url"},
+		{"db:url:primary", "db", "url:primary"},
+		{"db:path/to/key", "db", "path/to/key"},
+		{`db\:url`, DefaultStoreName, "db:url"},
+		{`a\\b:c`, `a\b`, "c"},
+		{`we\:ird:key`, "we:ird", "key"},
+		{"db:", "db", ""},
+	}
+
+	for _, c := range cases {
+		gotStore, gotKey := SplitAddress(c.in)
+		if gotStore != c.wantStore || gotKey != c.wantKey {
+			t.Errorf("Expected %q to be %q/%q, received %q/%q", c.in, c.wantStore, c.wantKey, gotStore, gotKey)
+		}
+
+		if c.in != "key" && c.wantStore != DefaultStoreName {
+			rejoinedStore, rejoinedKey := SplitAddress(JoinAddress(gotStore, gotKey))
+			if rejoinedStore != gotStore || rejoinedKey != gotKey {
+				t.Errorf("Expected %q to survive joining, received %q/%q", c.in, rejoinedStore, rejoinedKey)
+			}
+		}
+	}
+}
+
+func TestSubtreeKeys(t *testing.T) {
+	keys := []string{"db/url", "db", "dbx", "web/db/url", "db/replica/url"}
+
+	cases := []struct {
+		prefix string
+		want   []string
+	}{
+		{"db/", []string{"db", "db/replica/url", "db/url"}},
+		{"db", []string{"db", "db/replica/url", "db/url"}},
+		{"db/replica", []string{"db/replica/url"}},
+		{"", []string{"db", "db/replica/url", "db/url", "dbx", "web/db/url"}},
+		{"missing/", []string{}},
+	}
+
+	for _, c := range cases {
+		got := SubtreeKeys(keys, c.prefix)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Expected %q under %q, received %q", c.want, c.prefix, got)
+		}
+	}
+}
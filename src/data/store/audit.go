@@ -0,0 +1,332 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"keepo/src/crypto"
+	"log"
+	"os"
+	"os/user"
+	"time"
+)
+
+/**
+ * Audit log layout, a file beside the store that events are appended to:
+ *
+ * record-length		- uint32
+ * previous-hash		- 32 bytes, the sha256 of the previous record, for the first of the store id
+ * key-id				- grantIDSize bytes, zeros when sealed with the store's audit key, otherwise
+ *						  the id of the grant whose key sealed it
+ * event				- crypto envelope of the event fields, with the hash and key id as
+ *						  associated data
+ *
+ * Each record names the one before it, so changing or removing a record breaks the chain at the
+ * next and forging one needs a key. Records cut from the end leave no trace. A broken chain is
+ * reported by ReadAudit and warned of as events are recorded on after it.
+ *
+ * Whether a store is audited is recorded in its header, which the index MAC authenticates.
+ */
+
+const AuditExtension = ".audit"
+
+// audit event fields
+const (
+	eventTimeField      uint16 = 1
+	eventOperationField uint16 = 2
+	eventKeyField       uint16 = 3
+	eventUserField      uint16 = 4
+)
+
+// AuditEvent is one operation on a store as its audit log records it
+type AuditEvent struct {
+	Time      time.Time `json:"time"`
+	Operation string    `json:"operation,omitempty"`
+	Key       string    `json:"key,omitempty"`
+	User      string    `json:"user,omitempty"`
+	// Grant names the grant the store was read with, if any
+	Grant string `json:"grant,omitempty"`
+	// Sealed is set for events of revoked grants, whose key is gone, they are still chained
+	Sealed bool `json:"sealed,omitempty"`
+}
+
+// AuditEnabled tells whether the store keeps an audit log, no secret is needed
+func AuditEnabled(path string) (bool, error) {
+	file, err := getIndex(GetStorePath(path))
+	if err != nil {
+		return false, err
+	}
+	return file.audited(), nil
+}
+
+// SetAuditing starts or stops the store's audit log, recording the change in it. A log that is
+// stopped is kept and continued when it is started again.
+func SetAuditing(path string, secret *Secret, enabled bool) (err error) {
+	storePath, file, storeSecret, err := openStore(path, secret, false)
+	if err != nil {
+		return err
+	}
+	defer storeSecret.Destroy()
+	unsealedSecret := storeSecret.Key()
+
+	if file.header.get(storeIDField) == nil {
+		return InvalidFormatError("store predates entry binding and cannot keep an audit log")
+	}
+
+	if enabled {
+		file.header.set(auditField, []byte{1})
+		if err = audit(storePath, file, unsealedSecret, "audit on"); err != nil {
+			return err
+		}
+	} else {
+		// a log that cannot be written must not keep the store from being changed, so
+		// stopping it goes ahead without the record
+		_ = audit(storePath, file, unsealedSecret, "audit off")
+		file.header.set(auditField, nil)
+	}
+
+	dataMap, err := loadDataMap(storePath, file, unsealedSecret, func(key string) bool { return false })
+	if err != nil {
+		return err
+	}
+	return set(storePath, file, dataMap)
+}
+
+// AuditListing records a listing of the store's keys, which are read without a secret, so
+// audited stores are unlocked to be listed. Stores without a log are left alone.
+func AuditListing(path string, secret *Secret) (err error) {
+	storePath, file, readSecret, err := openStoreReader(path, secret)
+	if err != nil {
+		return err
+	}
+	defer readSecret.Destroy()
+	return audit(storePath, file, readSecret.Key(), "list")
+}
+
+// ReadAudit unseals the store's audit log, verifying the chain as it goes. When verification
+// fails the events before the broken record are returned with the error.
+func ReadAudit(path string, secret *Secret) (events []AuditEvent, err error) {
+	storePath, file, storeSecret, err := openStore(path, secret, false)
+	if err != nil {
+		return nil, err
+	}
+	defer storeSecret.Destroy()
+
+	auditKey, err := auditKeyFor(storeSecret.Key())
+	if err != nil {
+		return nil, err
+	}
+	defer auditKey.Destroy()
+	grants, err := file.grants(storeSecret.Key())
+	if err != nil {
+		return nil, err
+	}
+	defer destroyGrants(grants)
+
+	events = []AuditEvent{}
+	err = readAuditLog(storePath, file, func(index int, keyID, sealed, associatedData []byte) error {
+		key, grant := auditKey, ""
+		if !bytes.Equal(keyID, make([]byte, grantIDSize)) {
+			key, grant = nil, hex.EncodeToString(keyID)
+			for _, candidate := range grants {
+				if bytes.Equal(candidate.id, keyID) {
+					key = candidate.key
+				}
+			}
+			if key == nil {
+				events = append(events, AuditEvent{Grant: grant, Sealed: true})
+				return nil
+			}
+		}
+
+		event, err := openAuditEvent(file, key.Key(), sealed, associatedData)
+		if err != nil {
+			return AuditBrokenError(index + 1)
+		}
+		event.Grant = grant
+		events = append(events, event)
+		return nil
+	})
+	return events, err
+}
+
+func (s *storeFile) audited() bool {
+	return s.header.get(auditField) != nil
+}
+
+func auditPath(storePath string) string {
+	return storePath + AuditExtension
+}
+
+// auditKeyFor derives the audit key from the store secret, so the log needs no key of its own
+func auditKeyFor(unsealedSecret *[crypto.SecretSize]byte) (*crypto.Buffer, error) {
+	material := append([]byte("keepo audit"), unsealedSecret[:]...)
+	hash := crypto.GetHash(material)
+	crypto.Wipe(material)
+	return crypto.NewBufferFrom(hash[:])
+}
+
+// audit appends an event for each key, or one without a key, to the log of an audited store.
+// Stores opened with a grant token seal the events with the grant's key, which the owner holds.
+func audit(storePath string, file *storeFile, secret *[crypto.SecretSize]byte, operation string, keys ...string) error {
+	if !file.audited() {
+		return nil
+	}
+
+	key, keyID := secret, make([]byte, grantIDSize)
+	if file.grantID != nil {
+		keyID = file.grantID
+	} else {
+		auditKey, err := auditKeyFor(secret)
+		if err != nil {
+			return err
+		}
+		defer auditKey.Destroy()
+		key = auditKey.Key()
+	}
+
+	previous, broken, err := auditChainEnd(storePath, file)
+	if err != nil {
+		return err
+	}
+	if broken != nil {
+		// a broken log must not keep the store from being used, events are chained on from its
+		// last record and ReadAudit reports the break
+		log.Printf("warning: the %s, recording on", broken)
+	}
+
+	fo, err := os.OpenFile(auditPath(storePath), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := fo.Close(); err != nil {
+			panic(err)
+		}
+	}()
+
+	if len(keys) == 0 {
+		keys = []string{""}
+	}
+	for _, dataKey := range keys {
+		var event fields
+		event.add(eventTimeField, encodeUint64(uint64(time.Now().UnixNano())))
+		event.add(eventOperationField, []byte(operation))
+		if len(dataKey) > 0 {
+			event.add(eventKeyField, []byte(dataKey))
+		}
+		event.add(eventUserField, []byte(auditUser()))
+
+		associatedData := append(append([]byte{}, previous[:]...), keyID...)
+		sealed := sealRecord(file, encodeFields(event), key, associatedData)
+		record := append(associatedData, sealed...)
+		if err = writeBytes(fo, record); err != nil {
+			return err
+		}
+		previous = sha256.Sum256(record)
+	}
+	return nil
+}
+
+// auditChainEnd hashes through the log to the hash the next record names, no key is needed. A
+// broken chain is given with the hash of the last record read as its end.
+func auditChainEnd(storePath string, file *storeFile) (end [crypto.HashSize]byte, broken *State, err error) {
+	end = auditChainStart(file)
+	fi, err := os.Open(auditPath(storePath))
+	if os.IsNotExist(err) {
+		return end, nil, nil
+	}
+	if err != nil {
+		return end, nil, err
+	}
+	defer func() {
+		if err := fi.Close(); err != nil {
+			panic(err)
+		}
+	}()
+
+	reader := bufio.NewReader(fi)
+	for index := 0; ; index++ {
+		record, err := readBytes(reader)
+		if err == io.EOF {
+			return end, broken, nil
+		}
+		if err != nil {
+			return end, AuditBrokenError(index + 1), nil
+		}
+		if broken == nil && (len(record) < crypto.HashSize+grantIDSize || !bytes.Equal(record[:crypto.HashSize], end[:])) {
+			broken = AuditBrokenError(index + 1)
+		}
+		end = sha256.Sum256(record)
+	}
+}
+
+func auditChainStart(file *storeFile) [crypto.HashSize]byte {
+	return crypto.GetHash(append([]byte("keepo audit log"), file.header.get(storeIDField)...))
+}
+
+// readAuditLog passes each record to read once its previous hash is verified, an absent log
+// has no records
+func readAuditLog(storePath string, file *storeFile, read func(index int, keyID, sealed, associatedData []byte) error) error {
+	fi, err := os.Open(auditPath(storePath))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := fi.Close(); err != nil {
+			panic(err)
+		}
+	}()
+
+	reader := bufio.NewReader(fi)
+	previous := auditChainStart(file)
+	for index := 0; ; index++ {
+		record, err := readBytes(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil || len(record) < crypto.HashSize+grantIDSize {
+			return AuditBrokenError(index + 1)
+		}
+
+		associatedData := record[:crypto.HashSize+grantIDSize]
+		if !bytes.Equal(associatedData[:crypto.HashSize], previous[:]) {
+			return AuditBrokenError(index + 1)
+		}
+		if err = read(index, associatedData[crypto.HashSize:], record[len(associatedData):], associatedData); err != nil {
+			return err
+		}
+		previous = sha256.Sum256(record)
+	}
+}
+
+func openAuditEvent(file *storeFile, key *[crypto.SecretSize]byte, sealed, associatedData []byte) (event AuditEvent, err error) {
+	opened, err := openRecord(file, sealed, key, associatedData)
+	if err != nil {
+		return event, err
+	}
+	decoded, err := decodeFields(opened)
+	if err != nil {
+		return event, err
+	}
+
+	event.Time = time.Unix(0, int64(decodeUint64(decoded.get(eventTimeField))))
+	event.Operation = string(decoded.get(eventOperationField))
+	event.Key = string(decoded.get(eventKeyField))
+	event.User = string(decoded.get(eventUserField))
+	return event, nil
+}
+
+// auditUser names the user running keepo, falling back to the environment where the user
+// database is not available
+func auditUser() string {
+	if current, err := user.Current(); err == nil {
+		return current.Username
+	}
+	return os.Getenv("USER")
+}
@@ -0,0 +1,90 @@
+package store
+
+import (
+	"fmt"
+	"io/ioutil"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+
+	path := "."
+	cleanup(path, t)
+
+	owner := func() *Secret { return NewSecret([]byte("password01"), nil) }
+	err := SetMapValue(path, "db/password", "hunter2", owner())
+	if err != nil {
+		t.Errorf("could not set map value '%q'", err)
+	}
+
+	fmt.Println("test operations are recorded once auditing is on")
+	err = SetAuditing(path, owner(), true)
+	if err != nil {
+		t.Fatalf("could not start auditing '%q'", err)
+	}
+	_ = SetMapValue(path, "mail", "secret", owner())
+	_, _ = GetMapValue(path, "db/password", owner())
+	_ = AuditListing(path, owner())
+	granted, token, _ := GrantAccess(path, owner(), "db/*")
+	grant, _ := ParseToken(token.Bytes())
+	_, _ = GetMapValue(path, "db/password", &Secret{Grant: grant})
+	_ = ClearMapValue(path, "mail", owner())
+
+	events, err := ReadAudit(path, owner())
+	if err != nil {
+		t.Fatalf("could not read audit log '%q'", err)
+	}
+	var operations []string
+	for _, event := range events {
+		operations = append(operations, event.Operation+" "+event.Key)
+	}
+	expected := fmt.Sprint([]string{"audit on ", "set mail", "get db/password", "list ",
+		"grant " + granted.ID + " db/password", "get db/password", "clear mail"})
+	if fmt.Sprint(operations) != expected {
+		t.Errorf("Expected %q, received %q", expected, fmt.Sprint(operations))
+	}
+	if len(events) == 7 && (len(events[5].Grant) == 0 || len(events[0].User) == 0) {
+		t.Errorf("expected the token read to name its grant and events their user")
+	}
+
+	fmt.Println("test a changed record breaks the chain")
+	logPath := auditPath(GetStorePath(path))
+	contents, _ := ioutil.ReadFile(logPath)
+	contents[len(contents)/2] ^= 1
+	_ = ioutil.WriteFile(logPath, contents, 0600)
+	_, err = ReadAudit(path, owner())
+	if state, ok := err.(*State); !ok || state.Code() != 20 {
+		t.Errorf("expected a changed record to fail verification but got '%q'", err)
+	}
+	_, err = GetMapValue(path, "db/password", owner())
+	if err != nil {
+		t.Errorf("expected a broken log to keep recording but got '%q'", err)
+	}
+	if _, err = ReadAudit(path, owner()); err == nil {
+		t.Errorf("expected the log to stay broken")
+	}
+
+	fmt.Println("test turning auditing off without the secret fails verification")
+	storePath := GetStorePath(path)
+	original, _ := ioutil.ReadFile(storePath)
+	file, _ := getIndex(storePath)
+	file.header.set(auditField, nil)
+	rewriteIndex(storePath, file, t)
+	if _, err = GetMapValue(path, "db/password", owner()); err != IndexVerificationFailedState {
+		t.Errorf("Expected %q, received %q", IndexVerificationFailedState, err)
+	}
+	_ = ioutil.WriteFile(storePath, original, 0600)
+
+	fmt.Println("test stopping the audit log")
+	err = SetAuditing(path, owner(), false)
+	if err != nil {
+		t.Errorf("could not stop auditing '%q'", err)
+	}
+	_, err = GetMapValue(path, "db/password", owner())
+	if err != nil {
+		t.Errorf("could not get map value '%q'", err)
+	}
+
+	token.Destroy()
+	cleanup(path, t)
+}
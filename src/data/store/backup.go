@@ -0,0 +1,551 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"keepo/src/crypto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+/**
+ * Backups are copies of store files named by the store and the time they were taken in UTC:
+ *
+ * <store>-20060102T150405.000000000Z.kpo
+ *
+ * Each store is copied into the backups directory beside it before it is replaced, keeping as
+ * many copies as its policy retains. Archives bundle copies of several stores into one file:
+ *
+ * magic			- "KPB" and the archive version
+ * factors			- 1 byte, the factors the archive key is derived from
+ * salt				- 32 random bytes mixed into the archive key
+ * stream			- a crypto stream of members, each the store name length prefixed and the
+ *					  store file prefixed by its uint64 length
+ *
+ * Archives hide the store names and keys the store files leave readable.
+ */
+
+// BackupDirectory is the directory beside a store its copies are kept in before it is replaced
+const BackupDirectory = "backups"
+
+// ArchiveExtension is the extension of backup archives
+const ArchiveExtension = ".kpb"
+
+// DefaultBackupRetention is the copies kept of a store unless its policy sets another
+const DefaultBackupRetention = 5
+
+const backupTimeLayout = "20060102T150405.000000000Z"
+
+const archiveVersion = 1
+
+var archiveMagic = []byte("KPB")
+
+const archivePurpose = "keepo archive"
+
+// Backup is a backup file and the stores it holds, an archive may hold several
+type Backup struct {
+	Path   string    `json:"path"`
+	Stores []string  `json:"stores"`
+	Taken  time.Time `json:"taken"`
+	Size   int64     `json:"size"`
+}
+
+// BackupStores copies each store into the directory, verifying each copy matches its store
+func BackupStores(names []string, dir string) (backups []Backup, err error) {
+	taken := time.Now()
+	for _, name := range names {
+		storePath := GetStorePath(name)
+		if _, err = getIndex(storePath); err != nil {
+			return backups, err
+		}
+
+		backup, err := backupStore(storePath, dir, taken)
+		if err != nil {
+			return backups, err
+		}
+		backups = append(backups, backup)
+	}
+	return backups, nil
+}
+
+// ArchiveStores bundles copies of the stores into one archive in the directory, sealed with a
+// key of the secret's factors, and verifies the archive opens to the stores
+func ArchiveStores(names []string, dir string, secret *Secret) (backup Backup, err error) {
+	factors := secret.Factors() & (PassphraseFactor | KeyFileFactor)
+	if factors == 0 {
+		return backup, FactorMissingError(PassphraseFactor)
+	}
+
+	backup = Backup{Taken: time.Now(), Stores: names}
+	backup.Path = filepath.Join(dir, "keepo-"+backup.Taken.UTC().Format(backupTimeLayout)+ArchiveExtension)
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return backup, err
+	}
+
+	digests := make(map[string][]byte, len(names))
+	err = writeArchive(backup.Path, factors, secret, func(add func(name string, fi *os.File) error) error {
+		for _, name := range names {
+			fi, err := os.Open(GetStorePath(name))
+			if err != nil {
+				return err
+			}
+			digests[name], err = fileDigest(fi)
+			if err == nil {
+				err = add(name, fi)
+			}
+			if closeErr := fi.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = os.Remove(backup.Path)
+		return backup, err
+	}
+
+	read := 0
+	err = readArchive(backup.Path, secret, func(name string, member io.Reader) error {
+		digest, err := fileDigest(member)
+		if err == nil && !bytes.Equal(digest, digests[name]) {
+			err = InvalidFormatError("the archive's copy of '" + name + "' differs from the store")
+		}
+		read++
+		return err
+	})
+	if err == nil && read != len(names) {
+		err = InvalidFormatError("the archive is missing stores")
+	}
+	if err != nil {
+		_ = os.Remove(backup.Path)
+		return backup, err
+	}
+
+	info, err := os.Stat(backup.Path)
+	if err != nil {
+		return backup, err
+	}
+	backup.Size = info.Size()
+	return backup, nil
+}
+
+// BackupFactors reads the factors a backup, a store copy or an archive, is opened with
+func BackupFactors(path string) (Factors, error) {
+	if !isArchive(path) {
+		return RequiredFileFactors(path)
+	}
+	fi, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := fi.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	factors, _, err := readArchiveHeader(fi)
+	return factors, err
+}
+
+// RestoreBackup verifies every store the backup holds opens with the secret before replacing any
+// of them, each store replaced being backed up first. A store copy is restored to the store
+// named, or the store it was taken of, an archive restores the stores named or all it holds.
+func RestoreBackup(path string, names []string, secret *Secret) (restored []string, err error) {
+	sources := make(map[string]string)
+	if isArchive(path) {
+		dir, err := ioutil.TempDir("", "keepo-restore")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(dir)
+
+		wanted := make(map[string]bool, len(names))
+		for _, name := range names {
+			wanted[name] = true
+		}
+		err = readArchive(path, secret, func(name string, member io.Reader) error {
+			if len(names) > 0 && !wanted[name] {
+				_, err := io.Copy(ioutil.Discard, member)
+				return err
+			}
+			sources[name] = filepath.Join(dir, filepath.Base(GetStorePath(name)))
+			return writeFile(sources[name], member)
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			if _, ok := sources[name]; !ok {
+				return nil, InvalidFormatError("the archive holds no store '" + name + "'")
+			}
+		}
+	} else {
+		name, _, ok := parseBackupName(filepath.Base(path))
+		if len(names) > 0 {
+			name, ok = names[0], true
+		}
+		if !ok {
+			return nil, InvalidFormatError("name the store to restore the copy to")
+		}
+		sources[name] = path
+	}
+
+	for name, source := range sources {
+		if err = verifyStoreFile(source, secret); err != nil {
+			return nil, err
+		}
+		restored = append(restored, name)
+	}
+	sort.Strings(restored)
+
+	for _, name := range restored {
+		if err = restoreStore(sources[name], GetStorePath(name), secret); err != nil {
+			return restored, err
+		}
+	}
+	return restored, nil
+}
+
+// verifyStoreFile unlocks the store file and reads every entry, so a damaged copy is found
+// before it replaces anything
+func verifyStoreFile(storePath string, secret *Secret) error {
+	file, storeSecret, err := openStoreFile(storePath, secret, false)
+	if err != nil {
+		return err
+	}
+	defer storeSecret.Destroy()
+
+	for _, key := range file.keys() {
+		if _, _, err = hashEntry(storePath, file, key, storeSecret.Key()); err != nil {
+			return EntryVerificationFailedState
+		}
+	}
+	return nil
+}
+
+// restoreStore replaces the store with the verified copy, backing up the store it replaces once
+// the copy is in place beside it, as the backup may prune the copy restored
+func restoreStore(source, storePath string, secret *Secret) error {
+	fi, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	temporaryPath := storePath + ".tmp"
+	err = writeFile(temporaryPath, fi)
+	if closeErr := fi.Close(); err == nil {
+		err = closeErr
+	}
+	if current, indexErr := getIndex(storePath); err == nil && indexErr == nil {
+		err = backupBeforeWrite(storePath, current.policy().Backups)
+	}
+	if err == nil {
+		err = os.Rename(temporaryPath, storePath)
+	}
+	if err != nil {
+		_ = os.Remove(temporaryPath)
+		return err
+	}
+
+	file, storeSecret, err := openStoreFile(storePath, secret, false)
+	if err != nil {
+		return err
+	}
+	defer storeSecret.Destroy()
+	return audit(storePath, file, storeSecret.Key(), "restore")
+}
+
+// backupBeforeWrite copies the store about to be replaced into the backups directory beside it,
+// pruning its copies to the number retained. Only store files are backed up, not the temporary
+// files merges write.
+func backupBeforeWrite(storePath string, retained int) error {
+	if retained <= 0 || !strings.HasSuffix(storePath, Extension) {
+		return nil
+	}
+	if _, err := os.Stat(storePath); os.IsNotExist(err) {
+		return nil
+	}
+
+	dir := filepath.Join(filepath.Dir(storePath), BackupDirectory)
+	if _, err := backupStore(storePath, dir, time.Now()); err != nil {
+		return err
+	}
+	return pruneBackups(dir, strings.TrimSuffix(filepath.Base(storePath), Extension), retained)
+}
+
+// backupStore copies the store file into the directory and verifies the copy
+func backupStore(storePath, dir string, taken time.Time) (backup Backup, err error) {
+	name := strings.TrimSuffix(filepath.Base(storePath), Extension)
+	backup = Backup{Stores: []string{name}, Taken: taken}
+	backup.Path = filepath.Join(dir, name+"-"+taken.UTC().Format(backupTimeLayout)+Extension)
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return backup, err
+	}
+
+	fi, err := os.Open(storePath)
+	if err != nil {
+		return backup, err
+	}
+	defer func() {
+		if err := fi.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	if err = writeFile(backup.Path, fi); err != nil {
+		_ = os.Remove(backup.Path)
+		return backup, err
+	}
+
+	if err = verifyCopy(storePath, backup.Path); err != nil {
+		_ = os.Remove(backup.Path)
+		return backup, err
+	}
+	info, err := os.Stat(backup.Path)
+	if err != nil {
+		return backup, err
+	}
+	backup.Size = info.Size()
+	return backup, nil
+}
+
+// verifyCopy checks the copy holds the same bytes as the store and reads as a store
+func verifyCopy(storePath, copyPath string) error {
+	digests := make([][]byte, 2)
+	for index, path := range []string{storePath, copyPath} {
+		fi, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		digests[index], err = fileDigest(fi)
+		if closeErr := fi.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if !bytes.Equal(digests[0], digests[1]) {
+		return InvalidFormatError("the copy of '" + storePath + "' differs from the store")
+	}
+	_, err := getIndex(copyPath)
+	return err
+}
+
+// pruneBackups removes the oldest copies of the store beyond the number retained
+func pruneBackups(dir, name string, retained int) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	var copies []string
+	for _, f := range files {
+		if copyName, _, ok := parseBackupName(f.Name()); ok && copyName == name {
+			copies = append(copies, f.Name())
+		}
+	}
+	// names of one store sort by the time they were taken
+	sort.Strings(copies)
+	for len(copies) > retained {
+		if err = os.Remove(filepath.Join(dir, copies[0])); err != nil {
+			return err
+		}
+		copies = copies[1:]
+	}
+	return nil
+}
+
+// parseBackupName reads the store and time of a copy's file name
+func parseBackupName(fileName string) (name string, taken time.Time, ok bool) {
+	if !strings.HasSuffix(fileName, Extension) {
+		return "", taken, false
+	}
+	fileName = strings.TrimSuffix(fileName, Extension)
+	index := strings.LastIndex(fileName, "-")
+	if index <= 0 {
+		return "", taken, false
+	}
+	taken, err := time.Parse(backupTimeLayout, fileName[index+1:])
+	if err != nil {
+		return "", taken, false
+	}
+	return fileName[:index], taken, true
+}
+
+// writeArchive writes the archive header and seals the members added into its stream
+func writeArchive(path string, factors Factors, secret *Secret, members func(add func(name string, fi *os.File) error) error) error {
+	salt := crypto.GenerateSecret()
+	key, err := saltedKey(archivePurpose, factors, secret, salt[:])
+	if err != nil {
+		return err
+	}
+	defer key.Destroy()
+
+	fo, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(fo)
+	_, err = writer.Write(append(append(append([]byte{}, archiveMagic...), archiveVersion, byte(factors)), salt[:]...))
+
+	var stream io.WriteCloser
+	if err == nil {
+		stream, err = crypto.NewStreamWriter(writer, key.Key())
+	}
+	if err == nil {
+		err = members(func(name string, fi *os.File) error {
+			info, err := fi.Stat()
+			if err != nil {
+				return err
+			}
+			if _, err = fi.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			if err = writeBytes(stream, []byte(name)); err != nil {
+				return err
+			}
+			if err = binary.Write(stream, binary.LittleEndian, uint64(info.Size())); err != nil {
+				return err
+			}
+			_, err = io.CopyN(stream, fi, info.Size())
+			return err
+		})
+	}
+	if err == nil {
+		err = stream.Close()
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if closeErr := fo.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// readArchive opens the archive with the secret and passes each member to read, which must read
+// the member to its end
+func readArchive(path string, secret *Secret, read func(name string, member io.Reader) error) error {
+	fi, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := fi.Close(); err != nil {
+			panic(err)
+		}
+	}()
+
+	reader := bufio.NewReader(fi)
+	factors, salt, err := readArchiveHeader(reader)
+	if err != nil {
+		return err
+	}
+	key, err := saltedKey(archivePurpose, factors, secret, salt)
+	if err != nil {
+		return err
+	}
+	defer key.Destroy()
+
+	stream, err := crypto.NewStreamReader(reader, key.Key())
+	if err != nil {
+		return err
+	}
+	for {
+		name, err := readBytes(stream)
+		if err == io.EOF {
+			return nil
+		}
+		if err == crypto.StreamAuthenticationFailed {
+			return AuthenticationFailedState
+		}
+		if err != nil {
+			return err
+		}
+
+		var size uint64
+		if err = binary.Read(stream, binary.LittleEndian, &size); err != nil {
+			return err
+		}
+		member := io.LimitReader(stream, int64(size))
+		if err = read(string(name), member); err != nil {
+			return err
+		}
+		if _, err = io.Copy(ioutil.Discard, member); err != nil {
+			return err
+		}
+	}
+}
+
+func readArchiveHeader(reader io.Reader) (factors Factors, salt []byte, err error) {
+	header := make([]byte, len(archiveMagic)+2+crypto.SecretSize)
+	if _, err = io.ReadFull(reader, header); err != nil {
+		return 0, nil, InvalidFormatError("could not read archive header")
+	}
+	if !bytes.Equal(header[:len(archiveMagic)], archiveMagic) || header[len(archiveMagic)] != archiveVersion {
+		return 0, nil, InvalidFormatError("not a keepo archive")
+	}
+	return Factors(header[len(archiveMagic)+1]), header[len(archiveMagic)+2:], nil
+}
+
+// saltedKey derives a key for the purpose from the factors as a store's unlock key is, with the
+// salt, so archives and sealed documents never share a key
+func saltedKey(purpose string, factors Factors, secret *Secret, salt []byte) (*crypto.Buffer, error) {
+	unlock, err := unlockKey(factors, secret)
+	if err != nil {
+		return nil, err
+	}
+	defer crypto.Wipe(unlock[:])
+
+	material := append(append([]byte(purpose), salt...), unlock[:]...)
+	defer crypto.Wipe(material)
+	key := sha256.Sum256(material)
+	defer crypto.Wipe(key[:])
+	return crypto.NewBufferFrom(key[:])
+}
+
+// isArchive tells archives from store copies by their magic
+func isArchive(path string) bool {
+	fi, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer func() {
+		if err := fi.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	header := make([]byte, len(archiveMagic))
+	_, err = io.ReadFull(fi, header)
+	return err == nil && bytes.Equal(header, archiveMagic)
+}
+
+// writeFile writes what is read to a file readable by its owner alone
+func writeFile(path string, reader io.Reader) error {
+	fo, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fo, reader)
+	if closeErr := fo.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func fileDigest(reader io.Reader) ([]byte, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, reader); err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
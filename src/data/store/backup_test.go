@@ -0,0 +1,139 @@
+package store
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBackupBeforeWrite(t *testing.T) {
+
+	path := "."
+	cleanup(path, t)
+
+	secret := func() *Secret { return NewSecret([]byte("password01"), nil) }
+	fmt.Println("test each write keeps a copy of the store it replaces")
+	for _, value := range []string{"one", "two", "three"} {
+		if err := SetMapValue(path, "key", value, secret()); err != nil {
+			t.Errorf("could not set map value '%q'", err)
+		}
+	}
+	if copies := backupCopies(path, t); len(copies) != 2 {
+		t.Errorf("Expected %d copies, received %q", 2, copies)
+	}
+
+	fmt.Println("test copies beyond the policy's retention are pruned")
+	policy, _ := GetPolicy(path)
+	policy.Backups = 1
+	if err := SetPolicy(path, secret(), policy); err != nil {
+		t.Fatalf("could not set policy '%q'", err)
+	}
+	if err := SetMapValue(path, "key", "four", secret()); err != nil {
+		t.Errorf("could not set map value '%q'", err)
+	}
+	copies := backupCopies(path, t)
+	if len(copies) != 1 {
+		t.Fatalf("Expected %d copy, received %q", 1, copies)
+	}
+
+	fmt.Println("test a copy is restored once verified, backing up the store it replaces")
+	if _, err := RestoreBackup(copies[0], nil, NewSecret([]byte("password02"), nil)); err != AuthenticationFailedState {
+		t.Errorf("expected authentication error, but got '%q'", err)
+	}
+	if got, err := GetMapValue(path, "key", secret()); err != nil || string(got) != "four" {
+		t.Errorf("Expected %q, received %q '%q'", "four", got, err)
+	}
+	restored, err := RestoreBackup(copies[0], nil, secret())
+	if err != nil || len(restored) != 1 || restored[0] != "." {
+		t.Fatalf("could not restore backup %q '%q'", restored, err)
+	}
+	if got, err := GetMapValue(path, "key", secret()); err != nil || string(got) != "three" {
+		t.Errorf("Expected %q, received %q '%q'", "three", got, err)
+	}
+
+	fmt.Println("test backups are off with a retention of none")
+	policy.Backups = 0
+	if err := SetPolicy(path, secret(), policy); err != nil {
+		t.Fatalf("could not set policy '%q'", err)
+	}
+	before := backupCopies(path, t)
+	if err := SetMapValue(path, "key", "five", secret()); err != nil {
+		t.Errorf("could not set map value '%q'", err)
+	}
+	if after := backupCopies(path, t); len(after) != len(before) {
+		t.Errorf("Expected %q, received %q", before, after)
+	}
+
+	cleanup(path, t)
+}
+
+func TestBackupArchive(t *testing.T) {
+
+	path, other := ".", "backup-other"
+	for _, name := range []string{path, other} {
+		cleanup(name, t)
+	}
+	dir, err := ioutil.TempDir("", "keepo-backups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	secret := func() *Secret { return NewSecret([]byte("password01"), nil) }
+	for _, name := range []string{path, other} {
+		if err := SetMapValue(name, "key", name, secret()); err != nil {
+			t.Errorf("could not set map value '%q'", err)
+		}
+	}
+
+	fmt.Println("test stores are copied into the directory")
+	backups, err := BackupStores([]string{path, other}, dir)
+	if err != nil || len(backups) != 2 {
+		t.Fatalf("could not back up stores %v '%q'", backups, err)
+	}
+	if _, err = getIndex(backups[1].Path); err != nil {
+		t.Errorf("expected the copy to read as a store but got '%q'", err)
+	}
+
+	fmt.Println("test an archive restores the stores it bundles")
+	archive, err := ArchiveStores([]string{path, other}, dir, secret())
+	if err != nil {
+		t.Fatalf("could not archive stores '%q'", err)
+	}
+	if factors, err := BackupFactors(archive.Path); err != nil || factors != PassphraseFactor {
+		t.Errorf("Expected %s, received %s '%q'", PassphraseFactor, factors, err)
+	}
+	for _, name := range []string{path, other} {
+		if err := SetMapValue(name, "key", "changed", secret()); err != nil {
+			t.Errorf("could not set map value '%q'", err)
+		}
+	}
+
+	if _, err = RestoreBackup(archive.Path, nil, NewSecret([]byte("password02"), nil)); err != AuthenticationFailedState {
+		t.Errorf("expected authentication error, but got '%q'", err)
+	}
+	restored, err := RestoreBackup(archive.Path, []string{other}, secret())
+	if err != nil || len(restored) != 1 {
+		t.Fatalf("could not restore archive %q '%q'", restored, err)
+	}
+	for name, want := range map[string]string{path: "changed", other: other} {
+		if got, err := GetMapValue(name, "key", secret()); err != nil || string(got) != want {
+			t.Errorf("Expected %q, received %q for %s '%q'", want, got, name, err)
+		}
+	}
+
+	for _, name := range []string{path, other} {
+		cleanup(name, t)
+	}
+}
+
+func backupCopies(path string, t *testing.T) []string {
+	storePath := GetStorePath(path)
+	copies, err := filepath.Glob(filepath.Join(filepath.Dir(storePath), BackupDirectory, filepath.Base(path)+"-*"+Extension))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return copies
+}
@@ -0,0 +1,125 @@
+package store
+
+import (
+	"bytes"
+	"encoding/hex"
+	"keepo/src/crypto"
+	"sort"
+)
+
+// Change names how a key differs between two stores
+type Change string
+
+const (
+	Added   Change = "added"
+	Removed Change = "removed"
+	Changed Change = "changed"
+)
+
+// Difference is a key added, removed or changed between the store before and the one after
+type Difference struct {
+	Key    string       `json:"key"`
+	Change Change       `json:"change"`
+	Before *DiffedValue `json:"before,omitempty"`
+	After  *DiffedValue `json:"after,omitempty"`
+	// ValueChanged and MetadataChanged tell what changed of a key in both stores
+	ValueChanged    bool `json:"value_changed,omitempty"`
+	MetadataChanged bool `json:"metadata_changed,omitempty"`
+}
+
+// DiffedValue is a key's value in one of the stores, given by its fingerprint unless values are
+// shown, values longer than a password or not text are never shown
+type DiffedValue struct {
+	Fingerprint string `json:"fingerprint"`
+	Value       string `json:"value,omitempty"`
+	Metadata
+}
+
+// fingerprintSize is the bytes of a value's keyed digest shown as its fingerprint
+const fingerprintSize = 8
+
+// DiffStoreFiles unlocks the store files before and after with the secret and gives the keys that
+// differ, ordered by key. Fingerprints are keyed by the secret of the store before, so they stay
+// the same between diffs of it and tell nothing of a value without it. Showing values is audited.
+func DiffStoreFiles(before, after string, secret *Secret, showValues bool) (differences []Difference, err error) {
+	paths := []string{before, after}
+	files := make([]*storeFile, len(paths))
+	secrets := make([]*crypto.Buffer, len(paths))
+	for index, path := range paths {
+		file, storeSecret, err := openStoreFile(path, secret, false)
+		if err != nil {
+			return nil, err
+		}
+		defer storeSecret.Destroy()
+		files[index], secrets[index] = file, storeSecret
+	}
+
+	fingerprintKey := digestValue(secrets[0].Bytes(), []byte("keepo value fingerprint"))
+	defer crypto.Wipe(fingerprintKey)
+
+	values := make([]map[string]*DiffedValue, len(paths))
+	var keys []string
+	for index, file := range files {
+		values[index] = make(map[string]*DiffedValue, len(file.index))
+		for _, key := range file.keys() {
+			valueHash, metadata, err := hashEntry(paths[index], file, key, secrets[index].Key())
+			if err != nil {
+				return nil, err
+			}
+			fingerprint := digestValue(fingerprintKey, valueHash)[:fingerprintSize]
+			values[index][key] = &DiffedValue{Fingerprint: hex.EncodeToString(fingerprint), Metadata: metadata}
+			if _, ok := values[0][key]; index == 0 || !ok {
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+
+	differences = []Difference{}
+	for _, key := range keys {
+		difference := Difference{Key: key, Before: values[0][key], After: values[1][key]}
+		switch {
+		case difference.After == nil:
+			difference.Change = Removed
+		case difference.Before == nil:
+			difference.Change = Added
+		default:
+			difference.Change = Changed
+			difference.ValueChanged = difference.Before.Fingerprint != difference.After.Fingerprint
+			difference.MetadataChanged = !bytes.Equal(encodeEntry(&Entry{Metadata: difference.Before.Metadata}),
+				encodeEntry(&Entry{Metadata: difference.After.Metadata}))
+			if !difference.ValueChanged && !difference.MetadataChanged {
+				continue
+			}
+		}
+		differences = append(differences, difference)
+	}
+
+	if !showValues {
+		return differences, nil
+	}
+	for index, file := range files {
+		var shown []string
+		for _, difference := range differences {
+			diffed := map[int]*DiffedValue{0: difference.Before, 1: difference.After}[index]
+			if diffed == nil {
+				continue
+			}
+			value, err := readCheckedValue(paths[index], file, difference.Key, secrets[index].Key())
+			if err != nil {
+				return nil, err
+			}
+			if value != nil {
+				diffed.Value = string(value)
+				crypto.Wipe(value)
+				shown = append(shown, difference.Key)
+			}
+		}
+		if len(shown) > 0 {
+			if err = audit(paths[index], file, secrets[index].Key(), "diff", shown...); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return differences, nil
+}
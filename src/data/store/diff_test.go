@@ -0,0 +1,91 @@
+package store
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestDiffStoreFiles(t *testing.T) {
+
+	path, backup := ".", "diff-backup"
+	for _, name := range []string{path, backup} {
+		cleanup(name, t)
+	}
+
+	secret := func() *Secret { return NewSecret([]byte("password01"), nil) }
+	for key, value := range map[string]string{"changed": "before", "removed": "before", "kept": "before", "tagged": "before"} {
+		if err := SetMapValue(path, key, value, secret()); err != nil {
+			t.Errorf("could not set map value '%q'", err)
+		}
+	}
+	copyStore(path, backup, t)
+
+	for key, value := range map[string]string{"changed": "after", "added": "after"} {
+		if err := SetMapValue(path, key, value, secret()); err != nil {
+			t.Errorf("could not set map value '%q'", err)
+		}
+	}
+	if err := ClearMapValue(path, "removed", secret()); err != nil {
+		t.Errorf("could not clear map value '%q'", err)
+	}
+	err := UpdateMapEntry(path, "tagged", secret(), false, func(entry *Entry) { entry.Tags = []string{"work"} })
+	if err != nil {
+		t.Errorf("could not update map entry '%q'", err)
+	}
+
+	fmt.Println("test keys added, removed and changed are found by fingerprint")
+	differences, err := DiffStoreFiles(GetStorePath(backup), GetStorePath(path), secret(), false)
+	if err != nil {
+		t.Fatalf("could not diff store files '%q'", err)
+	}
+	cases := []struct {
+		key             string
+		change          Change
+		valueChanged    bool
+		metadataChanged bool
+	}{
+		{"added", Added, false, false},
+		{"changed", Changed, true, false},
+		{"removed", Removed, false, false},
+		{"tagged", Changed, false, true},
+	}
+	if len(differences) != len(cases) {
+		t.Fatalf("Expected %d differences, received %v", len(cases), differences)
+	}
+	for index, c := range cases {
+		got := differences[index]
+		if got.Key != c.key || got.Change != c.change || got.ValueChanged != c.valueChanged || got.MetadataChanged != c.metadataChanged {
+			t.Errorf("Expected %s %s, received %v", c.change, c.key, got)
+		}
+		for _, value := range []*DiffedValue{got.Before, got.After} {
+			if value != nil && (len(value.Fingerprint) != 2*fingerprintSize || len(value.Value) > 0) {
+				t.Errorf("Expected a fingerprint alone for %s, received %v", c.key, value)
+			}
+		}
+	}
+	if differences[1].Before.Fingerprint == differences[1].After.Fingerprint {
+		t.Errorf("Expected changed values to have different fingerprints")
+	}
+	if differences[3].Before.Fingerprint != differences[3].After.Fingerprint {
+		t.Errorf("Expected equal values to have equal fingerprints")
+	}
+
+	fmt.Println("test values are shown when asked")
+	differences, err = DiffStoreFiles(GetStorePath(backup), GetStorePath(path), secret(), true)
+	if err != nil {
+		t.Fatalf("could not diff store files '%q'", err)
+	}
+	if differences[1].Before.Value != "before" || differences[1].After.Value != "after" {
+		t.Errorf("Expected %q and %q, received %v", "before", "after", differences[1])
+	}
+
+	fmt.Println("test a wrong secret does not diff")
+	_, err = DiffStoreFiles(GetStorePath(backup), GetStorePath(path), NewSecret([]byte("password02"), nil), false)
+	if err != AuthenticationFailedState {
+		t.Errorf("expected authentication error, but got '%q'", err)
+	}
+
+	for _, name := range []string{path, backup} {
+		cleanup(name, t)
+	}
+}
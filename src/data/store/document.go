@@ -0,0 +1,85 @@
+package store
+
+import (
+	"bytes"
+	"encoding/pem"
+	"keepo/src/crypto"
+)
+
+/**
+ * Sealed documents keep generated files, such as secret manifests and env files, safe to commit.
+ * They are PEM blocks of type "KEEPO SEALED DOCUMENT" holding:
+ *
+ * magic			- "KPD" and the document version
+ * factors			- 1 byte, the factors the document key is derived from
+ * salt				- 32 random bytes mixed into the document key
+ * envelope			- the document sealed with the header above as associated data
+ */
+
+// DocumentType is the PEM type of sealed documents
+const DocumentType = "KEEPO SEALED DOCUMENT"
+
+const documentVersion = 1
+
+const documentPurpose = "keepo document"
+
+var documentMagic = []byte("KPD")
+
+// SealDocument seals the document with a key of the secret's factors, the caller wipes the document
+func SealDocument(document []byte, factors Factors, secret *Secret) ([]byte, error) {
+	salt := crypto.GenerateSecret()
+	key, err := saltedKey(documentPurpose, factors, secret, salt[:])
+	if err != nil {
+		return nil, err
+	}
+	defer key.Destroy()
+
+	header := append(append(append([]byte{}, documentMagic...), documentVersion, byte(factors)), salt[:]...)
+	envelope, err := crypto.Seal(DefaultCipher, key.Key(), document, header)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: DocumentType, Bytes: append(header, envelope...)}), nil
+}
+
+// DocumentFactors reads the factors a sealed document is opened with, no secret is needed
+func DocumentFactors(sealed []byte) (Factors, error) {
+	header, _, err := readDocument(sealed)
+	if err != nil {
+		return 0, err
+	}
+	return Factors(header[len(documentMagic)+1]), nil
+}
+
+// OpenDocument opens a document sealed by SealDocument, the caller wipes the document returned
+func OpenDocument(sealed []byte, secret *Secret) ([]byte, error) {
+	header, envelope, err := readDocument(sealed)
+	if err != nil {
+		return nil, err
+	}
+	key, err := saltedKey(documentPurpose, Factors(header[len(documentMagic)+1]), secret, header[len(documentMagic)+2:])
+	if err != nil {
+		return nil, err
+	}
+	defer key.Destroy()
+
+	document, err := crypto.Open(key.Key(), envelope, header)
+	if err == crypto.EnvelopeAuthenticationFailed {
+		return nil, AuthenticationFailedState
+	}
+	return document, err
+}
+
+// readDocument splits a sealed document into its header and envelope
+func readDocument(sealed []byte) (header, envelope []byte, err error) {
+	block, _ := pem.Decode(sealed)
+	if block == nil || block.Type != DocumentType {
+		return nil, nil, InvalidFormatError("not a keepo sealed document")
+	}
+	size := len(documentMagic) + 2 + crypto.SecretSize
+	if len(block.Bytes) < size || !bytes.Equal(block.Bytes[:len(documentMagic)], documentMagic) ||
+		block.Bytes[len(documentMagic)] != documentVersion {
+		return nil, nil, InvalidFormatError("not a keepo sealed document")
+	}
+	return block.Bytes[:size], block.Bytes[size:], nil
+}
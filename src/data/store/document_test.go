@@ -0,0 +1,39 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestSealDocument(t *testing.T) {
+
+	document := []byte("DB_PASSWORD=correct horse battery staple\n")
+	secret := func() *Secret { return NewSecret([]byte("password01"), []byte("key file")) }
+
+	fmt.Println("test a sealed document opens with the factors it was sealed with")
+	sealed, err := SealDocument(document, PassphraseFactor|KeyFileFactor, secret())
+	if err != nil {
+		t.Fatalf("could not seal document '%q'", err)
+	}
+	if bytes.Contains(sealed, []byte("DB_PASSWORD")) {
+		t.Errorf("expected the sealed document to hide its content")
+	}
+	if factors, err := DocumentFactors(sealed); err != nil || factors != PassphraseFactor|KeyFileFactor {
+		t.Errorf("Expected %v, received %v '%q'", PassphraseFactor|KeyFileFactor, factors, err)
+	}
+	if got, err := OpenDocument(sealed, secret()); err != nil || !bytes.Equal(got, document) {
+		t.Errorf("Expected %q, received %q '%q'", document, got, err)
+	}
+
+	fmt.Println("test sealed documents refuse other secrets and other content")
+	if _, err = OpenDocument(sealed, NewSecret([]byte("password02"), []byte("key file"))); err != AuthenticationFailedState {
+		t.Errorf("expected authentication error, but got '%q'", err)
+	}
+	if _, err = OpenDocument(sealed, NewSecret([]byte("password01"), nil)); err == nil {
+		t.Errorf("expected a missing key file to be refused")
+	}
+	if _, err = OpenDocument(document, secret()); err == nil {
+		t.Errorf("expected a plain document to be refused")
+	}
+}
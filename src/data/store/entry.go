@@ -0,0 +1,205 @@
+package store
+
+import (
+	"bytes"
+	"keepo/src/crypto"
+	"strings"
+	"time"
+)
+
+// entry record fields
+const (
+	valueField uint16 = 1
+	urlField   uint16 = 2
+	tagField   uint16 = 3
+	notesField uint16 = 4
+	// the key a streamed value was sealed with
+	streamKeyField uint16 = 5
+	// unix seconds and nanoseconds
+	expiresField uint16 = 6
+	maxAgeField  uint16 = 7
+)
+
+// Metadata is sealed with the value, so it is only readable once the store is unlocked
+type Metadata struct {
+	URL   string   `json:"url,omitempty"`
+	Tags  []string `json:"tags,omitempty"`
+	Notes string   `json:"notes,omitempty"`
+	// Expires and MaxAge, counted from the value's last change, limit how long it is used
+	Expires *time.Time `json:"expires,omitempty"`
+	MaxAge  Age        `json:"max_age,omitempty"`
+}
+
+type Entry struct {
+	Value []byte
+	Metadata
+	streamKey []byte
+}
+
+// Fields names the searchable metadata fields and their text
+func (m *Metadata) Fields() map[string]string {
+	return map[string]string{
+		"url":   m.URL,
+		"tags":  strings.Join(m.Tags, ","),
+		"notes": m.Notes,
+	}
+}
+
+func encodeEntry(entry *Entry) []byte {
+	var record fields
+	record.add(valueField, entry.Value)
+	if len(entry.URL) > 0 {
+		record.add(urlField, []byte(entry.URL))
+	}
+	for _, tag := range entry.Tags {
+		record.add(tagField, []byte(tag))
+	}
+	if len(entry.Notes) > 0 {
+		record.add(notesField, []byte(entry.Notes))
+	}
+	if entry.streamKey != nil {
+		record.add(streamKeyField, entry.streamKey)
+	}
+	if entry.Expires != nil {
+		record.add(expiresField, encodeUint64(uint64(entry.Expires.Unix())))
+	}
+	if entry.MaxAge > 0 {
+		record.add(maxAgeField, encodeUint64(uint64(entry.MaxAge)))
+	}
+	return encodeFields(record)
+}
+
+func decodeEntry(encoded []byte) (entry *Entry, err error) {
+	record, err := decodeFields(encoded)
+	if err != nil {
+		return nil, InvalidFormatError("could not decode entry")
+	}
+
+	entry = &Entry{Value: record.get(valueField)}
+	if entry.Value == nil {
+		entry.Value = []byte{}
+	}
+	entry.URL = string(record.get(urlField))
+	for _, tag := range record.getAll(tagField) {
+		entry.Tags = append(entry.Tags, string(tag))
+	}
+	entry.Notes = string(record.get(notesField))
+	entry.streamKey = record.get(streamKeyField)
+	if expires := record.get(expiresField); expires != nil {
+		at := time.Unix(int64(decodeUint64(expires)), 0)
+		entry.Expires = &at
+	}
+	entry.MaxAge = Age(decodeUint64(record.get(maxAgeField)))
+	return entry, nil
+}
+
+// entryBinding is the associated data tying an entry to its store, key name and sequence number,
+// so entries moved between keys or stores or replaced by earlier data fail to open
+func entryBinding(file *storeFile, key string) []byte {
+	storeID := file.header.get(storeIDField)
+	if storeID == nil {
+		return nil
+	}
+
+	var binding bytes.Buffer
+	binding.WriteString("keepo entry")
+	_ = writeBytes(&binding, storeID)
+	_ = writeBytes(&binding, []byte(key))
+	binding.Write(encodeUint64(file.sequence(key)))
+	return binding.Bytes()
+}
+
+// openEntry unseals data read for an index entry, version 1 stores sealed bare values
+func openEntry(file *storeFile, key string, data []byte, secret *[crypto.SecretSize]byte) (*Entry, error) {
+	binding := entryBinding(file, key)
+	entryKey, err := openEntryKey(file, key, secret, binding)
+	if err != nil {
+		return nil, err
+	}
+	defer entryKey.Destroy()
+	if entryKey != nil {
+		secret = entryKey.Key()
+	}
+
+	unsealed, err := openRecord(file, data, secret, binding)
+	if err != nil {
+		return nil, err
+	}
+	if file.version == legacyVersion {
+		return &Entry{Value: unsealed}, nil
+	}
+	return decodeEntry(unsealed)
+}
+
+// sealEntry seals an entry at the key's next sequence number, the data must then be written.
+// Entries of bound stores are sealed with a new entry key of their own, wrapped with the store
+// secret and with the key of each grant whose pattern matches, so grants open only their entries.
+func sealEntry(file *storeFile, key string, entry *Entry, secret *[crypto.SecretSize]byte) ([]byte, error) {
+	file.nextSequence(key)
+	file.mirrorExpiry(key, &entry.Metadata)
+	encoded := encodeEntry(entry)
+	defer crypto.Wipe(encoded)
+
+	binding := entryBinding(file, key)
+	if binding == nil {
+		return sealRecord(file, encoded, secret, binding), nil
+	}
+
+	entryKey := crypto.GenerateSecretBuffer()
+	defer entryKey.Destroy()
+	attributes := &file.entry(key).attributes
+	attributes.set(entryKeyAttribute, sealRecord(file, entryKey.Bytes(), secret, binding))
+	attributes.set(grantKeyAttribute, nil)
+
+	grants, err := file.grants(secret)
+	if err != nil {
+		return nil, err
+	}
+	defer destroyGrants(grants)
+	for _, grant := range grants {
+		glob, err := GlobPattern(grant.pattern)
+		if err == nil && glob.MatchString(key) {
+			wrapped := sealRecord(file, entryKey.Bytes(), grant.key.Key(), binding)
+			attributes.add(grantKeyAttribute, append(append([]byte{}, grant.id...), wrapped...))
+		}
+	}
+	return sealRecord(file, encoded, entryKey.Key(), binding), nil
+}
+
+// openEntryKey unwraps the key an entry is sealed with, nil for entries sealed with the store
+// secret itself. Stores opened with a grant unwrap the grant's copy, which only granted entries hold.
+func openEntryKey(file *storeFile, key string, secret *[crypto.SecretSize]byte, binding []byte) (*crypto.Buffer, error) {
+	wrapped := file.attributes(key).get(entryKeyAttribute)
+	if file.grantID != nil {
+		wrapped = nil
+		for _, candidate := range file.attributes(key).getAll(grantKeyAttribute) {
+			if bytes.HasPrefix(candidate, file.grantID) {
+				wrapped = candidate[len(file.grantID):]
+			}
+		}
+		if wrapped == nil {
+			return nil, GrantDeniedState
+		}
+	}
+	if wrapped == nil {
+		return nil, nil
+	}
+
+	unwrapped, err := openRecord(file, wrapped, secret, binding)
+	if err != nil {
+		return nil, err
+	}
+	if len(unwrapped) != crypto.SecretSize {
+		crypto.Wipe(unwrapped)
+		return nil, InvalidFormatError("entry key was not of key length")
+	}
+	return crypto.NewBufferFrom(unwrapped)
+}
+
+// streamSecret gives the key a streamed value is sealed with, earlier streams used the store secret
+func (e *Entry) streamSecret(secret *[crypto.SecretSize]byte) *[crypto.SecretSize]byte {
+	if len(e.streamKey) != crypto.SecretSize {
+		return secret
+	}
+	return (*[crypto.SecretSize]byte)(e.streamKey)
+}
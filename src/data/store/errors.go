@@ -1,7 +1,11 @@
 package store
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
+// State codes are stable and are reported to callers as numeric error codes
 type State struct {
 	code int
 	message string
@@ -9,11 +13,52 @@ type State struct {
 
 var AuthenticationFailedState = &State{10, "authentication failed"}
 var ValueAbsentState = &State{11, "value absent"}
+var EntryVerificationFailedState = &State{14, "entry does not belong to its key, or was replaced by earlier data"}
+var RecoveryFailedState = &State{16, "the shares do not recover this store's secret"}
+var GrantDeniedState = &State{17, "the grant does not cover this key"}
+var UnknownGrantState = &State{18, "no such grant in this store, it may have been revoked"}
+var ReadOnlyGrantState = &State{19, "grant tokens only read, changing the store needs its secret"}
+var UnrelatedStoresState = &State{23, "the stores are not copies of one store and cannot be merged"}
+var IndexVerificationFailedState = &State{24, "the store index fails verification, it was changed without the store secret"}
+var UnlockConflictState = &State{25, "both copies changed how the store is unlocked, the merge would unlock with neither"}
 
 func InvalidFormatError(message string) *State {
 	return &State{12, fmt.Sprintf("invalid format: %s", message)}
 }
 
+func ValueTooLargeError(size int) *State {
+	return &State{13, fmt.Sprintf("value of %d bytes is larger than the maximum of %d bytes", size, MaxValueSize)}
+}
+
+func FactorMissingError(missing Factors) *State {
+	names := map[Factors]string{PassphraseFactor: "a passphrase", KeyFileFactor: "a key file"}
+	message, ok := names[missing]
+	if !ok {
+		message = "a passphrase and a key file"
+	}
+	return &State{15, "the store requires " + message}
+}
+
+func AuditBrokenError(record int) *State {
+	return &State{20, fmt.Sprintf("audit log fails verification at record %d", record)}
+}
+
+func ExpiredError(key string, expired time.Time) *State {
+	return &State{21, fmt.Sprintf("the value of '%s' expired on %s and must be rotated", key, expired.Format("2006-01-02"))}
+}
+
+func OverdueError(count int) *State {
+	return &State{21, fmt.Sprintf("%d expired and must be rotated", count)}
+}
+
+func WeakValueError(key, reason string) *State {
+	return &State{22, fmt.Sprintf("the value of '%s' is too weak, %s", key, reason)}
+}
+
+func (e *State) Code() int {
+	return e.code
+}
+
 func (e *State) Error() string {
 	return fmt.Sprintf("%s", e.message)
-}
\ No newline at end of file
+}
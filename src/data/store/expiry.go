@@ -0,0 +1,154 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Age is a length of time given in days or weeks as well as the units of time.ParseDuration
+type Age time.Duration
+
+const day = 24 * time.Hour
+
+// ParseAge reads an age such as 90d, 2w or 12h
+func ParseAge(text string) (Age, error) {
+	text = strings.TrimSpace(text)
+	for suffix, unit := range map[string]time.Duration{"d": day, "w": 7 * day} {
+		if strings.HasSuffix(text, suffix) {
+			count, err := strconv.Atoi(strings.TrimSuffix(text, suffix))
+			if err != nil || count < 0 {
+				return 0, fmt.Errorf("invalid age '%s'", text)
+			}
+			return Age(time.Duration(count) * unit), nil
+		}
+	}
+
+	duration, err := time.ParseDuration(text)
+	if err != nil || duration < 0 {
+		return 0, fmt.Errorf("invalid age '%s', expected e.g. 90d, 2w or 12h", text)
+	}
+	return Age(duration), nil
+}
+
+// String gives whole days as such, other ages as a duration
+func (a Age) String() string {
+	if a != 0 && time.Duration(a)%day == 0 {
+		return strconv.FormatInt(int64(time.Duration(a)/day), 10) + "d"
+	}
+	return time.Duration(a).String()
+}
+
+func (a Age) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// ParseExpiry reads an expiry given as a date, a date and time in RFC 3339, or an age from now
+func ParseExpiry(text string, now time.Time) (time.Time, error) {
+	if expires, err := time.ParseInLocation("2006-01-02", text, time.Local); err == nil {
+		return expires, nil
+	}
+	if expires, err := time.Parse(time.RFC3339, text); err == nil {
+		return expires, nil
+	}
+	age, err := ParseAge(text)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid expiry '%s', expected a date such as 2030-01-31 or an age such as 90d", text)
+	}
+	return now.Add(time.Duration(age)), nil
+}
+
+// Expiry is when an entry's value is due to be rotated, read from the index without a secret
+type Expiry struct {
+	Key     string     `json:"key"`
+	Rotated *time.Time `json:"rotated,omitempty"`
+	Expires time.Time  `json:"expires"`
+}
+
+// Expired tells whether the value is overdue at the time given
+func (e Expiry) Expired(now time.Time) bool {
+	return !now.Before(e.Expires)
+}
+
+// ListExpiries gives the entries that expire, soonest first, no secret is needed
+func ListExpiries(path string) (expiries []Expiry, err error) {
+	file, err := getIndex(GetStorePath(path))
+	if err != nil {
+		return nil, err
+	}
+
+	expiries = []Expiry{}
+	for _, key := range file.keys() {
+		if expiry, ok := file.expiry(key); ok {
+			expiries = append(expiries, expiry)
+		}
+	}
+	sort.Slice(expiries, func(i, j int) bool {
+		if expiries[i].Expires.Equal(expiries[j].Expires) {
+			return expiries[i].Key < expiries[j].Key
+		}
+		return expiries[i].Expires.Before(expiries[j].Expires)
+	})
+	return expiries, nil
+}
+
+// CheckExpiry fails with ExpiredError when the store refuses expired values and the key's has
+// expired, reading a value is otherwise left to the caller
+func CheckExpiry(path, key string) error {
+	file, err := getIndex(GetStorePath(path))
+	if err != nil {
+		return err
+	}
+	if !file.policy().RefuseExpired {
+		return nil
+	}
+	if expiry, ok := file.expiry(key); ok && expiry.Expired(time.Now()) {
+		return ExpiredError(key, expiry.Expires)
+	}
+	return nil
+}
+
+// expiry gives the earlier of the entry's expiry date and its rotation plus its max age, or the
+// store's. Entries whose rotation was never recorded do not age.
+func (s *storeFile) expiry(key string) (expiry Expiry, ok bool) {
+	attributes := s.attributes(key)
+	expiry.Key = key
+
+	if expires := attributes.get(expiresAttribute); expires != nil {
+		expiry.Expires, ok = time.Unix(int64(decodeUint64(expires)), 0), true
+	}
+
+	maxAge := time.Duration(decodeUint64(attributes.get(maxAgeAttribute)))
+	if maxAge == 0 {
+		maxAge = time.Duration(s.policy().MaxAge)
+	}
+	if rotated := attributes.get(rotatedAttribute); rotated != nil {
+		at := time.Unix(int64(decodeUint64(rotated)), 0)
+		expiry.Rotated = &at
+		if due := at.Add(maxAge); maxAge > 0 && (!ok || due.Before(expiry.Expires)) {
+			expiry.Expires, ok = due, true
+		}
+	}
+	return expiry, ok
+}
+
+// setRotated records when the key's value last changed
+func (s *storeFile) setRotated(key string, at time.Time) {
+	s.entry(key).attributes.set(rotatedAttribute, encodeUint64(uint64(at.Unix())))
+}
+
+// mirrorExpiry copies the entry's sealed expiry and max age into its index attributes, so they
+// are listed without a secret
+func (s *storeFile) mirrorExpiry(key string, metadata *Metadata) {
+	attributes := &s.entry(key).attributes
+	attributes.set(expiresAttribute, nil)
+	if metadata.Expires != nil {
+		attributes.set(expiresAttribute, encodeUint64(uint64(metadata.Expires.Unix())))
+	}
+	attributes.set(maxAgeAttribute, nil)
+	if metadata.MaxAge > 0 {
+		attributes.set(maxAgeAttribute, encodeUint64(uint64(metadata.MaxAge)))
+	}
+}
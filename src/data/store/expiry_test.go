@@ -0,0 +1,103 @@
+package store
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestParseAge(t *testing.T) {
+	cases := []struct {
+		in   string
+		want Age
+		out  string
+	}{
+		{"90d", Age(90 * day), "90d"},
+		{"2w", Age(14 * day), "14d"},
+		{"12h", Age(12 * time.Hour), "12h0m0s"},
+	}
+
+	for _, c := range cases {
+		got, err := ParseAge(c.in)
+		if err != nil || got != c.want {
+			t.Errorf("Expected %q, received %q", c.want, got)
+		}
+		if got.String() != c.out {
+			t.Errorf("Expected %q, received %q", c.out, got.String())
+		}
+	}
+
+	for _, invalid := range []string{"", "d", "-3d", "soon"} {
+		if _, err := ParseAge(invalid); err == nil {
+			t.Errorf("expected '%s' to fail", invalid)
+		}
+	}
+}
+
+func TestExpiry(t *testing.T) {
+
+	path := "."
+	cleanup(path, t)
+
+	secret := func() *Secret { return NewSecret([]byte("password01"), nil) }
+	yesterday := time.Now().Add(-day)
+	err := SetMapValue(path, "old", "value", secret())
+	if err != nil {
+		t.Errorf("could not set map value '%q'", err)
+	}
+	err = SetMapValue(path, "fresh", "value", secret())
+	if err != nil {
+		t.Errorf("could not set map value '%q'", err)
+	}
+
+	fmt.Println("test an expiry date is listed without a secret")
+	err = SetMapMetadata(path, "old", Metadata{Expires: &yesterday}, secret())
+	if err != nil {
+		t.Errorf("could not set map metadata '%q'", err)
+	}
+	expiries, err := ListExpiries(path)
+	if err != nil || len(expiries) != 1 || expiries[0].Key != "old" || !expiries[0].Expired(time.Now()) {
+		t.Errorf("expected 'old' alone to have expired but got %v, '%q'", expiries, err)
+	}
+	if err = CheckExpiry(path, "old"); err != nil {
+		t.Errorf("expected expired values to be given without a policy but got '%q'", err)
+	}
+
+	fmt.Println("test a store max age applies to every entry")
+	err = SetPolicy(path, secret(), Policy{MinStrength: DefaultMinStrength, MaxAge: Age(90 * day), RefuseExpired: true})
+	if err != nil {
+		t.Errorf("could not set policy '%q'", err)
+	}
+	expiries, _ = ListExpiries(path)
+	if len(expiries) != 2 || expiries[1].Key != "fresh" || expiries[1].Expires.Before(time.Now().Add(89*day)) {
+		t.Errorf("expected 'fresh' to expire in 90 days but got %v", expiries)
+	}
+
+	fmt.Println("test expired values are refused by policy")
+	err = CheckExpiry(path, "old")
+	if state, ok := err.(*State); !ok || state.Code() != 21 {
+		t.Errorf("expected an expired value to be refused but got '%q'", err)
+	}
+	if err = CheckExpiry(path, "fresh"); err != nil {
+		t.Errorf("expected a fresh value to be given but got '%q'", err)
+	}
+
+	fmt.Println("test changing a value rotates it")
+	err = SetMapMetadata(path, "old", Metadata{MaxAge: Age(30 * day)}, secret())
+	if err != nil {
+		t.Errorf("could not set map metadata '%q'", err)
+	}
+	err = SetMapValue(path, "old", "rotated", secret())
+	if err != nil {
+		t.Errorf("could not set map value '%q'", err)
+	}
+	expiries, _ = ListExpiries(path)
+	if len(expiries) != 2 || expiries[0].Key != "old" || expiries[0].Expires.After(time.Now().Add(31*day)) {
+		t.Errorf("expected 'old' to expire in 30 days but got %v", expiries)
+	}
+	if err = CheckExpiry(path, "old"); err != nil {
+		t.Errorf("expected a rotated value to be given but got '%q'", err)
+	}
+
+	cleanup(path, t)
+}
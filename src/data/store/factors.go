@@ -0,0 +1,161 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"keepo/src/crypto"
+	"keepo/src/util"
+	"strings"
+)
+
+// Factors are the parts of a secret a store requires, recorded in its header
+type Factors byte
+
+const (
+	PassphraseFactor Factors = 1
+	KeyFileFactor    Factors = 2
+)
+
+var factorNames = map[string]Factors{
+	"passphrase": PassphraseFactor,
+	"keyfile":    KeyFileFactor,
+	"both":       PassphraseFactor | KeyFileFactor,
+}
+
+// ParseFactors reads factors given as passphrase, keyfile or both
+func ParseFactors(name string) (Factors, error) {
+	if factors, ok := factorNames[strings.ToLower(name)]; ok {
+		return factors, nil
+	}
+	return 0, fmt.Errorf("unknown factors '%s', expected passphrase, keyfile or both", name)
+}
+
+func (f Factors) String() string {
+	for name, factors := range factorNames {
+		if factors == f {
+			return name
+		}
+	}
+	return fmt.Sprintf("factors(%d)", byte(f))
+}
+
+// Secret holds the factors given to unlock a store in secure buffers, any may be nil. A grant
+// token, as read by ParseToken, stands in for the factors when only reading.
+type Secret struct {
+	Passphrase *crypto.Buffer
+	KeyFile    *crypto.Buffer
+	Grant      *crypto.Buffer
+}
+
+// NewSecret moves the passphrase and key file into secure buffers, wiping them, a nil or empty
+// factor is left out
+func NewSecret(passphrase, keyFile []byte) *Secret {
+	secret := &Secret{}
+	var err error
+	if len(passphrase) > 0 {
+		secret.Passphrase, err = crypto.NewBufferFrom(passphrase)
+		util.CheckError(err, "could not allocate passphrase")
+	}
+	if len(keyFile) > 0 {
+		secret.KeyFile, err = crypto.NewBufferFrom(keyFile)
+		util.CheckError(err, "could not allocate key file")
+	}
+	return secret
+}
+
+// Factors names the factors the secret holds, a grant token is not one
+func (s *Secret) Factors() (factors Factors) {
+	if s == nil {
+		return 0
+	}
+	if s.Passphrase.Len() > 0 {
+		factors |= PassphraseFactor
+	}
+	if s.KeyFile.Len() > 0 {
+		factors |= KeyFileFactor
+	}
+	return factors
+}
+
+// grantOnly tells whether the secret holds a grant token and no factors
+func (s *Secret) grantOnly() bool {
+	return s != nil && s.Grant != nil && s.Factors() == 0
+}
+
+func (s *Secret) Destroy() {
+	if s != nil {
+		s.Passphrase.Destroy()
+		s.KeyFile.Destroy()
+		s.Grant.Destroy()
+	}
+}
+
+// unlockKey derives the key the store secret is sealed with from the factors the store requires.
+// Passphrase only stores use the passphrase hash as they always have, other combinations hash
+// each factor length prefixed so no two combinations can give the same input.
+func unlockKey(factors Factors, secret *Secret) (key [crypto.HashSize]byte, err error) {
+	if missing := factors &^ secret.Factors(); missing != 0 {
+		return key, FactorMissingError(missing)
+	}
+	if factors == PassphraseFactor {
+		return crypto.GetHash(secret.Passphrase.Bytes()), nil
+	}
+
+	var material bytes.Buffer
+	defer func() { crypto.Wipe(material.Bytes()) }()
+	material.WriteString("keepo unlock")
+	material.WriteByte(byte(factors))
+	if factors&PassphraseFactor != 0 {
+		_ = writeBytes(&material, secret.Passphrase.Bytes())
+	}
+	if factors&KeyFileFactor != 0 {
+		_ = writeBytes(&material, secret.KeyFile.Bytes())
+	}
+	return crypto.GetHash(material.Bytes()), nil
+}
+
+// RequiredFactors reads the factors a store requires from its header, no secret is needed
+func RequiredFactors(path string) (Factors, error) {
+	return RequiredFileFactors(GetStorePath(path))
+}
+
+// RequiredFileFactors reads the factors of the store at a file path rather than by name
+func RequiredFileFactors(storePath string) (Factors, error) {
+	file, err := getIndex(storePath)
+	if err != nil {
+		return 0, err
+	}
+	return file.factors(), nil
+}
+
+// SetRequiredFactors unlocks the store with the factors it requires now and reseals its secret
+// with the factors given, which the secret must hold
+func SetRequiredFactors(path string, secret *Secret, factors Factors) (err error) {
+	if factors == 0 || factors&^(PassphraseFactor|KeyFileFactor) != 0 {
+		return fmt.Errorf("invalid factors %s", factors)
+	}
+
+	storePath, file, storeSecret, err := openStore(path, secret, false)
+	if err != nil {
+		return err
+	}
+	defer storeSecret.Destroy()
+
+	key, err := unlockKey(factors, secret)
+	if err != nil {
+		return err
+	}
+	file.header.set(secretField, sealData(storeSecret.Bytes(), &key))
+	crypto.Wipe(key[:])
+	file.setFactors(factors)
+
+	dataMap, err := loadDataMap(storePath, file, storeSecret.Key(), func(key string) bool { return false })
+	if err != nil {
+		return err
+	}
+	err = set(storePath, file, dataMap)
+	if err != nil {
+		return err
+	}
+	return audit(storePath, file, storeSecret.Key(), "factors "+factors.String())
+}
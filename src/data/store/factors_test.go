@@ -0,0 +1,87 @@
+package store
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseFactors(t *testing.T) {
+	cases := []struct {
+		in   string
+		want Factors
+	}{
+		{"passphrase", PassphraseFactor},
+		{"keyfile", KeyFileFactor},
+		{"Both", PassphraseFactor | KeyFileFactor},
+	}
+
+	for _, c := range cases {
+		got, err := ParseFactors(c.in)
+		if err != nil || got != c.want {
+			t.Errorf("Expected %q, received %q", c.want, got)
+		}
+	}
+
+	if _, err := ParseFactors("fingerprint"); err == nil {
+		t.Errorf("expected unknown factors to fail")
+	}
+}
+
+func TestKeyFileFactors(t *testing.T) {
+
+	path := "."
+	cleanup(path, t)
+
+	both := func() *Secret { return NewSecret([]byte("password01"), []byte("key file bytes")) }
+	passphrase := func() *Secret { return NewSecret([]byte("password01"), nil) }
+	keyFile := func() *Secret { return NewSecret(nil, []byte("key file bytes")) }
+
+	fmt.Println("test a store started with a key file requires it")
+	err := SetMapValue(path, "key", "value", both())
+	if err != nil {
+		t.Errorf("could not set map value '%q'", err)
+	}
+	factors, err := RequiredFactors(path)
+	if err != nil || factors != PassphraseFactor|KeyFileFactor {
+		t.Errorf("Expected %q, received %q", PassphraseFactor|KeyFileFactor, factors)
+	}
+
+	_, err = GetMapValue(path, "key", passphrase())
+	if state, ok := err.(*State); !ok || state.Code() != 15 {
+		t.Errorf("expected a missing key file to fail but got '%q'", err)
+	}
+	_, err = GetMapValue(path, "key", NewSecret([]byte("password01"), []byte("other key file")))
+	if err != AuthenticationFailedState {
+		t.Errorf("Expected %q, received %q", AuthenticationFailedState, err)
+	}
+	value, err := GetMapValue(path, "key", both())
+	if err != nil || string(value) != "value" {
+		t.Errorf("Expected %q, received %q", "value", value)
+	}
+
+	fmt.Println("test changing a store to its key file alone")
+	err = SetRequiredFactors(path, both(), KeyFileFactor)
+	if err != nil {
+		t.Errorf("could not set required factors '%q'", err)
+	}
+	value, err = GetMapValue(path, "key", keyFile())
+	if err != nil || string(value) != "value" {
+		t.Errorf("Expected %q, received %q", "value", value)
+	}
+	_, err = GetMapValue(path, "key", passphrase())
+	if _, ok := err.(*State); !ok || err == AuthenticationFailedState {
+		t.Errorf("expected a missing key file to fail but got '%q'", err)
+	}
+
+	fmt.Println("test changing a store back to its passphrase")
+	err = SetRequiredFactors(path, both(), PassphraseFactor)
+	if err != nil {
+		t.Errorf("could not set required factors '%q'", err)
+	}
+	value, err = GetMapValue(path, "key", passphrase())
+	if err != nil || string(value) != "value" {
+		t.Errorf("Expected %q, received %q", "value", value)
+	}
+
+	cleanup(path, t)
+}
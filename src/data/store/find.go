@@ -0,0 +1,129 @@
+package store
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Match is a key found by Find with the names of what matched, 'key' or metadata fields
+type Match struct {
+	Store  string   `json:"store"`
+	Key    string   `json:"key"`
+	Fields []string `json:"fields"`
+}
+
+// GlobPattern compiles a glob into an anchored regular expression, '*' matches any run of
+// characters including the key separator, '?' a single character and '[...]' a class
+func GlobPattern(glob string) (*regexp.Regexp, error) {
+	var expression strings.Builder
+	expression.WriteString("^")
+
+	for index := 0; index < len(glob); index++ {
+		switch character := glob[index]; character {
+		case '*':
+			expression.WriteString(".*")
+		case '?':
+			expression.WriteString(".")
+		case '\\':
+			if index+1 < len(glob) {
+				index++
+			}
+			expression.WriteString(regexp.QuoteMeta(glob[index : index+1]))
+		case '[':
+			// a ']' first in the class, after any '!', is taken literally
+			start := index + 1
+			if start < len(glob) && glob[start] == '!' {
+				start++
+			}
+			end := -1
+			if start < len(glob) {
+				end = strings.Index(glob[start+1:], "]")
+			}
+			if end < 0 {
+				expression.WriteString(regexp.QuoteMeta("["))
+				continue
+			}
+			end += start + 1
+			expression.WriteString("[")
+			if start > index+1 {
+				expression.WriteString("^")
+			}
+			for _, member := range glob[start:end] {
+				if member == '\\' || member == ']' || member == '[' {
+					expression.WriteString("\\")
+				}
+				expression.WriteRune(member)
+			}
+			expression.WriteString("]")
+			index = end
+		default:
+			expression.WriteString(regexp.QuoteMeta(string(character)))
+		}
+	}
+
+	expression.WriteString("$")
+	return regexp.Compile(expression.String())
+}
+
+// Find searches the key names of every store, matching either the key or its full address, and
+// when a secret is given the metadata of the stores it unlocks. Stores it does not unlock are
+// searched by key name only and returned as locked.
+func Find(pattern *regexp.Regexp, secret *Secret) (matches []Match, locked []string, err error) {
+	names, err := GetStoreNames()
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		keys, err := ListMapKeys(name)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var metadata map[string]Metadata
+		if secret.Factors() != 0 {
+			metadata, err = GetMapMetadata(name, secret)
+			if err == AuthenticationFailedState {
+				locked = append(locked, name)
+			} else if err != nil {
+				return nil, nil, err
+			}
+		}
+
+		for _, key := range keys {
+			var matched []string
+			if pattern.MatchString(key) || pattern.MatchString(JoinAddress(name, key)) {
+				matched = append(matched, "key")
+			}
+
+			if entry, ok := metadata[key]; ok {
+				fields := entry.Fields()
+				for _, field := range []string{"url", "tags", "notes"} {
+					if len(fields[field]) > 0 && metadataMatches(pattern, &entry, field) {
+						matched = append(matched, field)
+					}
+				}
+			}
+
+			if len(matched) > 0 {
+				matches = append(matches, Match{name, key, matched})
+			}
+		}
+	}
+	return matches, locked, nil
+}
+
+// tags are matched one at a time so a glob can name a single tag
+func metadataMatches(pattern *regexp.Regexp, entry *Metadata, field string) bool {
+	if field == "tags" {
+		for _, tag := range entry.Tags {
+			if pattern.MatchString(tag) {
+				return true
+			}
+		}
+		return false
+	}
+	return pattern.MatchString(entry.Fields()[field])
+}
@@ -0,0 +1,84 @@
+package store
+
+import (
+	"testing"
+)
+
+func TestGlobPattern(t *testing.T) {
+	cases := []struct {
+		glob    string
+		matches []string
+		misses  []string
+	}{
+		{"db*", []string{"db", "db/url", "dbx"}, []string{"web/db"}},
+		{"*/url", []string{"db/url", "a/b/url"}, []string{"url", "db/urls"}},
+		{"k?y", []string{"key", "kay"}, []string{"ky", "keey"}},
+		{"[ab]*", []string{"a", "b/c"}, []string{"c"}},
+		{"[!ab]*", []string{"c"}, []string{"a"}},
+		{"[]a]", []string{"]", "a"}, []string{"b"}},
+		{"[!]]", []string{"a"}, []string{"]"}},
+		{"[!]a]x", []string{"bx"}, []string{"ax", "]x"}},
+		{"a[]", []string{"a[]"}, []string{"a"}},
+		{`a\*`, []string{"a*"}, []string{"ab"}},
+		{"db:*", []string{"db:url"}, []string{"default:db"}},
+	}
+
+	for _, c := range cases {
+		pattern, err := GlobPattern(c.glob)
+		if err != nil {
+			t.Errorf("could not compile %q '%q'", c.glob, err)
+			continue
+		}
+		for _, v := range c.matches {
+			if !pattern.MatchString(v) {
+				t.Errorf("expected %q to match %q", c.glob, v)
+			}
+		}
+		for _, v := range c.misses {
+			if pattern.MatchString(v) {
+				t.Errorf("expected %q not to match %q", c.glob, v)
+			}
+		}
+	}
+}
+
+func TestFind(t *testing.T) {
+
+	path := "."
+	cleanup(path, t)
+
+	secret := NewSecret([]byte("password01"), nil)
+	err := SetMapValue(path, "db/url", "postgres://", secret)
+	if err != nil {
+		t.Errorf("could not set map value '%q'", err)
+	}
+	err = SetMapValue(path, "web/login", "hunter2", secret)
+	if err != nil {
+		t.Errorf("could not set map value '%q'", err)
+	}
+	err = SetMapMetadata(path, "web/login", Metadata{URL: "https://db.example.com", Tags: []string{"db"}}, secret)
+	if err != nil {
+		t.Errorf("could not set metadata '%q'", err)
+	}
+
+	pattern, _ := GlobPattern("*db*")
+	matches, _, err := Find(pattern, nil)
+	if err != nil || len(matches) != 1 || matches[0].Key != "db/url" {
+		t.Errorf("expected only 'db/url' to match by key but got '%v' '%q'", matches, err)
+	}
+
+	matches, locked, err := Find(pattern, secret)
+	if err != nil || len(matches) != 2 || len(locked) != 0 {
+		t.Fatalf("expected both keys to match when unlocked but got '%v' '%q'", matches, err)
+	}
+	if fields := matches[1].Fields; matches[1].Key != "web/login" || len(fields) != 2 || fields[0] != "url" || fields[1] != "tags" {
+		t.Errorf("expected 'web/login' to match on url and tags but got '%v'", matches[1])
+	}
+
+	matches, locked, err = Find(pattern, NewSecret([]byte("wrong"), nil))
+	if err != nil || len(matches) != 1 || len(locked) != 1 {
+		t.Errorf("expected a locked store searched by key only but got '%v' '%v' '%q'", matches, locked, err)
+	}
+
+	cleanup(path, t)
+}
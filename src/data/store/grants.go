@@ -0,0 +1,359 @@
+package store
+
+import (
+	"bytes"
+	"encoding/base32"
+	"encoding/hex"
+	"keepo/src/crypto"
+	"os"
+	"sort"
+	"strings"
+)
+
+/**
+ * Grant header field value:
+ *
+ * grant-id				- grantIDSize bytes
+ * grant-record			- sealed with the store secret, bound to the store and grant id:
+ *   pattern			- the glob of keys granted
+ *   key				- the grant key, which the token carries
+ *
+ * Granted entries hold a copy of their entry key wrapped with the grant key, a grant id followed
+ * by the sealed entry key, as a grant key index attribute. Only the store secret opens a grant
+ * record, so a token can neither widen its pattern nor wrap entry keys for itself.
+ *
+ * Token text, base32 without padding after the prefix:
+ *
+ * version				- 1 byte, tokenVersion
+ * grant-id				- grantIDSize bytes
+ * grant-key			- the grant key
+ */
+
+const (
+	TokenPrefix  = "KEEPO-GRANT-"
+	tokenVersion = 1
+	grantIDSize  = 8
+)
+
+// grant record fields
+const (
+	grantPatternField uint16 = 1
+	grantKeyField     uint16 = 2
+)
+
+var tokenEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Grant gives read only access to the keys matching its pattern at the time they are sealed
+type Grant struct {
+	ID      string   `json:"id"`
+	Pattern string   `json:"pattern"`
+	Keys    []string `json:"keys"`
+}
+
+type grantRecord struct {
+	id      []byte
+	pattern string
+	key     *crypto.Buffer
+}
+
+// GrantAccess adds a grant for the keys matching the glob, including those set later, returning
+// the grant and its token in a buffer the caller destroys. Granted entries are resealed under
+// new entry keys wrapped for the grant.
+func GrantAccess(path string, secret *Secret, pattern string) (grant Grant, token *crypto.Buffer, err error) {
+	glob, err := GlobPattern(pattern)
+	if err != nil {
+		return grant, nil, err
+	}
+
+	storePath, file, storeSecret, err := openStore(path, secret, false)
+	if err != nil {
+		return grant, nil, err
+	}
+	defer storeSecret.Destroy()
+	unsealedSecret := storeSecret.Key()
+
+	if file.header.get(storeIDField) == nil {
+		return grant, nil, InvalidFormatError("store predates entry binding and cannot hold grants")
+	}
+
+	nonce := crypto.GenerateNonce()
+	id := nonce[:grantIDSize]
+	grantKey := crypto.GenerateSecretBuffer()
+	defer grantKey.Destroy()
+
+	record := encodeFields(fields{{grantPatternField, []byte(pattern)}, {grantKeyField, grantKey.Bytes()}})
+	file.header.add(grantField, append(append([]byte{}, id...), sealRecord(file, record, unsealedSecret, grantBinding(file, id))...))
+	crypto.Wipe(record)
+
+	grant = Grant{ID: hex.EncodeToString(id), Pattern: pattern, Keys: []string{}}
+	for _, key := range file.keys() {
+		if glob.MatchString(key) {
+			grant.Keys = append(grant.Keys, key)
+		}
+	}
+	sort.Strings(grant.Keys)
+
+	dataMap, err := resealEntries(storePath, file, grant.Keys, unsealedSecret, false)
+	if err != nil {
+		return grant, nil, err
+	}
+	if err = set(storePath, file, dataMap); err != nil {
+		return grant, nil, err
+	}
+	if err = audit(storePath, file, unsealedSecret, "grant "+grant.ID, grant.Keys...); err != nil {
+		return grant, nil, err
+	}
+	token, err = encodeToken(id, grantKey)
+	return grant, token, err
+}
+
+// RevokeAccess removes a grant, resealing the entries it covered under new entry and stream keys
+// so keys unwrapped with its token earlier no longer open them
+func RevokeAccess(path string, secret *Secret, id string) (revoked Grant, err error) {
+	storePath, file, storeSecret, err := openStore(path, secret, false)
+	if err != nil {
+		return revoked, err
+	}
+	defer storeSecret.Destroy()
+	unsealedSecret := storeSecret.Key()
+
+	grants, err := file.grants(unsealedSecret)
+	if err != nil {
+		return revoked, err
+	}
+	defer destroyGrants(grants)
+
+	var kept fields
+	found := false
+	for _, candidate := range file.header {
+		if candidate.tag == grantField && hex.EncodeToString(candidate.value[:grantIDSize]) == strings.ToLower(id) {
+			found = true
+			continue
+		}
+		kept = append(kept, candidate)
+	}
+	if !found {
+		return revoked, UnknownGrantState
+	}
+	file.header = kept
+
+	revoked.ID = strings.ToLower(id)
+	revoked.Keys = grantedKeys(file, revoked.ID)
+	for _, grant := range grants {
+		if hex.EncodeToString(grant.id) == revoked.ID {
+			revoked.Pattern = grant.pattern
+		}
+	}
+
+	dataMap, err := resealEntries(storePath, file, revoked.Keys, unsealedSecret, true)
+	if err == nil {
+		err = set(storePath, file, dataMap)
+	}
+	if err != nil {
+		return revoked, err
+	}
+	return revoked, audit(storePath, file, unsealedSecret, "revoke "+revoked.ID, revoked.Keys...)
+}
+
+// ListGrants unlocks the store to read the pattern of each grant, with the keys it covers
+func ListGrants(path string, secret *Secret) (list []Grant, err error) {
+	_, file, storeSecret, err := openStore(path, secret, false)
+	if err != nil {
+		return nil, err
+	}
+	defer storeSecret.Destroy()
+
+	grants, err := file.grants(storeSecret.Key())
+	if err != nil {
+		return nil, err
+	}
+	defer destroyGrants(grants)
+
+	list = make([]Grant, 0, len(grants))
+	for _, grant := range grants {
+		id := hex.EncodeToString(grant.id)
+		list = append(list, Grant{ID: id, Pattern: grant.pattern, Keys: grantedKeys(file, id)})
+	}
+	return list, nil
+}
+
+// ParseToken reads a token as printed by GrantAccess into a buffer holding its grant id and key,
+// ready to be given as a Secret's Grant
+func ParseToken(text []byte) (*crypto.Buffer, error) {
+	text = bytes.TrimSpace(text)
+	if !bytes.HasPrefix(text, []byte(TokenPrefix)) {
+		return nil, InvalidFormatError("token does not start with " + TokenPrefix)
+	}
+
+	decoded, err := crypto.NewBuffer(tokenEncoding.DecodedLen(len(text) - len(TokenPrefix)))
+	if err != nil {
+		return nil, err
+	}
+	n, err := tokenEncoding.Decode(decoded.Bytes(), text[len(TokenPrefix):])
+	if err != nil || n != 1+grantIDSize+crypto.SecretSize || decoded.Bytes()[0] != tokenVersion {
+		decoded.Destroy()
+		return nil, InvalidFormatError("token is not a keepo grant token")
+	}
+
+	grant, err := crypto.NewBuffer(grantIDSize + crypto.SecretSize)
+	if err == nil {
+		copy(grant.Bytes(), decoded.Bytes()[1:n])
+	}
+	decoded.Destroy()
+	return grant, err
+}
+
+func encodeToken(id []byte, grantKey *crypto.Buffer) (*crypto.Buffer, error) {
+	payload, err := crypto.NewBuffer(1 + grantIDSize + crypto.SecretSize)
+	if err != nil {
+		return nil, err
+	}
+	defer payload.Destroy()
+	payload.Bytes()[0] = tokenVersion
+	copy(payload.Bytes()[1:], id)
+	copy(payload.Bytes()[1+grantIDSize:], grantKey.Bytes())
+
+	token, err := crypto.NewBuffer(len(TokenPrefix) + tokenEncoding.EncodedLen(payload.Len()))
+	if err != nil {
+		return nil, err
+	}
+	copy(token.Bytes(), TokenPrefix)
+	tokenEncoding.Encode(token.Bytes()[len(TokenPrefix):], payload.Bytes())
+	return token, nil
+}
+
+// openGrant opens a store with a grant token, whose key stands in for the store secret and only
+// opens the entries granted to it. The grant key is given in a buffer the caller destroys.
+func openGrant(path string, secret *Secret) (storePath string, file *storeFile, grantKey *crypto.Buffer, err error) {
+	storePath = GetStorePath(path)
+	file, err = getIndex(storePath)
+	if _, ok := err.(*os.PathError); ok {
+		return storePath, nil, nil, ValueAbsentState
+	}
+	if err != nil {
+		return storePath, nil, nil, err
+	}
+
+	token := secret.Grant.Bytes()
+	if len(token) != grantIDSize+crypto.SecretSize {
+		return storePath, nil, nil, InvalidFormatError("token is not a keepo grant token")
+	}
+	id := token[:grantIDSize]
+
+	for _, value := range file.header.getAll(grantField) {
+		if bytes.HasPrefix(value, id) {
+			grantKey, err = crypto.NewBuffer(crypto.SecretSize)
+			if err != nil {
+				return storePath, nil, nil, err
+			}
+			copy(grantKey.Bytes(), token[grantIDSize:])
+			file.grantID = append([]byte{}, id...)
+			return storePath, file, grantKey, nil
+		}
+	}
+	return storePath, nil, nil, UnknownGrantState
+}
+
+// grants opens the store's grant records, the caller destroys their keys
+func (s *storeFile) grants(unsealedSecret *[crypto.SecretSize]byte) (grants []grantRecord, err error) {
+	for _, value := range s.header.getAll(grantField) {
+		if len(value) < grantIDSize {
+			destroyGrants(grants)
+			return nil, InvalidFormatError("grant too short")
+		}
+		id := value[:grantIDSize]
+
+		opened, err := openRecord(s, value[grantIDSize:], unsealedSecret, grantBinding(s, id))
+		if err != nil {
+			destroyGrants(grants)
+			return nil, err
+		}
+		record, err := decodeFields(opened)
+		if err != nil || len(record.get(grantKeyField)) != crypto.SecretSize {
+			crypto.Wipe(opened)
+			destroyGrants(grants)
+			return nil, InvalidFormatError("could not decode grant")
+		}
+
+		key, err := crypto.NewBufferFrom(record.get(grantKeyField))
+		crypto.Wipe(opened)
+		if err != nil {
+			destroyGrants(grants)
+			return nil, err
+		}
+		grants = append(grants, grantRecord{id, string(record.get(grantPatternField)), key})
+	}
+	return grants, nil
+}
+
+func destroyGrants(grants []grantRecord) {
+	for _, grant := range grants {
+		grant.key.Destroy()
+	}
+}
+
+// grantBinding is the associated data tying a grant record to its store and grant id
+func grantBinding(file *storeFile, id []byte) []byte {
+	var binding bytes.Buffer
+	binding.WriteString("keepo grant")
+	_ = writeBytes(&binding, file.header.get(storeIDField))
+	_ = writeBytes(&binding, id)
+	return binding.Bytes()
+}
+
+// grantedKeys lists the keys holding an entry key wrapped for the grant
+func grantedKeys(file *storeFile, id string) []string {
+	keys := []string{}
+	for key, entry := range file.index {
+		for _, wrapped := range entry.attributes.getAll(grantKeyAttribute) {
+			if len(wrapped) > grantIDSize && hex.EncodeToString(wrapped[:grantIDSize]) == id {
+				keys = append(keys, key)
+				break
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// resealEntries seals the keys again under new entry keys, wrapped for the grants covering them
+// now, while the rest of the store's data is copied as it is. Streamed values are encrypted again
+// under new stream keys when rekeyed, as their stream keys are in the records grants opened.
+func resealEntries(storePath string, file *storeFile, keys []string, unsealedSecret *[crypto.SecretSize]byte, rekey bool) (map[string]*entryData, error) {
+	resealed := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		resealed[key] = true
+	}
+	dataMap, err := loadDataMap(storePath, file, unsealedSecret, func(key string) bool {
+		return resealed[key]
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys {
+		if file.streamed(key) {
+			entry, err := readStreamedRecord(storePath, file, key, unsealedSecret)
+			if err != nil {
+				return nil, err
+			}
+			dataMap[key], err = restreamData(storePath, file, key, entry, unsealedSecret, rekey)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		entry, err := readEntry(storePath, file, key, unsealedSecret)
+		if err != nil {
+			return nil, err
+		}
+		record, err := sealEntry(file, key, entry, unsealedSecret)
+		crypto.Wipe(entry.Value)
+		if err != nil {
+			return nil, err
+		}
+		dataMap[key] = memoryData(record)
+	}
+	return dataMap, nil
+}
@@ -0,0 +1,168 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"keepo/src/crypto"
+	"os"
+	"testing"
+)
+
+func TestGrants(t *testing.T) {
+
+	path := "."
+	cleanup(path, t)
+
+	owner := func() *Secret { return NewSecret([]byte("password01"), nil) }
+	for key, value := range map[string]string{"db/user": "admin", "db/password": "hunter2", "mail": "secret"} {
+		err := SetMapValue(path, key, value, owner())
+		if err != nil {
+			t.Errorf("could not set map value '%q'", err)
+		}
+	}
+	err := SetMapStream(path, "db/cert", bytes.NewReader([]byte("certificate")), owner(), nil)
+	if err != nil {
+		t.Errorf("could not set map stream '%q'", err)
+	}
+
+	fmt.Println("test granting the keys matching a glob")
+	grant, token, err := GrantAccess(path, owner(), "db/*")
+	if err != nil {
+		t.Fatalf("could not grant access '%q'", err)
+	}
+	if len(grant.Keys) != 3 {
+		t.Errorf("Expected %d granted keys, received %q", 3, grant.Keys)
+	}
+	tokenSecret := func() *Secret {
+		parsed, err := ParseToken(token.Bytes())
+		if err != nil {
+			t.Fatalf("could not parse token '%q'", err)
+		}
+		return &Secret{Grant: parsed}
+	}
+
+	value, err := GetMapValue(path, "db/password", tokenSecret())
+	if err != nil || string(value) != "hunter2" {
+		t.Errorf("Expected %q, received %q", "hunter2", value)
+	}
+	var streamed bytes.Buffer
+	_, err = GetMapStream(path, "db/cert", &streamed, tokenSecret())
+	if err != nil || streamed.String() != "certificate" {
+		t.Errorf("Expected %q, received %q", "certificate", streamed.String())
+	}
+
+	fmt.Println("test a token opens nothing else and cannot change the store")
+	_, err = GetMapValue(path, "mail", tokenSecret())
+	if err != GrantDeniedState {
+		t.Errorf("Expected %q, received %q", GrantDeniedState, err)
+	}
+	err = SetMapValue(path, "db/password", "changed", tokenSecret())
+	if err != ReadOnlyGrantState {
+		t.Errorf("Expected %q, received %q", ReadOnlyGrantState, err)
+	}
+	metadata, err := GetMapMetadata(path, tokenSecret())
+	if _, ok := metadata["mail"]; err != nil || ok || len(metadata) != 3 {
+		t.Errorf("expected the metadata of granted keys only but got %d entries, '%q'", len(metadata), err)
+	}
+
+	fmt.Println("test keys set later are granted when they match")
+	err = SetMapValue(path, "db/host", "localhost", owner())
+	if err != nil {
+		t.Errorf("could not set map value '%q'", err)
+	}
+	value, err = GetMapValue(path, "db/host", tokenSecret())
+	if err != nil || string(value) != "localhost" {
+		t.Errorf("Expected %q, received %q", "localhost", value)
+	}
+	grants, err := ListGrants(path, owner())
+	if err != nil || len(grants) != 1 || grants[0].Pattern != "db/*" || len(grants[0].Keys) != 4 {
+		t.Errorf("expected the grant to cover 4 keys but got %v, '%q'", grants, err)
+	}
+
+	// the stream key a token holder unwrapped, to read the stream with once revoked
+	storePath, file, grantKey, err := openGrant(path, tokenSecret())
+	if err != nil {
+		t.Fatalf("could not open grant '%q'", err)
+	}
+	granted, err := readStreamedRecord(storePath, file, "db/cert", grantKey.Key())
+	grantKey.Destroy()
+	if err != nil || len(granted.streamKey) != crypto.SecretSize {
+		t.Fatalf("could not read streamed record '%q'", err)
+	}
+	if value, err := readStream(storePath, "db/cert", (*[crypto.SecretSize]byte)(granted.streamKey)); err != nil || string(value) != "certificate" {
+		t.Errorf("Expected %q, received %q '%q'", "certificate", value, err)
+	}
+
+	fmt.Println("test a revoked token opens nothing")
+	revoked, err := RevokeAccess(path, owner(), grant.ID)
+	if err != nil || len(revoked.Keys) != 4 {
+		t.Errorf("could not revoke grant '%q'", err)
+	}
+	_, err = GetMapValue(path, "db/password", tokenSecret())
+	if err != UnknownGrantState {
+		t.Errorf("Expected %q, received %q", UnknownGrantState, err)
+	}
+	value, err = GetMapValue(path, "db/password", owner())
+	if err != nil || string(value) != "hunter2" {
+		t.Errorf("Expected %q, received %q", "hunter2", value)
+	}
+
+	fmt.Println("test a streamed value no longer opens with the stream key unwrapped before")
+	streamed.Reset()
+	_, err = GetMapStream(path, "db/cert", &streamed, owner())
+	if err != nil || streamed.String() != "certificate" {
+		t.Errorf("Expected %q, received %q", "certificate", streamed.String())
+	}
+	if _, err = readStream(storePath, "db/cert", (*[crypto.SecretSize]byte)(granted.streamKey)); err == nil {
+		t.Errorf("expected the previous stream key to fail")
+	}
+
+	_, err = RevokeAccess(path, owner(), grant.ID)
+	if err != UnknownGrantState {
+		t.Errorf("Expected %q, received %q", UnknownGrantState, err)
+	}
+
+	token.Destroy()
+	cleanup(path, t)
+}
+
+// readStream decrypts a streamed value with the stream key given
+func readStream(storePath, key string, streamKey *[crypto.SecretSize]byte) ([]byte, error) {
+	file, err := getIndex(storePath)
+	if err != nil {
+		return nil, err
+	}
+	start, length, err := dataRange(storePath, file.version, file.index[key].offset)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Open(storePath)
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+	if _, err = fi.Seek(int64(start), io.SeekStart); err != nil {
+		return nil, err
+	}
+	record, err := readBytes(fi)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := crypto.NewStreamReader(io.LimitReader(fi, int64(length)-4-int64(len(record))), streamKey)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(stream)
+}
+
+func TestParseToken(t *testing.T) {
+	if _, err := ParseToken([]byte("KEEPO-GRANT-AAAA")); err == nil {
+		t.Errorf("expected a short token to fail")
+	}
+	if _, err := ParseToken([]byte("not a token")); err == nil {
+		t.Errorf("expected text without the prefix to fail")
+	}
+}
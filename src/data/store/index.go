@@ -0,0 +1,183 @@
+package store
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"keepo/src/crypto"
+	"sort"
+)
+
+/**
+ * Bound stores authenticate their header and index with a MAC under the store secret, so the
+ * sequence numbers entries are bound to cannot be rolled back together with their data. The MAC
+ * is checked when the store is opened with its secret and covers:
+ *
+ * header				- the header fields but the index MAC and merge witnesses, as fields
+ * data-key-count		- uint32
+ *
+ * data-key-length		- uint32
+ * data-key-value		- data-key-length bytes, in key order
+ * attributes			- the key's index attributes, as fields
+ * ...
+ *
+ * Data offsets are left out, the data is bound to its key and sequence number when sealed.
+ *
+ * Copies merged without their secret cannot be given a MAC, they hold a witness of the base and
+ * of each copy merged instead: its authenticated content with its MAC, or with its own witnesses.
+ * The merge is verified by merging the witnesses again, each copy having sealed no entry at an
+ * earlier sequence number than the base, and it takes a MAC when the store is next written with
+ * its secret.
+ *
+ * Stores opened with a grant token cannot check the MAC and rely on the binding of each entry.
+ */
+
+const indexPurpose = "keepo index"
+
+// witness fields, beside the index MAC or merge witnesses of the copy witnessed
+const witnessContentField uint16 = 1
+
+// indexContent encodes what the index MAC covers
+func (s *storeFile) indexContent() []byte {
+	var header fields
+	for _, candidate := range s.header {
+		if candidate.tag != indexMACField && candidate.tag != mergedIndexField {
+			header.add(candidate.tag, candidate.value)
+		}
+	}
+
+	keys := s.keys()
+	sort.Strings(keys)
+
+	var content bytes.Buffer
+	_ = writeFields(&content, header)
+	_ = binary.Write(&content, binary.LittleEndian, uint32(len(keys)))
+	for _, key := range keys {
+		_ = writeBytes(&content, []byte(key))
+		_ = writeFields(&content, s.attributes(key))
+	}
+	return content.Bytes()
+}
+
+// readIndexContent reads the header and index of a witnessed copy, without data offsets
+func readIndexContent(content []byte) (file *storeFile, err error) {
+	reader := bytes.NewReader(content)
+	file = newStoreFile()
+	if file.header, err = readFields(reader); err != nil {
+		return nil, InvalidFormatError("could not read witnessed header")
+	}
+
+	var count uint32
+	if err = binary.Read(reader, binary.LittleEndian, &count); err != nil {
+		return nil, InvalidFormatError("could not read witnessed index count")
+	}
+	for i := uint32(0); i < count; i++ {
+		key, err := readBytes(reader)
+		if err != nil {
+			return nil, InvalidFormatError("could not read a witnessed index key")
+		}
+		entry := &indexEntry{}
+		if entry.attributes, err = readFields(reader); err != nil {
+			return nil, InvalidFormatError("could not read witnessed index attributes")
+		}
+		file.index[string(key)] = entry
+	}
+	if reader.Len() > 0 {
+		return nil, InvalidFormatError("trailing bytes after witnessed index")
+	}
+	return file, nil
+}
+
+func indexMAC(content []byte, secret *[crypto.SecretSize]byte) []byte {
+	mac := hmac.New(sha256.New, secret[:])
+	mac.Write([]byte(indexPurpose))
+	mac.Write(content)
+	return mac.Sum(nil)
+}
+
+// authenticateIndex gives the store its index MAC, replacing any merge witnesses
+func (s *storeFile) authenticateIndex(secret *[crypto.SecretSize]byte) {
+	s.header.set(mergedIndexField, nil)
+	s.header.set(indexMACField, indexMAC(s.indexContent(), secret))
+}
+
+// verifyIndex checks the index MAC of a bound store, or the witnesses of a merge
+func (s *storeFile) verifyIndex(secret *[crypto.SecretSize]byte) error {
+	if s.header.get(storeIDField) == nil {
+		return nil
+	}
+	return verifyIndexContent(s.indexContent(), s.header, secret)
+}
+
+func verifyIndexContent(content []byte, authentication fields, secret *[crypto.SecretSize]byte) error {
+	if mac := authentication.get(indexMACField); mac != nil {
+		if !hmac.Equal(mac, indexMAC(content, secret)) {
+			return IndexVerificationFailedState
+		}
+		return nil
+	}
+
+	witnesses := authentication.getAll(mergedIndexField)
+	if len(witnesses) != 3 {
+		return IndexVerificationFailedState
+	}
+	copies := make([]*storeFile, len(witnesses))
+	for index, witness := range witnesses {
+		witnessed, err := decodeFields(witness)
+		if err != nil {
+			return InvalidFormatError("could not read a merge witness")
+		}
+		witnessedContent := witnessed.get(witnessContentField)
+		if err = verifyIndexContent(witnessedContent, witnessed, secret); err != nil {
+			return err
+		}
+		if copies[index], err = readIndexContent(witnessedContent); err != nil {
+			return err
+		}
+	}
+
+	base, ours, theirs := copies[0], copies[1], copies[2]
+	if !descendsFrom(base, ours) || !descendsFrom(base, theirs) {
+		return IndexVerificationFailedState
+	}
+	header, chosen, err := mergeIndex(base, ours, theirs)
+	if err != nil {
+		return IndexVerificationFailedState
+	}
+	merged := newStoreFile()
+	merged.header = header
+	for key, source := range chosen {
+		if source != nil {
+			merged.entry(key).attributes = source.attributes(key)
+		}
+	}
+	if !bytes.Equal(merged.indexContent(), content) {
+		return IndexVerificationFailedState
+	}
+	return nil
+}
+
+// descendsFrom tells whether a copy could have descended from the base, sequence numbers only grow
+func descendsFrom(base, file *storeFile) bool {
+	if decodeUint64(file.header.get(sequenceField)) < decodeUint64(base.header.get(sequenceField)) {
+		return false
+	}
+	for key := range base.index {
+		if _, ok := file.index[key]; ok && file.sequence(key) < base.sequence(key) {
+			return false
+		}
+	}
+	return true
+}
+
+// witness encodes the copy's index content with what authenticates it, for a merge without the secret
+func (s *storeFile) witness() []byte {
+	witnessed := fields{{witnessContentField, s.indexContent()}}
+	for _, candidate := range s.header {
+		if candidate.tag == indexMACField || candidate.tag == mergedIndexField {
+			witnessed.add(candidate.tag, candidate.value)
+		}
+	}
+	return encodeFields(witnessed)
+}
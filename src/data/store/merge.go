@@ -0,0 +1,408 @@
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"keepo/src/crypto"
+	"os"
+	"time"
+)
+
+/**
+ * Copies of one store share its store id and store secret, so an entry sealed in either opens
+ * in the other and copies are merged by taking each entry's sealed data as it is, with its index
+ * attributes, from the copy that changed it:
+ *
+ * - an entry changed in one copy since the base they descend from is taken from that copy
+ * - an entry cleared in one copy and left alone in the other is cleared
+ * - an entry changed in both, or changed in one and cleared in the other, is a conflict
+ *
+ * Merging without the secret, as git's merge driver does, an entry changed is one sealed since
+ * the base and conflicts go to the copy that modified the entry last. Merging with the secret
+ * entries are compared by value and metadata, and conflicts are resolved by the caller.
+ *
+ * Header fields are merged the same way, one field at a time and grants by id, and the sequence
+ * number is the higher of the two so entries sealed later take new numbers. The sealed secret,
+ * its factors and the cipher are taken together from one copy, so the merge unlocks as it does,
+ * and copies that both changed them are not merged. Entries taken from
+ * one copy are wrapped only for the grants that copy held, a grant added in the other reads them
+ * once they are next set.
+ */
+
+// Side names the copy of a store a merged entry is taken from
+type Side string
+
+const (
+	Ours   Side = "ours"
+	Theirs Side = "theirs"
+)
+
+// Conflict is a key both copies changed since their base, one of them possibly clearing it
+type Conflict struct {
+	Key string `json:"key"`
+	// Ours and Theirs are the metadata of each copy's entry, nil when that copy cleared the key
+	Ours           *Metadata `json:"ours,omitempty"`
+	Theirs         *Metadata `json:"theirs,omitempty"`
+	OursModified   time.Time `json:"ours_modified"`
+	TheirsModified time.Time `json:"theirs_modified"`
+	Resolution     Side      `json:"resolution"`
+}
+
+// PreferNewest resolves a conflict to the copy that modified the entry last, a key cleared in
+// one copy is kept from the other as when it was cleared is not recorded
+func PreferNewest(conflict Conflict) Side {
+	if conflict.Theirs != nil && (conflict.Ours == nil || conflict.TheirsModified.After(conflict.OursModified)) {
+		return Theirs
+	}
+	return Ours
+}
+
+// MergeResult lists the keys of a merged store and the conflicts resolved making it
+type MergeResult struct {
+	Keys      []string   `json:"keys"`
+	Conflicts []Conflict `json:"conflicts"`
+}
+
+// MergeStoreFiles merges the copies of a store at ours and theirs, unlocking them and their base
+// with the secret, and writes the result to out with the same store secret. Keys changed in both
+// copies are passed to resolve. Copies of different stores fail with UnrelatedStoresState.
+func MergeStoreFiles(base, ours, theirs, out string, secret *Secret, resolve func(conflict Conflict) Side) (result MergeResult, err error) {
+	paths := []string{base, ours, theirs}
+	files := make([]*storeFile, len(paths))
+	var unsealedSecret *crypto.Buffer
+	for index, path := range paths {
+		file, storeSecret, err := openStoreFile(path, secret, false)
+		if err != nil {
+			return result, err
+		}
+		defer storeSecret.Destroy()
+
+		files[index] = file
+		if index == 0 {
+			unsealedSecret = storeSecret
+		}
+		storeID := file.header.get(storeIDField)
+		if file.version != formatVersion || storeID == nil || !bytes.Equal(storeID, files[0].header.get(storeIDField)) ||
+			!bytes.Equal(storeSecret.Bytes(), unsealedSecret.Bytes()) {
+			return result, UnrelatedStoresState
+		}
+	}
+
+	header, err := mergeHeader(files[0].header, files[1].header, files[2].header)
+	if err != nil {
+		return result, err
+	}
+
+	digests := make([]map[string][]byte, len(files))
+	for index, file := range files {
+		digests[index] = make(map[string][]byte, len(file.index))
+		for _, key := range file.keys() {
+			if digests[index][key], err = entryDigest(paths[index], file, key, unsealedSecret.Key()); err != nil {
+				return result, err
+			}
+		}
+	}
+	baseDigests, oursFile, oursDigests, theirsFile, theirsDigests := digests[0], files[1], digests[1], files[2], digests[2]
+
+	result = MergeResult{Keys: []string{}, Conflicts: []Conflict{}}
+	chosen := make(map[string]*storeFile)
+	for _, key := range append(oursFile.keys(), theirsFile.keys()...) {
+		if _, ok := chosen[key]; ok {
+			continue
+		}
+
+		oursDigest, inOurs := oursDigests[key]
+		theirsDigest, inTheirs := theirsDigests[key]
+		baseDigest, inBase := baseDigests[key]
+		oursChanged := inOurs != inBase || !bytes.Equal(oursDigest, baseDigest)
+		theirsChanged := inTheirs != inBase || !bytes.Equal(theirsDigest, baseDigest)
+
+		side := Ours
+		switch {
+		case inOurs == inTheirs && bytes.Equal(oursDigest, theirsDigest):
+		case !oursChanged:
+			side = Theirs
+		case theirsChanged:
+			conflict := Conflict{Key: key, OursModified: oursFile.modified(key), TheirsModified: theirsFile.modified(key)}
+			if conflict.Ours, err = mergeMetadata(ours, oursFile, key, unsealedSecret.Key()); err != nil {
+				return result, err
+			}
+			if conflict.Theirs, err = mergeMetadata(theirs, theirsFile, key, unsealedSecret.Key()); err != nil {
+				return result, err
+			}
+			side = resolve(conflict)
+			conflict.Resolution = side
+			result.Conflicts = append(result.Conflicts, conflict)
+		}
+
+		chosen[key] = map[Side]*storeFile{Ours: oursFile, Theirs: theirsFile}[side]
+		if _, ok := chosen[key].index[key]; !ok {
+			chosen[key] = nil
+			continue
+		}
+		result.Keys = append(result.Keys, key)
+	}
+
+	return result, writeMerged(out, header, chosen, map[*storeFile]string{oursFile: ours, theirsFile: theirs}, unsealedSecret)
+}
+
+// MergeStores merges the store file at theirs into the one at ours without their secret, as
+// git's merge driver does. The merged store holds witnesses of the copies it was merged from in
+// place of an index MAC, so copies without the base they descend from, empty or absent when they
+// were started apart, are not merged. Copies of different stores fail with UnrelatedStoresState.
+func MergeStores(base, ours, theirs string) (err error) {
+	oursFile, err := getIndex(ours)
+	if err != nil {
+		return err
+	}
+	theirsFile, err := getIndex(theirs)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(base)
+	if err != nil || info.Size() == 0 {
+		return UnrelatedStoresState
+	}
+	baseFile, err := getIndex(base)
+	if err != nil {
+		return err
+	}
+
+	storeID := oursFile.header.get(storeIDField)
+	for _, file := range []*storeFile{baseFile, oursFile, theirsFile} {
+		if file.version != formatVersion || storeID == nil || !bytes.Equal(storeID, file.header.get(storeIDField)) {
+			return UnrelatedStoresState
+		}
+	}
+
+	header, chosen, err := mergeIndex(baseFile, oursFile, theirsFile)
+	if err != nil {
+		return err
+	}
+	for _, file := range []*storeFile{baseFile, oursFile, theirsFile} {
+		header.add(mergedIndexField, file.witness())
+	}
+	return writeMerged(ours, header, chosen, map[*storeFile]string{oursFile: ours, theirsFile: theirs}, nil)
+}
+
+// mergeIndex merges the headers of the copies and chooses the copy each entry is taken from
+// without the secret, as merges witnessed are verified by merging them again
+func mergeIndex(base, ours, theirs *storeFile) (header fields, chosen map[string]*storeFile, err error) {
+	chosen = make(map[string]*storeFile)
+	for _, key := range append(ours.keys(), theirs.keys()...) {
+		chosen[key] = mergeEntry(base, ours, theirs, key)
+	}
+	header, err = mergeHeader(base.header, ours.header, theirs.header)
+	return header, chosen, err
+}
+
+// mergeEntry chooses the copy the key's entry is taken from without the secret, nil when it is
+// cleared
+func mergeEntry(base, ours, theirs *storeFile, key string) *storeFile {
+	_, inOurs := ours.index[key]
+	_, inTheirs := theirs.index[key]
+	oursChanged, theirsChanged := changedSince(base, ours, key), changedSince(base, theirs, key)
+
+	switch {
+	case inOurs && inTheirs:
+		if !oursChanged || (theirsChanged && theirs.modified(key).After(ours.modified(key))) {
+			return theirs
+		}
+		return ours
+	case inOurs && oursChanged:
+		return ours
+	case inTheirs && theirsChanged:
+		return theirs
+	}
+	return nil
+}
+
+// changedSince tells whether the key's entry was sealed, or added, since the base. Every seal
+// takes a new sequence number, so equal numbers are the same entry.
+func changedSince(base, file *storeFile, key string) bool {
+	if _, ok := base.index[key]; !ok {
+		return true
+	}
+	return base.sequence(key) != file.sequence(key)
+}
+
+// writeMerged writes the entries chosen, copying each from the copy chosen, nil leaves it out.
+// The index is authenticated with the store secret when it is given.
+func writeMerged(out string, header fields, chosen map[string]*storeFile, sources map[*storeFile]string, secret *crypto.Buffer) error {
+	merged := newStoreFile()
+	merged.header = header
+	merged.secret = secret
+
+	dataMap := make(map[string]*entryData)
+	for key, source := range chosen {
+		if source == nil {
+			continue
+		}
+		start, length, err := dataRange(sources[source], source.version, source.index[key].offset)
+		if err != nil {
+			return err
+		}
+		merged.entry(key).attributes = source.attributes(key)
+		dataMap[key] = &entryData{source: sources[source], start: start, length: length}
+	}
+	return set(out, merged, dataMap)
+}
+
+// unlockFields record how the store is unlocked, the secret is sealed for the factors recorded
+// so they are merged together
+var unlockFields = []uint16{secretField, factorsField, cipherField}
+
+// mergeHeader takes each field from the copy that changed it, ours when both did. How the store
+// is unlocked is taken whole from one copy, both changing it is UnlockConflictState.
+func mergeHeader(base, ours, theirs fields) (fields, error) {
+	oursUnlock, theirsUnlock := differ(base, ours, unlockFields), differ(base, theirs, unlockFields)
+	if oursUnlock && theirsUnlock && differ(ours, theirs, unlockFields) {
+		return nil, UnlockConflictState
+	}
+
+	merged := append(fields{}, ours...)
+	for _, candidate := range append(append(fields{}, ours...), theirs...) {
+		tag := candidate.tag
+		if tag == grantField || tag == sequenceField || tag == indexMACField || tag == mergedIndexField {
+			continue
+		}
+		if unlocks(tag) {
+			if !oursUnlock {
+				merged.set(tag, theirs.get(tag))
+			}
+			continue
+		}
+		if bytes.Equal(ours.get(tag), base.get(tag)) {
+			merged.set(tag, theirs.get(tag))
+		}
+	}
+
+	sequence := decodeUint64(ours.get(sequenceField))
+	if theirsSequence := decodeUint64(theirs.get(sequenceField)); theirsSequence > sequence {
+		sequence = theirsSequence
+	}
+	merged.set(sequenceField, encodeUint64(sequence))
+
+	// the merged index is authenticated afresh
+	merged.set(indexMACField, nil)
+	merged.set(mergedIndexField, nil)
+
+	merged.set(grantField, nil)
+	for _, grant := range mergeGrants(base.getAll(grantField), ours.getAll(grantField), theirs.getAll(grantField)) {
+		merged.add(grantField, grant)
+	}
+	return merged, nil
+}
+
+func unlocks(tag uint16) bool {
+	for _, unlockField := range unlockFields {
+		if tag == unlockField {
+			return true
+		}
+	}
+	return false
+}
+
+// differ tells whether two copies differ in any of the fields
+func differ(first, second fields, tags []uint16) bool {
+	for _, tag := range tags {
+		if !bytes.Equal(first.get(tag), second.get(tag)) {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeGrants keeps the grants both copies hold and those one added, a grant either revoked
+// stays revoked
+func mergeGrants(base, ours, theirs [][]byte) (merged [][]byte) {
+	holds := func(grants [][]byte, grant []byte) bool {
+		for _, candidate := range grants {
+			if bytes.Equal(candidate[:grantIDSize], grant[:grantIDSize]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, grant := range ours {
+		if holds(theirs, grant) || !holds(base, grant) {
+			merged = append(merged, grant)
+		}
+	}
+	for _, grant := range theirs {
+		if !holds(ours, grant) && !holds(base, grant) {
+			merged = append(merged, grant)
+		}
+	}
+	return merged
+}
+
+// entryDigest hashes an entry's value and metadata, so entries are compared without keeping
+// their values
+func entryDigest(storePath string, file *storeFile, key string, unsealedSecret *[crypto.SecretSize]byte) ([]byte, error) {
+	valueHash, metadata, err := hashEntry(storePath, file, key, unsealedSecret)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(encodeEntry(&Entry{Value: valueHash, Metadata: metadata}))
+	return digest[:], nil
+}
+
+// hashEntry hashes an entry's value, streamed values as they are read, giving its metadata too
+func hashEntry(storePath string, file *storeFile, key string, unsealedSecret *[crypto.SecretSize]byte) ([]byte, Metadata, error) {
+	valueHash := sha256.New()
+	if !file.streamed(key) {
+		entry, err := readEntry(storePath, file, key, unsealedSecret)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		valueHash.Write(entry.Value)
+		crypto.Wipe(entry.Value)
+		return valueHash.Sum(nil), entry.Metadata, nil
+	}
+
+	fi, stream, entry, err := openStreamedValue(storePath, file, key, unsealedSecret)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	_, err = io.Copy(valueHash, stream)
+	crypto.Wipe(entry.streamKey)
+	if closeErr := fi.Close(); err == nil {
+		err = closeErr
+	}
+	return valueHash.Sum(nil), entry.Metadata, err
+}
+
+// mergeMetadata reads the metadata of a copy's entry, nil when the copy has no entry for the key
+func mergeMetadata(storePath string, file *storeFile, key string, unsealedSecret *[crypto.SecretSize]byte) (*Metadata, error) {
+	if _, ok := file.index[key]; !ok {
+		return nil, nil
+	}
+	entry, err := readRecord(storePath, file, key, unsealedSecret)
+	if err != nil {
+		return nil, err
+	}
+	crypto.Wipe(entry.Value)
+	crypto.Wipe(entry.streamKey)
+	return &entry.Metadata, nil
+}
+
+// modified gives when the key's entry was last set, entries set before this was recorded fall
+// back to their last rotation
+func (s *storeFile) modified(key string) time.Time {
+	attributes := s.attributes(key)
+	if modified := attributes.get(modifiedAttribute); modified != nil {
+		return time.Unix(0, int64(decodeUint64(modified)))
+	}
+	if rotated := attributes.get(rotatedAttribute); rotated != nil {
+		return time.Unix(int64(decodeUint64(rotated)), 0)
+	}
+	return time.Time{}
+}
+
+// setModified records when the key's entry was last set, to order changes made in different copies
+func (s *storeFile) setModified(key string, at time.Time) {
+	s.entry(key).attributes.set(modifiedAttribute, encodeUint64(uint64(at.UnixNano())))
+}
@@ -0,0 +1,243 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"testing"
+)
+
+func TestMergeStores(t *testing.T) {
+
+	path, base, theirs := ".", "merge-base", "merge-theirs"
+	for _, name := range []string{path, base, theirs} {
+		cleanup(name, t)
+	}
+
+	secret := func() *Secret { return NewSecret([]byte("password01"), nil) }
+	for key, value := range map[string]string{"both": "base", "cleared": "base", "kept": "base"} {
+		if err := SetMapValue(path, key, value, secret()); err != nil {
+			t.Errorf("could not set map value '%q'", err)
+		}
+	}
+	copyStore(path, base, t)
+	copyStore(path, theirs, t)
+
+	fmt.Println("test changes in both copies are merged entry by entry")
+	for key, value := range map[string]string{"both": "theirs", "kept": "theirs", "added": "theirs"} {
+		if err := SetMapValue(theirs, key, value, secret()); err != nil {
+			t.Errorf("could not set map value '%q'", err)
+		}
+	}
+	if err := SetMapStream(theirs, "streamed", bytes.NewReader([]byte("stream")), secret(), nil); err != nil {
+		t.Errorf("could not set map stream '%q'", err)
+	}
+	if err := SetMapValue(path, "both", "ours", secret()); err != nil {
+		t.Errorf("could not set map value '%q'", err)
+	}
+	if err := ClearMapValue(path, "cleared", secret()); err != nil {
+		t.Errorf("could not clear map value '%q'", err)
+	}
+
+	err := MergeStores(GetStorePath(base), GetStorePath(path), GetStorePath(theirs))
+	if err != nil {
+		t.Fatalf("could not merge stores '%q'", err)
+	}
+
+	cases := []struct {
+		key  string
+		want string
+	}{
+		{"both", "ours"},
+		{"kept", "theirs"},
+		{"added", "theirs"},
+		{"streamed", "stream"},
+	}
+	for _, c := range cases {
+		got, err := GetMapValue(path, c.key, secret())
+		if err != nil || string(got) != c.want {
+			t.Errorf("Expected %q, received %q for %s '%q'", c.want, got, c.key, err)
+		}
+	}
+	if _, err = GetMapValue(path, "cleared", secret()); err != ValueAbsentState {
+		t.Errorf("expected the cleared key to stay cleared but got '%q'", err)
+	}
+
+	fmt.Println("test the merged store takes new sequence numbers")
+	if err = SetMapValue(path, "later", "value", secret()); err != nil {
+		t.Errorf("could not set map value '%q'", err)
+	}
+	if got, err := GetMapValue(path, "added", secret()); err != nil || string(got) != "theirs" {
+		t.Errorf("Expected %q, received %q '%q'", "theirs", got, err)
+	}
+
+	fmt.Println("test a merge rolling entries back to an earlier copy fails verification")
+	copyStore(path, "merge-rolled", t)
+	if err = MergeStores(GetStorePath(path), GetStorePath("merge-rolled"), GetStorePath(base)); err != nil {
+		t.Fatalf("could not merge stores '%q'", err)
+	}
+	if _, err = GetMapValue("merge-rolled", "both", secret()); err != IndexVerificationFailedState {
+		t.Errorf("Expected %q, received %q", IndexVerificationFailedState, err)
+	}
+	cleanup("merge-rolled", t)
+
+	fmt.Println("test stores started apart are not merged")
+	cleanup(theirs, t)
+	if err = SetMapValue(theirs, "other", "value", secret()); err != nil {
+		t.Errorf("could not set map value '%q'", err)
+	}
+	err = MergeStores(GetStorePath(base), GetStorePath(path), GetStorePath(theirs))
+	if err != UnrelatedStoresState {
+		t.Errorf("expected unrelated stores to fail but got '%q'", err)
+	}
+
+	for _, name := range []string{path, base, theirs} {
+		cleanup(name, t)
+	}
+}
+
+func TestMergeStoreFiles(t *testing.T) {
+
+	path, base, theirs, out := ".", "merge-base", "merge-theirs", "merge-out"
+	for _, name := range []string{path, base, theirs, out} {
+		cleanup(name, t)
+	}
+
+	secret := func() *Secret { return NewSecret([]byte("password01"), nil) }
+	for key, value := range map[string]string{"both": "base", "same": "base", "cleared": "base", "kept": "base"} {
+		if err := SetMapValue(path, key, value, secret()); err != nil {
+			t.Errorf("could not set map value '%q'", err)
+		}
+	}
+	copyStore(path, base, t)
+	copyStore(path, theirs, t)
+
+	for key, value := range map[string]string{"both": "theirs", "same": "changed", "added": "theirs"} {
+		if err := SetMapValue(theirs, key, value, secret()); err != nil {
+			t.Errorf("could not set map value '%q'", err)
+		}
+	}
+	if err := ClearMapValue(theirs, "cleared", secret()); err != nil {
+		t.Errorf("could not clear map value '%q'", err)
+	}
+	for key, value := range map[string]string{"both": "ours", "same": "changed", "cleared": "ours"} {
+		if err := SetMapValue(path, key, value, secret()); err != nil {
+			t.Errorf("could not set map value '%q'", err)
+		}
+	}
+
+	merge := func(resolve func(conflict Conflict) Side) MergeResult {
+		result, err := MergeStoreFiles(GetStorePath(base), GetStorePath(path), GetStorePath(theirs), GetStorePath(out), secret(), resolve)
+		if err != nil {
+			t.Fatalf("could not merge store files '%q'", err)
+		}
+		return result
+	}
+
+	fmt.Println("test conflicts are resolved by the newest change")
+	result := merge(PreferNewest)
+	if len(result.Conflicts) != 2 || len(result.Keys) != 5 {
+		t.Errorf("expected two conflicts and five keys but got %v", result)
+	}
+	cases := []struct {
+		key  string
+		want string
+	}{
+		{"both", "ours"},
+		{"same", "changed"},
+		{"cleared", "ours"},
+		{"kept", "base"},
+		{"added", "theirs"},
+	}
+	for _, c := range cases {
+		got, err := GetMapValue(out, c.key, secret())
+		if err != nil || string(got) != c.want {
+			t.Errorf("Expected %q, received %q for %s '%q'", c.want, got, c.key, err)
+		}
+	}
+
+	fmt.Println("test conflicts are resolved as the caller chooses")
+	merge(func(conflict Conflict) Side {
+		if conflict.Key == "cleared" && (conflict.Ours == nil || conflict.Theirs != nil) {
+			t.Errorf("expected theirs alone to have cleared the key but got %v", conflict)
+		}
+		return Theirs
+	})
+	if got, err := GetMapValue(out, "both", secret()); err != nil || string(got) != "theirs" {
+		t.Errorf("Expected %q, received %q '%q'", "theirs", got, err)
+	}
+	if _, err := GetMapValue(out, "cleared", secret()); err != ValueAbsentState {
+		t.Errorf("expected the cleared key to be cleared but got '%q'", err)
+	}
+
+	fmt.Println("test a wrong secret does not merge")
+	_, err := MergeStoreFiles(GetStorePath(base), GetStorePath(path), GetStorePath(theirs), GetStorePath(out),
+		NewSecret([]byte("password02"), nil), PreferNewest)
+	if err != AuthenticationFailedState {
+		t.Errorf("expected authentication error, but got '%q'", err)
+	}
+
+	for _, name := range []string{path, base, theirs, out} {
+		cleanup(name, t)
+	}
+}
+
+func TestMergeUnlocking(t *testing.T) {
+
+	path, base, theirs := ".", "merge-base", "merge-theirs"
+	for _, name := range []string{path, base, theirs} {
+		cleanup(name, t)
+	}
+
+	if err := SetMapValue(path, "key", "base", NewSecret([]byte("password01"), nil)); err != nil {
+		t.Errorf("could not set map value '%q'", err)
+	}
+	shares, err := SplitStoreSecret(path, NewSecret([]byte("password01"), nil), 3, 2)
+	if err != nil {
+		t.Fatalf("could not split store secret '%q'", err)
+	}
+	copyStore(path, base, t)
+	copyStore(path, theirs, t)
+
+	fmt.Println("test copies that both changed how the store is unlocked are not merged")
+	if err = RecoverStore(path, shares[:2], NewSecret([]byte("password02"), nil)); err != nil {
+		t.Errorf("could not recover store '%q'", err)
+	}
+	keyFileSecret := func() *Secret { return NewSecret([]byte("password01"), []byte("key file")) }
+	if err = SetRequiredFactors(theirs, keyFileSecret(), PassphraseFactor|KeyFileFactor); err != nil {
+		t.Errorf("could not set required factors '%q'", err)
+	}
+	err = MergeStores(GetStorePath(base), GetStorePath(path), GetStorePath(theirs))
+	if err != UnlockConflictState {
+		t.Errorf("Expected %q, received %q", UnlockConflictState, err)
+	}
+
+	fmt.Println("test the copy that changed how the store is unlocked gives the merge its secret")
+	copyStore(base, path, t)
+	if err = SetMapValue(path, "ours", "ours", NewSecret([]byte("password01"), nil)); err != nil {
+		t.Errorf("could not set map value '%q'", err)
+	}
+	if err = MergeStores(GetStorePath(base), GetStorePath(path), GetStorePath(theirs)); err != nil {
+		t.Fatalf("could not merge stores '%q'", err)
+	}
+	if got, err := GetMapValue(path, "ours", keyFileSecret()); err != nil || string(got) != "ours" {
+		t.Errorf("Expected %q, received %q '%q'", "ours", got, err)
+	}
+	if _, err = GetMapValue(path, "ours", NewSecret([]byte("password01"), nil)); err == nil {
+		t.Errorf("expected the merge to require the key file")
+	}
+
+	for _, name := range []string{path, base, theirs} {
+		cleanup(name, t)
+	}
+}
+
+func copyStore(from, to string, t *testing.T) {
+	contents, err := ioutil.ReadFile(GetStorePath(from))
+	if err == nil {
+		err = ioutil.WriteFile(GetStorePath(to), contents, 0600)
+	}
+	if err != nil {
+		t.Fatalf("could not copy store '%q'", err)
+	}
+}
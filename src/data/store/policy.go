@@ -0,0 +1,240 @@
+package store
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"io"
+	"keepo/src/crypto"
+	"keepo/src/strength"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// DefaultMinStrength is the least strength of a store's values unless its policy sets another
+const DefaultMinStrength = 3
+
+// Policy is the store's default max age and whether expired values are refused, the least
+// strength of the values set and whether weaker ones are rejected or only warned of, and the
+// copies kept of the store before it is replaced
+type Policy struct {
+	MaxAge        Age  `json:"max_age,omitempty"`
+	RefuseExpired bool `json:"refuse_expired"`
+	MinStrength   int  `json:"min_strength"`
+	RejectWeak    bool `json:"reject_weak"`
+	Backups       int  `json:"backups"`
+}
+
+// GetPolicy reads the store's policy from its header, no secret is needed
+func GetPolicy(path string) (policy Policy, err error) {
+	file, err := getIndex(GetStorePath(path))
+	if err != nil {
+		return policy, err
+	}
+	return file.policy(), nil
+}
+
+// SetPolicy records the store's policy. Entries whose rotation was never recorded are taken as
+// rotated now, so a new max age does not expire them at once.
+func SetPolicy(path string, secret *Secret, policy Policy) (err error) {
+	if policy.MinStrength < strength.MinScore || policy.MinStrength > strength.MaxScore {
+		return InvalidFormatError("the least strength runs from 0 to 4")
+	}
+	if policy.Backups < 0 {
+		return InvalidFormatError("the copies kept cannot be fewer than none")
+	}
+
+	storePath, file, storeSecret, err := openStore(path, secret, false)
+	if err != nil {
+		return err
+	}
+	defer storeSecret.Destroy()
+	unsealedSecret := storeSecret.Key()
+
+	file.header.set(policyMaxAgeField, nil)
+	if policy.MaxAge > 0 {
+		file.header.set(policyMaxAgeField, encodeUint64(uint64(policy.MaxAge)))
+		for _, key := range file.keys() {
+			if file.attributes(key).get(rotatedAttribute) == nil {
+				file.setRotated(key, time.Now())
+			}
+		}
+	}
+	file.header.set(policyRefuseField, nil)
+	if policy.RefuseExpired {
+		file.header.set(policyRefuseField, []byte{1})
+	}
+	file.header.set(policyStrengthField, nil)
+	if policy.MinStrength != DefaultMinStrength {
+		file.header.set(policyStrengthField, []byte{byte(policy.MinStrength)})
+	}
+	file.header.set(policyRejectField, nil)
+	if policy.RejectWeak {
+		file.header.set(policyRejectField, []byte{1})
+	}
+	file.header.set(policyBackupsField, nil)
+	if policy.Backups != DefaultBackupRetention {
+		file.header.set(policyBackupsField, encodeUint64(uint64(policy.Backups)))
+	}
+
+	dataMap, err := loadDataMap(storePath, file, unsealedSecret, func(key string) bool { return false })
+	if err != nil {
+		return err
+	}
+	err = set(storePath, file, dataMap)
+	if err != nil {
+		return err
+	}
+	return audit(storePath, file, unsealedSecret, "policy")
+}
+
+// ValueCheck is how strong a value is and how often it appears in a breach dataset
+type ValueCheck struct {
+	Score    int    `json:"score"`
+	Warning  string `json:"warning,omitempty"`
+	Breaches int    `json:"breaches,omitempty"`
+	// Weak is set when the value is weaker than the store's policy allows or has been breached
+	Weak bool `json:"weak"`
+}
+
+// CheckValue estimates the strength of a value about to be set, the key and store names count as
+// guessable, and looks it up in the breach dataset when one is given. A weak value fails with
+// WeakValueError when the store's policy rejects them, a store yet to be created warns.
+func CheckValue(path, key string, value []byte, breaches string) (check ValueCheck, err error) {
+	policy := Policy{MinStrength: DefaultMinStrength, Backups: DefaultBackupRetention}
+	if file, err := getIndex(GetStorePath(path)); err == nil {
+		policy = file.policy()
+	}
+
+	check, err = checkValue(policy, path, key, value, breaches)
+	if err == nil && check.Weak && policy.RejectWeak {
+		return check, WeakValueError(key, check.Warning)
+	}
+	return check, err
+}
+
+// ValueReport is the check of one of a store's values, values that are equal have equal digests
+type ValueReport struct {
+	Key string `json:"key"`
+	ValueCheck
+	Digest []byte `json:"-"`
+}
+
+// CheckValues checks each of the store's values short enough to be a password, values that are
+// longer or not text are skipped. Values are digested with the key given rather than kept, so
+// reuse is found across stores checked with the same key. Reading the values is audited.
+func CheckValues(path string, secret *Secret, breaches string, digestKey []byte) (reports []ValueReport, err error) {
+	storePath, file, storeSecret, err := openStoreReader(path, secret)
+	if err != nil {
+		return nil, err
+	}
+	defer storeSecret.Destroy()
+	unsealedSecret := storeSecret.Key()
+
+	reports = []ValueReport{}
+	var checked []string
+	for _, key := range file.keys() {
+		value, err := readCheckedValue(storePath, file, key, unsealedSecret)
+		if err == GrantDeniedState {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if value == nil {
+			continue
+		}
+
+		report := ValueReport{Key: key, Digest: digestValue(digestKey, value)}
+		report.ValueCheck, err = checkValue(file.policy(), path, key, value, breaches)
+		crypto.Wipe(value)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+		checked = append(checked, key)
+	}
+	if len(checked) == 0 {
+		return reports, nil
+	}
+	return reports, audit(storePath, file, unsealedSecret, "check", checked...)
+}
+
+// maxCheckedSize bounds the values checked, longer ones are keys or files rather than passwords
+const maxCheckedSize = 1024
+
+// readCheckedValue reads the value when it is text no longer than maxCheckedSize, nil otherwise
+func readCheckedValue(storePath string, file *storeFile, key string, unsealedSecret *[crypto.SecretSize]byte) ([]byte, error) {
+	var value []byte
+	if file.streamed(key) {
+		fi, stream, entry, err := openStreamedValue(storePath, file, key, unsealedSecret)
+		if err != nil {
+			return nil, err
+		}
+		value = make([]byte, maxCheckedSize+1)
+		n, err := io.ReadFull(stream, value)
+		crypto.Wipe(entry.streamKey)
+		if closeErr := fi.Close(); err == nil || err == io.ErrUnexpectedEOF || err == io.EOF {
+			err = closeErr
+		}
+		if err != nil {
+			crypto.Wipe(value)
+			return nil, err
+		}
+		value = value[:n]
+	} else {
+		entry, err := readEntry(storePath, file, key, unsealedSecret)
+		if err != nil {
+			return nil, err
+		}
+		value = entry.Value
+	}
+
+	if len(value) > maxCheckedSize || !utf8.Valid(value) {
+		crypto.Wipe(value)
+		return nil, nil
+	}
+	return value, nil
+}
+
+func checkValue(policy Policy, path, key string, value []byte, breaches string) (check ValueCheck, err error) {
+	result := strength.Estimate(string(value), strings.TrimSuffix(path, Extension), key)
+	check.Score, check.Warning = result.Score, result.Warning
+	if len(breaches) > 0 {
+		if check.Breaches, err = strength.BreachCount(breaches, value); err != nil {
+			return check, err
+		}
+	}
+	if check.Breaches > 0 {
+		check.Warning = "it appears in known breaches"
+	}
+
+	check.Weak = check.Score < policy.MinStrength || check.Breaches > 0
+	if check.Weak && len(check.Warning) == 0 {
+		check.Warning = "it is weaker than the store's policy allows"
+	}
+	return check, nil
+}
+
+func digestValue(digestKey, value []byte) []byte {
+	mac := hmac.New(sha256.New, digestKey)
+	mac.Write(value)
+	return mac.Sum(nil)
+}
+
+func (s *storeFile) policy() Policy {
+	policy := Policy{
+		MaxAge:        Age(decodeUint64(s.header.get(policyMaxAgeField))),
+		RefuseExpired: s.header.get(policyRefuseField) != nil,
+		MinStrength:   DefaultMinStrength,
+		RejectWeak:    s.header.get(policyRejectField) != nil,
+		Backups:       DefaultBackupRetention,
+	}
+	if backups := s.header.get(policyBackupsField); backups != nil {
+		policy.Backups = int(decodeUint64(backups))
+	}
+	if minStrength := s.header.get(policyStrengthField); len(minStrength) == 1 {
+		policy.MinStrength = int(minStrength[0])
+	}
+	return policy
+}
@@ -0,0 +1,73 @@
+package store
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestValuePolicy(t *testing.T) {
+
+	path := "."
+	cleanup(path, t)
+
+	secret := func() *Secret { return NewSecret([]byte("password01"), nil) }
+	err := SetMapValue(path, "db", "x7$Kq!9zLm#2", secret())
+	if err != nil {
+		t.Errorf("could not set map value '%q'", err)
+	}
+
+	fmt.Println("test weak values are warned of by default")
+	check, err := CheckValue(path, "db", []byte("password1"), "")
+	if err != nil || !check.Weak || len(check.Warning) == 0 {
+		t.Errorf("expected a warning for a weak value but got %v, '%q'", check, err)
+	}
+	check, err = CheckValue(path, "db", []byte("db2021"), "")
+	if err != nil || !check.Weak {
+		t.Errorf("expected the key name to weaken the value but got %v, '%q'", check, err)
+	}
+
+	fmt.Println("test weak values are rejected by policy")
+	err = SetPolicy(path, secret(), Policy{MinStrength: 4, RejectWeak: true})
+	if err != nil {
+		t.Errorf("could not set policy '%q'", err)
+	}
+	policy, err := GetPolicy(path)
+	if err != nil || policy.MinStrength != 4 || !policy.RejectWeak {
+		t.Errorf("expected the policy to be kept but got %v, '%q'", policy, err)
+	}
+	_, err = CheckValue(path, "db", []byte("password1"), "")
+	if state, ok := err.(*State); !ok || state.Code() != 22 {
+		t.Errorf("expected a weak value to be rejected but got '%q'", err)
+	}
+	check, err = CheckValue(path, "db", []byte("correct horse battery staple"), "")
+	if err != nil || check.Weak {
+		t.Errorf("expected a strong value to be accepted but got %v, '%q'", check, err)
+	}
+
+	fmt.Println("test values are checked together and reuse shows in their digests")
+	for key, value := range map[string]string{"mail": "password1", "web": "password1", "key": string(make([]byte, 2048))} {
+		if err = SetMapValue(path, key, value, secret()); err != nil {
+			t.Errorf("could not set map value '%q'", err)
+		}
+	}
+	reports, err := CheckValues(path, secret(), "", []byte("digest key"))
+	if err != nil || len(reports) != 3 {
+		t.Errorf("expected three values to be checked but got %v, '%q'", reports, err)
+	}
+	digests := make(map[string]string)
+	for _, report := range reports {
+		digests[report.Key] = string(report.Digest)
+		if (report.Key == "db") == report.Weak {
+			t.Errorf("expected only 'db' to be strong but got %v", report)
+		}
+	}
+	if digests["mail"] != digests["web"] || digests["mail"] == digests["db"] {
+		t.Errorf("expected equal values alone to have equal digests")
+	}
+
+	if err = SetPolicy(path, secret(), Policy{MinStrength: 5}); err == nil {
+		t.Errorf("expected a strength above 4 to fail")
+	}
+
+	cleanup(path, t)
+}
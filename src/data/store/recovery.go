@@ -0,0 +1,94 @@
+package store
+
+import (
+	"keepo/src/crypto"
+	"sort"
+)
+
+// SplitStoreSecret unlocks the store and splits its secret into shares, any threshold of which
+// recover the store without its passphrase or key file
+func SplitStoreSecret(path string, secret *Secret, shares, threshold int) ([]crypto.Share, error) {
+	storePath, file, storeSecret, err := openStore(path, secret, false)
+	if err != nil {
+		return nil, err
+	}
+	defer storeSecret.Destroy()
+
+	split, err := crypto.SplitSecret(storeSecret.Bytes(), shares, threshold)
+	if err != nil {
+		return nil, err
+	}
+	return split, audit(storePath, file, storeSecret.Key(), "split")
+}
+
+// RecoverStore rebuilds the store secret from shares and reseals it with the factors of the new
+// secret, which replace those the store required
+func RecoverStore(path string, shares []crypto.Share, secret *Secret) (err error) {
+	storePath := GetStorePath(path)
+	file, err := getIndex(storePath)
+	if err != nil {
+		return err
+	}
+
+	combined, err := crypto.CombineShares(shares)
+	if err != nil {
+		return err
+	}
+	storeSecret, err := crypto.NewBufferFrom(combined)
+	if err != nil {
+		return err
+	}
+	defer storeSecret.Destroy()
+
+	if storeSecret.Len() != crypto.SecretSize || !verifyStoreSecret(storePath, file, storeSecret.Key()) {
+		return RecoveryFailedState
+	}
+
+	factors := secret.Factors()
+	if factors&PassphraseFactor == 0 && factors&KeyFileFactor == 0 {
+		return FactorMissingError(PassphraseFactor)
+	}
+	key, err := unlockKey(factors, secret)
+	if err != nil {
+		return err
+	}
+	file.header.set(secretField, sealData(storeSecret.Bytes(), &key))
+	crypto.Wipe(key[:])
+	file.setFactors(factors)
+	if file.version == legacyVersion {
+		bindStore(file)
+	}
+	file.secret = storeSecret
+
+	dataMap, err := loadDataMap(storePath, file, storeSecret.Key(), func(key string) bool { return false })
+	if err != nil {
+		return err
+	}
+	err = set(storePath, file, dataMap)
+	if err != nil {
+		return err
+	}
+	return audit(storePath, file, storeSecret.Key(), "recover")
+}
+
+// verifyStoreSecret checks the index MAC of bound stores with the secret, which audited stores
+// keep when their last entry is cleared, and opens an entry of earlier stores, which are removed
+// with their last entry. Shares of another store or split give a secret that verifies neither.
+func verifyStoreSecret(storePath string, file *storeFile, unsealedSecret *[crypto.SecretSize]byte) bool {
+	if file.header.get(storeIDField) != nil {
+		return file.verifyIndex(unsealedSecret) == nil
+	}
+
+	keys := file.keys()
+	if len(keys) == 0 {
+		return false
+	}
+	sort.Strings(keys)
+
+	entry, err := readRecord(storePath, file, keys[0], unsealedSecret)
+	if err != nil {
+		return false
+	}
+	crypto.Wipe(entry.Value)
+	return true
+}
@@ -0,0 +1,77 @@
+package store
+
+import (
+	"fmt"
+	"keepo/src/crypto"
+	"testing"
+)
+
+func TestRecoverStore(t *testing.T) {
+
+	path, otherPath := ".", "recovery-other"
+	cleanup(path, t)
+	cleanup(otherPath, t)
+
+	err := SetMapValue(path, "key", "value", NewSecret([]byte("password01"), nil))
+	if err != nil {
+		t.Errorf("could not set map value '%q'", err)
+	}
+	err = SetMapValue(otherPath, "key", "other", NewSecret([]byte("password01"), nil))
+	if err != nil {
+		t.Errorf("could not set map value '%q'", err)
+	}
+
+	fmt.Println("test splitting the store secret")
+	shares, err := SplitStoreSecret(path, NewSecret([]byte("password01"), nil), 5, 3)
+	if err != nil || len(shares) != 5 {
+		t.Fatalf("could not split store secret '%q'", err)
+	}
+	otherShares, _ := SplitStoreSecret(otherPath, NewSecret([]byte("password01"), nil), 5, 3)
+
+	fmt.Println("test shares of another store do not recover it")
+	err = RecoverStore(path, otherShares[:3], NewSecret([]byte("password02"), nil))
+	if err != RecoveryFailedState {
+		t.Errorf("Expected %q, received %q", RecoveryFailedState, err)
+	}
+	err = RecoverStore(path, shares[:2], NewSecret([]byte("password02"), nil))
+	if err == nil {
+		t.Errorf("expected too few shares to fail")
+	}
+
+	fmt.Println("test recovering the store with a new passphrase")
+	err = RecoverStore(path, []crypto.Share{shares[4], shares[1], shares[2]}, NewSecret([]byte("password02"), nil))
+	if err != nil {
+		t.Errorf("could not recover store '%q'", err)
+	}
+
+	value, err := GetMapValue(path, "key", NewSecret([]byte("password02"), nil))
+	if err != nil || string(value) != "value" {
+		t.Errorf("Expected %q, received %q", "value", value)
+	}
+	_, err = GetMapValue(path, "key", NewSecret([]byte("password01"), nil))
+	if err != AuthenticationFailedState {
+		t.Errorf("Expected %q, received %q", AuthenticationFailedState, err)
+	}
+
+	fmt.Println("test recovering an audited store without entries")
+	if err = SetAuditing(path, NewSecret([]byte("password02"), nil), true); err != nil {
+		t.Errorf("could not start auditing '%q'", err)
+	}
+	if err = ClearMapValue(path, "key", NewSecret([]byte("password02"), nil)); err != nil {
+		t.Errorf("could not clear map value '%q'", err)
+	}
+	err = RecoverStore(path, otherShares[:3], NewSecret([]byte("password03"), nil))
+	if err != RecoveryFailedState {
+		t.Errorf("Expected %q, received %q", RecoveryFailedState, err)
+	}
+	err = RecoverStore(path, shares[:3], NewSecret([]byte("password03"), nil))
+	if err != nil {
+		t.Errorf("could not recover store '%q'", err)
+	}
+	if _, err = ReadAudit(path, NewSecret([]byte("password03"), nil)); err != nil {
+		t.Errorf("could not read audit log '%q'", err)
+	}
+
+	cleanup(path, t)
+	cleanup(otherPath, t)
+}
@@ -1,8 +1,10 @@
 package store
 
 import (
+	"bytes"
 	"golang.org/x/crypto/nacl/secretbox"
 	"io"
+	"io/ioutil"
 	"keepo/src/crypto"
 	"keepo/src/util"
 	"log"
@@ -10,16 +12,28 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"time"
 )
 
 const DefaultStoreName = "default"
 const Extension = ".kpo"
 
-func GetStorePath(storeName string) string {
+// DefaultCipher seals the entries of new stores, existing stores keep the cipher their header records
+const DefaultCipher = crypto.XChaCha20Poly1305
+
+// MaxValueSize is the largest value an entry holds, values are sealed whole in memory
+const MaxValueSize = 1 << 30
 
+// GetStoreDirectory gives the directory stores are kept in, alongside the executable
+func GetStoreDirectory() string {
 	executable, err := os.Executable()
 	util.CheckError(err, "could not get executable path")
-	path := filepath.Dir(executable)
+	return filepath.Dir(executable)
+}
+
+func GetStorePath(storeName string) string {
+
+	path := GetStoreDirectory()
 
 	if strings.HasSuffix(storeName, Extension) {
 		return path + string(filepath.Separator) + storeName
@@ -28,172 +42,455 @@ func GetStorePath(storeName string) string {
 	return path + string(filepath.Separator) + storeName + Extension
 }
 
+// GetStoreNames lists the stores in the store directory without their extension
+func GetStoreNames() (names []string, err error) {
+	files, err := ioutil.ReadDir(GetStoreDirectory())
+	if err != nil {
+		return nil, err
+	}
+
+	names = make([]string, 0, len(files))
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), Extension) && !f.IsDir() {
+			names = append(names, strings.TrimSuffix(f.Name(), Extension))
+		}
+	}
+	return names, nil
+}
+
 func GetMapKeys(path string) (keys []string) {
-	storePath := GetStorePath(path)
-	_, dataMap, err := getIndex(storePath)
+	keys, err := ListMapKeys(path)
 	if err == io.EOF {
 		log.Println("empty data store")
 		os.Exit(0)
 	}
 	util.CheckError(err, "could not access data")
+	return keys
+}
 
-	keys = make([]string, 0, len(dataMap))
-	for key := range dataMap {
-		keys = append(keys, key)
+// ListMapKeys reads the sorted key names from the unencrypted index, no secret is needed
+func ListMapKeys(path string) (keys []string, err error) {
+	file, err := getIndex(GetStorePath(path))
+	if err != nil {
+		return nil, err
 	}
+
+	keys = file.keys()
 	sort.Strings(keys)
-	return keys
+	return keys, nil
 }
 
-func GetMapValue(path, dataKey, secret string) (value []byte, err error) {
-	storePath := GetStorePath(path)
-	sealedSecret, dataIndex, err := getIndex(storePath)
-	if _, ok := err.(*os.PathError); ok {
-		return nil, ValueAbsentState
+// CheckSecret opens the store with the secret, so a secret that does not is found before it is relied on
+func CheckSecret(path string, secret *Secret) error {
+	_, _, storeSecret, err := openStore(path, secret, false)
+	if err != nil {
+		return err
 	}
+	storeSecret.Destroy()
+	return nil
+}
 
+func GetMapValue(path, dataKey string, secret *Secret) (value []byte, err error) {
+	entry, err := GetMapEntry(path, dataKey, secret)
 	if err != nil {
 		return nil, err
 	}
+	return entry.Value, nil
+}
 
-	unsealedSecret, err := unsealSecret(secret, sealedSecret)
+// GetMapEntry gets the value for a key together with its metadata
+func GetMapEntry(path, dataKey string, secret *Secret) (entry *Entry, err error) {
+	storePath, file, storeSecret, err := openStoreReader(path, secret)
 	if err != nil {
 		return nil, err
 	}
+	defer storeSecret.Destroy()
+	unsealedSecret := storeSecret.Key()
 
-	dataOffset := dataIndex[dataKey]
-	if dataOffset == 0 {
+	if _, ok := file.index[dataKey]; !ok {
 		return nil, ValueAbsentState
 	}
 
-	data, err := getData(storePath, dataOffset)
-	util.CheckError(err, "could not read data")
-	unsealedData := unsealData(data, unsealedSecret)
+	entry, err = readEntry(storePath, file, dataKey, unsealedSecret)
+	if err == nil {
+		err = audit(storePath, file, unsealedSecret, "get", dataKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// GetMapMetadata unseals the metadata of every entry, leaving values sealed, a grant token gives
+// that of the entries granted to it
+func GetMapMetadata(path string, secret *Secret) (metadata map[string]Metadata, err error) {
+	storePath, file, storeSecret, err := openStoreReader(path, secret)
+	if err != nil {
+		return nil, err
+	}
+	defer storeSecret.Destroy()
+	unsealedSecret := storeSecret.Key()
+
+	metadata = make(map[string]Metadata, len(file.index))
+	for key := range file.index {
+		var entry *Entry
+		if file.streamed(key) {
+			entry, err = readStreamedRecord(storePath, file, key, unsealedSecret)
+		} else {
+			entry, err = readEntry(storePath, file, key, unsealedSecret)
+		}
+		if err == GrantDeniedState {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		crypto.Wipe(entry.Value)
+		metadata[key] = entry.Metadata
+	}
+	return metadata, audit(storePath, file, unsealedSecret, "metadata")
+}
+
+func SetMapValue(path, dataKey, dataValue string, secret *Secret) (err error) {
+	return SetMapBytes(path, dataKey, []byte(dataValue), secret)
+}
 
-	return unsealedData, nil
+// SetMapBytes sets a binary value, keeping any metadata the key already has
+func SetMapBytes(path, dataKey string, dataValue []byte, secret *Secret) (err error) {
+	return UpdateMapEntry(path, dataKey, secret, true, func(entry *Entry) {
+		entry.Value = dataValue
+	})
 }
 
-func SetMapValue(path, dataKey, dataValue, secret string) (err error) {
-	storePath := GetStorePath(path)
-	sealedSecret, dataIndex, err := getIndex(storePath)
+// SetMapMetadata replaces the metadata of an existing key, leaving its value alone
+func SetMapMetadata(path, dataKey string, metadata Metadata, secret *Secret) (err error) {
+	return UpdateMapEntry(path, dataKey, secret, false, func(entry *Entry) {
+		entry.Metadata = metadata
+	})
+}
 
-	if _, ok := err.(*os.PathError); ok {
-		dataIndex = make(map[string]uint64)
-		err = nil
-		log.Println("starting new data store")
+// UpdateMapEntry passes the current entry for the key to update, an empty one when create
+// allows a new key or store, and writes back the result. Streamed values are not loaded, the
+// entry's Value is nil and if it is left nil the streamed value is kept.
+func UpdateMapEntry(path, dataKey string, secret *Secret, create bool, update func(entry *Entry)) (err error) {
+	storePath, file, storeSecret, err := openStore(path, secret, create)
+	if err != nil {
+		return err
+	}
+	defer storeSecret.Destroy()
+	unsealedSecret := storeSecret.Key()
+
+	entry := &Entry{}
+	streamed := file.streamed(dataKey)
+	_, exists := file.index[dataKey]
+	if exists && streamed {
+		entry, err = readStreamedRecord(storePath, file, dataKey, unsealedSecret)
+	} else if exists {
+		entry, err = readEntry(storePath, file, dataKey, unsealedSecret)
+	} else if !create {
+		return ValueAbsentState
+	}
+	if err != nil {
+		return err
 	}
+	if streamed {
+		entry.Value = nil
+	}
+
+	// the value read is wiped once the entry is sealed, unless update kept it
+	previous := entry.Value
+	update(entry)
+	if len(entry.Value) > MaxValueSize {
+		return ValueTooLargeError(len(entry.Value))
+	}
+
+	// a changed value is a rotation, and an entry given a max age ages from now if it never rotated
+	if !exists || (entry.Value != nil && !bytes.Equal(previous, entry.Value)) ||
+		(entry.MaxAge > 0 && file.attributes(dataKey).get(rotatedAttribute) == nil) {
+		file.setRotated(dataKey, time.Now())
+	}
+	file.setModified(dataKey, time.Now())
 
+	dataMap, err := loadDataMap(storePath, file, unsealedSecret, func(key string) bool {
+		return key == dataKey
+	})
 	if err != nil {
 		return err
 	}
 
-	// authenticate
-	unsealedSecret, err := unsealSecret(secret, sealedSecret)
+	if streamed && entry.Value == nil {
+		dataMap[dataKey], err = restreamData(storePath, file, dataKey, entry, unsealedSecret, false)
+		if err != nil {
+			return err
+		}
+	} else {
+		file.entry(dataKey).attributes.set(streamedAttribute, nil)
+		record, err := sealEntry(file, dataKey, entry, unsealedSecret)
+		if err != nil {
+			return err
+		}
+		dataMap[dataKey] = memoryData(record)
+	}
+	crypto.Wipe(previous)
+
+	err = set(storePath, file, dataMap)
 	if err != nil {
 		return err
 	}
+	return audit(storePath, file, unsealedSecret, "set", dataKey)
+}
 
-	dataMap := make(map[string][]byte, len(dataIndex))
-	for k, v := range dataIndex {
-		if strings.Compare(k ,dataKey) == 0 {
-			continue
+func ClearMapValue(path, dataKey string, secret *Secret) (err error) {
+	_, err = clearMapKeys(path, secret, func(keys []string) []string {
+		for _, key := range keys {
+			if key == dataKey {
+				return []string{dataKey}
+			}
 		}
+		return nil
+	})
+	return err
+}
 
-		data, err := getData(storePath, v)
-		util.CheckError(err, "could not read data for entry: " + k)
-		dataMap[k] = data
+// ClearMapSubtree clears the key at prefix and every key beneath it, returning the cleared keys
+func ClearMapSubtree(path, prefix string, secret *Secret) (cleared []string, err error) {
+	return clearMapKeys(path, secret, func(keys []string) []string {
+		return SubtreeKeys(keys, prefix)
+	})
+}
+
+func clearMapKeys(path string, secret *Secret, selectKeys func(keys []string) []string) (cleared []string, err error) {
+
+	storePath, file, storeSecret, err := openStore(path, secret, false)
+	if err != nil {
+		return nil, err
 	}
+	defer storeSecret.Destroy()
+	unsealedSecret := storeSecret.Key()
 
-	dataMap[dataKey] = sealData([]byte(dataValue), unsealedSecret)
+	cleared = selectKeys(file.keys())
+	if len(cleared) == 0 {
+		return nil, ValueAbsentState
+	}
 
-	if sealedSecret == nil {
-		sealedSecret = sealData(unsealedSecret[:], crypto.GetHash([]byte(secret)))
+	// if these are the last values delete the store, unless it is audited as its log would
+	// then be unreadable
+	if len(cleared) == len(file.index) && !file.audited() {
+		return cleared, os.Remove(storePath)
+	}
+
+	for _, key := range cleared {
+		delete(file.index, key)
+	}
+
+	// time to re-pack
+	dataMap, err := loadDataMap(storePath, file, unsealedSecret, func(key string) bool { return false })
+	if err != nil {
+		return nil, err
 	}
+	err = set(storePath, file, dataMap)
+	if err != nil {
+		return nil, err
+	}
+	return cleared, audit(storePath, file, unsealedSecret, "clear", cleared...)
+}
 
-	return set(storePath, sealedSecret, dataMap)
+// openStore reads the store index and authenticates the secret, when create is set an absent
+// store is started with a newly generated store secret. The store secret is given in a buffer
+// the caller destroys.
+func openStore(path string, secret *Secret, create bool) (storePath string, file *storeFile, storeSecret *crypto.Buffer, err error) {
+	storePath = GetStorePath(path)
+	file, storeSecret, err = openStoreFile(storePath, secret, create)
+	return storePath, file, storeSecret, err
 }
 
-func ClearMapValue(path, dataKey, secret string) (err error) {
+// openStoreFile opens the store at a file path rather than by name in the store directory
+func openStoreFile(storePath string, secret *Secret, create bool) (file *storeFile, storeSecret *crypto.Buffer, err error) {
+	if secret.grantOnly() {
+		return nil, nil, ReadOnlyGrantState
+	}
+	file, err = getIndex(storePath)
 
-	storePath := GetStorePath(path)
-	sealedSecret, dataIndex, err := getIndex(storePath)
 	if _, ok := err.(*os.PathError); ok {
-		return ValueAbsentState
+		if !create {
+			return nil, nil, ValueAbsentState
+		}
+
+		// a new store requires the factors it is started with
+		factors := secret.Factors()
+		key, err := unlockKey(factors, secret)
+		if err != nil || factors&PassphraseFactor == 0 {
+			return nil, nil, FactorMissingError(PassphraseFactor)
+		}
+
+		log.Println("starting new data store")
+		file = newStoreFile()
+		storeSecret = crypto.GenerateSecretBuffer()
+		file.header.set(secretField, sealData(storeSecret.Bytes(), &key))
+		crypto.Wipe(key[:])
+		file.setFactors(factors)
+		bindStore(file)
+		file.secret = storeSecret
+		return file, storeSecret, nil
 	}
 
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	_, err = unsealSecret(secret, sealedSecret)
+	// authenticate
+	storeSecret, err = unsealSecret(file.factors(), secret, file.sealedSecret())
 	if err != nil {
-		return err
+		return nil, nil, err
+	}
+	if err = file.verifyIndex(storeSecret.Key()); err != nil {
+		storeSecret.Destroy()
+		return nil, nil, err
+	}
+	if file.version == legacyVersion {
+		// every entry is resealed when a version 1 store is upgraded, so it can take up binding
+		bindStore(file)
 	}
+	file.secret = storeSecret
+	return file, storeSecret, nil
+}
 
-	if _, ok := dataIndex[dataKey]; ok {
+// openStoreReader opens a store to read from, with the factors it requires or a grant token
+func openStoreReader(path string, secret *Secret) (storePath string, file *storeFile, readSecret *crypto.Buffer, err error) {
+	if secret.grantOnly() {
+		return openGrant(path, secret)
+	}
+	return openStore(path, secret, false)
+}
 
-		// if this is the last value delete the store
-		if len(dataIndex) == 1 {
-			err := os.Remove(storePath)
-			return err
-		}
+// bindStore records the default cipher and a new store id, entries sealed from then on are
+// bound to the store
+func bindStore(file *storeFile) {
+	nonce := crypto.GenerateNonce()
+	file.header.set(cipherField, []byte{byte(DefaultCipher)})
+	file.header.set(storeIDField, nonce[:storeIDSize])
+}
 
-		delete(dataIndex, dataKey)
+// readEntry reads an entry with its value, streamed values are read whole up to MaxValueSize
+func readEntry(storePath string, file *storeFile, dataKey string, unsealedSecret *[crypto.SecretSize]byte) (*Entry, error) {
+	if file.streamed(dataKey) {
+		return readStreamedEntry(storePath, file, dataKey, unsealedSecret)
+	}
 
-		dataMap := make(map[string][]byte, len(dataIndex))
-		for k, v := range dataIndex {
-			if strings.Compare(k ,dataKey) == 0 {
-				continue
-			}
+	data, err := getData(storePath, file.version, file.index[dataKey].offset)
+	if err != nil {
+		return nil, err
+	}
+	return openEntry(file, dataKey, data, unsealedSecret)
+}
 
-			data, err := getData(storePath, v)
-			util.CheckError(err, "could not read data for entry: " + k)
-			dataMap[k] = data
+// loadDataMap locates the sealed data of every entry not skipped so it can be copied into the
+// rewritten store, entries of version 1 stores are resealed as records in the current format
+func loadDataMap(storePath string, file *storeFile, unsealedSecret *[crypto.SecretSize]byte, skip func(key string) bool) (map[string]*entryData, error) {
+	dataMap := make(map[string]*entryData, len(file.index))
+	for k, v := range file.index {
+		if skip(k) {
+			continue
 		}
 
-		// time to re-pack
-		err := set(storePath, sealedSecret[:], dataMap)
-		util.CheckError(err, "could not write data")
-		return nil
-	} else {
-		return ValueAbsentState
+		if file.version == legacyVersion {
+			data, err := getData(storePath, file.version, v.offset)
+			if err != nil {
+				return nil, err
+			}
+			entry, err := openEntry(file, k, data, unsealedSecret)
+			if err != nil {
+				return nil, err
+			}
+			record, err := sealEntry(file, k, entry, unsealedSecret)
+			crypto.Wipe(entry.Value)
+			if err != nil {
+				return nil, err
+			}
+			dataMap[k] = memoryData(record)
+			continue
+		}
+
+		start, length, err := dataRange(storePath, file.version, v.offset)
+		if err != nil {
+			return nil, InvalidFormatError("could not locate data for entry: " + k)
+		}
+		dataMap[k] = &entryData{source: storePath, start: start, length: length}
 	}
+	return dataMap, nil
 }
 
-func unsealSecret(secret string, sealedSecret []byte) (unsealedSecret [crypto.SecretSize]byte, err error) {
+func unsealSecret(factors Factors, secret *Secret, sealedSecret []byte) (storeSecret *crypto.Buffer, err error) {
 	if sealedSecret == nil {
-		return crypto.GenerateSecret(), nil
+		return crypto.GenerateSecretBuffer(), nil
 	}
 
 	// verify the secret
-	hashedSecret := crypto.GetHash([]byte(secret))
+	hashedSecret, err := unlockKey(factors, secret)
+	if err != nil {
+		return nil, err
+	}
+	defer crypto.Wipe(hashedSecret[:])
 	var nonce [crypto.NonceSize]byte
 	copy(nonce[:], sealedSecret[:crypto.NonceSize])
 
 	out, ok := secretbox.Open(nil, sealedSecret[crypto.NonceSize:], &nonce, &hashedSecret)
 	if !ok {
-		return unsealedSecret, AuthenticationFailedState
+		return nil, AuthenticationFailedState
 	}
 
 	util.CheckState(len(out) == crypto.SecretSize, "unsealed secret was not of key length")
-	copy(unsealedSecret[:], out)
-	return unsealedSecret, nil
+	storeSecret, err = crypto.NewBufferFrom(out)
+	util.CheckError(err, "could not allocate secret")
+	return storeSecret, nil
 }
 
-func unsealData(sealedData []byte, secret [crypto.SecretSize]byte) (unsealedData []byte){
+func unsealData(sealedData []byte, secret *[crypto.SecretSize]byte) (unsealedData []byte, ok bool){
+	if len(sealedData) < crypto.NonceSize {
+		return nil, false
+	}
 	var nonce [crypto.NonceSize]byte
 	copy(nonce[:], sealedData[:crypto.NonceSize])
-	unsealedData, ok := secretbox.Open(nil, sealedData[crypto.NonceSize:], &nonce, &secret)
+	return secretbox.Open(nil, sealedData[crypto.NonceSize:], &nonce, secret)
+}
+
+func sealData(data []byte, secret *[crypto.SecretSize]byte) (sealedData []byte){
+	var nonce = crypto.GenerateNonce()
+	return secretbox.Seal(nonce[:], data, &nonce, secret)
+}
+
+// sealRecord seals with the cipher recorded in the store header, or secretbox when there is none,
+// which cannot authenticate the associated data
+func sealRecord(file *storeFile, data []byte, secret *[crypto.SecretSize]byte, associatedData []byte) []byte {
+	cipher, ok := file.cipher()
 	if !ok {
-		log.Println("authentication failed")
-		os.Exit(0)
+		return sealData(data, secret)
 	}
-	return unsealedData
+
+	envelope, err := crypto.Seal(cipher, secret, data, associatedData)
+	util.CheckError(err, "could not seal data")
+	return envelope
 }
 
-func sealData(data []byte, secret [crypto.SecretSize]byte) (sealedData []byte){
-	var nonce = crypto.GenerateNonce()
-	return secretbox.Seal(nonce[:], data, &nonce, &secret)
+// openRecord opens data sealed by sealRecord, envelopes name their own algorithm so records
+// sealed before a change of cipher still open
+func openRecord(file *storeFile, sealedData []byte, secret *[crypto.SecretSize]byte, associatedData []byte) ([]byte, error) {
+	if _, ok := file.cipher(); !ok || file.version == legacyVersion {
+		data, ok := unsealData(sealedData, secret)
+		if !ok {
+			return nil, EntryVerificationFailedState
+		}
+		return data, nil
+	}
+
+	data, err := crypto.Open(secret, sealedData, associatedData)
+	if err == crypto.EnvelopeAuthenticationFailed {
+		return nil, EntryVerificationFailedState
+	}
+	if err != nil {
+		return nil, InvalidFormatError("could not open entry: " + err.Error())
+	}
+	return data, nil
 }
 
 /* // conversion code for v1
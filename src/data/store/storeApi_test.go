@@ -1,10 +1,13 @@
 package store
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
 	"keepo/src/crypto"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -19,7 +22,7 @@ func TestAuthenticationFailure(t *testing.T) {
 	testPath := "."
 	cleanup(testPath, t)
 
-	secret := "password01"
+	secret := NewSecret([]byte("password01"), nil)
 	testEntries := []testEntry{{"testKey1", "testValue1"}}
 
 	for k, v := range testEntries {
@@ -29,13 +32,13 @@ func TestAuthenticationFailure(t *testing.T) {
 		}
 	}
 
-	wrongSecret := "password02"
+	wrongSecret := NewSecret([]byte("password02"), nil)
 	testAuthenticationOnGet(testPath, wrongSecret, testEntries, t)
 	testAuthenticationOnSet(testPath, wrongSecret, testEntries, t)
 	testAuthenticationOnClear(testPath, wrongSecret, testEntries, t)
 }
 
-func testAuthenticationOnClear(testPath, secret string, testEntries []testEntry, t *testing.T) {
+func testAuthenticationOnClear(testPath string, secret *Secret, testEntries []testEntry, t *testing.T) {
 	fmt.Println("test clearing store value with incorrect secret")
 	err := ClearMapValue(testPath, testEntries[0].key, secret)
 	if err == nil {
@@ -48,7 +51,7 @@ func testAuthenticationOnClear(testPath, secret string, testEntries []testEntry,
 	}
 }
 
-func testAuthenticationOnSet(testPath, secret string, testEntries []testEntry, t *testing.T) {
+func testAuthenticationOnSet(testPath string, secret *Secret, testEntries []testEntry, t *testing.T) {
 	fmt.Println("test setting store value with incorrect secret")
 	err := SetMapValue(testPath, testEntries[0].key, "newValue", secret)
 	if err == nil {
@@ -61,7 +64,7 @@ func testAuthenticationOnSet(testPath, secret string, testEntries []testEntry, t
 	}
 }
 
-func testAuthenticationOnGet(path, secret string, testEntries []testEntry, t *testing.T) {
+func testAuthenticationOnGet(path string, secret *Secret, testEntries []testEntry, t *testing.T) {
 	fmt.Println("test getting store value with incorrect secret")
 	_, err := GetMapValue(path, testEntries[0].key, secret)
 	if err == nil {
@@ -79,7 +82,7 @@ func TestGetAbsentValue(t *testing.T) {
 	path := "."
 	cleanup(path, t)
 
-	secret := "password01"
+	secret := NewSecret([]byte("password01"), nil)
 	testEntries := []testEntry{{"testKey1", "testValue1"}}
 
 	fmt.Println("test getting value on empty store")
@@ -127,7 +130,7 @@ func TestDataStoreRoundTrip(t *testing.T) {
 	path := "."
 	cleanup(path, t)
 
-	secret := "password01"
+	secret := NewSecret([]byte("password01"), nil)
 	testData := crypto.GenerateNonce()
 	testKey2 := "testKey2"
 	testValue2 := string(testData[:])
@@ -198,4 +201,184 @@ func cleanup(path string, t *testing.T) {
 			t.Errorf("could not delete existing store '%q'", err)
 		}
 	}
-}
\ No newline at end of file
+	_ = os.Remove(auditPath(storePath))
+	_ = pruneBackups(filepath.Join(filepath.Dir(storePath), BackupDirectory), strings.TrimSuffix(filepath.Base(storePath), Extension), 0)
+	_ = os.Remove(filepath.Join(filepath.Dir(storePath), BackupDirectory))
+}
+func TestClearSubtree(t *testing.T) {
+
+	path := "."
+	cleanup(path, t)
+
+	secret := NewSecret([]byte("password01"), nil)
+	testEntries := []testEntry{
+		{"db/primary/url", "postgres://primary"},
+		{"db/replica/url", "postgres://replica"},
+		{"db:legacy", "value:with:colons"},
+		{"web/token", "token"}}
+
+	for k, v := range testEntries {
+		err := SetMapValue(path, v.key, v.value, secret)
+		if err != nil {
+			t.Errorf("could not set map value %q '%q'", k, err)
+		}
+	}
+
+	fmt.Println("test clearing a subtree")
+	cleared, err := ClearMapSubtree(path, "db/", secret)
+	if err != nil {
+		t.Errorf("could not clear subtree '%q'", err)
+	}
+	if len(cleared) != 2 || cleared[0] != "db/primary/url" || cleared[1] != "db/replica/url" {
+		t.Errorf("expected the two db keys to be cleared but cleared %q", cleared)
+	}
+
+	retrievedKeys := GetMapKeys(path)
+	if len(retrievedKeys) != 2 || retrievedKeys[0] != "db:legacy" || retrievedKeys[1] != "web/token" {
+		t.Errorf("expected 'db:legacy' and 'web/token' to remain but found %q", retrievedKeys)
+	}
+
+	value, err := GetMapValue(path, "db:legacy", secret)
+	if err != nil || string(value) != "value:with:colons" {
+		t.Errorf("expected colon key to keep its value but got %q '%q'", value, err)
+	}
+
+	fmt.Println("test clearing an absent subtree")
+	_, err = ClearMapSubtree(path, "db/", secret)
+	if err != ValueAbsentState {
+		t.Errorf("expected value to be absent but was %s", err)
+	}
+
+	fmt.Println("test a failed write is returned")
+	backups := filepath.Join(filepath.Dir(GetStorePath(path)), BackupDirectory)
+	_ = os.RemoveAll(backups)
+	if err = ioutil.WriteFile(backups, nil, 0600); err != nil {
+		t.Fatalf("could not block backups '%q'", err)
+	}
+	if _, err = ClearMapSubtree(path, "web/", secret); err == nil {
+		t.Errorf("expected clearing to fail when the store cannot be backed up")
+	}
+	if retrievedKeys = GetMapKeys(path); len(retrievedKeys) != 2 {
+		t.Errorf("expected the store to be left as it was but found %q", retrievedKeys)
+	}
+	_ = os.Remove(backups)
+
+	cleanup(path, t)
+}
+
+func TestBinaryValue(t *testing.T) {
+
+	path := "."
+	cleanup(path, t)
+
+	secret := NewSecret([]byte("password01"), nil)
+	value := make([]byte, 70000)
+	for i := range value {
+		value[i] = byte(i)
+	}
+
+	fmt.Println("test setting a binary value")
+	err := SetMapBytes(path, "tls/key", value, secret)
+	if err != nil {
+		t.Errorf("could not set binary value '%q'", err)
+	}
+
+	retrieved, err := GetMapValue(path, "tls/key", secret)
+	if err != nil || !bytes.Equal(retrieved, value) {
+		t.Errorf("expected binary value to round trip but got %d bytes '%q'", len(retrieved), err)
+	}
+
+	cleanup(path, t)
+}
+
+func TestStreamedValue(t *testing.T) {
+
+	path := "."
+	cleanup(path, t)
+
+	secret := NewSecret([]byte("password01"), nil)
+	value := make([]byte, 3*crypto.ChunkSize+100)
+	for i := range value {
+		value[i] = byte(i * 7)
+	}
+
+	fmt.Println("test streaming a value into the store")
+	err := SetMapValue(path, "other", "otherValue", secret)
+	if err != nil {
+		t.Errorf("could not set map value '%q'", err)
+	}
+	err = SetMapStream(path, "backup", bytes.NewReader(value), secret, func(metadata *Metadata) {
+		metadata.Notes = "nightly"
+	})
+	if err != nil {
+		t.Errorf("could not stream value '%q'", err)
+	}
+
+	var streamed bytes.Buffer
+	metadata, err := GetMapStream(path, "backup", &streamed, secret)
+	if err != nil || !bytes.Equal(streamed.Bytes(), value) || metadata.Notes != "nightly" {
+		t.Errorf("expected streamed value to round trip but got %d bytes '%q'", streamed.Len(), err)
+	}
+
+	fmt.Println("test updating metadata keeps the streamed value")
+	err = SetMapMetadata(path, "backup", Metadata{URL: "https://example.com", Notes: "nightly"}, secret)
+	if err != nil {
+		t.Errorf("could not set metadata '%q'", err)
+	}
+
+	entry, err := GetMapEntry(path, "backup", secret)
+	if err != nil || !bytes.Equal(entry.Value, value) || entry.URL != "https://example.com" || entry.Notes != "nightly" {
+		t.Errorf("expected streamed entry to keep its value and metadata '%q'", err)
+	}
+
+	other, err := GetMapValue(path, "other", secret)
+	if err != nil || string(other) != "otherValue" {
+		t.Errorf("Expected %q, received %q", "otherValue", other)
+	}
+
+	fmt.Println("test setting a value inline replaces the streamed one")
+	err = SetMapValue(path, "backup", "small", secret)
+	if err != nil {
+		t.Errorf("could not set map value '%q'", err)
+	}
+	streamed.Reset()
+	_, err = GetMapStream(path, "backup", &streamed, secret)
+	if err != nil || streamed.String() != "small" {
+		t.Errorf("Expected %q, received %q", "small", streamed.String())
+	}
+
+	fmt.Println("test updating a streamed entry that fails to open reports it")
+	err = SetMapStream(path, "tampered", bytes.NewReader(value), secret, nil)
+	if err != nil {
+		t.Errorf("could not stream value '%q'", err)
+	}
+	storePath := GetStorePath(path)
+	file, err := getIndex(storePath)
+	if err != nil {
+		t.Fatalf("could not read index '%q'", err)
+	}
+	start, _, err := dataRange(storePath, file.version, file.index["tampered"].offset)
+	if err != nil {
+		t.Fatalf("could not locate data '%q'", err)
+	}
+	fo, err := os.OpenFile(storePath, os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := make([]byte, 1)
+	if _, err = fo.ReadAt(record, int64(start)+8); err == nil {
+		_, err = fo.WriteAt([]byte{record[0] ^ 0xff}, int64(start)+8)
+	}
+	if closeErr := fo.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = SetMapMetadata(path, "tampered", Metadata{Notes: "changed"}, secret)
+	if err == nil {
+		t.Errorf("expected a tampered streamed entry to fail to update")
+	}
+
+	cleanup(path, t)
+}
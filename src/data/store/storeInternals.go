@@ -1,12 +1,67 @@
 package store
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/binary"
+	"io"
+	"keepo/src/crypto"
 	"os"
 )
 
 /**
- * Store layout:
+ * Store layout (version 2):
+ *
+ * header:
+ * magic				- "KPO" followed by the format version byte
+ * field-count			- uint32
+ *
+ * field-tag			- uint16
+ * field-length			- uint32
+ * field-value			- field-length bytes
+ * ...
+ *
+ * index:
+ * data-key-count		- uint32
+ *
+ * data-key-length		- uint32
+ * data-key-value  		- data-key-length bytes
+ * data-value-offset	- offset in bytes, uint64
+ * attribute-count		- uint32
+ * attributes			- encoded as header fields
+ * ...
+ *
+ * data:
+ * data-values:
+ * data-value-length	- uint64
+ * data-value  			- data-value-length bytes
+ * ...
+ *
+ * Header fields hold the store secret, sealed with the passphrase hash, and the id of the cipher
+ * entries are sealed with as one byte. Stores recording no cipher seal entries with secretbox,
+ * those recording one seal them as crypto envelopes.
+ *
+ * The factors field records, as one byte, which of the passphrase and key file the store secret
+ * is sealed with. Stores without it are sealed with the passphrase alone.
+ *
+ * Stores with a store id bind each entry to the store, its key name and the sequence number it
+ * was sealed at, given as associated data. The header holds the last sequence number used and
+ * each index entry the one its data was sealed at, as uint64 values.
+ *
+ * Their header and index are authenticated with a MAC under the store secret, see index.go.
+ *
+ * Their entries are sealed with entry keys of their own, held by each index entry sealed with the
+ * store secret and with the key of every grant covering it. Grants are header fields, see grants.go.
+ *
+ * Data values are sealed entry records, whose value and metadata are encoded as fields.
+ * Field lengths are uint32 so entry values are limited to MaxValueSize, well within them.
+ * Entries with the streamed attribute instead hold:
+ *
+ * record-length		- uint32
+ * record				- the sealed record, without its value
+ * value				- the value as a crypto stream, of any length
+ *
+ * Store layout (version 1):
  *
  * header:
  * secret-length 		- uint32
@@ -23,12 +78,196 @@ import (
  * data:
  * data-values:
  * data-value-length	- uint32
- * data-value  			- data-value-length bytes
+ * data-value  			- data-value-length bytes, the bare sealed value
  * ...
  *
+ * Version 1 stores are read as they are and written as version 2 on their next change.
  */
 
-func getIndex(path string) (sealedSecret []byte, dataIndex map[string]uint64, err error) {
+const (
+	legacyVersion = 1
+	formatVersion = 2
+)
+
+var magic = []byte("KPO")
+
+// header fields
+const (
+	secretField uint16 = 1
+	cipherField   uint16 = 2
+	storeIDField  uint16 = 3
+	sequenceField uint16 = 4
+	factorsField  uint16 = 5
+	// repeated, one per grant
+	grantField    uint16 = 6
+	// present when the store keeps an audit log
+	auditField uint16 = 7
+	// the store's default max age in nanoseconds, and present when expired values are refused
+	policyMaxAgeField uint16 = 8
+	policyRefuseField uint16 = 9
+	// the least strength of the values set, when not the default, and present when weaker values
+	// are rejected rather than warned of
+	policyStrengthField uint16 = 10
+	policyRejectField   uint16 = 11
+	// the copies kept of the store before it is replaced, when not the default
+	policyBackupsField uint16 = 12
+	// the MAC of the header and index of a bound store or, repeated, the witnesses of the base and
+	// copies it was merged from without its secret, see index.go
+	indexMACField    uint16 = 13
+	mergedIndexField uint16 = 14
+)
+
+const storeIDSize = 16
+
+// maxDataSize bounds the data of entries held whole, their value with room for its metadata and sealing
+const maxDataSize = MaxValueSize + 1<<20
+
+// index attributes
+const (
+	// the entry's data is its sealed record followed by the value as a crypto stream
+	streamedAttribute uint16 = 1
+	// the sequence number the entry's data was sealed at
+	sequenceAttribute uint16 = 2
+	// the key the entry is sealed with, sealed with the store secret
+	entryKeyAttribute uint16 = 3
+	// repeated, a grant id and the entry key sealed with that grant's key
+	grantKeyAttribute uint16 = 4
+	// when the value last changed in unix seconds, and copies of the sealed expiry and max age
+	rotatedAttribute uint16 = 5
+	expiresAttribute uint16 = 6
+	maxAgeAttribute  uint16 = 7
+	// when the entry was last set in unix nanoseconds, ordering changes when copies are merged
+	modifiedAttribute uint16 = 8
+)
+
+type field struct {
+	tag   uint16
+	value []byte
+}
+
+// fields keep their order and a tag may repeat, as tags do in entry records
+type fields []field
+
+func (f fields) get(tag uint16) []byte {
+	for _, candidate := range f {
+		if candidate.tag == tag {
+			return candidate.value
+		}
+	}
+	return nil
+}
+
+func (f fields) getAll(tag uint16) (values [][]byte) {
+	for _, candidate := range f {
+		if candidate.tag == tag {
+			values = append(values, candidate.value)
+		}
+	}
+	return values
+}
+
+// set replaces every field with the tag, a nil value just removes them
+func (f *fields) set(tag uint16, value []byte) {
+	kept := (*f)[:0]
+	for _, candidate := range *f {
+		if candidate.tag != tag {
+			kept = append(kept, candidate)
+		}
+	}
+	*f = kept
+	if value != nil {
+		f.add(tag, value)
+	}
+}
+
+func (f *fields) add(tag uint16, value []byte) {
+	*f = append(*f, field{tag, value})
+}
+
+type indexEntry struct {
+	offset     uint64
+	attributes fields
+}
+
+// storeFile is the header and index of a store, data values are read from the file on demand
+type storeFile struct {
+	version int
+	header  fields
+	index   map[string]*indexEntry
+	// set when the store is opened with a grant token rather than the store secret
+	grantID []byte
+	// set when the store is opened with its secret, the index is authenticated as it is written
+	secret *crypto.Buffer
+}
+
+func newStoreFile() *storeFile {
+	return &storeFile{version: formatVersion, index: make(map[string]*indexEntry)}
+}
+
+func (s *storeFile) sealedSecret() []byte {
+	return s.header.get(secretField)
+}
+
+// cipher gives the algorithm entries are sealed with, none for stores sealing with secretbox
+func (s *storeFile) cipher() (algorithm crypto.Algorithm, ok bool) {
+	recorded := s.header.get(cipherField)
+	if len(recorded) != 1 {
+		return 0, false
+	}
+	return crypto.Algorithm(recorded[0]), true
+}
+
+// factors gives the factors the store secret is sealed with
+func (s *storeFile) factors() Factors {
+	recorded := s.header.get(factorsField)
+	if len(recorded) != 1 {
+		return PassphraseFactor
+	}
+	return Factors(recorded[0])
+}
+
+// setFactors records the factors, leaving the field out for passphrase only stores
+func (s *storeFile) setFactors(factors Factors) {
+	if factors == PassphraseFactor {
+		s.header.set(factorsField, nil)
+		return
+	}
+	s.header.set(factorsField, []byte{byte(factors)})
+}
+
+// entry gives the index entry for a key, adding it when absent
+func (s *storeFile) entry(key string) *indexEntry {
+	if _, ok := s.index[key]; !ok {
+		s.index[key] = &indexEntry{}
+	}
+	return s.index[key]
+}
+
+func (s *storeFile) streamed(key string) bool {
+	return s.attributes(key).get(streamedAttribute) != nil
+}
+
+func (s *storeFile) sequence(key string) uint64 {
+	return decodeUint64(s.attributes(key).get(sequenceAttribute))
+}
+
+// nextSequence takes the store's next sequence number for a key about to be sealed, so data
+// sealed for it earlier no longer opens
+func (s *storeFile) nextSequence(key string) {
+	next := decodeUint64(s.header.get(sequenceField)) + 1
+	s.header.set(sequenceField, encodeUint64(next))
+	s.entry(key).attributes.set(sequenceAttribute, encodeUint64(next))
+}
+
+func (s *storeFile) keys() []string {
+	keys := make([]string, 0, len(s.index))
+	for key := range s.index {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func getIndex(path string) (file *storeFile, err error) {
 
 	// open input file
 	if fi, err := os.Open(path); err == nil {
@@ -40,62 +279,78 @@ func getIndex(path string) (sealedSecret []byte, dataIndex map[string]uint64, er
 			}
 		}()
 
+		reader := bufio.NewReader(fi)
 		uint32Bytes := make([]byte, 4)
-		uint64Bytes := make([]byte, 8)
+		file = newStoreFile()
 
-		// read the secret
-		_, err := fi.Read(uint32Bytes)
+		_, err := io.ReadFull(reader, uint32Bytes)
 		if err != nil {
-			return nil, nil, InvalidFormatError("could not read secret length")
+			return nil, InvalidFormatError("could not read header")
 		}
 
-		secretLength := binary.LittleEndian.Uint32(uint32Bytes)
-		sealedSecret = make([]byte, secretLength)
-		_, err = fi.Read(sealedSecret)
-		if err != nil {
-			return nil, nil, InvalidFormatError("could not read secret")
+		if bytes.Equal(uint32Bytes[:len(magic)], magic) {
+			file.version = int(uint32Bytes[len(magic)])
+			if file.version != formatVersion {
+				return nil, InvalidFormatError("unsupported store version")
+			}
+
+			file.header, err = readFields(reader)
+			if err != nil {
+				return nil, InvalidFormatError("could not read header fields")
+			}
+		} else {
+			file.version = legacyVersion
+
+			// the first word was the length of the secret
+			sealedSecret, err := readBytes(io.MultiReader(bytes.NewReader(uint32Bytes), reader))
+			if err != nil {
+				return nil, InvalidFormatError("could not read secret")
+			}
+			file.header.add(secretField, sealedSecret)
+		}
+
+		if file.sealedSecret() == nil {
+			return nil, InvalidFormatError("store has no secret")
 		}
 
 		// read the index
-		_, err = fi.Read(uint32Bytes)
+		_, err = io.ReadFull(reader, uint32Bytes)
 		if err != nil {
-			return nil, nil, InvalidFormatError("could not read index count")
+			return nil, InvalidFormatError("could not read index count")
 		}
 
 		indexCount := int(binary.LittleEndian.Uint32(uint32Bytes))
-		dataIndex = make(map[string]uint64, indexCount)
 
 		// read index entries
 		for i := 0; i < indexCount; i++ {
-			_, err = fi.Read(uint32Bytes)
+			keyBytes, err := readBytes(reader)
 			if err != nil {
-				return sealedSecret, dataIndex, InvalidFormatError("could not read an index key length")
+				return file, InvalidFormatError("could not read an index key")
 			}
 
-			keyLength := int(binary.LittleEndian.Uint32(uint32Bytes))
-
-			keyBytes := make([]byte, keyLength)
-			_, err = fi.Read(keyBytes)
+			entry := &indexEntry{}
+			err = binary.Read(reader, binary.LittleEndian, &entry.offset)
 			if err != nil {
-				return sealedSecret, dataIndex, InvalidFormatError("could not read an index key")
+				return file, InvalidFormatError("could not read an index data offset")
 			}
 
-			_, err = fi.Read(uint64Bytes)
-			if err != nil {
-				return sealedSecret, dataIndex, InvalidFormatError("could not read an index data offset")
+			if file.version == formatVersion {
+				entry.attributes, err = readFields(reader)
+				if err != nil {
+					return file, InvalidFormatError("could not read index attributes")
+				}
 			}
 
-			dataOffset := binary.LittleEndian.Uint64(uint64Bytes)
-			dataIndex[string(keyBytes)] = dataOffset
+			file.index[string(keyBytes)] = entry
 		}
 
-		return sealedSecret, dataIndex, err
+		return file, nil
 	} else {
-		return nil, nil, err
+		return nil, err
 	}
 }
 
-func getData(path string, dataOffset uint64) (data []byte, err error) {
+func getData(path string, version int, dataOffset uint64) (data []byte, err error) {
 
 	// open input file
 	if fi, err := os.Open(path); err == nil {
@@ -107,21 +362,38 @@ func getData(path string, dataOffset uint64) (data []byte, err error) {
 			}
 		}()
 
-		uint32Bytes := make([]byte, 4)
-
-		_, err := fi.Seek(int64(dataOffset), 0)
+		_, err := fi.Seek(int64(dataOffset), io.SeekStart)
 		if err != nil {
 			return nil, InvalidFormatError("could not seek to data offset")
 		}
 
-		_, err = fi.Read(uint32Bytes)
+		var dataLength uint64
+		if version == legacyVersion {
+			var legacyLength uint32
+			err = binary.Read(fi, binary.LittleEndian, &legacyLength)
+			dataLength = uint64(legacyLength)
+		} else {
+			err = binary.Read(fi, binary.LittleEndian, &dataLength)
+		}
 		if err != nil {
 			return nil, InvalidFormatError("could not read data length")
 		}
-		dataLength := int(binary.LittleEndian.Uint32(uint32Bytes))
+
+		// lengths are checked before allocating, so a damaged store cannot exhaust memory
+		info, err := fi.Stat()
+		if err != nil {
+			return nil, err
+		}
+		position, err := fi.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, InvalidFormatError("could not seek to data")
+		}
+		if dataLength > maxDataSize || dataLength > uint64(info.Size()-position) {
+			return nil, InvalidFormatError("data length exceeds the store")
+		}
 
 		data := make([]byte, dataLength)
-		_, err = fi.Read(data)
+		_, err = io.ReadFull(fi, data)
 		if err != nil {
 			return nil, InvalidFormatError("could not read data")
 		}
@@ -132,10 +404,75 @@ func getData(path string, dataOffset uint64) (data []byte, err error) {
 	}
 }
 
-func set(path string, sealedSecret []byte, dataMap map[string][]byte) (err error) {
+// entryData supplies the data of an entry when a store is written: held in memory, copied from
+// a range of the previous store file behind any data held in memory or streamed, which for at
+// most one entry may be without a known length
+type entryData struct {
+	data   []byte
+	source string
+	start  uint64
+	length uint64
+	stream func(w io.Writer) error
+}
+
+func memoryData(data []byte) *entryData {
+	return &entryData{data: data, length: uint64(len(data))}
+}
+
+// dataRange locates the data of an entry without reading it
+func dataRange(path string, version int, dataOffset uint64) (start uint64, length uint64, err error) {
+	if fi, err := os.Open(path); err == nil {
+
+		// close fi on exit and check for its returned error
+		defer func() {
+			if err := fi.Close(); err != nil {
+				panic(err)
+			}
+		}()
+
+		_, err := fi.Seek(int64(dataOffset), io.SeekStart)
+		if err != nil {
+			return 0, 0, InvalidFormatError("could not seek to data offset")
+		}
+
+		if version == legacyVersion {
+			var legacyLength uint32
+			err = binary.Read(fi, binary.LittleEndian, &legacyLength)
+			return dataOffset + 4, uint64(legacyLength), err
+		}
+		err = binary.Read(fi, binary.LittleEndian, &length)
+		return dataOffset + 8, length, err
+	} else {
+		return 0, 0, err
+	}
+}
+
+// set writes the store beside its path and renames it into place, so a failed write leaves the
+// previous store untouched. Stores are always written in the current format version.
+func set(path string, file *storeFile, dataMap map[string]*entryData) (err error) {
+
+	if file.secret != nil && file.header.get(storeIDField) != nil {
+		file.authenticateIndex(file.secret.Key())
+	}
+
+	temporaryPath := path + ".tmp"
+	err = writeStore(temporaryPath, file, dataMap)
+	if err != nil {
+		_ = os.Remove(temporaryPath)
+		return err
+	}
+
+	if err = backupBeforeWrite(path, file.policy().Backups); err != nil {
+		_ = os.Remove(temporaryPath)
+		return err
+	}
+	return os.Rename(temporaryPath, path)
+}
+
+func writeStore(path string, file *storeFile, dataMap map[string]*entryData) (err error) {
 
 	// open output file
-	if fo, err := os.Create(path); err == nil {
+	if fo, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600); err == nil {
 
 		// close fo on exit and check for its returned error
 		defer func() {
@@ -144,91 +481,262 @@ func set(path string, sealedSecret []byte, dataMap map[string][]byte) (err error
 			}
 		}()
 
-		uint32Bytes := make([]byte, 4)
-		uint64Bytes := make([]byte, 8)
+		writer := bufio.NewWriter(fo)
 
-		// write the sealedSecret
-		binary.LittleEndian.PutUint32(uint32Bytes, uint32(len(sealedSecret)))
-		_, err = fo.Write(uint32Bytes)
+		// write the header
+		_, err = writer.Write(append(append([]byte{}, magic...), formatVersion))
 		if err != nil {
-			return InvalidFormatError("could not write secret length")
+			return InvalidFormatError("could not write magic")
 		}
 
-		_, err = fo.Write(sealedSecret)
+		err = writeFields(writer, file.header)
 		if err != nil {
-			return InvalidFormatError("could not write secret")
+			return InvalidFormatError("could not write header fields")
 		}
 
-		// write the header count
-		entryCount := uint32(len(dataMap))
-		binary.LittleEndian.PutUint32(uint32Bytes, entryCount)
-		_, err = fo.Write(uint32Bytes)
-		if err != nil {
-			return InvalidFormatError("could not write key count")
+		// write the index, data offsets follow from the index size so are known up front
+		// with the streamed entry, whose length is not, placed last
+		keys := make([]string, 0, len(dataMap))
+		streamed := ""
+		indexSize := 4
+		for k, v := range dataMap {
+			if v.stream != nil && v.length == 0 {
+				streamed = k
+			} else {
+				keys = append(keys, k)
+			}
+			indexSize += 4 + len(k) + 8 + fieldsSize(file.attributes(k))
+		}
+		if len(streamed) > 0 {
+			keys = append(keys, streamed)
 		}
 
-		// write the header
-		headerMap := make(map[string]uint64, 0)
-		for k := range dataMap {
+		headerSize := len(magic) + 1 + fieldsSize(file.header)
+		dataOffset := uint64(headerSize + indexSize)
 
-			binary.LittleEndian.PutUint32(uint32Bytes, uint32(len(k)))
-			_, err = fo.Write(uint32Bytes)
-			if err != nil {
-				return InvalidFormatError("could not write header entry length for: " + k)
-			}
+		err = binary.Write(writer, binary.LittleEndian, uint32(len(keys)))
+		if err != nil {
+			return InvalidFormatError("could not write key count")
+		}
 
-			_, err = fo.Write([]byte(k))
+		for _, k := range keys {
+			err = writeBytes(writer, []byte(k))
 			if err != nil {
 				return InvalidFormatError("could not write header entry for: " + k)
 			}
 
-			currentPosition, err := fo.Seek(0, 1)
+			err = binary.Write(writer, binary.LittleEndian, dataOffset)
 			if err != nil {
-				return InvalidFormatError("could not get current position of file")
+				return InvalidFormatError("could not write value position")
 			}
 
-			headerMap[k] = uint64(currentPosition)
-
-			binary.LittleEndian.PutUint64(uint64Bytes, uint64(0))
-			_, err = fo.Write(uint64Bytes)
+			err = writeFields(writer, file.attributes(k))
 			if err != nil {
-				return InvalidFormatError("could not write value position placeholder")
+				return InvalidFormatError("could not write attributes for: " + k)
 			}
-		}
 
-		// write the data and update the header value offsets
-		for k, v := range dataMap {
+			dataOffset += 8 + dataMap[k].length
+		}
 
-			// track current value position
-			currentPosition, err := fo.Seek(0, 1)
+		// write the data in index order
+		for _, k := range keys {
+			err = binary.Write(writer, binary.LittleEndian, dataMap[k].length)
 			if err != nil {
-				return InvalidFormatError("could not get current position of file")
+				return InvalidFormatError("could not write entry length for value of: " + k)
 			}
 
-			_, err = fo.Seek(int64(headerMap[k]), 0)
-			binary.LittleEndian.PutUint64(uint64Bytes, uint64(currentPosition))
-			_, err = fo.Write(uint64Bytes)
+			err = writeData(writer, dataMap[k])
 			if err != nil {
-				return InvalidFormatError("could not write value position")
+				return err
 			}
+		}
 
-			_, err = fo.Seek(currentPosition, 0)
-
-			// write the value
-			binary.LittleEndian.PutUint32(uint32Bytes, uint32(len(v)))
-			_, err = fo.Write(uint32Bytes)
-			if err != nil {
-				return InvalidFormatError("could not write entry length for value of: " + k)
-			}
+		err = writer.Flush()
+		if err != nil || len(streamed) == 0 {
+			return err
+		}
 
-			_, err = fo.Write(v)
-			if err != nil {
-				return InvalidFormatError("could not write entry value for: " + k)
-			}
+		// now the streamed entry's length is known it replaces the placeholder
+		end, err := fo.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return InvalidFormatError("could not get current position of file")
 		}
 
+		lengthOffset := int64(dataOffset - dataMap[streamed].length - 8)
+		_, err = fo.Seek(lengthOffset, io.SeekStart)
+		if err == nil {
+			err = binary.Write(fo, binary.LittleEndian, uint64(end-lengthOffset-8))
+		}
+		if err != nil {
+			return InvalidFormatError("could not write entry length for value of: " + streamed)
+		}
 		return nil
 	} else {
 		return err
 	}
-}
\ No newline at end of file
+}
+
+func writeData(writer io.Writer, data *entryData) (err error) {
+	if data.stream != nil && data.length == 0 {
+		return data.stream(writer)
+	}
+	if data.stream != nil {
+		counter := &countingWriter{writer: writer}
+		err = data.stream(counter)
+		if err == nil && counter.count != data.length {
+			return InvalidFormatError("streamed entry was not of its given length")
+		}
+		return err
+	}
+	_, err = writer.Write(data.data)
+	if err != nil || len(data.source) == 0 {
+		return err
+	}
+
+	fi, err := os.Open(data.source)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := fi.Close(); err != nil {
+			panic(err)
+		}
+	}()
+
+	_, err = fi.Seek(int64(data.start), io.SeekStart)
+	if err == nil {
+		_, err = io.CopyN(writer, fi, int64(data.length)-int64(len(data.data)))
+	}
+	if err != nil {
+		return InvalidFormatError("could not copy entry data")
+	}
+	return nil
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	writer io.Writer
+	count  uint64
+}
+
+func (c *countingWriter) Write(p []byte) (n int, err error) {
+	n, err = c.writer.Write(p)
+	c.count += uint64(n)
+	return n, err
+}
+
+func (s *storeFile) attributes(key string) fields {
+	if entry, ok := s.index[key]; ok {
+		return entry.attributes
+	}
+	return nil
+}
+
+// readBytes reads a length and that many bytes, which are read as they arrive rather than
+// allocated up front, so a damaged length cannot take more memory than the file holds
+func readBytes(reader io.Reader) (value []byte, err error) {
+	var length uint32
+	err = binary.Read(reader, binary.LittleEndian, &length)
+	if err != nil {
+		return nil, err
+	}
+	if length > maxDataSize {
+		return nil, InvalidFormatError("field length exceeds the bound")
+	}
+
+	var buffer bytes.Buffer
+	_, err = io.CopyN(&buffer, reader, int64(length))
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return buffer.Bytes(), err
+}
+
+func writeBytes(writer io.Writer, value []byte) (err error) {
+	err = binary.Write(writer, binary.LittleEndian, uint32(len(value)))
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(value)
+	return err
+}
+
+func readFields(reader io.Reader) (values fields, err error) {
+	var count uint32
+	err = binary.Read(reader, binary.LittleEndian, &count)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := uint32(0); i < count; i++ {
+		var tag uint16
+		err = binary.Read(reader, binary.LittleEndian, &tag)
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := readBytes(reader)
+		if err != nil {
+			return nil, err
+		}
+		values.add(tag, value)
+	}
+	return values, nil
+}
+
+func writeFields(writer io.Writer, values fields) (err error) {
+	err = binary.Write(writer, binary.LittleEndian, uint32(len(values)))
+	if err != nil {
+		return err
+	}
+
+	for _, value := range values {
+		err = binary.Write(writer, binary.LittleEndian, value.tag)
+		if err != nil {
+			return err
+		}
+
+		err = writeBytes(writer, value.value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func fieldsSize(values fields) (size int) {
+	size = 4
+	for _, value := range values {
+		size += 2 + 4 + len(value.value)
+	}
+	return size
+}
+
+func encodeUint64(value uint64) []byte {
+	encoded := make([]byte, 8)
+	binary.LittleEndian.PutUint64(encoded, value)
+	return encoded
+}
+
+// decodeUint64 reads absent or malformed values as zero
+func decodeUint64(encoded []byte) uint64 {
+	if len(encoded) != 8 {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(encoded)
+}
+
+func encodeFields(values fields) []byte {
+	var buffer bytes.Buffer
+	_ = writeFields(&buffer, values)
+	return buffer.Bytes()
+}
+
+func decodeFields(encoded []byte) (values fields, err error) {
+	reader := bytes.NewReader(encoded)
+	values, err = readFields(reader)
+	if err == nil && reader.Len() > 0 {
+		err = InvalidFormatError("trailing bytes after fields")
+	}
+	return values, err
+}
@@ -0,0 +1,331 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"keepo/src/crypto"
+	"os"
+	"testing"
+)
+
+// rewriteIndex writes the store with the header and index given, without the store secret
+func rewriteIndex(storePath string, file *storeFile, t *testing.T) {
+	dataMap := make(map[string]*entryData)
+	for key, entry := range file.index {
+		start, length, err := dataRange(storePath, file.version, entry.offset)
+		if err != nil {
+			t.Fatalf("could not locate data '%q'", err)
+		}
+		dataMap[key] = &entryData{source: storePath, start: start, length: length}
+	}
+	if err := writeStore(storePath+".rewritten", file, dataMap); err != nil {
+		t.Fatalf("could not write store '%q'", err)
+	}
+	if err := os.Rename(storePath+".rewritten", storePath); err != nil {
+		t.Fatalf("could not replace store '%q'", err)
+	}
+}
+
+// writeLegacyStore writes a version 1 store as earlier releases did
+func writeLegacyStore(path string, secret *Secret, values map[string]string, t *testing.T) {
+	unsealedSecret := crypto.GenerateSecret()
+	hashedSecret := crypto.GetHash(secret.Passphrase.Bytes())
+	sealedSecret := sealData(unsealedSecret[:], &hashedSecret)
+
+	var buffer []byte
+	uint32Bytes := make([]byte, 4)
+	uint64Bytes := make([]byte, 8)
+
+	binary.LittleEndian.PutUint32(uint32Bytes, uint32(len(sealedSecret)))
+	buffer = append(append(buffer, uint32Bytes...), sealedSecret...)
+	binary.LittleEndian.PutUint32(uint32Bytes, uint32(len(values)))
+	buffer = append(buffer, uint32Bytes...)
+
+	keys := make([]string, 0, len(values))
+	offset := len(buffer)
+	for k := range values {
+		keys = append(keys, k)
+		offset += 4 + len(k) + 8
+	}
+
+	var data []byte
+	for _, k := range keys {
+		binary.LittleEndian.PutUint32(uint32Bytes, uint32(len(k)))
+		buffer = append(append(buffer, uint32Bytes...), k...)
+		binary.LittleEndian.PutUint64(uint64Bytes, uint64(offset+len(data)))
+		buffer = append(buffer, uint64Bytes...)
+
+		sealed := sealData([]byte(values[k]), &unsealedSecret)
+		binary.LittleEndian.PutUint32(uint32Bytes, uint32(len(sealed)))
+		data = append(append(data, uint32Bytes...), sealed...)
+	}
+
+	f, err := os.Create(GetStorePath(path))
+	if err != nil {
+		t.Fatalf("could not create legacy store '%q'", err)
+	}
+	defer f.Close()
+	if _, err = f.Write(append(buffer, data...)); err != nil {
+		t.Fatalf("could not write legacy store '%q'", err)
+	}
+}
+
+func TestLegacyStoreUpgrade(t *testing.T) {
+
+	path := "."
+	cleanup(path, t)
+
+	secret := NewSecret([]byte("password01"), nil)
+	writeLegacyStore(path, secret, map[string]string{"one": "first", "two": "second"}, t)
+
+	file, err := getIndex(GetStorePath(path))
+	if err != nil || file.version != legacyVersion {
+		t.Fatalf("expected a version 1 store but got '%v' '%q'", file, err)
+	}
+
+	value, err := GetMapValue(path, "two", secret)
+	if err != nil || string(value) != "second" {
+		t.Errorf("expected legacy value 'second' but got %q '%q'", value, err)
+	}
+
+	err = SetMapMetadata(path, "one", Metadata{URL: "https://example.com", Tags: []string{"a", "b"}}, secret)
+	if err != nil {
+		t.Errorf("could not set metadata '%q'", err)
+	}
+
+	file, err = getIndex(GetStorePath(path))
+	if err != nil || file.version != formatVersion {
+		t.Fatalf("expected the store to be upgraded but got '%v' '%q'", file, err)
+	}
+	if _, ok := file.cipher(); !ok || file.header.get(storeIDField) == nil {
+		t.Errorf("expected the upgraded store to bind its entries")
+	}
+
+	for k, v := range map[string]string{"one": "first", "two": "second"} {
+		entry, err := GetMapEntry(path, k, secret)
+		if err != nil || string(entry.Value) != v {
+			t.Errorf("expected upgraded value %q but got '%v' '%q'", v, entry, err)
+		}
+	}
+
+	entry, _ := GetMapEntry(path, "one", secret)
+	if entry.URL != "https://example.com" || len(entry.Tags) != 2 || entry.Tags[1] != "b" {
+		t.Errorf("expected metadata to be kept but got '%v'", entry.Metadata)
+	}
+
+	cleanup(path, t)
+}
+
+func TestStoreCipher(t *testing.T) {
+
+	path := "."
+	cleanup(path, t)
+
+	secret := NewSecret([]byte("password01"), nil)
+	err := SetMapValue(path, "key", "value", secret)
+	if err != nil {
+		t.Errorf("could not set map value '%q'", err)
+	}
+
+	storePath := GetStorePath(path)
+	file, err := getIndex(storePath)
+	if err != nil {
+		t.Fatalf("could not read index '%q'", err)
+	}
+	cipher, ok := file.cipher()
+	if !ok || cipher != DefaultCipher {
+		t.Errorf("expected new stores to record %s but got %v", DefaultCipher, file.header.get(cipherField))
+	}
+
+	data, err := getData(storePath, file.version, file.index["key"].offset)
+	if err != nil {
+		t.Fatalf("could not read data '%q'", err)
+	}
+	sealedWith, err := crypto.EnvelopeAlgorithm(data)
+	if err != nil || sealedWith != DefaultCipher {
+		t.Errorf("expected the entry to be sealed with %s but got %s '%q'", DefaultCipher, sealedWith, err)
+	}
+
+	value, err := GetMapValue(path, "key", secret)
+	if err != nil || string(value) != "value" {
+		t.Errorf("Expected %q, received %q", "value", value)
+	}
+
+	cleanup(path, t)
+}
+
+func TestEntryBinding(t *testing.T) {
+
+	path := "."
+	cleanup(path, t)
+
+	secret := NewSecret([]byte("password01"), nil)
+	for _, key := range []string{"prod/db", "test/db"} {
+		err := SetMapValue(path, key, key+"-password", secret)
+		if err != nil {
+			t.Errorf("could not set map value '%q'", err)
+		}
+	}
+
+	storePath := GetStorePath(path)
+	file, err := getIndex(storePath)
+	if err != nil {
+		t.Fatalf("could not read index '%q'", err)
+	}
+	storeSecret, err := unsealSecret(file.factors(), secret, file.sealedSecret())
+	if err != nil {
+		t.Fatalf("could not unseal secret '%q'", err)
+	}
+	defer storeSecret.Destroy()
+	unsealedSecret := storeSecret.Key()
+
+	fmt.Println("test data swapped between keys fails verification")
+	prodData, _ := getData(storePath, file.version, file.index["prod/db"].offset)
+	_, err = openEntry(file, "test/db", prodData, unsealedSecret)
+	if err != EntryVerificationFailedState {
+		t.Errorf("Expected %q, received %q", EntryVerificationFailedState, err)
+	}
+
+	fmt.Println("test earlier data for a key fails verification")
+	copyStore(path, "binding-earlier", t)
+	err = SetMapValue(path, "prod/db", "rotated", secret)
+	if err != nil {
+		t.Errorf("could not set map value '%q'", err)
+	}
+	file, _ = getIndex(storePath)
+	_, err = openEntry(file, "prod/db", prodData, unsealedSecret)
+	if err != EntryVerificationFailedState {
+		t.Errorf("Expected %q, received %q", EntryVerificationFailedState, err)
+	}
+
+	fmt.Println("test data from another store fails verification")
+	other := newStoreFile()
+	other.header = append(fields{}, file.header...)
+	other.header.set(storeIDField, make([]byte, storeIDSize))
+	other.index = file.index
+	currentData, _ := getData(storePath, file.version, file.index["prod/db"].offset)
+	_, err = openEntry(other, "prod/db", currentData, unsealedSecret)
+	if err != EntryVerificationFailedState {
+		t.Errorf("Expected %q, received %q", EntryVerificationFailedState, err)
+	}
+
+	entry, err := openEntry(file, "prod/db", currentData, unsealedSecret)
+	if err != nil || string(entry.Value) != "rotated" {
+		t.Errorf("Expected %q, received '%v' '%q'", "rotated", entry, err)
+	}
+
+	fmt.Println("test earlier data with its earlier index attributes fails verification")
+	earlierPath := GetStorePath("binding-earlier")
+	earlier, err := getIndex(earlierPath)
+	if err != nil {
+		t.Fatalf("could not read index '%q'", err)
+	}
+	dataMap := make(map[string]*entryData)
+	for key, source := range map[string]string{"prod/db": earlierPath, "test/db": storePath} {
+		sourceFile := map[string]*storeFile{earlierPath: earlier, storePath: file}[source]
+		start, length, err := dataRange(source, sourceFile.version, sourceFile.index[key].offset)
+		if err != nil {
+			t.Fatalf("could not locate data '%q'", err)
+		}
+		file.entry(key).attributes = sourceFile.attributes(key)
+		dataMap[key] = &entryData{source: source, start: start, length: length}
+	}
+	if err = writeStore(storePath+".rolled", file, dataMap); err != nil {
+		t.Fatalf("could not write store '%q'", err)
+	}
+	if err = os.Rename(storePath+".rolled", storePath); err != nil {
+		t.Fatalf("could not replace store '%q'", err)
+	}
+	if _, err = GetMapValue(path, "prod/db", secret); err != IndexVerificationFailedState {
+		t.Errorf("Expected %q, received %q", IndexVerificationFailedState, err)
+	}
+
+	cleanup(path, t)
+	cleanup("binding-earlier", t)
+}
+
+func TestDataLengthBounds(t *testing.T) {
+
+	path := "."
+	cleanup(path, t)
+
+	secret := NewSecret([]byte("password01"), nil)
+	if err := SetMapValue(path, "key", "value", secret); err != nil {
+		t.Errorf("could not set map value '%q'", err)
+	}
+	storePath := GetStorePath(path)
+	file, err := getIndex(storePath)
+	if err != nil {
+		t.Fatalf("could not read index '%q'", err)
+	}
+	offset := file.index["key"].offset
+
+	fmt.Println("test a damaged data length is refused before it is allocated")
+	fo, err := os.OpenFile(storePath, os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fo.WriteAt([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f}, int64(offset))
+	if closeErr := fo.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = getData(storePath, file.version, offset); !invalidFormat(err) {
+		t.Errorf("expected invalid format error, but got '%q'", err)
+	}
+
+	fmt.Println("test a truncated store is refused")
+	cleanup(path, t)
+	if err := SetMapValue(path, "key", "value", secret); err != nil {
+		t.Errorf("could not set map value '%q'", err)
+	}
+	if file, err = getIndex(storePath); err != nil {
+		t.Fatalf("could not read index '%q'", err)
+	}
+	offset = file.index["key"].offset
+	if err = os.Truncate(storePath, int64(offset)+12); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = getData(storePath, file.version, offset); !invalidFormat(err) {
+		t.Errorf("expected invalid format error, but got '%q'", err)
+	}
+
+	fmt.Println("test damaged header field and index key lengths are refused before they are allocated")
+	for _, length := range []uint32{0xffffffff, 0x3fffffff} {
+		cleanup(path, t)
+		if err := SetMapValue(path, "key", "value", secret); err != nil {
+			t.Errorf("could not set map value '%q'", err)
+		}
+		content, err := ioutil.ReadFile(storePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyAt := bytes.Index(content, append([]byte{3, 0, 0, 0}, "key"...))
+		if keyAt < 0 {
+			t.Fatal("could not find the index key")
+		}
+
+		// the first header field's length follows the magic, the field count and its tag
+		for _, at := range []int{len(magic) + 1 + 4 + 2, keyAt} {
+			damaged := append([]byte{}, content...)
+			binary.LittleEndian.PutUint32(damaged[at:], length)
+			if err = ioutil.WriteFile(storePath, damaged, 0600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err = getIndex(storePath); !invalidFormat(err) {
+				t.Errorf("expected invalid format error, but got '%q'", err)
+			}
+		}
+	}
+
+	cleanup(path, t)
+}
+
+func invalidFormat(err error) bool {
+	state, ok := err.(*State)
+	return ok && state.Code() == InvalidFormatError("").Code()
+}
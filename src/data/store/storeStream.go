@@ -0,0 +1,283 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"keepo/src/crypto"
+	"os"
+	"time"
+)
+
+// SetMapStream seals the value read from reader chunk by chunk, so values of any size are stored
+// without being held in memory. The key's existing metadata is kept, passed to update when given.
+func SetMapStream(path, dataKey string, reader io.Reader, secret *Secret, update func(metadata *Metadata)) (err error) {
+	storePath, file, storeSecret, err := openStore(path, secret, true)
+	if err != nil {
+		return err
+	}
+	defer storeSecret.Destroy()
+	unsealedSecret := storeSecret.Key()
+
+	var metadata Metadata
+	if _, ok := file.index[dataKey]; ok {
+		entry, err := readRecord(storePath, file, dataKey, unsealedSecret)
+		if err != nil {
+			return err
+		}
+		metadata = entry.Metadata
+	}
+	if update != nil {
+		update(&metadata)
+	}
+
+	dataMap, err := loadDataMap(storePath, file, unsealedSecret, func(key string) bool {
+		return key == dataKey
+	})
+	if err != nil {
+		return err
+	}
+
+	// each stream has its own key, sealed in the record so the stream is bound with it
+	streamKey := crypto.GenerateSecretBuffer()
+	defer streamKey.Destroy()
+	record, err := sealEntry(file, dataKey, &Entry{Value: []byte{}, Metadata: metadata, streamKey: streamKey.Bytes()}, unsealedSecret)
+	if err != nil {
+		return err
+	}
+	dataMap[dataKey] = &entryData{stream: func(w io.Writer) error {
+		err := writeBytes(w, record)
+		if err != nil {
+			return err
+		}
+
+		stream, err := crypto.NewStreamWriter(w, streamKey.Key())
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(stream, reader)
+		if err != nil {
+			return err
+		}
+		return stream.Close()
+	}}
+	file.entry(dataKey).attributes.set(streamedAttribute, []byte{1})
+	file.setRotated(dataKey, time.Now())
+	file.setModified(dataKey, time.Now())
+
+	err = set(storePath, file, dataMap)
+	if err != nil {
+		return err
+	}
+	return audit(storePath, file, unsealedSecret, "set", dataKey)
+}
+
+// GetMapStream writes the value for a key to writer, streamed values are decrypted chunk by chunk,
+// and gives back the key's metadata
+func GetMapStream(path, dataKey string, writer io.Writer, secret *Secret) (metadata Metadata, err error) {
+	storePath, file, storeSecret, err := openStoreReader(path, secret)
+	if err != nil {
+		return metadata, err
+	}
+	defer storeSecret.Destroy()
+	unsealedSecret := storeSecret.Key()
+
+	if _, ok := file.index[dataKey]; !ok {
+		return metadata, ValueAbsentState
+	}
+	if err = audit(storePath, file, unsealedSecret, "get", dataKey); err != nil {
+		return metadata, err
+	}
+
+	if !file.streamed(dataKey) {
+		entry, err := readEntry(storePath, file, dataKey, unsealedSecret)
+		if err != nil {
+			return metadata, err
+		}
+		_, err = writer.Write(entry.Value)
+		crypto.Wipe(entry.Value)
+		return entry.Metadata, err
+	}
+
+	fi, stream, entry, err := openStreamedValue(storePath, file, dataKey, unsealedSecret)
+	if err != nil {
+		return metadata, err
+	}
+	defer func() {
+		if err := fi.Close(); err != nil {
+			panic(err)
+		}
+	}()
+
+	defer crypto.Wipe(entry.streamKey)
+
+	_, err = io.Copy(writer, stream)
+	return entry.Metadata, err
+}
+
+// readRecord reads an entry's metadata, along with its value unless that is streamed
+func readRecord(storePath string, file *storeFile, dataKey string, unsealedSecret *[crypto.SecretSize]byte) (*Entry, error) {
+	if file.streamed(dataKey) {
+		return readStreamedRecord(storePath, file, dataKey, unsealedSecret)
+	}
+	return readEntry(storePath, file, dataKey, unsealedSecret)
+}
+
+func readStreamedRecord(storePath string, file *storeFile, dataKey string, unsealedSecret *[crypto.SecretSize]byte) (*Entry, error) {
+	fi, _, entry, err := openStreamedValue(storePath, file, dataKey, unsealedSecret)
+	if err != nil {
+		return nil, err
+	}
+	return entry, fi.Close()
+}
+
+func readStreamedEntry(storePath string, file *storeFile, dataKey string, unsealedSecret *[crypto.SecretSize]byte) (*Entry, error) {
+	fi, stream, entry, err := openStreamedValue(storePath, file, dataKey, unsealedSecret)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := fi.Close(); err != nil {
+			panic(err)
+		}
+	}()
+
+	value, err := ioutil.ReadAll(io.LimitReader(stream, MaxValueSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(value) > MaxValueSize {
+		return nil, ValueTooLargeError(len(value))
+	}
+	entry.Value = value
+	return entry, nil
+}
+
+// openStreamedValue opens the store at a streamed entry, returning its record and a reader for
+// its value, the file is left for the caller to close
+func openStreamedValue(storePath string, file *storeFile, dataKey string, unsealedSecret *[crypto.SecretSize]byte) (fi *os.File, stream io.Reader, entry *Entry, err error) {
+	start, length, err := dataRange(storePath, file.version, file.index[dataKey].offset)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	fi, err = os.Open(storePath)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	_, err = fi.Seek(int64(start), io.SeekStart)
+	var record []byte
+	if err == nil {
+		record, err = readBytes(fi)
+	}
+	if err != nil {
+		_ = fi.Close()
+		return nil, nil, nil, InvalidFormatError("could not open streamed entry: " + dataKey)
+	}
+
+	entry, err = openEntry(file, dataKey, record, unsealedSecret)
+	if err == nil && file.grantID != nil && entry.streamKey == nil {
+		// streams from before stream keys are sealed with the store secret itself
+		err = GrantDeniedState
+	}
+	if err == nil {
+		streamLength := int64(length) - 4 - int64(len(record))
+		stream, err = crypto.NewStreamReader(io.LimitReader(fi, streamLength), entry.streamSecret(unsealedSecret))
+	}
+	if err != nil {
+		_ = fi.Close()
+		return nil, nil, nil, err
+	}
+	return fi, stream, entry, nil
+}
+
+// restreamData copies a streamed value as it is behind a newly sealed record for the entry or,
+// rekeyed, decrypts it and encrypts it again under a new stream key, so the stream key of the
+// previous record no longer opens it
+func restreamData(storePath string, file *storeFile, dataKey string, entry *Entry, unsealedSecret *[crypto.SecretSize]byte, rekey bool) (*entryData, error) {
+	start, length, err := dataRange(storePath, file.version, file.index[dataKey].offset)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Open(storePath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := fi.Close(); err != nil {
+			panic(err)
+		}
+	}()
+
+	var recordLength uint32
+	_, err = fi.Seek(int64(start), io.SeekStart)
+	if err == nil {
+		err = binary.Read(fi, binary.LittleEndian, &recordLength)
+	}
+	if err != nil {
+		return nil, InvalidFormatError("could not read streamed entry: " + dataKey)
+	}
+	valueStart := start + 4 + uint64(recordLength)
+	valueLength := length - 4 - uint64(recordLength)
+
+	sealedKey := entry.streamKey
+	var previousKey, streamKey [crypto.SecretSize]byte
+	if rekey {
+		copy(previousKey[:], entry.streamSecret(unsealedSecret)[:])
+		streamKey = crypto.GenerateSecret()
+		sealedKey = streamKey[:]
+	}
+
+	sealed, err := sealEntry(file, dataKey, &Entry{Value: []byte{}, Metadata: entry.Metadata, streamKey: sealedKey}, unsealedSecret)
+	if err != nil {
+		return nil, err
+	}
+	var record bytes.Buffer
+	err = writeBytes(&record, sealed)
+	if err != nil {
+		return nil, err
+	}
+	if !rekey {
+		return &entryData{data: record.Bytes(), source: storePath, start: valueStart, length: uint64(record.Len()) + valueLength}, nil
+	}
+
+	// streams of the same value have the same length, so the data length is known up front
+	return &entryData{length: uint64(record.Len()) + valueLength, stream: func(w io.Writer) error {
+		defer crypto.Wipe(previousKey[:])
+		defer crypto.Wipe(streamKey[:])
+
+		fi, err := os.Open(storePath)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := fi.Close(); err != nil {
+				panic(err)
+			}
+		}()
+
+		_, err = fi.Seek(int64(valueStart), io.SeekStart)
+		if err != nil {
+			return InvalidFormatError("could not read streamed entry: " + dataKey)
+		}
+		reader, err := crypto.NewStreamReader(io.LimitReader(fi, int64(valueLength)), &previousKey)
+		if err != nil {
+			return err
+		}
+
+		if _, err = w.Write(record.Bytes()); err != nil {
+			return err
+		}
+		stream, err := crypto.NewStreamWriter(w, &streamKey)
+		if err != nil {
+			return err
+		}
+		if _, err = io.Copy(stream, reader); err != nil {
+			return err
+		}
+		return stream.Close()
+	}}, nil
+}
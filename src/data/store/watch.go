@@ -0,0 +1,100 @@
+package store
+
+import (
+	"os"
+	"sort"
+	"time"
+)
+
+/**
+ * Stores are watched through the store directory, each store is replaced by renaming a new file
+ * over it, so a store renamed into place or removed is read again and its key versions compared
+ * with those read before. Values are never read, changes carry the key alone.
+ */
+
+// KeyChange is a key added, changed or removed in a store, it never carries the value
+type KeyChange struct {
+	Store  string `json:"store"`
+	Key    string `json:"key"`
+	Change Change `json:"change"`
+}
+
+// KeyVersions reads when each of the store's keys was last set from its index, no secret is
+// needed. A store that is absent has no keys.
+func KeyVersions(path string) (versions map[string]time.Time, err error) {
+	file, err := getIndex(GetStorePath(path))
+	if os.IsNotExist(err) {
+		return map[string]time.Time{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	versions = make(map[string]time.Time, len(file.index))
+	for _, key := range file.keys() {
+		versions[key] = file.modified(key)
+	}
+	return versions, nil
+}
+
+// CompareVersions gives the changes from one reading of a store's key versions to the next for
+// the keys in the subtree at prefix, ordered by key
+func CompareVersions(storeName, prefix string, before, after map[string]time.Time) (changes []KeyChange) {
+	for key, modified := range after {
+		if !InSubtree(key, prefix) {
+			continue
+		}
+		if previous, ok := before[key]; !ok {
+			changes = append(changes, KeyChange{Store: storeName, Key: key, Change: Added})
+		} else if !previous.Equal(modified) {
+			changes = append(changes, KeyChange{Store: storeName, Key: key, Change: Changed})
+		}
+	}
+	for key := range before {
+		if _, ok := after[key]; !ok && InSubtree(key, prefix) {
+			changes = append(changes, KeyChange{Store: storeName, Key: key, Change: Removed})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Key < changes[j].Key })
+	return changes
+}
+
+// storeVersions holds the key versions of each store watched as they were last read
+type storeVersions map[string]map[string]time.Time
+
+// readVersions reads the key versions of the store watched, or of every store when none is named
+func readVersions(storeName string) (storeVersions, error) {
+	names := []string{storeName}
+	if len(storeName) == 0 {
+		var err error
+		if names, err = GetStoreNames(); err != nil {
+			return nil, err
+		}
+	}
+	versions := make(storeVersions, len(names))
+	for _, name := range names {
+		read, err := KeyVersions(name)
+		if err != nil {
+			return nil, err
+		}
+		versions[name] = read
+	}
+	return versions, nil
+}
+
+// update reads the store's key versions again and sends the changes to the keys under the prefix,
+// it reports false when stop closed before they were all sent
+func (v storeVersions) update(storeName, prefix string, stop <-chan struct{}, changes chan<- KeyChange) (bool, error) {
+	after, err := KeyVersions(storeName)
+	if err != nil {
+		return true, err
+	}
+	for _, change := range CompareVersions(storeName, prefix, v[storeName], after) {
+		select {
+		case changes <- change:
+		case <-stop:
+			return false, nil
+		}
+	}
+	v[storeName] = after
+	return true, nil
+}
@@ -0,0 +1,88 @@
+package store
+
+import (
+	"bytes"
+	"golang.org/x/sys/unix"
+	"os"
+	"path/filepath"
+	"strings"
+	"unsafe"
+)
+
+// watchMask selects the events that replace, create or remove a store in the store directory
+const watchMask = unix.IN_MOVED_TO | unix.IN_MOVED_FROM | unix.IN_CLOSE_WRITE | unix.IN_DELETE
+
+// WatchStore sends the changes to the store's keys under the prefix until stop is closed, every
+// store is watched when none is named. The store directory is watched with inotify.
+func WatchStore(storeName, prefix string, stop <-chan struct{}, changes chan<- KeyChange) error {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return err
+	}
+	// a non-blocking file is read through the runtime poller, so closing it ends a read
+	events := os.NewFile(uintptr(fd), "inotify")
+	defer events.Close()
+	if _, err = unix.InotifyAddWatch(fd, GetStoreDirectory(), watchMask); err != nil {
+		return err
+	}
+
+	versions, err := readVersions(storeName)
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stop:
+			_ = events.Close()
+		case <-done:
+		}
+	}()
+
+	buffer := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		read, err := events.Read(buffer)
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, name := range changedStores(buffer[:read]) {
+			if len(storeName) > 0 && name != storeName {
+				continue
+			}
+			if ok, err := versions.update(name, prefix, stop, changes); !ok || err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// changedStores gives the stores named by the events read, in the order they were first named
+func changedStores(events []byte) (names []string) {
+	seen := make(map[string]bool)
+	for offset := 0; offset+unix.SizeofInotifyEvent <= len(events); {
+		event := (*unix.InotifyEvent)(unsafe.Pointer(&events[offset]))
+		start := offset + unix.SizeofInotifyEvent
+		offset = start + int(event.Len)
+		if event.Len == 0 || offset > len(events) {
+			continue
+		}
+
+		name := string(bytes.TrimRight(events[start:offset], "\x00"))
+		if !strings.HasSuffix(name, Extension) || filepath.Base(name) != name {
+			continue
+		}
+		name = strings.TrimSuffix(name, Extension)
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
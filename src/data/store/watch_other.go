@@ -0,0 +1,51 @@
+//go:build !linux
+
+package store
+
+import "time"
+
+// pollInterval is how often stores are read for changes where inotify is missing
+const pollInterval = time.Second
+
+// WatchStore sends the changes to the store's keys under the prefix until stop is closed, every
+// store is watched when none is named. Without inotify the stores are read every pollInterval.
+func WatchStore(storeName, prefix string, stop <-chan struct{}, changes chan<- KeyChange) error {
+	versions, err := readVersions(storeName)
+	if err != nil {
+		return err
+	}
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+		}
+
+		names := []string{storeName}
+		if len(storeName) == 0 {
+			if names, err = GetStoreNames(); err != nil {
+				return err
+			}
+			// stores removed since the last reading are read as absent
+			for name := range versions {
+				names = appendMissing(names, name)
+			}
+		}
+		for _, name := range names {
+			if ok, err := versions.update(name, prefix, stop, changes); !ok || err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func appendMissing(names []string, name string) []string {
+	for _, existing := range names {
+		if existing == name {
+			return names
+		}
+	}
+	return append(names, name)
+}
@@ -0,0 +1,60 @@
+package store
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestWatchStore(t *testing.T) {
+
+	path := "."
+	cleanup(path, t)
+
+	secret := func() *Secret { return NewSecret([]byte("password01"), nil) }
+	for key, value := range map[string]string{"db/password": "before", "db/user": "before", "api/key": "before"} {
+		if err := SetMapValue(path, key, value, secret()); err != nil {
+			t.Errorf("could not set map value '%q'", err)
+		}
+	}
+
+	stop, changes, ended := make(chan struct{}), make(chan KeyChange, 8), make(chan error, 1)
+	go func() { ended <- WatchStore(path, "db", stop, changes) }()
+	time.Sleep(20 * time.Millisecond)
+
+	fmt.Println("test keys added, changed and removed under the prefix are watched")
+	if err := SetMapValue(path, "db/password", "after", secret()); err != nil {
+		t.Errorf("could not set map value '%q'", err)
+	}
+	if err := SetMapValue(path, "db/host", "after", secret()); err != nil {
+		t.Errorf("could not set map value '%q'", err)
+	}
+	if err := ClearMapValue(path, "db/user", secret()); err != nil {
+		t.Errorf("could not clear map value '%q'", err)
+	}
+	if err := SetMapValue(path, "api/key", "after", secret()); err != nil {
+		t.Errorf("could not set map value '%q'", err)
+	}
+
+	want := map[string]Change{"db/password": Changed, "db/host": Added, "db/user": Removed}
+	received := make(map[string]Change)
+	for deadline := time.After(5 * time.Second); len(received) < len(want); {
+		select {
+		case change := <-changes:
+			received[change.Key] = change.Change
+		case <-deadline:
+			t.Fatalf("Expected %v, received %v", want, received)
+		}
+	}
+	for key, change := range want {
+		if received[key] != change {
+			t.Errorf("Expected %s %s, received %v", key, change, received)
+		}
+	}
+
+	close(stop)
+	if err := <-ended; err != nil {
+		t.Errorf("could not watch store '%q'", err)
+	}
+	cleanup(path, t)
+}
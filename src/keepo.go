@@ -1,217 +1,2102 @@
 package main
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"keepo/src/cli"
+	"keepo/src/crypto"
+	"keepo/src/data/gitsync"
 	"keepo/src/data/input"
 	"keepo/src/data/output"
 	"keepo/src/data/store"
+	"keepo/src/mount"
+	"keepo/src/server"
+	"keepo/src/strength"
 	"keepo/src/util"
+	"log"
 	"math/rand"
 	"os"
+	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
+	"unicode/utf8"
 )
 
 const version = 1.2
 
+// maxKeyFileSize bounds the key files read, generated ones hold a random secret
+const maxKeyFileSize = 1 << 20
+
+// expiringSoon is how far ahead list flags values that are about to expire
+const expiringSoon = 14 * 24 * time.Hour
+
+// mountTimeout is how long a mount goes unused before it is unmounted, unless --timeout is given
+const mountTimeout = 15 * time.Minute
+
+// tokenVariable names the environment variable a grant token may be given in
+const tokenVariable = "KEEPO_TOKEN"
+
+// breachVariable names the environment variable a breach dataset may be given in
+const breachVariable = "KEEPO_BREACHES"
+
+// maxCheckedSize bounds the values read from a file or stdin that are checked for strength, longer
+// ones are files rather than typed or pasted passwords
+const maxCheckedSize = 4096
+
+// mergeCommandName is the hidden command git runs to merge two copies of a store
+const mergeCommandName = "__merge"
+
+// maxShareSize bounds the share lines read, a store secret's share is well within it
+const maxShareSize = 1024
+
+var format = output.Text
+
 func main() {
-	arguments := os.Args[1:]
-	show, clip, pass := parameterSearch(arguments)
-	arguments = commandSearch(arguments)
-	processCommand(arguments, show, clip, pass)
-}
-
-func printUsage() {
-	boldOpen := "\033[1m"
-	boldClose := "\033[0m"
-	fmt.Println(
-		"version: " + boldOpen +  strconv.FormatFloat(version, 'f', 1, 64) + boldClose +
-			"\n\n" +
-			"Keepo is a utility for managing key-value stores" +
-			"\n\n" +
-			"usage: " + boldOpen + "keepo [options] <command>" + boldClose +
-			"\n\n" +
-			"commands:\n\n" +
-			"\t" + boldOpen + "list \t[store]" + boldClose + "\t\t\t" + "list status and keys for store (omit for all stores)" +
-			"\n\n" +
-			"\t" + boldOpen + "set \t[store:]<key> [value]" + boldClose + "\t" + "sets a key and its value (omit for random value)" +
-			"\n\n" +
-			"\t" + boldOpen + "get \t[store:]<key>" + boldClose + "\t\t" + "gets the value for a key" +
-			"\n\n" +
-			"\t" + boldOpen + "clear \t[store:]<key>" + boldClose + "\t\t" + "clears the key/value" +
-			"\n\n" +
-			"\toptions:\n" +
-			"\t\t" + boldOpen + "-s, --show" + boldClose + "\t\tsend output to stdout\n" +
-			"\t\t" + boldOpen + "-c, --copy" + boldClose + "\t\tcopy output to clipboard\n" +
-			"\t\t" + boldOpen + "-p, --pass" + boldClose + "\t\tnext argument will be passphrase" +
-			"\n")
-}
-
-func parameterSearch(parameters []string) (show bool, clip bool, pass string) {
-	show, clip, pass = false, false, ""
-	for index := 0; index < len(parameters); index++ {
-		switch parameters[index] {
-		case "-s", "--show":
-			show = true
-		case "-c", "--copy":
-			clip = true
-		case "-p", "--pass":
-			pass = parameters[index + 1]
-		}
-	}
-	return show, clip, pass
-}
-
-func commandSearch(parameters []string) (command []string) {
-	for index := 0; index < len(parameters); index++ {
-		switch parameters[index] {
-		case "list", "get", "set", "clear":
-			return parameters[index:]
+	app := newApp()
+	err := app.Execute(os.Args[1:])
+	if usageError, ok := err.(*cli.UsageError); ok {
+		util.Fail(util.UsageCode, usageError.Error()+"\n"+app.Hint(usageError))
+	}
+}
+
+func newApp() (app *cli.App) {
+	keyArgument := func(index int, current string) []string {
+		if index == 0 {
+			return completeKeys(current)
 		}
+		return nil
 	}
-	return nil
+
+	metadataFlags := []cli.Flag{
+		{Long: "url", Value: "url", Usage: "url the value is used at"},
+		{Long: "tags", Value: "tags", Usage: "comma separated tags"},
+		{Long: "notes", Value: "notes", Usage: "free text notes"},
+		{Long: "expires", Value: "date|age", Usage: "when the value expires, e.g. 2030-01-31 or 90d from now, 'never' clears it"},
+		{Long: "max-age", Value: "age", Usage: "longest the value is used before it must be rotated, e.g. 90d, 'never' clears it"},
+	}
+
+	breachFlag := cli.Flag{Long: "breaches", Value: "path",
+		Usage: "breach dataset of SHA-1 range files or one ordered hash file (or $" + breachVariable + ")"}
+
+	exportKeysFlag := cli.Flag{Long: "keys", Value: "glob,...", Usage: "comma separated keys to include, '*' also matches '/' (default all)"}
+	exportEncryptFlag := cli.Flag{Long: "encrypt", Short: "e", Usage: "seal the output with the store's passphrase or key file"}
+
+	storeFlag := cli.Flag{Long: "store", Value: "store", Usage: "store to use, the whole argument is then the key",
+		Complete: completeStores}
+
+	app = &cli.App{
+		Name:    "keepo",
+		Summary: "Keepo is a utility for managing key-value stores",
+		Version: strconv.FormatFloat(version, 'f', 1, 64),
+		Flags: []cli.Flag{
+			{Long: "pass", Short: "p", Value: "passphrase", Usage: "passphrase for the store (prompted for when omitted)"},
+			{Long: "key-file", Short: "k", Value: "path", Usage: "key file for stores that require one"},
+			{Long: "token", Value: "token", Usage: "grant token to read with in place of the passphrase (or $" + tokenVariable + ")"},
+			{Long: "output", Short: "o", Value: "format", Usage: "output format: json, yaml or text",
+				Complete: func() []string { return []string{"json", "yaml", "text"} }},
+		},
+		Before: func(context *cli.Context) {
+			if len(context.String("output")) > 0 {
+				selected, err := output.ParseFormat(context.String("output"))
+				util.CheckError(err, "could not select output format")
+				format = selected
+			}
+			util.SetErrorFormat(format)
+		},
+	}
+
+	app.Commands = []*cli.Command{
+		{Name: "list", Args: "[store[:prefix/]]", Summary: "list status and keys for store (omit for all stores)",
+			Help:    "a prefix limits the listing to the keys beneath it, e.g. 'keepo list db:prod/'",
+			MaxArgs: 1, Complete: keyArgument, Run: runList,
+			Flags: []cli.Flag{storeFlag}},
+		{Name: "set", Args: "[store:]<key> [value]", Summary: "sets a key and its value (omit for random value)",
+			Help:    "the store ends at the first colon, later colons belong to the key, and '\\:' escapes a colon in the store part",
+			MinArgs: 1, MaxArgs: 2, Complete: keyArgument, Run: runSet,
+			Flags: append([]cli.Flag{storeFlag,
+				{Long: "from-file", Short: "f", Value: "path", Usage: "read the value from a file, binary values are kept exactly"},
+				{Long: "stdin", Usage: "read the value from stdin, so it never appears in the process list"},
+				breachFlag,
+			}, metadataFlags...)},
+		{Name: "get", Args: "[store:]<key>", Summary: "gets the value for a key",
+			MinArgs: 1, MaxArgs: 1, Complete: keyArgument, Run: runGet,
+			Flags: []cli.Flag{
+				{Long: "show", Short: "s", Usage: "send output to stdout"},
+				{Long: "copy", Short: "c", Usage: "copy output to clipboard"},
+				{Long: "to-file", Short: "t", Value: "path", Usage: "write the value to a file readable only by you"},
+				storeFlag,
+			}},
+		{Name: "clear", Args: "[store:]<key>", Summary: "clears the key/value",
+			MinArgs: 1, MaxArgs: 1, Complete: keyArgument, Run: runClear,
+			Flags: []cli.Flag{
+				{Long: "recursive", Short: "r", Usage: "clear the key and every key beneath it"},
+				storeFlag,
+			}},
+		{Name: "meta", Args: "[store:]<key>", Summary: "shows or sets the metadata for a key",
+			Help:    "metadata is sealed with the value, options given replace that field and others are kept",
+			MinArgs: 1, MaxArgs: 1, Complete: keyArgument, Run: runMeta,
+			Flags: append([]cli.Flag{storeFlag}, metadataFlags...)},
+		{Name: "find", Args: "<pattern>", Summary: "finds keys matching a glob across every store",
+			Help: "matches are printed as store:key, '*' also matches '/', and with --metadata the url,\n" +
+				"tags and notes of each store the passphrase unlocks are searched as well",
+			MinArgs: 1, MaxArgs: 1, Run: runFind,
+			Flags: []cli.Flag{
+				{Long: "regex", Short: "e", Usage: "the pattern is a regular expression matched anywhere"},
+				{Long: "metadata", Short: "m", Usage: "unlock stores to search their metadata"},
+			}},
+		{Name: "pick", Args: "[store]", Summary: "fuzzy find a key as you type and copy its value",
+			Help: "type to filter, arrows or ctrl-n/ctrl-p to move, enter to choose and escape to cancel,\n" +
+				"without a store every store the passphrase unlocks is offered",
+			MaxArgs: 1, Complete: func(index int, current string) []string { return completeStores() },
+			Run: runPick,
+			Flags: []cli.Flag{
+				{Long: "show", Short: "s", Usage: "send the value to stdout instead of the clipboard"},
+			}},
+		{Name: "keyfile", Args: "gen <path> | require <store> <passphrase|keyfile|both>",
+			Summary: "create a key file or choose the factors a store is unlocked with",
+			Help: "'gen' writes a new random key file readable only by you, 'require' reseals the store so it is\n" +
+				"unlocked with its passphrase, the key file given with --key-file, or both",
+			MinArgs: 2, MaxArgs: 3, Run: runKeyFile,
+			Complete: func(index int, current string) []string {
+				switch index {
+				case 0:
+					return []string{"gen", "require"}
+				case 2:
+					return []string{"both", "keyfile", "passphrase"}
+				}
+				return nil
+			}},
+		{Name: "recovery", Args: "split [store] | restore [store]",
+			Summary: "split a store's secret into shares or restore the store from them",
+			Help: "'split' prints shares to hand to different people, any --threshold of them restore the store.\n" +
+				"'restore' reads shares from stdin one per line and then sets a new passphrase",
+			MinArgs: 1, MaxArgs: 2, Run: runRecovery,
+			Complete: func(index int, current string) []string {
+				if index == 0 {
+					return []string{"restore", "split"}
+				}
+				return completeStores()
+			},
+			Flags: []cli.Flag{
+				{Long: "shares", Value: "count", Usage: "number of shares to split into (default 5)"},
+				{Long: "threshold", Value: "count", Usage: "number of shares that restore the store (default 3)"},
+			}},
+		{Name: "expiring", Args: "[store]", Summary: "list values that expire soon, failing when any has expired",
+			Help:    "meant for cron jobs, every store is checked when none is given, no passphrase is needed",
+			MaxArgs: 1, Complete: func(index int, current string) []string { return completeStores() },
+			Run: runExpiring,
+			Flags: []cli.Flag{
+				{Long: "within", Value: "age", Usage: "how far ahead to look, e.g. 14d (default 14d)"},
+			}},
+		{Name: "policy", Args: "[store]", Summary: "shows or sets a store's expiry and strength policy",
+			Help: "the store's max age applies to values without their own, and with --refuse-expired\n" +
+				"'get' and 'pick' refuse values that have expired until they are set again. Values set\n" +
+				"weaker than --min-strength, from 0 to 4, or found in breaches are warned of, or rejected\n" +
+				"with --reject-weak. Each write first copies the store into the backups directory beside it,\n" +
+				"keeping the last --backups copies",
+			MaxArgs: 1, Complete: func(index int, current string) []string { return completeStores() },
+			Run: runPolicy,
+			Flags: []cli.Flag{
+				{Long: "max-age", Value: "age", Usage: "default max age of the store's values, e.g. 90d, 'never' clears it"},
+				{Long: "refuse-expired", Usage: "refuse to get expired values"},
+				{Long: "allow-expired", Usage: "get expired values again"},
+				{Long: "min-strength", Value: "score", Usage: "least strength of the values set (default 3)"},
+				{Long: "reject-weak", Usage: "reject weak values rather than warn of them"},
+				{Long: "warn-weak", Usage: "warn of weak values and set them anyway"},
+				{Long: "backups", Value: "count", Usage: "copies kept of the store before each write, 0 for none (default 5)"},
+			}},
+		{Name: "grant", Args: "--keys <[store:]glob> --read-only | --list [store]",
+			Summary: "grant read only access to some keys with a token",
+			Help: "the token printed reads the keys matching the glob, including those set later, e.g.\n" +
+				"'keepo --token <token> get db:password', and never changes the store",
+			MaxArgs: 1, Complete: func(index int, current string) []string { return completeStores() },
+			Run: runGrant,
+			Flags: []cli.Flag{
+				{Long: "keys", Value: "[store:]glob", Usage: "keys to grant, '*' also matches '/'"},
+				{Long: "read-only", Usage: "grant reading only, the one kind of grant there is"},
+				{Long: "list", Usage: "list the grants of the store with the keys they cover"},
+			}},
+		{Name: "revoke", Args: "[store] <grant-id>", Summary: "revoke a grant so its token reads nothing",
+			Help:    "the entries the grant covered are resealed under new keys",
+			MinArgs: 1, MaxArgs: 2, Run: runRevoke,
+			Complete: func(index int, current string) []string {
+				if index == 0 {
+					return completeStores()
+				}
+				return nil
+			}},
+		{Name: "audit", Args: "[store]", Summary: "show and verify a store's audit log, or start or stop it",
+			Help: "the log records each get, set, clear, list and change of factors or grants with its time\n" +
+				"and user, sealed and hash chained so a changed or removed record fails verification",
+			MaxArgs: 1, Complete: func(index int, current string) []string { return completeStores() },
+			Run: runAudit,
+			Flags: []cli.Flag{
+				{Long: "enable", Usage: "start keeping the audit log"},
+				{Long: "disable", Usage: "stop keeping the audit log, the log is kept"},
+			}},
+		{Name: "audit-passwords", Args: "[store]", Summary: "check the strength of stored values and find reused ones",
+			Help: "values short enough to be passwords are scored, looked up in the breach dataset when one\n" +
+				"is given and compared across keys, every store the passphrase unlocks is checked when none is given",
+			MaxArgs: 1, Complete: func(index int, current string) []string { return completeStores() },
+			Run:   runAuditPasswords,
+			Flags: []cli.Flag{breachFlag}},
+		{Name: "sync", Summary: "commit store changes to git and pull and push them to a remote",
+			Help: "the store directory is kept as a git repository, with --remote the remote is set, e.g. a\n" +
+				"bare repository, and changes made elsewhere are merged entry by entry, the later change to\n" +
+				"an entry winning, without a passphrase",
+			MaxArgs: 0, Run: runSync,
+			Flags: []cli.Flag{
+				{Long: "remote", Value: "url", Usage: "git remote to synchronise with, kept for later syncs"},
+			}},
+		{Name: "merge", Args: "<base> <ours> <theirs> --out <path>", Summary: "merge two diverged copies of a store file",
+			Help: "the copies and the base they were copied from are unlocked and merged key by key, keys\n" +
+				"changed in both are asked about unless --prefer is given",
+			MinArgs: 3, MaxArgs: 3, Run: runMerge,
+			Flags: []cli.Flag{
+				{Long: "out", Value: "path", Usage: "file to write the merged store to"},
+				{Long: "prefer", Value: "ours|theirs|newest", Usage: "resolve conflicts without asking"},
+			}},
+		{Name: "diff", Args: "<before> <after>", Summary: "show the keys added, removed and changed between two stores",
+			Help: "each side is a store file, a store name or store@revision for a store as synced at a git\n" +
+				"revision, e.g. 'keepo diff default@HEAD~1 default'. Changed values are shown by fingerprint,\n" +
+				"the same for equal values, unless --show-values is given",
+			MinArgs: 2, MaxArgs: 2, Run: runDiff,
+			Complete: func(index int, current string) []string { return completeStores() },
+			Flags: []cli.Flag{
+				{Long: "show-values", Usage: "show the values that changed rather than their fingerprints"},
+			}},
+		{Name: "backup", Args: "[store] --to <dir>", Summary: "copy stores into a directory, or bundle them into an archive",
+			Help: "each copy is named by its store and the time it was taken and checked against the store.\n" +
+				"With --archive the copies are bundled into one encrypted .kpb file, sealed with the\n" +
+				"passphrase and key file given, which hides the store and key names the copies show",
+			MaxArgs: 1, Complete: func(index int, current string) []string { return completeStores() },
+			Run: runBackup,
+			Flags: []cli.Flag{
+				{Long: "to", Value: "dir", Usage: "directory to write the backups to"},
+				{Long: "all", Short: "a", Usage: "back up every store"},
+				{Long: "archive", Usage: "bundle the copies into one encrypted archive"},
+			}},
+		{Name: "restore", Args: "<backup> [store]", Summary: "restore stores from a backup copy or archive",
+			Help: "every store in the backup is unlocked and read before any is replaced, and each store\n" +
+				"replaced is first copied into the backups directory beside it. A copy restores the store it\n" +
+				"was taken of unless another is named, an archive restores the store named or all it holds",
+			MinArgs: 1, MaxArgs: 2, Run: runRestore,
+			Complete: func(index int, current string) []string {
+				if index == 1 {
+					return completeStores()
+				}
+				return nil
+			}},
+		{Name: "k8s-secret", Args: "[store] --name <name>", Summary: "print a Kubernetes Secret manifest of a store's values",
+			Help: "every key is included unless --keys names some, with characters Kubernetes refuses in its\n" +
+				"name becoming '_'. With --seal the values are sealed to the sealed-secrets controller's\n" +
+				"certificate, and with --encrypt the manifest is sealed for 'keepo decrypt', either safe to commit",
+			MaxArgs: 1, Complete: func(index int, current string) []string { return completeStores() },
+			Run: runKubernetesSecret,
+			Flags: []cli.Flag{
+				{Long: "name", Short: "n", Value: "name", Usage: "name of the Secret"},
+				{Long: "namespace", Value: "namespace", Usage: "namespace of the Secret, needed with --seal"},
+				exportKeysFlag,
+				{Long: "seal", Value: "cert", Usage: "sealed-secrets certificate to write a SealedSecret for, e.g. from 'kubeseal --fetch-cert'"},
+				exportEncryptFlag,
+			}},
+		{Name: "dotenv", Args: "[store]", Summary: "print a store's values as an env file for docker's --env-file",
+			Help: "every key is included unless --keys names some, as a variable named by the key in upper case\n" +
+				"with other characters becoming '_'. Values are written literally as docker reads them, so\n" +
+				"values holding a line break are refused. With --encrypt the file is sealed for 'keepo decrypt'",
+			MaxArgs: 1, Complete: func(index int, current string) []string { return completeStores() },
+			Run: runDotenv,
+			Flags: []cli.Flag{exportKeysFlag, exportEncryptFlag}},
+		{Name: "decrypt", Args: "<path>", Summary: "print a manifest or env file written with --encrypt",
+			Help:    "the document is opened with the passphrase or key file of the store it was written from",
+			MinArgs: 1, MaxArgs: 1, Run: runDecrypt},
+		{Name: "watch", Args: "[store[:key]]", Summary: "print the keys added, changed and removed as stores change",
+			Help: "every store is watched when none is given, and a key watches it and the keys beneath it.\n" +
+				"Values are never read, so no passphrase is needed. With --exec each change runs the command\n" +
+				"with $KEEPO_STORE, $KEEPO_KEY and $KEEPO_CHANGE set, and with --pid the process is signalled",
+			MaxArgs: 1, Complete: keyArgument, Run: runWatch,
+			Flags: []cli.Flag{
+				{Long: "exec", Short: "e", Value: "command", Usage: "shell command to run on each change"},
+				{Long: "pid", Value: "pid", Usage: "process to signal on each change"},
+				{Long: "signal", Value: "signal", Usage: "signal sent to --pid, e.g. HUP or USR1 (default HUP)",
+					Complete: func() []string { return signalNames() }},
+			}},
+		{Name: "mount", Args: "[store] <mountpoint>", Summary: "mount a store as a filesystem with a file for each key",
+			Help: "each key is a file decrypted as it is read and each segment of a key a directory. Files are\n" +
+				"read-only unless --read-write is given, when closing a written file sets its key. The store is\n" +
+				"unmounted on interrupt, or once no file has been open for --timeout",
+			MinArgs: 1, MaxArgs: 2, Run: runMount,
+			Complete: func(index int, current string) []string {
+				if index == 0 {
+					return completeStores()
+				}
+				return nil
+			},
+			Flags: []cli.Flag{
+				{Long: "read-write", Short: "w", Usage: "let files be written, created and removed"},
+				{Long: "timeout", Short: "t", Value: "age", Usage: "unmount after going unused this long, e.g. 30m or 1d, 'never' keeps it (default 15m)"},
+			}},
+		{Name: "serve", Args: "--listen <unix:path|host:port>", Summary: "serve stores over an HTTP/JSON API to token holders",
+			Help: "the stores are unlocked once when the server starts, and each request needs an API token\n" +
+				"from 'keepo serve-token' as 'Authorization: Bearer <token>'. Addresses beyond loopback need\n" +
+				"TLS, and the API is described at /v1/openapi.json",
+			MaxArgs: 0, Run: runServe,
+			Flags: []cli.Flag{
+				{Long: "listen", Short: "l", Value: "address", Usage: "unix:<path> or host:port to listen on"},
+				{Long: "tokens", Value: "path", Usage: "file of API tokens (default tokens.json beside the stores)"},
+				{Long: "tls-cert", Value: "path", Usage: "certificate to serve TCP over TLS with"},
+				{Long: "tls-key", Value: "path", Usage: "private key of the TLS certificate"},
+				breachFlag,
+			}},
+		{Name: "serve-grpc", Args: "--socket <path>", Summary: "serve stores over gRPC on a Unix socket to token holders",
+			Help: "the service is described in src/api/keepo.proto and Go applications call it with the\n" +
+				"keepo/src/client package. Tokens from 'keepo serve-token' are given as 'authorization: Bearer'\n" +
+				"metadata",
+			MaxArgs: 0, Run: runServeGRPC,
+			Flags: []cli.Flag{
+				{Long: "socket", Short: "l", Value: "path", Usage: "Unix socket to listen on, readable by you alone"},
+				{Long: "tokens", Value: "path", Usage: "file of API tokens (default tokens.json beside the stores)"},
+				breachFlag,
+			}},
+		{Name: "serve-token", Args: "<name> --keys <[store:]glob,...> [--write] | <name> --remove | --list",
+			Summary: "add, remove or list the API tokens 'serve' and 'serve-grpc' accept",
+			Help: "the token is printed once and only its hash is kept. It reads the keys matching its globs,\n" +
+				"a glob in the store part matching stores by name, and sets and clears them with --write",
+			MaxArgs: 1, Run: runServeToken,
+			Flags: []cli.Flag{
+				{Long: "keys", Value: "[store:]glob,...", Usage: "comma separated keys the token covers, '*' also matches '/'"},
+				{Long: "write", Usage: "let the token set and clear the keys it covers"},
+				{Long: "remove", Usage: "remove the named token"},
+				{Long: "list", Usage: "list the tokens with the keys they cover"},
+				{Long: "tokens", Value: "path", Usage: "file of API tokens (default tokens.json beside the stores)"},
+			}},
+		{Name: mergeCommandName, Args: "<base> <ours> <theirs>", MinArgs: 3, MaxArgs: 3,
+			Run: func(context *cli.Context) {
+				err := store.MergeStores(context.Arguments[0], context.Arguments[1], context.Arguments[2])
+				checks("could not merge store", err)
+			}},
+		{Name: "completion", Args: "<bash|zsh|fish>", Summary: "print a shell completion script",
+			Help:    "load it with e.g. 'source <(keepo completion bash)'",
+			MinArgs: 1, MaxArgs: 1, Run: func(context *cli.Context) {
+				script, err := app.CompletionScript(context.Arguments[0])
+				util.CheckError(err, "could not generate completion")
+				fmt.Print(script)
+			},
+			Complete: func(index int, current string) []string { return []string{"bash", "fish", "zsh"} }},
+		{Name: cli.CompleteCommandName, Args: "<shell> <line>", MinArgs: 2, MaxArgs: 2,
+			Run: func(context *cli.Context) {
+				for _, candidate := range app.Complete(context.Arguments[0], context.Arguments[1]) {
+					fmt.Println(candidate)
+				}
+			}},
+	}
+	return app
 }
 
-func processCommand(arguments []string, show bool, clip bool, pass string) {
-	if arguments == nil {
-		printUsage()
-		os.Exit(0)
+func runList(context *cli.Context) {
+	if len(context.Arguments) > 0 || len(context.String("store")) > 0 {
+		storeName, prefix := getListedStoreAndPrefix(context)
+		listings := []storeListing{listStore(storeName, prefix)}
+		auditListings(context, listings)
+		printListings(listings)
 	} else {
+		listings := listAll()
+		auditListings(context, listings)
+		printListings(listings)
+	}
+}
+
+// auditListings records the listing in the log of each audited store listed, which unlocks them
+func auditListings(context *cli.Context, listings []storeListing) {
+	var audited []string
+	for _, listing := range listings {
+		if enabled, err := store.AuditEnabled(listing.Store); err == nil && enabled {
+			audited = append(audited, listing.Store)
+		}
+	}
+	if len(audited) == 0 {
+		return
+	}
+
+	secret := getSecret(context, audited...)
+	defer secret.Destroy()
+	for _, name := range audited {
+		err := store.AuditListing(name, secret)
+		checks("could not record the listing of '"+name+"'", err)
+	}
+}
+
+func runGet(context *cli.Context) {
+	storeName, KeyName := getStoreAndKeyName(context)
+
+	checks("could not get value", store.CheckExpiry(storeName, KeyName))
 
-		commandWord := arguments[0]
-		arguments = arguments[1:]
-		switch commandWord {
+	// values written to a file are streamed, so they need not fit in memory
+	secret := getSecret(context, storeName)
+	defer secret.Destroy()
 
-		case "list":
+	if path := context.String("to-file"); len(path) > 0 {
+		var metadata store.Metadata
+		err := writeValueFile(path, func(w io.Writer) (err error) {
+			metadata, err = store.GetMapStream(storeName, KeyName, w, secret)
+			return err
+		})
+		checks("could not write value to '"+path+"'", err)
+		printResult(commandResult{Store: storeName, Key: KeyName, Action: "get", Metadata: &metadata})
+		return
+	}
+
+	entry := getEntry(storeName, KeyName, secret)
+	util.CheckState(entry.Value != nil, fmt.Sprintf("expected key '%s' to have a value", KeyName))
+
+	deliverValue(storeName, KeyName, entry, context.Bool("show"), context.Bool("copy"))
+}
 
-			if len(arguments) > 0 {
-				listStore(arguments[0])
+// deliverValue copies the value to the clipboard and, when shown or not copied, prints it. The
+// value is moved into a secure buffer and wiped once delivered.
+func deliverValue(storeName, key string, entry *store.Entry, show, clip bool) {
+	value, err := crypto.NewBufferFrom(entry.Value)
+	util.CheckError(err, "could not allocate value")
+	defer value.Destroy()
+
+	if clip {
+		err := output.CopyToClipboard(value)
+		util.CheckError(err, "could not copy to clipboard")
+	}
+
+	result := commandResult{Store: storeName, Key: key, Action: "get", Copied: clip, Metadata: &entry.Metadata}
+	if show || !clip {
+		if !format.Structured() {
+			printSecret(value)
+		} else {
+			// binary values cannot be carried in json or yaml strings as they are
+			text := string(value.Bytes())
+			if !utf8.Valid(value.Bytes()) {
+				text = base64.StdEncoding.EncodeToString(value.Bytes())
+				result.Encoding = "base64"
 			}
+			result.Value = &text
+		}
+	}
+	printResult(result)
+}
+
+func runPick(context *cli.Context) {
+	names := context.Arguments
+	if len(names) == 0 {
+		var err error
+		names, err = store.GetStoreNames()
+		util.CheckError(err, "could not read store directory")
+	}
+
+	secret := getSecret(context, names...)
+	defer secret.Destroy()
+
+	var items []input.PickItem
+	var picked []store.Match
+	for _, name := range names {
+		metadata, err := store.GetMapMetadata(name, secret)
+		if err == store.AuthenticationFailedState && len(context.Arguments) == 0 {
+			log.Printf("store '%s' was not unlocked, its keys are not offered", name)
+			continue
+		}
+		checks("could not read store '"+name+"'", err)
 
-			listAll()
+		keys := make([]string, 0, len(metadata))
+		for key := range metadata {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
 
-		case "get":
-			util.CheckState(len(arguments) > 0, "need a 'key' argument")
-			storeName, KeyName := getStoreAndKeyName(arguments[0])
+		for _, key := range keys {
+			items = append(items, input.PickItem{Label: store.JoinAddress(name, key), Preview: metadataLines(metadata[key])})
+			picked = append(picked, store.Match{Store: name, Key: key})
+		}
+	}
+	util.CheckState(len(items) > 0, "there are no keys to pick from")
 
-			value := get(storeName, KeyName, pass)
-			util.CheckState(value != nil, fmt.Sprintf("expected key '%s' to have a value", KeyName))
+	index, err := input.Pick(items)
+	util.CheckError(err, "no key was picked")
 
-			if clip {
-				err := output.CopyToClipboard(value)
-				util.CheckError(err, "could not copy to clipboard")
+	show := context.Bool("show")
+	checks("could not get value", store.CheckExpiry(picked[index].Store, picked[index].Key))
+	entry := getEntry(picked[index].Store, picked[index].Key, secret)
+	deliverValue(picked[index].Store, picked[index].Key, entry, show, !show)
+}
+
+func metadataLines(metadata store.Metadata) (lines []string) {
+	fields := metadata.Fields()
+	for _, name := range []string{"url", "tags", "notes"} {
+		if len(fields[name]) > 0 {
+			lines = append(lines, name+": "+fields[name])
+		}
+	}
+	lines = append(lines, expiryLines(metadata)...)
+	if len(lines) == 0 {
+		lines = append(lines, "no metadata")
+	}
+	return lines
+}
+
+func expiryLines(metadata store.Metadata) (lines []string) {
+	if metadata.Expires != nil {
+		lines = append(lines, "expires: "+metadata.Expires.Format("2006-01-02 15:04"))
+	}
+	if metadata.MaxAge > 0 {
+		lines = append(lines, "max age: "+metadata.MaxAge.String())
+	}
+	return lines
+}
+
+func runSet(context *cli.Context) {
+	storeName, KeyName := getStoreAndKeyName(context)
+
+	// values read from a file or stdin are streamed, so they need not fit in memory
+	if reader := getValueReader(context, storeName); reader != nil {
+		defer func() {
+			if err := reader.Close(); err != nil {
+				panic(err)
 			}
+		}()
+
+		checked, peeked := checkStream(context, storeName, KeyName, reader)
+		defer crypto.Wipe(peeked)
+
+		secret := getSecret(context, storeName)
+		defer secret.Destroy()
+		err := store.SetMapStream(storeName, KeyName, checked, secret, func(metadata *store.Metadata) {
+			updateMetadata(context, metadata)
+		})
+		checks("could not set value", err)
+		printResult(commandResult{Store: storeName, Key: KeyName, Action: "set"})
+		return
+	}
+
+	value := getValue(context)
+	defer crypto.Wipe(value)
+	if len(context.Arguments) > 1 {
+		checkValue(context, storeName, KeyName, value)
+	}
+
+	secret := getSecret(context, storeName)
+	defer secret.Destroy()
+	update(storeName, KeyName, secret, true, func(entry *store.Entry) {
+		entry.Value = value
+		updateMetadata(context, &entry.Metadata)
+	})
+	printResult(commandResult{Store: storeName, Key: KeyName, Action: "set"})
+}
+
+// checkValue warns of a weak value, or fails when the store's policy rejects weak values
+func checkValue(context *cli.Context, storeName, key string, value []byte) {
+	check, err := store.CheckValue(storeName, key, value, breachDataset(context))
+	checks("could not set value", err)
+	if check.Weak {
+		log.Printf("the value of '%s' is weak, %s", key, check.Warning)
+	}
+}
 
-			if show || !clip {
-				fmt.Printf("%s\n", value)
+// checkStream checks values read from a file or stdin when they are short text, as typed or pasted
+// passwords are, and gives back a reader of the whole value along with what was read to check it
+func checkStream(context *cli.Context, storeName, key string, reader io.Reader) (io.Reader, []byte) {
+	peeked := make([]byte, maxCheckedSize+1)
+	n, err := io.ReadFull(reader, peeked)
+	if err != io.EOF && err != io.ErrUnexpectedEOF {
+		util.CheckError(err, "could not read value")
+	}
+	peeked = peeked[:n]
+
+	if n <= maxCheckedSize && utf8.Valid(peeked) {
+		checkValue(context, storeName, key, bytes.TrimRight(peeked, "\r\n"))
+	}
+	return io.MultiReader(bytes.NewReader(peeked), reader), peeked
+}
+
+// breachDataset gives the breach dataset to check values against, none when it is not given
+func breachDataset(context *cli.Context) string {
+	if path := context.String("breaches"); len(path) > 0 {
+		return path
+	}
+	return os.Getenv(breachVariable)
+}
+
+func runMeta(context *cli.Context) {
+	storeName, KeyName := getStoreAndKeyName(context)
+
+	secret := getSecret(context, storeName)
+	defer secret.Destroy()
+
+	var metadata store.Metadata
+	if context.Has("url") || context.Has("tags") || context.Has("notes") || context.Has("expires") || context.Has("max-age") {
+		update(storeName, KeyName, secret, false, func(entry *store.Entry) {
+			updateMetadata(context, &entry.Metadata)
+			metadata = entry.Metadata
+		})
+	} else {
+		entry := getEntry(storeName, KeyName, secret)
+		crypto.Wipe(entry.Value)
+		metadata = entry.Metadata
+	}
+
+	if !format.Structured() {
+		fields := metadata.Fields()
+		for _, name := range []string{"url", "tags", "notes"} {
+			if len(fields[name]) > 0 {
+				fmt.Println(util.Bold(name+":") + " " + fields[name])
 			}
+		}
+		for _, line := range expiryLines(metadata) {
+			parts := strings.SplitN(line, ": ", 2)
+			fmt.Println(util.Bold(parts[0]+":") + " " + parts[1])
+		}
+	}
+	printResult(commandResult{Store: storeName, Key: KeyName, Action: "meta", Metadata: &metadata})
+}
 
-		case "set":
-			util.CheckState(len(arguments) > 0, "need a 'key' argument")
-			storeName, KeyName := getStoreAndKeyName(arguments[0])
+// updateMetadata replaces the fields given as options, an empty option clears its field
+func updateMetadata(context *cli.Context, metadata *store.Metadata) {
+	if context.Has("url") {
+		metadata.URL = context.String("url")
+	}
+	if context.Has("tags") {
+		metadata.Tags = nil
+		for _, tag := range strings.Split(context.String("tags"), ",") {
+			if tag = strings.TrimSpace(tag); len(tag) > 0 {
+				metadata.Tags = append(metadata.Tags, tag)
+			}
+		}
+	}
+	if context.Has("notes") {
+		metadata.Notes = context.String("notes")
+	}
+	if context.Has("expires") {
+		metadata.Expires = nil
+		if text := context.String("expires"); text != "never" {
+			expires, err := store.ParseExpiry(text, time.Now())
+			util.CheckError(err, "could not read --expires")
+			metadata.Expires = &expires
+		}
+	}
+	if context.Has("max-age") {
+		metadata.MaxAge = maxAgeOption(context)
+	}
+}
 
-			value := getValue(arguments[1:])
-			set(storeName, KeyName, value, pass)
+// maxAgeOption reads --max-age, where 'never' is no max age
+func maxAgeOption(context *cli.Context) store.Age {
+	if context.String("max-age") == "never" {
+		return 0
+	}
+	age, err := store.ParseAge(context.String("max-age"))
+	util.CheckError(err, "could not read --max-age")
+	return age
+}
 
-		case "clear":
-			util.CheckState(len(arguments) > 0, "need a 'key' argument")
-			storeName, KeyName := getStoreAndKeyName(arguments[0])
+func runFind(context *cli.Context) {
+	var pattern *regexp.Regexp
+	var err error
+	if context.Bool("regex") {
+		pattern, err = regexp.Compile(context.Arguments[0])
+	} else {
+		pattern, err = store.GlobPattern(context.Arguments[0])
+	}
+	util.CheckError(err, "could not compile pattern")
 
-			clear(storeName, KeyName, pass)
+	// key names are searched without a passphrase
+	var secret *store.Secret
+	if context.Bool("metadata") || context.Has("pass") || context.Has("key-file") {
+		names, err := store.GetStoreNames()
+		util.CheckError(err, "could not read store directory")
+		secret = getSecret(context, names...)
+		defer secret.Destroy()
+	}
 
-		default:
-			fmt.Printf("unknown command '%s'\n", commandWord)
-			printUsage()
-			os.Exit(1)
+	matches, locked, err := store.Find(pattern, secret)
+	util.CheckError(err, "could not search stores")
+	for _, name := range locked {
+		log.Printf("store '%s' was not unlocked, only its keys were searched", name)
+	}
+
+	if format.Structured() {
+		if matches == nil {
+			matches = make([]store.Match, 0)
+		}
+		err = output.Encode(os.Stdout, format, matches)
+		util.CheckError(err, "could not write matches")
+		return
+	}
+
+	for _, match := range matches {
+		fmt.Println(store.JoinAddress(match.Store, match.Key))
+	}
+}
+
+func runClear(context *cli.Context) {
+	if context.Bool("recursive") {
+		storeName, prefix := getStoreAndPrefix(context)
+		secret := getSecret(context, storeName)
+		defer secret.Destroy()
+		cleared := clearSubtree(storeName, prefix, secret)
+		if !format.Structured() {
+			for _, key := range cleared {
+				fmt.Println(key)
+			}
+		}
+		printResult(commandResult{Store: storeName, Key: prefix, Action: "clear", Keys: cleared})
+		return
+	}
+
+	storeName, KeyName := getStoreAndKeyName(context)
+	secret := getSecret(context, storeName)
+	defer secret.Destroy()
+
+	clear(storeName, KeyName, secret)
+	printResult(commandResult{Store: storeName, Key: KeyName, Action: "clear"})
+}
+
+func runKeyFile(context *cli.Context) {
+	switch action := context.Arguments[0]; {
+	case action == "gen" && len(context.Arguments) == 2:
+		path := context.Arguments[1]
+
+		// a lost key file locks its stores for good, so one is never replaced
+		key := crypto.GenerateSecretBuffer()
+		defer key.Destroy()
+		err := createValueFile(path, func(w io.Writer) error {
+			_, err := key.WriteTo(w)
+			return err
+		})
+		util.CheckState(!os.IsExist(err), "'"+path+"' already exists, key files are never overwritten")
+		util.CheckError(err, "could not write key file '"+path+"'")
+		printResult(commandResult{Key: path, Action: "keyfile"})
+	case action == "require" && len(context.Arguments) == 3:
+		storeName := context.Arguments[1]
+		factors, err := store.ParseFactors(context.Arguments[2])
+		util.CheckError(err, "could not read factors")
+		util.CheckState(factors&store.KeyFileFactor == 0 || context.Has("key-file"), "give the key file with --key-file")
+
+		// the store is unlocked with the factors it requires now and resealed with those given
+		secret := secretFor(context, requiredFactors(storeName)|factors)
+		defer secret.Destroy()
+		err = store.SetRequiredFactors(storeName, secret, factors)
+		checks("could not set the factors for '"+storeName+"'", err)
+
+		if !format.Structured() {
+			fmt.Printf("store '%s' is unlocked with %s\n", storeName, factors)
+		}
+		printResult(commandResult{Store: storeName, Action: "keyfile", Factors: factors.String()})
+	default:
+		util.Fail(util.UsageCode, "expected 'keyfile gen <path>' or 'keyfile require <store> <factors>'")
+	}
+}
+
+func runRecovery(context *cli.Context) {
+	storeName := store.DefaultStoreName
+	if len(context.Arguments) > 1 {
+		storeName = context.Arguments[1]
+	}
+
+	switch context.Arguments[0] {
+	case "split":
+		count, threshold := countOption(context, "shares", 5), countOption(context, "threshold", 3)
+		secret := getSecret(context, storeName)
+		defer secret.Destroy()
+
+		shares, err := store.SplitStoreSecret(storeName, secret, count, threshold)
+		checks("could not split the secret of '"+storeName+"'", err)
+
+		var texts []string
+		for _, share := range shares {
+			texts = append(texts, crypto.EncodeShare(share))
+		}
+		if !format.Structured() {
+			fmt.Println(strings.Join(texts, "\n"))
+		}
+		printResult(commandResult{Store: storeName, Action: "recovery", Shares: texts})
+	case "restore":
+		shares := readShares()
+		secret := secretFor(context, store.PassphraseFactor)
+		defer secret.Destroy()
+
+		err := store.RecoverStore(storeName, shares, secret)
+		checks("could not restore '"+storeName+"'", err)
+		if !format.Structured() {
+			fmt.Printf("store '%s' restored with its new %s\n", storeName, secret.Factors())
+		}
+		printResult(commandResult{Store: storeName, Action: "recovery", Factors: secret.Factors().String()})
+	default:
+		util.Fail(util.UsageCode, "expected 'recovery split [store]' or 'recovery restore [store]'")
+	}
+}
+
+// readShares reads shares from stdin until there are enough, leaving the rest of the input for
+// the new passphrase
+func readShares() (shares []crypto.Share) {
+	fmt.Fprintln(os.Stderr, "shares, one per line:")
+	for len(shares) == 0 || len(shares) < shares[0].Threshold {
+		line, err := input.ReadLine(maxShareSize)
+		if err == io.EOF {
+			break
+		}
+		util.CheckError(err, "could not read share")
+
+		text := string(line.Bytes())
+		line.Destroy()
+		if len(text) == 0 {
+			continue
+		}
+		share, err := crypto.DecodeShare(text)
+		util.CheckError(err, "could not read share "+strconv.Itoa(len(shares)+1))
+		shares = append(shares, share)
+	}
+	util.CheckState(len(shares) > 0, "no shares were given")
+	return shares
+}
+
+func countOption(context *cli.Context, name string, fallback int) int {
+	if !context.Has(name) {
+		return fallback
+	}
+	count, err := strconv.Atoi(context.String(name))
+	util.CheckError(err, "--"+name+" must be a number")
+	return count
+}
+
+func runGrant(context *cli.Context) {
+	if context.Bool("list") {
+		storeName := store.DefaultStoreName
+		if len(context.Arguments) > 0 {
+			storeName = context.Arguments[0]
 		}
+		secret := getSecret(context, storeName)
+		defer secret.Destroy()
+
+		grants, err := store.ListGrants(storeName, secret)
+		checks("could not list the grants of '"+storeName+"'", err)
+		if format.Structured() {
+			err = output.Encode(os.Stdout, format, grants)
+			util.CheckError(err, "could not write grants")
+			return
+		}
+		for _, grant := range grants {
+			fmt.Printf("%s %s (%d keys)\n", grant.ID, grant.Pattern, len(grant.Keys))
+		}
+		return
+	}
+
+	if !context.Has("keys") || len(context.Arguments) > 0 {
+		util.Fail(util.UsageCode, "expected 'grant --keys <[store:]glob> --read-only' or 'grant --list [store]'")
+	}
+	if !context.Bool("read-only") {
+		util.Fail(util.UsageCode, "grants only ever read, give --read-only to say so")
+	}
+
+	storeName, pattern := store.SplitAddress(context.String("keys"))
+	secret := getSecret(context, storeName)
+	defer secret.Destroy()
+
+	grant, token, err := store.GrantAccess(storeName, secret, pattern)
+	checks("could not grant access to '"+storeName+"'", err)
+	defer token.Destroy()
+
+	if !format.Structured() {
+		printSecret(token)
+		fmt.Fprintf(os.Stderr, "grant %s reads %d keys of '%s', revoke it with 'keepo revoke %s %s'\n",
+			grant.ID, len(grant.Keys), storeName, storeName, grant.ID)
+		return
+	}
+	text := string(token.Bytes())
+	printResult(commandResult{Store: storeName, Key: pattern, Action: "grant", Keys: grant.Keys, Grant: grant.ID, Token: &text})
+}
+
+func runRevoke(context *cli.Context) {
+	storeName, id := store.DefaultStoreName, context.Arguments[0]
+	if len(context.Arguments) > 1 {
+		storeName, id = context.Arguments[0], context.Arguments[1]
+	}
+	secret := getSecret(context, storeName)
+	defer secret.Destroy()
+
+	revoked, err := store.RevokeAccess(storeName, secret, id)
+	checks("could not revoke grant '"+id+"'", err)
+	if !format.Structured() {
+		fmt.Printf("grant %s revoked, %d keys resealed\n", revoked.ID, len(revoked.Keys))
 	}
+	printResult(commandResult{Store: storeName, Key: revoked.Pattern, Action: "revoke", Keys: revoked.Keys, Grant: revoked.ID})
 }
 
+func runAudit(context *cli.Context) {
+	storeName := store.DefaultStoreName
+	if len(context.Arguments) > 0 {
+		storeName = context.Arguments[0]
+	}
+	util.CheckState(!context.Bool("enable") || !context.Bool("disable"), "give --enable or --disable, not both")
+
+	secret := getSecret(context, storeName)
+	defer secret.Destroy()
+
+	if context.Bool("enable") || context.Bool("disable") {
+		enabled := context.Bool("enable")
+		err := store.SetAuditing(storeName, secret, enabled)
+		checks("could not change the audit log of '"+storeName+"'", err)
+		if !format.Structured() {
+			fmt.Printf("store '%s' audit log %s\n", storeName, map[bool]string{true: "started", false: "stopped"}[enabled])
+		}
+		printResult(commandResult{Store: storeName, Action: "audit"})
+		return
+	}
+
+	events, err := store.ReadAudit(storeName, secret)
+	if format.Structured() {
+		encodeErr := output.Encode(os.Stdout, format, events)
+		util.CheckError(encodeErr, "could not write audit log")
+	} else {
+		for _, event := range events {
+			if event.Sealed {
+				fmt.Printf("(sealed for revoked grant %s)\n", event.Grant)
+				continue
+			}
+			line := fmt.Sprintf("%s %s %s %s", event.Time.Format(time.RFC3339), event.User, event.Operation, event.Key)
+			if len(event.Grant) > 0 {
+				line += " (grant " + event.Grant + ")"
+			}
+			fmt.Println(strings.TrimSpace(line))
+		}
+	}
+	checks("the audit log of '"+storeName+"' does not verify", err)
+	if !format.Structured() {
+		fmt.Fprintf(os.Stderr, "%d records verified\n", len(events))
+	}
+}
+
+func runAuditPasswords(context *cli.Context) {
+	names := context.Arguments
+	if len(names) == 0 {
+		var err error
+		names, err = store.GetStoreNames()
+		util.CheckError(err, "could not read store directory")
+	}
 
-func listAll() {
+	secret := getSecret(context, names...)
+	defer secret.Destroy()
+
+	// values are compared by digest under a key of this run alone, so no digest outlives it
+	digestKey := crypto.GenerateSecret()
+	defer crypto.Wipe(digestKey[:])
+
+	var reports []passwordReport
+	holders := make(map[string][]string)
+	for _, name := range names {
+		checked, err := store.CheckValues(name, secret, breachDataset(context), digestKey[:])
+		if err == store.AuthenticationFailedState && len(context.Arguments) == 0 {
+			log.Printf("store '%s' was not unlocked, its values are not checked", name)
+			continue
+		}
+		checks("could not check the values of '"+name+"'", err)
+
+		sort.Slice(checked, func(i, j int) bool { return checked[i].Key < checked[j].Key })
+		for _, report := range checked {
+			address := store.JoinAddress(name, report.Key)
+			holders[string(report.Digest)] = append(holders[string(report.Digest)], address)
+			reports = append(reports, passwordReport{Store: name, ValueReport: report})
+		}
+	}
+
+	for index := range reports {
+		report := &reports[index]
+		for _, address := range holders[string(report.Digest)] {
+			if address != store.JoinAddress(report.Store, report.Key) {
+				report.ReusedBy = append(report.ReusedBy, address)
+			}
+		}
+	}
+
+	if format.Structured() {
+		if reports == nil {
+			reports = make([]passwordReport, 0)
+		}
+		err := output.Encode(os.Stdout, format, reports)
+		util.CheckError(err, "could not write password report")
+		return
+	}
+
+	for _, report := range reports {
+		line := fmt.Sprintf("%s %s %d/%d", store.JoinAddress(report.Store, report.Key), util.Bold("strength"),
+			report.Score, strength.MaxScore)
+		if report.Weak && report.Breaches == 0 {
+			line += ", " + report.Warning
+		}
+		if report.Breaches > 0 {
+			line += fmt.Sprintf(", found %d times in breaches", report.Breaches)
+		}
+		if len(report.ReusedBy) > 0 {
+			line += ", " + util.Bold("reused by") + " " + strings.Join(report.ReusedBy, " ")
+		}
+		fmt.Println(line)
+	}
+}
+
+func runSync(context *cli.Context) {
 	executable, err := os.Executable()
 	util.CheckError(err, "could not get executable path")
-	path := filepath.Dir(executable)
-	files, err := ioutil.ReadDir(path)
-	util.CheckError(err, "could not read current directory")
-	for _, f := range files {
-		if strings.HasSuffix(f.Name(), store.Extension) {
-			listStore(f.Name())
+
+	result, err := gitsync.Sync(gitsync.Options{
+		Dir:       store.GetStoreDirectory(),
+		Extension: store.Extension,
+		Driver:    shellQuote(executable) + " " + mergeCommandName,
+		RemoteURL: context.String("remote"),
+	})
+	util.CheckError(err, "could not sync stores")
+
+	if format.Structured() {
+		err = output.Encode(os.Stdout, format, result)
+		util.CheckError(err, "could not write sync result")
+		return
+	}
+	for _, name := range result.Committed {
+		fmt.Println("committed " + name)
+	}
+	switch {
+	case len(result.Remote) == 0:
+		fmt.Println("no remote, give one with --remote to pull and push")
+	case result.Pushed:
+		fmt.Println("synchronised with " + result.Remote)
+	}
+}
+
+func runWatch(context *cli.Context) {
+	// a bare argument names a store, unlike elsewhere where it names a key
+	storeName, prefix := "", ""
+	if len(context.Arguments) > 0 {
+		storeName = context.Arguments[0]
+		if strings.Contains(storeName, ":") {
+			storeName, prefix = store.SplitAddress(storeName)
+		}
+	}
+
+	pid := 0
+	signalled := syscall.SIGHUP
+	if context.Has("pid") {
+		pid = countOption(context, "pid", 0)
+		util.CheckState(pid > 0, "--pid must be a process id")
+	}
+	if context.Has("signal") {
+		util.CheckState(pid > 0, "give --pid for the process to signal")
+		var ok bool
+		signalled, ok = parseSignal(context.String("signal"))
+		util.CheckState(ok, "unknown signal '"+context.String("signal")+"', expected one of "+strings.Join(signalNames(), ", "))
+	}
+
+	stop, changes, ended := make(chan struct{}), make(chan store.KeyChange), make(chan error, 1)
+	go func() { ended <- store.WatchStore(storeName, prefix, stop, changes) }()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	for {
+		select {
+		case <-signals:
+			close(stop)
+			util.CheckError(<-ended, "could not watch stores")
+			return
+		case err := <-ended:
+			util.CheckError(err, "could not watch stores")
+			return
+		case change := <-changes:
+			if format.Structured() {
+				err := output.Encode(os.Stdout, format, change)
+				util.CheckError(err, "could not write change")
+			} else {
+				fmt.Printf("%s %s\n", change.Change, store.JoinAddress(change.Store, change.Key))
+			}
+			notifyChange(context.String("exec"), pid, signalled, change)
 		}
 	}
 }
 
-func listStore(storeName string) {
-	if fi, err := os.Stat(store.GetStorePath(storeName)); err == nil {
-		printStatus(fmt.Sprintf("'%s' (%d bytes)", storeName, fi.Size()))
-		for _, v := range store.GetMapKeys(storeName) {
-			fmt.Println(v)
+// notifyChange runs the hook command and signals the process for a change, failures are logged
+// so the watch goes on
+func notifyChange(command string, pid int, signalled syscall.Signal, change store.KeyChange) {
+	if len(command) > 0 {
+		hook := exec.Command("sh", "-c", command)
+		hook.Env = append(os.Environ(), "KEEPO_STORE="+change.Store, "KEEPO_KEY="+change.Key,
+			"KEEPO_CHANGE="+string(change.Change))
+		hook.Stdout, hook.Stderr = os.Stderr, os.Stderr
+		if err := hook.Run(); err != nil {
+			log.Printf("hook for %s failed: %s", store.JoinAddress(change.Store, change.Key), err)
+		}
+	}
+	if pid > 0 {
+		if err := syscall.Kill(pid, signalled); err != nil {
+			log.Printf("could not signal process %d: %s", pid, err)
 		}
+	}
+}
+
+var watchSignals = map[string]syscall.Signal{
+	"HUP": syscall.SIGHUP, "INT": syscall.SIGINT, "TERM": syscall.SIGTERM, "USR1": syscall.SIGUSR1, "USR2": syscall.SIGUSR2,
+}
+
+// parseSignal reads a signal name, with or without its SIG prefix, or number
+func parseSignal(name string) (syscall.Signal, bool) {
+	if number, err := strconv.Atoi(name); err == nil && number > 0 {
+		return syscall.Signal(number), true
+	}
+	signalled, ok := watchSignals[strings.TrimPrefix(strings.ToUpper(name), "SIG")]
+	return signalled, ok
+}
+
+func signalNames() (names []string) {
+	for name := range watchSignals {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func runMount(context *cli.Context) {
+	storeName, mountpoint := store.DefaultStoreName, context.Arguments[0]
+	if len(context.Arguments) > 1 {
+		storeName, mountpoint = context.Arguments[0], context.Arguments[1]
+	}
+	options := mount.Options{ReadWrite: context.Bool("read-write"), Timeout: mountTimeout}
+	if context.Has("timeout") {
+		options.Timeout = 0
+		if context.String("timeout") != "never" {
+			age, err := store.ParseAge(context.String("timeout"))
+			util.CheckError(err, "could not read --timeout")
+			options.Timeout = time.Duration(age)
+		}
+	}
+
+	secret := getSecret(context, storeName)
+	defer secret.Destroy()
+	mounted, err := mount.New(storeName, mountpoint, secret, options)
+	checks("could not mount '"+storeName+"' on '"+mountpoint+"'", err)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		for range signals {
+			if err := mounted.Unmount(); err != nil {
+				log.Printf("could not unmount '%s': %s", mountpoint, err)
+			}
+		}
+	}()
+
+	log.Printf("mounted %s on %s", storeName, mountpoint)
+	mounted.Wait()
+}
+
+func runServe(context *cli.Context) {
+	util.CheckState(context.Has("listen"), "give --listen <unix:path|host:port> to serve on")
+	certFile, keyFile := context.String("tls-cert"), context.String("tls-key")
+	util.CheckState(len(certFile) > 0 == (len(keyFile) > 0), "give both --tls-cert and --tls-key")
+	util.CheckState(len(certFile) == 0 || !strings.HasPrefix(context.String("listen"), server.UnixPrefix),
+		"TLS is for TCP addresses, sockets are kept private by their permissions")
+
+	tokens, names, secret := unlockServed(context)
+	defer secret.Destroy()
+
+	listener, err := server.Listen(context.String("listen"), len(certFile) > 0)
+	util.CheckError(err, "could not listen on '"+context.String("listen")+"'")
+	api := server.New(secret, tokens)
+	api.Breaches = breachDataset(context)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		_ = api.Close()
+	}()
+
+	log.Printf("serving %d stores on %s", len(names), listener.Addr())
+	err = api.Serve(listener, certFile, keyFile)
+	util.CheckError(err, "could not serve")
+}
+
+func runServeGRPC(context *cli.Context) {
+	util.CheckState(context.Has("socket"), "give --socket <path> to serve on")
+	tokens, names, secret := unlockServed(context)
+	defer secret.Destroy()
+
+	listener, err := server.Listen(server.UnixPrefix+context.String("socket"), false)
+	util.CheckError(err, "could not listen on '"+context.String("socket")+"'")
+	keepo := server.NewGRPC(secret, tokens)
+	keepo.Breaches = breachDataset(context)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		keepo.Stop()
+	}()
+
+	log.Printf("serving %d stores over gRPC on %s", len(names), listener.Addr())
+	err = keepo.Serve(listener)
+	util.CheckError(err, "could not serve")
+}
+
+// unlockServed reads the API tokens and unlocks the stores some token covers, the caller destroys
+// the secret once it stops serving
+func unlockServed(context *cli.Context) (tokens []server.Token, names []string, secret *store.Secret) {
+	tokens, err := server.LoadTokens(tokensPath(context))
+	util.CheckError(err, "could not read tokens")
+	util.CheckState(len(tokens) > 0, "there are no tokens, add one with 'keepo serve-token'")
+
+	all, err := store.GetStoreNames()
+	util.CheckError(err, "could not read store directory")
+	for _, name := range all {
+		for _, token := range tokens {
+			if token.AllowsStore(name) {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	secret = getSecret(context, names...)
+	for _, name := range names {
+		checks("could not unlock '"+name+"'", store.CheckSecret(name, secret))
+	}
+	return tokens, names, secret
+}
+
+func runServeToken(context *cli.Context) {
+	path := tokensPath(context)
+	if context.Bool("list") {
+		tokens, err := server.LoadTokens(path)
+		util.CheckError(err, "could not read tokens")
+		if format.Structured() {
+			if tokens == nil {
+				tokens = make([]server.Token, 0)
+			}
+			err = output.Encode(os.Stdout, format, tokens)
+			util.CheckError(err, "could not write tokens")
+			return
+		}
+		for _, token := range tokens {
+			access := "read"
+			if token.Write {
+				access = "write"
+			}
+			fmt.Printf("%s %s %s\n", token.Name, access, strings.Join(token.Keys, ","))
+		}
+		return
+	}
+
+	if len(context.Arguments) != 1 {
+		util.Fail(util.UsageCode, "expected 'serve-token <name> --keys <[store:]glob,...>', '<name> --remove' or '--list'")
+	}
+	name := context.Arguments[0]
+	if context.Bool("remove") {
+		err := server.RemoveToken(path, name)
+		util.CheckError(err, "could not remove token '"+name+"'")
+		printResult(commandResult{Key: name, Action: "serve-token"})
+		return
+	}
+
+	util.CheckState(context.Has("keys"), "give --keys for the keys the token covers")
+	token, err := server.AddToken(path, name, strings.Split(context.String("keys"), ","), context.Bool("write"))
+	util.CheckError(err, "could not add token '"+name+"'")
+	defer token.Destroy()
+	if !format.Structured() {
+		printSecret(token)
+		fmt.Fprintf(os.Stderr, "token '%s' added, it is not shown again\n", name)
+		return
+	}
+	text := string(token.Bytes())
+	printResult(commandResult{Key: name, Action: "serve-token", Token: &text})
+}
+
+// tokensPath is the tokens file given, or the one beside the stores
+func tokensPath(context *cli.Context) string {
+	if path := context.String("tokens"); len(path) > 0 {
+		return path
+	}
+	return filepath.Join(store.GetStoreDirectory(), server.TokensFile)
+}
+
+func runMerge(context *cli.Context) {
+	base, ours, theirs := context.Arguments[0], context.Arguments[1], context.Arguments[2]
+	out := context.String("out")
+	util.CheckState(len(out) > 0, "give the file to write the merged store to with --out")
+
+	resolve := promptConflict
+	switch prefer := context.String("prefer"); prefer {
+	case "":
+	case "newest":
+		resolve = store.PreferNewest
+	case string(store.Ours), string(store.Theirs):
+		resolve = func(conflict store.Conflict) store.Side { return store.Side(prefer) }
+	default:
+		util.Fail(util.UsageCode, "--prefer must be ours, theirs or newest")
+	}
+
+	var factors store.Factors
+	for _, path := range context.Arguments {
+		required, err := store.RequiredFileFactors(path)
+		checks("could not read '"+path+"'", err)
+		factors |= required
+	}
+	secret := secretFor(context, factors)
+	defer secret.Destroy()
+
+	result, err := store.MergeStoreFiles(base, ours, theirs, out, secret, resolve)
+	checks("could not merge '"+ours+"' and '"+theirs+"'", err)
+
+	if format.Structured() {
+		err = output.Encode(os.Stdout, format, result)
+		util.CheckError(err, "could not write merge result")
+		return
+	}
+	for _, conflict := range result.Conflicts {
+		fmt.Printf("%s %s %s\n", conflict.Key, util.Bold("kept"), conflict.Resolution)
+	}
+	fmt.Printf("merged %d keys into '%s'\n", len(result.Keys), out)
+}
+
+func runDiff(context *cli.Context) {
+	var factors store.Factors
+	paths := make([]string, len(context.Arguments))
+	for index, argument := range context.Arguments {
+		path, remove := diffSource(argument)
+		defer remove()
+		paths[index] = path
+
+		required, err := store.RequiredFileFactors(path)
+		checks("could not read '"+argument+"'", err)
+		factors |= required
+	}
+	secret := secretFor(context, factors)
+	defer secret.Destroy()
+
+	differences, err := store.DiffStoreFiles(paths[0], paths[1], secret, context.Bool("show-values"))
+	checks("could not diff '"+context.Arguments[0]+"' and '"+context.Arguments[1]+"'", err)
+
+	if format.Structured() {
+		err = output.Encode(os.Stdout, format, differences)
+		util.CheckError(err, "could not write differences")
+		return
+	}
+	for _, difference := range differences {
+		switch difference.Change {
+		case store.Added:
+			fmt.Println("+ " + difference.Key + " " + diffedText(difference.After))
+		case store.Removed:
+			fmt.Println("- " + difference.Key + " " + diffedText(difference.Before))
+		default:
+			var changes []string
+			if difference.ValueChanged {
+				changes = append(changes, util.Bold("value")+" "+diffedText(difference.Before)+" -> "+diffedText(difference.After))
+			}
+			if difference.MetadataChanged {
+				changes = append(changes, util.Bold("metadata"))
+			}
+			fmt.Println("~ " + difference.Key + " " + strings.Join(changes, ", "))
+		}
+	}
+}
+
+// diffSource gives the store file an argument of diff names, a file, a store or store@revision,
+// and a function removing the copy a revision is read into
+func diffSource(argument string) (path string, remove func()) {
+	remove = func() {}
+	if _, err := os.Stat(argument); err == nil {
+		return argument, remove
+	}
+	index := strings.LastIndex(argument, "@")
+	if index < 0 {
+		return store.GetStorePath(argument), remove
+	}
+
+	name, revision := argument[:index], argument[index+1:]
+	storePath := store.GetStorePath(name)
+	contents, err := gitsync.ReadRevision(store.GetStoreDirectory(), revision, filepath.Base(storePath))
+	util.CheckError(err, "could not read '"+name+"' at revision '"+revision+"'")
+
+	dir, err := ioutil.TempDir("", "keepo-diff")
+	util.CheckError(err, "could not create temporary directory")
+	// the copy is removed when the diff fails too, which exits before deferred calls run
+	remove = func() { _ = os.RemoveAll(dir) }
+	util.OnFail(remove)
+	path = filepath.Join(dir, filepath.Base(storePath))
+	err = ioutil.WriteFile(path, contents, 0600)
+	util.CheckError(err, "could not copy '"+argument+"'")
+	return path, remove
+}
+
+// diffedText gives a diffed value as its fingerprint unless it is shown
+func diffedText(value *store.DiffedValue) string {
+	if len(value.Value) > 0 {
+		return strconv.Quote(value.Value)
+	}
+	return value.Fingerprint
+}
+
+// promptConflict asks on stderr which copy of a conflicting key to keep
+func promptConflict(conflict store.Conflict) store.Side {
+	fmt.Fprintf(os.Stderr, "'%s' changed in both copies\n", conflict.Key)
+	fmt.Fprintln(os.Stderr, "  ours:   "+describeSide(conflict.Ours, conflict.OursModified))
+	fmt.Fprintln(os.Stderr, "  theirs: "+describeSide(conflict.Theirs, conflict.TheirsModified))
+	for {
+		fmt.Fprint(os.Stderr, "keep (o)urs or (t)heirs? ")
+		line, err := input.ReadLine(maxShareSize)
+		util.CheckState(err != io.EOF, "no choice given for '"+conflict.Key+"'")
+		util.CheckError(err, "could not read choice")
+		answer := strings.ToLower(string(line.Bytes()))
+		line.Destroy()
+
+		switch answer {
+		case "o", string(store.Ours):
+			return store.Ours
+		case "t", string(store.Theirs):
+			return store.Theirs
+		}
+	}
+}
+
+func describeSide(metadata *store.Metadata, modified time.Time) string {
+	if metadata == nil {
+		return "cleared"
+	}
+	description := "set"
+	if !modified.IsZero() {
+		description += " " + modified.Local().Format("2006-01-02 15:04:05")
+	}
+	if len(metadata.URL) > 0 {
+		description += ", url " + metadata.URL
+	}
+	if len(metadata.Tags) > 0 {
+		description += ", tags " + strings.Join(metadata.Tags, ",")
+	}
+	return description
+}
+
+// shellQuote quotes the path for the shell git runs commands with
+func shellQuote(path string) string {
+	return "'" + strings.Replace(path, "'", `'\''`, -1) + "'"
+}
+
+func runBackup(context *cli.Context) {
+	util.CheckState(context.Has("to"), "give --to <dir> for the backups")
+	util.CheckState(!context.Bool("all") || len(context.Arguments) == 0, "give a store or --all, not both")
+
+	storeNames := []string{store.DefaultStoreName}
+	if context.Bool("all") {
+		names, err := store.GetStoreNames()
+		util.CheckError(err, "could not read store directory")
+		storeNames = names
+	} else if len(context.Arguments) > 0 {
+		storeNames = []string{context.Arguments[0]}
+	}
+	util.CheckState(len(storeNames) > 0, "there are no stores to back up")
+
+	var backups []store.Backup
+	if context.Bool("archive") {
+		secret := getSecret(context, storeNames...)
+		defer secret.Destroy()
+		backup, err := store.ArchiveStores(storeNames, context.String("to"), secret)
+		checks("could not archive stores", err)
+		backups = []store.Backup{backup}
 	} else {
-		printStatus(fmt.Sprintf("'%s' is absent", storeName))
+		var err error
+		backups, err = store.BackupStores(storeNames, context.String("to"))
+		checks("could not back up stores", err)
+	}
+
+	if format.Structured() {
+		err := output.Encode(os.Stdout, format, backups)
+		util.CheckError(err, "could not write backups")
+		return
+	}
+	for _, backup := range backups {
+		fmt.Printf("%s (%d bytes) %s\n", backup.Path, backup.Size, strings.Join(backup.Stores, ", "))
 	}
 }
 
+func runRestore(context *cli.Context) {
+	path, storeNames := context.Arguments[0], context.Arguments[1:]
+	factors, err := store.BackupFactors(path)
+	checks("could not read backup '"+path+"'", err)
+	secret := secretFor(context, factors)
+	defer secret.Destroy()
+
+	restored, err := store.RestoreBackup(path, storeNames, secret)
+	checks("could not restore backup '"+path+"'", err)
+	if !format.Structured() {
+		fmt.Printf("restored %s from '%s'\n", strings.Join(restored, ", "), path)
+	}
+	printResult(commandResult{Action: "restore", Stores: restored})
+}
+
+func runKubernetesSecret(context *cli.Context) {
+	storeName := store.DefaultStoreName
+	if len(context.Arguments) > 0 {
+		storeName = context.Arguments[0]
+	}
+	util.CheckState(context.Has("name"), "give --name for the Secret")
+	name, namespace := context.String("name"), context.String("namespace")
+	util.CheckState(!context.Has("seal") || len(namespace) > 0, "give --namespace, a sealed secret opens in its namespace alone")
+
+	secret := getSecret(context, storeName)
+	defer secret.Destroy()
+	values := exportValues(context, storeName, secret, output.SecretDataKey)
+	defer wipeValues(values)
+
+	writeExport(context, storeName, secret, func(w io.Writer) error {
+		if !context.Has("seal") {
+			return output.WriteKubernetesSecret(w, name, namespace, values)
+		}
+		content, err := ioutil.ReadFile(context.String("seal"))
+		util.CheckError(err, "could not read certificate '"+context.String("seal")+"'")
+		public, err := crypto.ParseCertificateKey(content)
+		util.CheckError(err, "could not read certificate '"+context.String("seal")+"'")
+
+		sealed := make([]output.NamedValue, len(values))
+		for index, value := range values {
+			sealed[index].Name = value.Name
+			sealed[index].Value, err = crypto.HybridSeal(public, value.Value, []byte(namespace+"/"+name))
+			util.CheckError(err, "could not seal '"+value.Name+"'")
+		}
+		return output.WriteSealedSecret(w, name, namespace, sealed)
+	})
+}
+
+func runDotenv(context *cli.Context) {
+	storeName := store.DefaultStoreName
+	if len(context.Arguments) > 0 {
+		storeName = context.Arguments[0]
+	}
+	secret := getSecret(context, storeName)
+	defer secret.Destroy()
+	values := exportValues(context, storeName, secret, output.EnvName)
+	defer wipeValues(values)
+
+	writeExport(context, storeName, secret, func(w io.Writer) error {
+		return output.WriteEnvFile(w, values)
+	})
+}
+
+func runDecrypt(context *cli.Context) {
+	path := context.Arguments[0]
+	sealed, err := ioutil.ReadFile(path)
+	util.CheckError(err, "could not read '"+path+"'")
+	factors, err := store.DocumentFactors(sealed)
+	checks("could not read '"+path+"'", err)
+	secret := secretFor(context, factors)
+	defer secret.Destroy()
+
+	document, err := store.OpenDocument(sealed, secret)
+	checks("could not decrypt '"+path+"'", err)
+	defer crypto.Wipe(document)
+	_, err = os.Stdout.Write(document)
+	util.CheckError(err, "could not write document")
+}
+
+// exportValues reads the values of the keys matching --keys, or of every key, named for the
+// document they are written to. Expired values and keys sharing a name are refused.
+func exportValues(context *cli.Context, storeName string, secret *store.Secret, name func(key string) string) (values []output.NamedValue) {
+	keys, err := store.ListMapKeys(storeName)
+	checks("could not list keys of '"+storeName+"'", err)
+	if context.Has("keys") {
+		var patterns []*regexp.Regexp
+		for _, glob := range strings.Split(context.String("keys"), ",") {
+			pattern, err := store.GlobPattern(glob)
+			util.CheckError(err, "could not read --keys")
+			patterns = append(patterns, pattern)
+		}
+		var matched []string
+		for _, key := range keys {
+			for _, pattern := range patterns {
+				if pattern.MatchString(key) {
+					matched = append(matched, key)
+					break
+				}
+			}
+		}
+		keys = matched
+	}
+	util.CheckState(len(keys) > 0, "no keys of '"+storeName+"' to write")
+	sort.Strings(keys)
+
+	named := make(map[string]string, len(keys))
+	for _, key := range keys {
+		checks("could not get value", store.CheckExpiry(storeName, key))
+		entry := getEntry(storeName, key, secret)
+		value := output.NamedValue{Name: name(key), Value: entry.Value}
+		if other, ok := named[value.Name]; ok {
+			wipeValues(append(values, value))
+			util.Fail(util.UsageCode, fmt.Sprintf("keys '%s' and '%s' are both named '%s', choose one with --keys", other, key, value.Name))
+		}
+		named[value.Name] = key
+		values = append(values, value)
+	}
+	return values
+}
+
+// writeExport writes the document to standard output, sealed with the store's factors when
+// --encrypt is given
+func writeExport(context *cli.Context, storeName string, secret *store.Secret, write func(w io.Writer) error) {
+	if !context.Bool("encrypt") {
+		util.CheckError(write(os.Stdout), "could not write document")
+		return
+	}
+	var document bytes.Buffer
+	defer func() { crypto.Wipe(document.Bytes()) }()
+	util.CheckError(write(&document), "could not write document")
+	sealed, err := store.SealDocument(document.Bytes(), requiredFactors(storeName), secret)
+	checks("could not encrypt document", err)
+	_, err = os.Stdout.Write(sealed)
+	util.CheckError(err, "could not write document")
+}
+
+func wipeValues(values []output.NamedValue) {
+	for _, value := range values {
+		crypto.Wipe(value.Value)
+	}
+}
+
+func runExpiring(context *cli.Context) {
+	within := expiringSoon
+	if context.Has("within") {
+		age, err := store.ParseAge(context.String("within"))
+		util.CheckError(err, "could not read --within")
+		within = time.Duration(age)
+	}
+
+	names := context.Arguments
+	if len(names) == 0 {
+		var err error
+		names, err = store.GetStoreNames()
+		util.CheckError(err, "could not read store directory")
+		sort.Strings(names)
+	}
+
+	now := time.Now()
+	expiring := []expiringValue{}
+	overdue := 0
+	for _, name := range names {
+		for _, expiry := range listExpiring(name, now.Add(within)) {
+			expired := expiry.Expired(now)
+			if expired {
+				overdue++
+			}
+			expiring = append(expiring, expiringValue{Store: name, Expiry: expiry, Expired: expired})
+			if !format.Structured() {
+				fmt.Println(store.JoinAddress(name, expiry.Key) + " " + expiryNote(expiry, now))
+			}
+		}
+	}
+
+	if format.Structured() {
+		err := output.Encode(os.Stdout, format, expiring)
+		util.CheckError(err, "could not write expiring values")
+	}
+	if overdue > 0 {
+		checks("values are overdue", store.OverdueError(overdue))
+	}
+}
+
+func runPolicy(context *cli.Context) {
+	storeName := store.DefaultStoreName
+	if len(context.Arguments) > 0 {
+		storeName = context.Arguments[0]
+	}
+	util.CheckState(!context.Bool("refuse-expired") || !context.Bool("allow-expired"),
+		"give --refuse-expired or --allow-expired, not both")
+
+	util.CheckState(!context.Bool("reject-weak") || !context.Bool("warn-weak"),
+		"give --reject-weak or --warn-weak, not both")
+
+	policy, err := store.GetPolicy(storeName)
+	checks("could not read the policy of '"+storeName+"'", err)
+
+	if context.Has("max-age") || context.Has("min-strength") || context.Bool("refuse-expired") || context.Bool("allow-expired") ||
+		context.Bool("reject-weak") || context.Bool("warn-weak") || context.Has("backups") {
+		if context.Has("max-age") {
+			policy.MaxAge = maxAgeOption(context)
+		}
+		if context.Bool("refuse-expired") || context.Bool("allow-expired") {
+			policy.RefuseExpired = context.Bool("refuse-expired")
+		}
+		if context.Has("min-strength") {
+			policy.MinStrength = countOption(context, "min-strength", store.DefaultMinStrength)
+		}
+		if context.Bool("reject-weak") || context.Bool("warn-weak") {
+			policy.RejectWeak = context.Bool("reject-weak")
+		}
+		if context.Has("backups") {
+			policy.Backups = countOption(context, "backups", store.DefaultBackupRetention)
+		}
+
+		secret := getSecret(context, storeName)
+		defer secret.Destroy()
+		err = store.SetPolicy(storeName, secret, policy)
+		checks("could not set the policy of '"+storeName+"'", err)
+	}
+
+	if format.Structured() {
+		err = output.Encode(os.Stdout, format, policy)
+		util.CheckError(err, "could not write policy")
+		return
+	}
+	maxAge := "none"
+	if policy.MaxAge > 0 {
+		maxAge = policy.MaxAge.String()
+	}
+	fmt.Printf("%s %s\n", util.Bold("max age:"), maxAge)
+	fmt.Printf("%s %t\n", util.Bold("refuse expired:"), policy.RefuseExpired)
+	fmt.Printf("%s %d\n", util.Bold("min strength:"), policy.MinStrength)
+	fmt.Printf("%s %t\n", util.Bold("reject weak:"), policy.RejectWeak)
+	fmt.Printf("%s %d\n", util.Bold("backups:"), policy.Backups)
+}
+
+// listExpiring gives the store's values that expire before the time given
+func listExpiring(storeName string, before time.Time) (expiring []store.Expiry) {
+	expiries, err := store.ListExpiries(storeName)
+	checks("could not read the expiries of '"+storeName+"'", err)
+	for _, expiry := range expiries {
+		if expiry.Expires.Before(before) {
+			expiring = append(expiring, expiry)
+		}
+	}
+	return expiring
+}
+
+func expiryNote(expiry store.Expiry, now time.Time) string {
+	if expiry.Expired(now) {
+		return "(expired " + expiry.Expires.Format("2006-01-02") + ")"
+	}
+	return "(expires " + expiry.Expires.Format("2006-01-02") + ")"
+}
+
+type expiringValue struct {
+	Store string `json:"store"`
+	store.Expiry
+	Expired bool `json:"expired"`
+}
+
+type passwordReport struct {
+	Store string `json:"store"`
+	store.ValueReport
+	// ReusedBy holds the other keys, as store:key, with the same value
+	ReusedBy []string `json:"reused_by,omitempty"`
+}
+
+type storeListing struct {
+	Store   string   `json:"store"`
+	Prefix  string   `json:"prefix,omitempty"`
+	Present bool     `json:"present"`
+	Size    int64    `json:"size"`
+	Keys    []string `json:"keys"`
+	// Expiring holds the keys listed that have expired or expire soon
+	Expiring []store.Expiry `json:"expiring,omitempty"`
+}
+
+type commandResult struct {
+	Store  string  `json:"store"`
+	Key    string  `json:"key"`
+	Action string  `json:"action"`
+	Value  *string `json:"value,omitempty"`
+	// Encoding is set when the value is not text and has been encoded
+	Encoding string   `json:"encoding,omitempty"`
+	Copied   bool     `json:"copied,omitempty"`
+	Keys     []string `json:"keys,omitempty"`
+	Stores   []string `json:"stores,omitempty"`
+	Factors  string   `json:"factors,omitempty"`
+	Shares   []string `json:"shares,omitempty"`
+	Grant    string   `json:"grant,omitempty"`
+	Token    *string  `json:"token,omitempty"`
+	*store.Metadata
+}
+
+func listAll() (listings []storeListing) {
+	names, err := store.GetStoreNames()
+	util.CheckError(err, "could not read store directory")
+	listings = make([]storeListing, 0, len(names))
+	for _, name := range names {
+		listings = append(listings, listStore(name, ""))
+	}
+	return listings
+}
+
+func listStore(storeName, prefix string) storeListing {
+	listing := storeListing{Store: strings.TrimSuffix(storeName, store.Extension), Prefix: prefix, Keys: make([]string, 0)}
+	if fi, err := os.Stat(store.GetStorePath(storeName)); err == nil {
+		listing.Present = true
+		listing.Size = fi.Size()
+		listing.Keys = store.SubtreeKeys(store.GetMapKeys(storeName), prefix)
+
+		listed := make(map[string]bool, len(listing.Keys))
+		for _, key := range listing.Keys {
+			listed[key] = true
+		}
+		for _, expiry := range listExpiring(storeName, time.Now().Add(expiringSoon)) {
+			if listed[expiry.Key] {
+				listing.Expiring = append(listing.Expiring, expiry)
+			}
+		}
+	}
+	return listing
+}
+
+func printListings(listings []storeListing) {
+	if format.Structured() {
+		err := output.Encode(os.Stdout, format, listings)
+		util.CheckError(err, "could not write listing")
+		return
+	}
+
+	for _, listing := range listings {
+		if listing.Present {
+			if len(listing.Prefix) > 0 {
+				printStatus(fmt.Sprintf("'%s' (%d bytes) under '%s'", listing.Store, listing.Size, listing.Prefix))
+			} else {
+				printStatus(fmt.Sprintf("'%s' (%d bytes)", listing.Store, listing.Size))
+			}
+			notes := make(map[string]string, len(listing.Expiring))
+			for _, expiry := range listing.Expiring {
+				notes[expiry.Key] = " " + util.Bold(expiryNote(expiry, time.Now()))
+			}
+			for _, v := range listing.Keys {
+				fmt.Println(v + notes[v])
+			}
+		} else {
+			printStatus(fmt.Sprintf("'%s' is absent", listing.Store))
+		}
+	}
+}
+
+// results are only reported in structured formats, text output stays quiet apart from values
+func printResult(result commandResult) {
+	if format.Structured() {
+		err := output.Encode(os.Stdout, format, result)
+		util.CheckError(err, "could not write result")
+	}
+}
+
+// printSecret writes the buffer straight to stdout, so no copy of the secret is left to wipe
+func printSecret(secret *crypto.Buffer) {
+	_, err := secret.WriteTo(os.Stdout)
+	if err == nil {
+		_, err = os.Stdout.Write([]byte("\n"))
+	}
+	util.CheckError(err, "could not write result")
+}
+
 func printStatus(status string) {
-	boldOpen := "\033[1m"
-	boldClose := "\033[0m"
-	fmt.Println("\nstore: " + boldOpen +  status + boldClose + "\n")
+	fmt.Println("\nstore: " + util.Bold(status) + "\n")
+}
+
+// getSecret gathers the factors the stores require, prompting for the passphrase when one of them
+// requires it and it was not given, the caller destroys the secret once the stores are opened
+func getSecret(context *cli.Context, storeNames ...string) *store.Secret {
+	return secretFor(context, requiredFactors(storeNames...))
 }
 
-func get(storeName, key, pass string) []byte {
-	if len(pass) == 0 {
-		pass = input.ReadPassword()
+// secretFor reads the factors given, prompting for the passphrase when it is required and not
+// given. A grant token given without factors is used alone, so a store is read without prompting.
+func secretFor(context *cli.Context, factors store.Factors) *store.Secret {
+	token := context.String("token")
+	if len(token) == 0 {
+		token = os.Getenv(tokenVariable)
+	}
+	if len(token) > 0 && !context.Has("pass") && !context.Has("key-file") {
+		grant, err := store.ParseToken([]byte(token))
+		util.CheckError(err, "could not read grant token")
+		return &store.Secret{Grant: grant}
 	}
 
-	value, err := store.GetMapValue(storeName, key, pass)
-	checks("could not get value", err)
-	return value
+	secret := &store.Secret{}
+	if path := context.String("key-file"); len(path) > 0 {
+		secret.KeyFile = readKeyFile(path)
+	}
+
+	if pass := context.String("pass"); len(pass) > 0 {
+		buffer, err := crypto.NewBufferFrom([]byte(pass))
+		util.CheckError(err, "could not allocate passphrase")
+		secret.Passphrase = buffer
+	} else if factors&store.PassphraseFactor != 0 {
+		buffer, err := input.ReadPassword()
+		util.CheckError(err, "could not read passphrase")
+		secret.Passphrase = buffer
+	}
+	return secret
 }
 
-func set(storeName, key, value, pass string) {
-	if len(pass) == 0 {
-		pass = input.ReadPassword()
+// requiredFactors gives every factor the stores require, absent stores are started with a passphrase
+func requiredFactors(storeNames ...string) (factors store.Factors) {
+	for _, name := range storeNames {
+		required, err := store.RequiredFactors(name)
+		if err != nil {
+			required = store.PassphraseFactor
+		}
+		factors |= required
 	}
-	err := store.SetMapValue(storeName, key, value, pass)
+	return factors
+}
+
+// readKeyFile reads a key file into a secure buffer, any file up to maxKeyFileSize will do
+func readKeyFile(path string) *crypto.Buffer {
+	f, err := os.Open(path)
+	util.CheckError(err, "could not open key file '"+path+"'")
+	defer func() {
+		if err := f.Close(); err != nil {
+			panic(err)
+		}
+	}()
+
+	contents, err := ioutil.ReadAll(io.LimitReader(f, maxKeyFileSize+1))
+	util.CheckError(err, "could not read key file '"+path+"'")
+	util.CheckState(len(contents) > 0 && len(contents) <= maxKeyFileSize,
+		fmt.Sprintf("key file '%s' must hold between 1 and %d bytes", path, maxKeyFileSize))
+
+	buffer, err := crypto.NewBufferFrom(contents)
+	util.CheckError(err, "could not allocate key file")
+	return buffer
+}
+
+func getEntry(storeName, key string, secret *store.Secret) *store.Entry {
+	entry, err := store.GetMapEntry(storeName, key, secret)
+	checks("could not get value", err)
+	return entry
+}
+
+func update(storeName, key string, secret *store.Secret, create bool, change func(entry *store.Entry)) {
+	err := store.UpdateMapEntry(storeName, key, secret, create, change)
 	checks("could not set value", err)
 }
 
-func clear(storeName, key, pass string) {
-	if len(pass) == 0 {
-		pass = input.ReadPassword()
-	}
-	err := store.ClearMapValue(storeName, key, pass)
+func clear(storeName, key string, secret *store.Secret) {
+	err := store.ClearMapValue(storeName, key, secret)
 	checks("could not clear value", err)
 }
 
+func clearSubtree(storeName, prefix string, secret *store.Secret) []string {
+	cleared, err := store.ClearMapSubtree(storeName, prefix, secret)
+	checks("could not clear values", err)
+	return cleared
+}
+
 func checks(message string, err error) {
 	if state, ok := err.(*store.State); ok && state == store.AuthenticationFailedState {
-		fmt.Println("\033[1;31mAuthentication Failed\033[0m")
-		os.Exit(1)
+		util.Fail(state.Code(), "Authentication Failed")
 	}
 	util.CheckError(err, message)
 }
 
-func getStoreAndKeyName(argument string) (string, string) {
-	values := strings.Split(argument, ":")
-	if len(values) > 1 {
-		return values[0], values[1]
+// getStoreAndKeyName reads the key address from the first argument, with --store it is taken whole as the key
+func getStoreAndKeyName(context *cli.Context) (string, string) {
+	storeName, keyName := getStoreAndPrefix(context)
+	util.CheckState(len(keyName) > 0, "need a 'key' argument")
+	return storeName, keyName
+}
+
+func getStoreAndPrefix(context *cli.Context) (string, string) {
+	argument := ""
+	if len(context.Arguments) > 0 {
+		argument = context.Arguments[0]
+	}
+
+	if storeName := context.String("store"); len(storeName) > 0 {
+		return storeName, argument
 	}
+	if len(argument) == 0 {
+		return store.DefaultStoreName, ""
+	}
+	return store.SplitAddress(argument)
+}
 
-	return store.DefaultStoreName, argument
+// getListedStoreAndPrefix reads the store and prefix list is given, where an argument without a
+// colon names a store rather than a prefix in the default one
+func getListedStoreAndPrefix(context *cli.Context) (string, string) {
+	if len(context.Arguments) > 0 && len(context.String("store")) == 0 && !strings.Contains(context.Arguments[0], ":") {
+		return context.Arguments[0], ""
+	}
+	return getStoreAndPrefix(context)
 }
 
-func getValue(arguments []string) string {
-	if len(arguments) > 0 {
-		return arguments[0]
-	} else {
-		return getRandomValue()
+// getValueReader opens the file or stdin the value is read from, nil when it is given otherwise
+func getValueReader(context *cli.Context, storeName string) io.ReadCloser {
+	sources := 0
+	for _, given := range []bool{len(context.Arguments) > 1, context.Has("from-file"), context.Bool("stdin")} {
+		if given {
+			sources++
+		}
+	}
+	util.CheckState(sources <= 1, "give the value as an argument, --from-file or --stdin, not several")
+
+	switch {
+	case context.Has("from-file"):
+		path := context.String("from-file")
+		f, err := os.Open(path)
+		util.CheckError(err, "could not open '"+path+"'")
+		return f
+	case context.Bool("stdin"):
+		util.CheckState(len(context.String("pass")) > 0 || requiredFactors(storeName)&store.PassphraseFactor == 0,
+			"--stdin needs the passphrase given with --pass")
+		return ioutil.NopCloser(os.Stdin)
+	}
+	return nil
+}
+
+// getValue takes the value from the argument, falling back to a random value
+func getValue(context *cli.Context) []byte {
+	if len(context.Arguments) > 1 {
+		return []byte(context.Arguments[1])
+	}
+	return []byte(getRandomValue())
+}
+
+// writeValueFile replaces the file once the value is written whole, through a temporary file
+// beside it readable and writable only by its owner, so a failed write leaves the file as it was
+func writeValueFile(path string, write func(w io.Writer) error) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+
+	err = f.Chmod(0600)
+	if err == nil {
+		err = write(f)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+	return err
+}
+
+// createValueFile creates a file that does not exist yet, readable and writable only by its owner,
+// and removes it again when the value cannot be written
+func createValueFile(path string, write func(w io.Writer) error) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = write(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(path)
 	}
+	return err
 }
 
 func getRandomValue() string {
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"keepo/src/data/store"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListedStoreAndPrefix(t *testing.T) {
+	cases := []struct {
+		in             []string
+		storeName, key string
+	}{
+		{[]string{"list", "db"}, "db", ""},
+		{[]string{"list", "db:app/"}, "db", "app/"},
+		{[]string{"list", `db\:url`}, store.DefaultStoreName, "db:url"},
+		{[]string{"list", "--store", "db", "app"}, "db", "app"},
+		{[]string{"list"}, store.DefaultStoreName, ""},
+	}
+
+	app := newApp()
+	for _, c := range cases {
+		context, err := app.Parse(c.in)
+		if err != nil {
+			t.Fatalf("Tried to parse %q but failed with %q", c.in, err)
+		}
+		storeName, prefix := getListedStoreAndPrefix(context)
+		if storeName != c.storeName || prefix != c.key {
+			t.Errorf("Expected %q and %q, received %q and %q", c.storeName, c.key, storeName, prefix)
+		}
+	}
+}
+
+func TestDiffSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keepo-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "backup@2026.kpo")
+	if err = ioutil.WriteFile(path, []byte("store"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if source, _ := diffSource(path); source != path {
+		t.Errorf("Expected %q, received %q", path, source)
+	}
+	if source, _ := diffSource("db"); source != store.GetStorePath("db") {
+		t.Errorf("Expected %q, received %q", store.GetStorePath("db"), source)
+	}
+}
+
+func TestWriteValueFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keepo-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "value.pem")
+	if err = ioutil.WriteFile(path, []byte("existing"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// a failed write leaves the file as it was, without the partial value beside it
+	failed := errors.New("failed")
+	err = writeValueFile(path, func(w io.Writer) error {
+		_, _ = w.Write([]byte("partial"))
+		return failed
+	})
+	if err != failed {
+		t.Errorf("Expected %q, received %q", failed, err)
+	}
+	if content, _ := ioutil.ReadFile(path); string(content) != "existing" {
+		t.Errorf("Expected %q, received %q", "existing", content)
+	}
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("Expected %d, received %d", 1, len(entries))
+	}
+
+	err = writeValueFile(path, func(w io.Writer) error {
+		_, err := w.Write([]byte("value"))
+		return err
+	})
+	if err != nil {
+		t.Errorf("could not write value file '%q'", err)
+	}
+	if content, _ := ioutil.ReadFile(path); string(content) != "value" {
+		t.Errorf("Expected %q, received %q", "value", content)
+	}
+	if info, err := os.Stat(path); err != nil {
+		t.Errorf("could not stat value file '%q'", err)
+	} else if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected %v, received %v", os.FileMode(0600), info.Mode().Perm())
+	}
+}
+
+func TestCreateValueFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keepo-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "store.key")
+	if err = ioutil.WriteFile(path, []byte("existing"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	err = createValueFile(path, func(w io.Writer) error {
+		_, err := w.Write([]byte("key"))
+		return err
+	})
+	if !os.IsExist(err) {
+		t.Errorf("Expected %q, received %q", os.ErrExist, err)
+	}
+	if content, _ := ioutil.ReadFile(path); string(content) != "existing" {
+		t.Errorf("Expected %q, received %q", "existing", content)
+	}
+}
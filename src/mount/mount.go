@@ -0,0 +1,495 @@
+// Package mount exposes a store as a FUSE filesystem, each key a file decrypted as it is opened
+// and each segment of a hierarchical key a directory
+package mount
+
+import (
+	"context"
+	"errors"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"keepo/src/crypto"
+	"keepo/src/data/store"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/**
+ * Values are read into a locked buffer when their file is opened and wiped when it is closed,
+ * they are never cached by the kernel as files are opened for direct I/O. A key that is also a
+ * directory of other keys, or holds an empty or dot segment, has no file and is skipped.
+ * Writable mounts set a file's value when it is closed after being written, create keys for new
+ * files and clear the keys of files removed.
+ */
+
+// attributeTimeout is how long the kernel keeps names and attributes before asking again
+const attributeTimeout = time.Second
+
+// Options choose whether files may be written and how long the mount is kept unused
+type Options struct {
+	ReadWrite bool
+	// Timeout unmounts the store once no file has been open for this long, never when zero
+	Timeout time.Duration
+}
+
+// Mount is a store mounted with the secret it was unlocked with
+type Mount struct {
+	storeName string
+	secret    *store.Secret
+	options   Options
+	server    *fuse.Server
+
+	// storeMutex is held around every read and write of the store, FUSE serves requests at once
+	// and each write replaces the whole store
+	storeMutex sync.Mutex
+
+	mutex    sync.Mutex
+	open     int
+	lastUsed time.Time
+}
+
+// New mounts the store at the mountpoint, which must be an empty directory. The caller destroys
+// the secret once Wait returns.
+func New(storeName, mountpoint string, secret *store.Secret, options Options) (*Mount, error) {
+	keys, err := store.ListMapKeys(storeName)
+	if err != nil && !(os.IsNotExist(err) && options.ReadWrite) {
+		return nil, err
+	}
+	if err = store.CheckSecret(storeName, secret); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	m := &Mount{storeName: storeName, secret: secret, options: options, lastUsed: time.Now()}
+	timeout := attributeTimeout
+	root := &directory{mount: m}
+	m.server, err = fs.Mount(mountpoint, root, &fs.Options{
+		MountOptions: fuse.MountOptions{FsName: "keepo:" + storeName, Name: "keepo", DirectMount: true},
+		EntryTimeout: &timeout,
+		AttrTimeout:  &timeout,
+		UID:          uint32(os.Getuid()),
+		GID:          uint32(os.Getgid()),
+		OnAdd: func(context context.Context) {
+			for _, key := range keys {
+				root.addKey(context, key)
+			}
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if options.Timeout > 0 {
+		go m.expire()
+	}
+	return m, nil
+}
+
+// Wait returns once the store is unmounted
+func (m *Mount) Wait() {
+	m.server.Wait()
+}
+
+// Unmount unmounts the store, failing while a file is open
+func (m *Mount) Unmount() error {
+	return m.server.Unmount()
+}
+
+// expire unmounts the store once it has gone unused for the timeout
+func (m *Mount) expire() {
+	interval := m.options.Timeout / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		m.mutex.Lock()
+		idle := m.open == 0 && time.Since(m.lastUsed) >= m.options.Timeout
+		m.mutex.Unlock()
+		if idle {
+			if err := m.Unmount(); err == nil {
+				return
+			}
+		}
+	}
+}
+
+// used records a file opened or closed, for the timeout
+func (m *Mount) used(opened int) {
+	m.mutex.Lock()
+	m.open += opened
+	m.lastUsed = time.Now()
+	m.mutex.Unlock()
+}
+
+func (m *Mount) fileMode() uint32 {
+	if m.options.ReadWrite {
+		return 0600
+	}
+	return 0400
+}
+
+func (m *Mount) directoryMode() uint32 {
+	if m.options.ReadWrite {
+		return 0700
+	}
+	return 0500
+}
+
+// directory is a segment of the keys beneath it, prefix is its path with a trailing separator
+type directory struct {
+	fs.Inode
+	mount  *Mount
+	prefix string
+}
+
+var _ = (fs.NodeGetattrer)((*directory)(nil))
+var _ = (fs.NodeCreater)((*directory)(nil))
+var _ = (fs.NodeMkdirer)((*directory)(nil))
+var _ = (fs.NodeUnlinker)((*directory)(nil))
+var _ = (fs.NodeRmdirer)((*directory)(nil))
+
+// addKey adds the file of a key beneath the directory, and the directories on its way
+func (d *directory) addKey(context context.Context, key string) {
+	segments := strings.Split(strings.TrimPrefix(key, d.prefix), store.KeySeparator)
+	parent := d
+	for index, segment := range segments {
+		if len(segment) == 0 || segment == "." || segment == ".." {
+			log.Printf("key '%s' has no file name and is not mounted", key)
+			return
+		}
+		child := parent.GetChild(segment)
+		if index == len(segments)-1 {
+			if child != nil {
+				log.Printf("key '%s' is also a directory and is not mounted", key)
+				return
+			}
+			node := &value{mount: d.mount, key: key}
+			parent.AddChild(segment, parent.NewPersistentInode(context, node, fs.StableAttr{Mode: syscall.S_IFREG}), false)
+			return
+		}
+
+		if child == nil {
+			next := &directory{mount: d.mount, prefix: parent.prefix + segment + store.KeySeparator}
+			child = parent.NewPersistentInode(context, next, fs.StableAttr{Mode: syscall.S_IFDIR})
+			parent.AddChild(segment, child, false)
+		}
+		next, ok := child.Operations().(*directory)
+		if !ok {
+			log.Printf("key '%s' lies beneath another key and is not mounted", key)
+			return
+		}
+		parent = next
+	}
+}
+
+func (d *directory) Getattr(context context.Context, handle fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = fuse.S_IFDIR | d.mount.directoryMode()
+	return fs.OK
+}
+
+func (d *directory) Create(context context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*fs.Inode, fs.FileHandle, uint32, syscall.Errno) {
+	if !d.mount.options.ReadWrite {
+		return nil, nil, 0, syscall.EROFS
+	}
+	node := &value{mount: d.mount, key: d.prefix + name}
+	child := d.NewPersistentInode(context, node, fs.StableAttr{Mode: syscall.S_IFREG})
+	d.AddChild(name, child, true)
+
+	// the key is created when the file is closed, even when nothing was written
+	h, result := node.handle(false)
+	if result != fs.OK {
+		return nil, nil, 0, result
+	}
+	h.dirty = true
+	out.Mode = fuse.S_IFREG | d.mount.fileMode()
+	return child, h, fuse.FOPEN_DIRECT_IO, fs.OK
+}
+
+func (d *directory) Mkdir(context context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if !d.mount.options.ReadWrite {
+		return nil, syscall.EROFS
+	}
+	// directories hold no keys until a file is created in them
+	next := &directory{mount: d.mount, prefix: d.prefix + name + store.KeySeparator}
+	child := d.NewPersistentInode(context, next, fs.StableAttr{Mode: syscall.S_IFDIR})
+	d.AddChild(name, child, false)
+	out.Mode = fuse.S_IFDIR | d.mount.directoryMode()
+	return child, fs.OK
+}
+
+func (d *directory) Unlink(context context.Context, name string) syscall.Errno {
+	if !d.mount.options.ReadWrite {
+		return syscall.EROFS
+	}
+	d.mount.storeMutex.Lock()
+	err := store.ClearMapValue(d.mount.storeName, d.prefix+name, d.mount.secret)
+	d.mount.storeMutex.Unlock()
+	if err != nil && err != store.ValueAbsentState {
+		return errorNumber(err)
+	}
+	return fs.OK
+}
+
+func (d *directory) Rmdir(context context.Context, name string) syscall.Errno {
+	if !d.mount.options.ReadWrite {
+		return syscall.EROFS
+	}
+	if child := d.GetChild(name); child != nil && len(child.Children()) > 0 {
+		return syscall.ENOTEMPTY
+	}
+	return fs.OK
+}
+
+// value is the file of a key
+type value struct {
+	fs.Inode
+	mount *Mount
+	key   string
+
+	mutex sync.Mutex
+	// size is the value's size when its file was last opened, values are not read to be sized
+	size uint64
+}
+
+var _ = (fs.NodeGetattrer)((*value)(nil))
+var _ = (fs.NodeSetattrer)((*value)(nil))
+var _ = (fs.NodeOpener)((*value)(nil))
+
+func (v *value) Getattr(context context.Context, handle fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	if h, ok := handle.(*valueHandle); ok {
+		return h.Getattr(context, out)
+	}
+	v.mutex.Lock()
+	out.Size = v.size
+	v.mutex.Unlock()
+	out.Mode = fuse.S_IFREG | v.mount.fileMode()
+	return fs.OK
+}
+
+// Setattr truncates the value of a file open for writing, other attributes are fixed
+func (v *value) Setattr(context context.Context, handle fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	size, ok := in.GetSize()
+	if !ok {
+		return v.Getattr(context, handle, out)
+	}
+	h, isHandle := handle.(*valueHandle)
+	if !v.mount.options.ReadWrite {
+		return syscall.EROFS
+	}
+	if !isHandle {
+		// truncating by name, as with 'truncate -s 0', sets the value at once
+		var result syscall.Errno
+		if h, result = v.handle(size > 0); result != fs.OK {
+			return result
+		}
+		defer h.Release(context)
+	}
+	if result := h.truncate(size); result != fs.OK {
+		return result
+	}
+	return h.Getattr(context, out)
+}
+
+func (v *value) Open(context context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	writing := flags&(syscall.O_WRONLY|syscall.O_RDWR) != 0
+	if writing && !v.mount.options.ReadWrite {
+		return nil, 0, syscall.EROFS
+	}
+	h, result := v.handle(flags&syscall.O_TRUNC == 0)
+	if result != fs.OK {
+		return nil, 0, result
+	}
+	h.dirty = flags&syscall.O_TRUNC != 0
+	h.append = flags&syscall.O_APPEND != 0
+	return h, fuse.FOPEN_DIRECT_IO, fs.OK
+}
+
+// handle opens the value, reading it unless it is about to be replaced
+func (v *value) handle(read bool) (*valueHandle, syscall.Errno) {
+	h := &valueHandle{node: v}
+	if read {
+		v.mount.storeMutex.Lock()
+		err := store.CheckExpiry(v.mount.storeName, v.key)
+		var entry *store.Entry
+		if err == nil {
+			entry, err = store.GetMapEntry(v.mount.storeName, v.key, v.mount.secret)
+		}
+		v.mount.storeMutex.Unlock()
+		if err != nil {
+			return nil, errorNumber(err)
+		}
+		if h.data, err = crypto.NewBufferFrom(entry.Value); err != nil {
+			return nil, syscall.ENOMEM
+		}
+		h.length = h.data.Len()
+		v.mutex.Lock()
+		v.size = uint64(h.length)
+		v.mutex.Unlock()
+	} else {
+		var err error
+		if h.data, err = crypto.NewBuffer(0); err != nil {
+			return nil, syscall.ENOMEM
+		}
+	}
+	v.mount.used(1)
+	return h, fs.OK
+}
+
+// valueHandle holds an open file's value in a locked buffer, wiped when the file is released. The
+// value is the buffer's first length bytes, the rest is zeroed room for writes.
+type valueHandle struct {
+	node *value
+
+	mutex  sync.Mutex
+	data   *crypto.Buffer
+	length int
+	dirty  bool
+	append bool
+}
+
+var _ = (fs.FileReader)((*valueHandle)(nil))
+var _ = (fs.FileWriter)((*valueHandle)(nil))
+var _ = (fs.FileGetattrer)((*valueHandle)(nil))
+var _ = (fs.FileFlusher)((*valueHandle)(nil))
+var _ = (fs.FileReleaser)((*valueHandle)(nil))
+
+func (h *valueHandle) Getattr(context context.Context, out *fuse.AttrOut) syscall.Errno {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	out.Size = uint64(h.length)
+	out.Mode = fuse.S_IFREG | h.node.mount.fileMode()
+	return fs.OK
+}
+
+func (h *valueHandle) Read(context context.Context, dest []byte, offset int64) (fuse.ReadResult, syscall.Errno) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	data := h.data.Bytes()[:h.length]
+	if offset >= int64(len(data)) {
+		return fuse.ReadResultData(nil), fs.OK
+	}
+	end := offset + int64(len(dest))
+	if end > int64(len(data)) {
+		end = int64(len(data))
+	}
+	// copied so the result does not refer to the buffer once it is wiped
+	read := copy(dest, data[offset:end])
+	return fuse.ReadResultData(dest[:read]), fs.OK
+}
+
+func (h *valueHandle) Write(context context.Context, data []byte, offset int64) (uint32, syscall.Errno) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	// the kernel places appends by the size it last saw, which is stale until the value is read
+	if h.append {
+		offset = int64(h.length)
+	}
+	end := uint64(offset) + uint64(len(data))
+	if end > store.MaxValueSize {
+		return 0, syscall.EFBIG
+	}
+	if result := h.grow(int(end)); result != fs.OK {
+		return 0, result
+	}
+	copy(h.data.Bytes()[offset:], data)
+	h.dirty = true
+	return uint32(len(data)), fs.OK
+}
+
+// Flush sets the value when the file was written, so an error reaches close
+func (h *valueHandle) Flush(context context.Context) syscall.Errno {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if !h.dirty {
+		return fs.OK
+	}
+	mount := h.node.mount
+	value := h.data.Bytes()[:h.length]
+	mount.storeMutex.Lock()
+	_, err := store.CheckValue(mount.storeName, h.node.key, value, "")
+	if err == nil {
+		err = store.SetMapBytes(mount.storeName, h.node.key, value, mount.secret)
+	}
+	mount.storeMutex.Unlock()
+	if err != nil {
+		log.Printf("could not set '%s': %s", h.node.key, err)
+		return errorNumber(err)
+	}
+	h.dirty = false
+	h.node.mutex.Lock()
+	h.node.size = uint64(h.length)
+	h.node.mutex.Unlock()
+	return fs.OK
+}
+
+func (h *valueHandle) Release(context context.Context) syscall.Errno {
+	result := h.Flush(context)
+	h.mutex.Lock()
+	h.data.Destroy()
+	h.mutex.Unlock()
+	h.node.mount.used(-1)
+	return result
+}
+
+func (h *valueHandle) truncate(size uint64) syscall.Errno {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if size > store.MaxValueSize {
+		return syscall.EFBIG
+	}
+	h.dirty = true
+	if int(size) < h.length {
+		crypto.Wipe(h.data.Bytes()[size:h.length])
+		h.length = int(size)
+		return fs.OK
+	}
+	return h.grow(int(size))
+}
+
+// grow lengthens the value, moving it into a buffer twice as large when it runs out of room and
+// wiping the one it leaves
+func (h *valueHandle) grow(length int) syscall.Errno {
+	if length <= h.length {
+		return fs.OK
+	}
+	if length > h.data.Len() {
+		room := 2 * h.data.Len()
+		if room < length {
+			room = length
+		}
+		larger, err := crypto.NewBuffer(room)
+		if err != nil {
+			return syscall.ENOMEM
+		}
+		copy(larger.Bytes(), h.data.Bytes()[:h.length])
+		h.data.Destroy()
+		h.data = larger
+	}
+	h.length = length
+	return fs.OK
+}
+
+// errorNumber gives a store error the closest error number
+func errorNumber(err error) syscall.Errno {
+	switch {
+	case os.IsNotExist(err), err == store.ValueAbsentState:
+		return syscall.ENOENT
+	case err == store.AuthenticationFailedState:
+		return syscall.EACCES
+	}
+	if state, ok := err.(*store.State); ok && state.Code() == store.WeakValueError("", "").Code() {
+		return syscall.EPERM
+	}
+	if state, ok := err.(*store.State); ok && state.Code() == store.ExpiredError("", time.Time{}).Code() {
+		return syscall.EPERM
+	}
+	// failures writing the store, such as a full disk, are reported as they are
+	var number syscall.Errno
+	if errors.As(err, &number) {
+		return number
+	}
+	return syscall.EIO
+}
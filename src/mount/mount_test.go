@@ -0,0 +1,124 @@
+package mount
+
+import (
+	"fmt"
+	"io/ioutil"
+	"keepo/src/crypto"
+	"keepo/src/data/store"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMount(t *testing.T) {
+
+	storeName := "mount-test"
+	cleanup(storeName)
+	defer cleanup(storeName)
+	mountpoint, err := ioutil.TempDir("", "keepo-mount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(mountpoint)
+
+	secret := func() *store.Secret {
+		passphrase, _ := crypto.NewBufferFrom([]byte("password01"))
+		return &store.Secret{Passphrase: passphrase}
+	}
+	if err := store.SetMapValue(storeName, "db/password", "correct horse battery staple", secret()); err != nil {
+		t.Fatalf("could not set map value '%q'", err)
+	}
+
+	mounted, err := New(storeName, mountpoint, secret(), Options{ReadWrite: true, Timeout: time.Hour})
+	if err != nil {
+		t.Skipf("could not mount, FUSE may be unavailable '%q'", err)
+	}
+	unmounted := false
+	defer func() {
+		if !unmounted {
+			_ = mounted.Unmount()
+		}
+	}()
+
+	fmt.Println("test keys are read as files beneath directories")
+	value, err := ioutil.ReadFile(filepath.Join(mountpoint, "db", "password"))
+	if err != nil || string(value) != "correct horse battery staple" {
+		t.Errorf("Expected %q, received %q '%q'", "correct horse battery staple", value, err)
+	}
+	if info, err := os.Stat(filepath.Join(mountpoint, "db", "password")); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Expected mode %v, received %v '%q'", os.FileMode(0600), info.Mode().Perm(), err)
+	}
+
+	fmt.Println("test files written and removed set and clear their keys")
+	if err = ioutil.WriteFile(filepath.Join(mountpoint, "db", "user"), []byte("admin"), 0600); err != nil {
+		t.Errorf("could not write file '%q'", err)
+	}
+	if err = os.Remove(filepath.Join(mountpoint, "db", "password")); err != nil {
+		t.Errorf("could not remove file '%q'", err)
+	}
+
+	fmt.Println("test files written at once all set their keys")
+	var written sync.WaitGroup
+	for index := 0; index < 8; index++ {
+		written.Add(1)
+		go func(name string) {
+			defer written.Done()
+			if err := ioutil.WriteFile(filepath.Join(mountpoint, name), []byte(name), 0600); err != nil {
+				t.Errorf("could not write file '%q'", err)
+			}
+		}(fmt.Sprintf("key%d", index))
+	}
+	written.Wait()
+
+	if err = mounted.Unmount(); err != nil {
+		t.Fatalf("could not unmount '%q'", err)
+	}
+	unmounted = true
+	mounted.Wait()
+
+	if keys, err := store.ListMapKeys(storeName); err != nil || len(keys) != 9 || keys[0] != "db/user" {
+		t.Errorf("Expected %q and 8 others, received %q '%q'", "db/user", keys, err)
+	}
+	for index := 0; index < 8; index++ {
+		name := fmt.Sprintf("key%d", index)
+		if entry, err := store.GetMapEntry(storeName, name, secret()); err != nil || string(entry.Value) != name {
+			t.Errorf("Expected %q, received '%q'", name, err)
+		}
+	}
+	if entry, err := store.GetMapEntry(storeName, "db/user", secret()); err != nil || string(entry.Value) != "admin" {
+		t.Errorf("Expected %q, received '%q'", "admin", err)
+	}
+
+	fmt.Println("test read-only mounts refuse writes and unmount when unused")
+	mounted, err = New(storeName, mountpoint, secret(), Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("could not mount '%q'", err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(mountpoint, "db", "user"), []byte("root"), 0600); err == nil {
+		t.Errorf("expected a read-only mount to refuse writes")
+	}
+	waited := make(chan struct{})
+	go func() {
+		mounted.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-time.After(10 * time.Second):
+		_ = mounted.Unmount()
+		t.Errorf("expected the mount to be unmounted once unused")
+	}
+}
+
+func cleanup(storeName string) {
+	storePath := store.GetStorePath(storeName)
+	_ = os.Remove(storePath)
+	backups := filepath.Join(filepath.Dir(storePath), store.BackupDirectory)
+	copies, _ := filepath.Glob(filepath.Join(backups, storeName+"-*"+store.Extension))
+	for _, path := range copies {
+		_ = os.Remove(path)
+	}
+	_ = os.Remove(backups)
+}
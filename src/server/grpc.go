@@ -0,0 +1,221 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"keepo/src/api"
+	"keepo/src/crypto"
+	"keepo/src/data/store"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// GRPCServer serves the keepo gRPC service with the secret it was unlocked with, to callers
+// presenting an API token as 'authorization: Bearer <token>' metadata
+type GRPCServer struct {
+	api.UnimplementedKeepoServer
+	secret *store.Secret
+	tokens []Token
+	// Breaches is the breach dataset values set are looked up in, none when empty
+	Breaches string
+
+	mutex  sync.Mutex
+	server *grpc.Server
+}
+
+// NewGRPC makes a gRPC server for the tokens, which opens stores with the secret, the caller
+// destroys the secret once the server is stopped
+func NewGRPC(secret *store.Secret, tokens []Token) *GRPCServer {
+	s := &GRPCServer{secret: secret, tokens: tokens}
+	s.server = grpc.NewServer()
+	api.RegisterKeepoServer(s.server, s)
+	return s
+}
+
+// Serve serves the service on the listener until the server is stopped
+func (s *GRPCServer) Serve(listener net.Listener) error {
+	return s.server.Serve(listener)
+}
+
+// Stop stops serving, ending any calls and watches in progress
+func (s *GRPCServer) Stop() {
+	s.server.Stop()
+}
+
+func (s *GRPCServer) Get(context context.Context, request *api.GetRequest) (*api.GetResponse, error) {
+	if err := s.check(context, request.Store, request.Key, false); err != nil {
+		return nil, err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := store.CheckExpiry(request.Store, request.Key); err != nil {
+		return nil, statusOf(err)
+	}
+	entry, err := store.GetMapEntry(request.Store, request.Key, s.secret)
+	if err != nil {
+		return nil, statusOf(err)
+	}
+	response := &api.GetResponse{Value: entry.Value, Metadata: &api.Metadata{
+		Url:    entry.URL,
+		Tags:   entry.Tags,
+		Notes:  entry.Notes,
+		MaxAge: int64(time.Duration(entry.MaxAge) / time.Second),
+	}}
+	if entry.Expires != nil {
+		response.Metadata.Expires = entry.Expires.Unix()
+	}
+	return response, nil
+}
+
+func (s *GRPCServer) Set(context context.Context, request *api.SetRequest) (*api.SetResponse, error) {
+	defer crypto.Wipe(request.Value)
+	if err := s.check(context, request.Store, request.Key, true); err != nil {
+		return nil, err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, err := store.CheckValue(request.Store, request.Key, request.Value, s.Breaches)
+	if err == nil {
+		err = store.SetMapBytes(request.Store, request.Key, request.Value, s.secret)
+	}
+	if err != nil {
+		return nil, statusOf(err)
+	}
+	return &api.SetResponse{}, nil
+}
+
+func (s *GRPCServer) Delete(context context.Context, request *api.DeleteRequest) (*api.DeleteResponse, error) {
+	if err := s.check(context, request.Store, request.Key, true); err != nil {
+		return nil, err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := store.ClearMapValue(request.Store, request.Key, s.secret); err != nil {
+		return nil, statusOf(err)
+	}
+	return &api.DeleteResponse{}, nil
+}
+
+func (s *GRPCServer) ListKeys(context context.Context, request *api.ListKeysRequest) (*api.ListKeysResponse, error) {
+	token, err := s.checkStore(context, request.Store)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := store.ListMapKeys(request.Store)
+	if err != nil {
+		return nil, statusOf(err)
+	}
+	response := &api.ListKeysResponse{Keys: []string{}}
+	for _, key := range store.SubtreeKeys(keys, request.Prefix) {
+		if token.Allows(request.Store, key, false) {
+			response.Keys = append(response.Keys, key)
+		}
+	}
+	return response, nil
+}
+
+// Watch streams changes to the keys the token covers until the caller cancels
+func (s *GRPCServer) Watch(request *api.WatchRequest, stream grpc.ServerStreamingServer[api.ChangeEvent]) error {
+	token, err := s.checkStore(stream.Context(), request.Store)
+	if err != nil {
+		return err
+	}
+
+	changes, failed := make(chan store.KeyChange), make(chan error, 1)
+	go func() {
+		failed <- store.WatchStore(request.Store, request.Prefix, stream.Context().Done(), changes)
+	}()
+	kinds := map[store.Change]api.ChangeEvent_Change{
+		store.Added:   api.ChangeEvent_ADDED,
+		store.Changed: api.ChangeEvent_CHANGED,
+		store.Removed: api.ChangeEvent_REMOVED,
+	}
+	for {
+		select {
+		case change := <-changes:
+			if !token.Allows(change.Store, change.Key, false) {
+				continue
+			}
+			if err := stream.Send(&api.ChangeEvent{Store: change.Store, Key: change.Key, Change: kinds[change.Change]}); err != nil {
+				return err
+			}
+		case err := <-failed:
+			if err != nil {
+				return statusOf(err)
+			}
+			return nil
+		}
+	}
+}
+
+// checkStore authenticates the call and refuses stores the token does not cover, which are
+// reported as absent so their names are not revealed
+func (s *GRPCServer) checkStore(context context.Context, storeName string) (*Token, error) {
+	var presented string
+	if values := metadata.ValueFromIncomingContext(context, "authorization"); len(values) > 0 {
+		presented = values[0]
+	}
+	if !strings.HasPrefix(presented, "Bearer ") {
+		return nil, status.Error(codes.Unauthenticated, "a valid token is needed")
+	}
+	token, ok := authenticate(s.tokens, []byte(strings.TrimSpace(strings.TrimPrefix(presented, "Bearer "))))
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "a valid token is needed")
+	}
+	if !validStoreName(storeName) {
+		return nil, status.Error(codes.InvalidArgument, "invalid store name '"+storeName+"'")
+	}
+	if !token.AllowsStore(storeName) {
+		return nil, status.Error(codes.NotFound, "no such store")
+	}
+	return token, nil
+}
+
+// check refuses keys the token does not cover, or may not change when writing
+func (s *GRPCServer) check(context context.Context, storeName, key string, write bool) error {
+	token, err := s.checkStore(context, storeName)
+	if err != nil {
+		return err
+	}
+	if !token.Allows(storeName, key, write) {
+		return status.Error(codes.PermissionDenied, "the token does not cover this key")
+	}
+	return nil
+}
+
+// statusOf gives a store error the status code closest to its own
+func statusOf(err error) error {
+	if os.IsNotExist(err) {
+		return status.Error(codes.NotFound, "no such store")
+	}
+	if errors.Is(err, syscall.ENOSPC) {
+		return status.Error(codes.ResourceExhausted, err.Error())
+	}
+	state, ok := err.(*store.State)
+	if !ok {
+		return status.Error(codes.Internal, err.Error())
+	}
+	code := codes.Internal
+	switch state.Code() {
+	case store.ValueAbsentState.Code():
+		code = codes.NotFound
+	case store.InvalidFormatError("").Code(), store.ValueTooLargeError(0).Code():
+		code = codes.InvalidArgument
+	case store.ExpiredError("", time.Time{}).Code(), store.WeakValueError("", "").Code():
+		code = codes.FailedPrecondition
+	case store.EntryVerificationFailedState.Code(), store.IndexVerificationFailedState.Code():
+		code = codes.DataLoss
+	}
+	return status.Error(code, state.Error())
+}
@@ -0,0 +1,138 @@
+package server
+
+// OpenAPI describes the API, version 1 only ever grows, changes that break callers take a new prefix
+const OpenAPI = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "keepo",
+    "description": "Read and change the values of keepo stores with an API token.",
+    "version": "1.0.0"
+  },
+  "servers": [{"url": "/v1"}],
+  "security": [{"token": []}],
+  "paths": {
+    "/stores": {
+      "get": {
+        "operationId": "listStores",
+        "summary": "List the stores the token covers",
+        "responses": {
+          "200": {"description": "The stores", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/StoreList"}}}},
+          "401": {"$ref": "#/components/responses/Failure"}
+        }
+      }
+    },
+    "/stores/{store}/keys": {
+      "parameters": [{"$ref": "#/components/parameters/store"}],
+      "get": {
+        "operationId": "listKeys",
+        "summary": "List the keys of the store the token covers",
+        "parameters": [
+          {"name": "prefix", "in": "query", "required": false, "description": "Limits the keys to those beneath the prefix", "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "200": {"description": "The keys", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/KeyList"}}}},
+          "400": {"$ref": "#/components/responses/Failure"},
+          "401": {"$ref": "#/components/responses/Failure"},
+          "404": {"$ref": "#/components/responses/Failure"}
+        }
+      }
+    },
+    "/stores/{store}/keys/{key}": {
+      "parameters": [
+        {"$ref": "#/components/parameters/store"},
+        {"name": "key", "in": "path", "required": true, "description": "The key, which may hold '/'", "schema": {"type": "string"}}
+      ],
+      "get": {
+        "operationId": "getValue",
+        "summary": "Get the value of a key and its metadata",
+        "responses": {
+          "200": {"description": "The value", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Value"}}}},
+          "401": {"$ref": "#/components/responses/Failure"},
+          "403": {"$ref": "#/components/responses/Failure"},
+          "404": {"$ref": "#/components/responses/Failure"},
+          "410": {"$ref": "#/components/responses/Failure"}
+        }
+      },
+      "put": {
+        "operationId": "setValue",
+        "summary": "Set the value of a key, keeping its metadata",
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"$ref": "#/components/schemas/NewValue"}}}
+        },
+        "responses": {
+          "204": {"description": "The value was set"},
+          "400": {"$ref": "#/components/responses/Failure"},
+          "401": {"$ref": "#/components/responses/Failure"},
+          "403": {"$ref": "#/components/responses/Failure"},
+          "422": {"$ref": "#/components/responses/Failure"}
+        }
+      },
+      "delete": {
+        "operationId": "clearValue",
+        "summary": "Clear a key and its value",
+        "responses": {
+          "204": {"description": "The key was cleared"},
+          "401": {"$ref": "#/components/responses/Failure"},
+          "403": {"$ref": "#/components/responses/Failure"},
+          "404": {"$ref": "#/components/responses/Failure"}
+        }
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "token": {"type": "http", "scheme": "bearer", "description": "An API token from 'keepo serve-token'"}
+    },
+    "parameters": {
+      "store": {"name": "store", "in": "path", "required": true, "schema": {"type": "string"}}
+    },
+    "responses": {
+      "Failure": {"description": "The request failed", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Failure"}}}}
+    },
+    "schemas": {
+      "StoreList": {
+        "type": "object",
+        "required": ["stores"],
+        "properties": {"stores": {"type": "array", "items": {"type": "string"}}}
+      },
+      "KeyList": {
+        "type": "object",
+        "required": ["store", "keys"],
+        "properties": {"store": {"type": "string"}, "keys": {"type": "array", "items": {"type": "string"}}}
+      },
+      "Value": {
+        "type": "object",
+        "required": ["store", "key", "value"],
+        "properties": {
+          "store": {"type": "string"},
+          "key": {"type": "string"},
+          "value": {"type": "string"},
+          "encoding": {"type": "string", "enum": ["base64"], "description": "Set when the value is not text"},
+          "url": {"type": "string"},
+          "tags": {"type": "array", "items": {"type": "string"}},
+          "notes": {"type": "string"},
+          "expires": {"type": "string", "format": "date-time"},
+          "max_age": {"type": "string", "description": "e.g. 90d"}
+        }
+      },
+      "NewValue": {
+        "type": "object",
+        "required": ["value"],
+        "properties": {
+          "value": {"type": "string"},
+          "encoding": {"type": "string", "enum": ["base64"], "description": "Set when the value is given in base64"}
+        }
+      },
+      "Failure": {
+        "type": "object",
+        "required": ["error"],
+        "properties": {
+          "error": {"type": "string"},
+          "code": {"type": "integer", "description": "The keepo error code, when there is one"}
+        }
+      }
+    }
+  }
+}
+`
@@ -0,0 +1,447 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"keepo/src/crypto"
+	"keepo/src/data/store"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+)
+
+/**
+ * The API serves the stores the server was unlocked for to callers presenting an API token:
+ *
+ * GET		/v1/stores						- the stores the token covers
+ * GET		/v1/stores/{store}/keys			- the store's keys the token covers, ?prefix= limits them
+ * GET		/v1/stores/{store}/keys/{key}	- the key's value and metadata
+ * PUT		/v1/stores/{store}/keys/{key}	- sets the key's value, {"value": "...", "encoding": "base64"}
+ * DELETE	/v1/stores/{store}/keys/{key}	- clears the key
+ * GET		/v1/openapi.json				- the OpenAPI description, no token is needed
+ *
+ * Keys may hold '/', the rest of the path is the key. Tokens are given as 'Authorization: Bearer'.
+ *
+ * Values served are written from a buffer that is wiped, but the copies the HTTP server and TLS
+ * keep in their own write buffers, and the strings values set are decoded into, cannot be wiped.
+ */
+
+// UnixPrefix starts listen addresses that are Unix socket paths
+const UnixPrefix = "unix:"
+
+// maxRequestSize bounds the request bodies read, a value encoded in base64 with room for the JSON
+const maxRequestSize = store.MaxValueSize/3*4 + 4096
+
+const apiPrefix = "/v1/"
+
+// Server serves the API with the secret it was unlocked with, one store operation at a time
+type Server struct {
+	secret *store.Secret
+	tokens []Token
+	// Breaches is the breach dataset values set are looked up in, none when empty
+	Breaches string
+
+	mutex  sync.Mutex
+	server *http.Server
+}
+
+// Value is a key's value, encoded in base64 when it is not text, and its metadata
+type Value struct {
+	Store    string `json:"store"`
+	Key      string `json:"key"`
+	Value    string `json:"value"`
+	Encoding string `json:"encoding,omitempty"`
+	*store.Metadata
+}
+
+// StoreList is the stores a token covers
+type StoreList struct {
+	Stores []string `json:"stores"`
+}
+
+// KeyList is the keys of a store a token covers
+type KeyList struct {
+	Store string   `json:"store"`
+	Keys  []string `json:"keys"`
+}
+
+// Failure is the body of every error response, Code is the store's error code when there is one
+type Failure struct {
+	Error string `json:"error"`
+	Code  int    `json:"code,omitempty"`
+}
+
+// New makes a server for the tokens, which opens stores with the secret, the caller destroys the
+// secret once the server is closed
+func New(secret *store.Secret, tokens []Token) *Server {
+	s := &Server{secret: secret, tokens: tokens}
+	s.server = &http.Server{Handler: s, ReadHeaderTimeout: 10 * time.Second, IdleTimeout: time.Minute}
+	return s
+}
+
+// Listen listens on a Unix socket, given as unix:<path>, or a TCP address. Sockets are made
+// readable by their owner alone, and TCP addresses other than loopback ones need TLS.
+func Listen(address string, tls bool) (net.Listener, error) {
+	if strings.HasPrefix(address, UnixPrefix) {
+		path := strings.TrimPrefix(address, UnixPrefix)
+		if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			// a socket left by a server that did not close
+			_ = os.Remove(path)
+		}
+		listener, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		if err = os.Chmod(path, 0600); err != nil {
+			_ = listener.Close()
+			return nil, err
+		}
+		return listener, nil
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); !tls && (ip == nil || !ip.IsLoopback()) && host != "localhost" {
+		return nil, store.InvalidFormatError("serving beyond loopback needs --tls-cert and --tls-key")
+	}
+	return net.Listen("tcp", address)
+}
+
+// Serve serves the API on the listener until the server is closed, over TLS when a certificate
+// and key are given
+func (s *Server) Serve(listener net.Listener, certFile, keyFile string) (err error) {
+	if len(certFile) > 0 || len(keyFile) > 0 {
+		err = s.server.ServeTLS(listener, certFile, keyFile)
+	} else {
+		err = s.server.Serve(listener)
+	}
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Close stops serving, closing the listener and any open connections
+func (s *Server) Close() error {
+	return s.server.Close()
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	path := r.URL.Path
+	if path == apiPrefix+"openapi.json" && r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, OpenAPI)
+		return
+	}
+	if !strings.HasPrefix(path, apiPrefix+"stores") {
+		fail(w, http.StatusNotFound, "no such resource", 0)
+		return
+	}
+
+	token, ok := s.authenticate(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="keepo"`)
+		fail(w, http.StatusUnauthorized, "a valid token is needed", 0)
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(path, apiPrefix+"stores"), "/", 4)
+	switch {
+	case len(parts) == 1 && len(parts[0]) == 0:
+		s.route(w, r, map[string]func(){http.MethodGet: func() { s.listStores(w, token) }})
+	case len(parts) == 3 && len(parts[0]) == 0 && parts[2] == "keys":
+		s.route(w, r, map[string]func(){http.MethodGet: func() { s.listKeys(w, r, token, parts[1]) }})
+	case len(parts) == 4 && len(parts[0]) == 0 && parts[2] == "keys" && len(parts[3]) > 0:
+		storeName, key := parts[1], parts[3]
+		s.route(w, r, map[string]func(){
+			http.MethodGet:    func() { s.getValue(w, token, storeName, key) },
+			http.MethodPut:    func() { s.setValue(w, r, token, storeName, key) },
+			http.MethodDelete: func() { s.clearValue(w, token, storeName, key) },
+		})
+	default:
+		fail(w, http.StatusNotFound, "no such resource", 0)
+	}
+}
+
+// route runs the handler for the request's method, one at a time as stores are files
+func (s *Server) route(w http.ResponseWriter, r *http.Request, handlers map[string]func()) {
+	handler, ok := handlers[r.Method]
+	if !ok {
+		var allowed []string
+		for method := range handlers {
+			allowed = append(allowed, method)
+		}
+		sort.Strings(allowed)
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		fail(w, http.StatusMethodNotAllowed, "method not allowed", 0)
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	handler()
+}
+
+func (s *Server) authenticate(r *http.Request) (*Token, bool) {
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return nil, false
+	}
+	return authenticate(s.tokens, []byte(strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer "))))
+}
+
+func (s *Server) listStores(w http.ResponseWriter, token *Token) {
+	names, err := store.GetStoreNames()
+	if err != nil {
+		failWith(w, err)
+		return
+	}
+	list := StoreList{Stores: []string{}}
+	for _, name := range names {
+		if token.AllowsStore(name) {
+			list.Stores = append(list.Stores, name)
+		}
+	}
+	respond(w, http.StatusOK, list)
+}
+
+func (s *Server) listKeys(w http.ResponseWriter, r *http.Request, token *Token, storeName string) {
+	if !s.checkStore(w, token, storeName) {
+		return
+	}
+	keys, err := store.ListMapKeys(storeName)
+	if err != nil {
+		failWith(w, err)
+		return
+	}
+	list := KeyList{Store: storeName, Keys: []string{}}
+	for _, key := range store.SubtreeKeys(keys, r.URL.Query().Get("prefix")) {
+		if token.Allows(storeName, key, false) {
+			list.Keys = append(list.Keys, key)
+		}
+	}
+	respond(w, http.StatusOK, list)
+}
+
+func (s *Server) getValue(w http.ResponseWriter, token *Token, storeName, key string) {
+	if !s.checkKey(w, token, storeName, key, false) {
+		return
+	}
+	if err := store.CheckExpiry(storeName, key); err != nil {
+		failWith(w, err)
+		return
+	}
+	entry, err := store.GetMapEntry(storeName, key, s.secret)
+	if err != nil {
+		failWith(w, err)
+		return
+	}
+	defer crypto.Wipe(entry.Value)
+
+	value := Value{Store: storeName, Key: key, Metadata: &entry.Metadata}
+	if !utf8.Valid(entry.Value) {
+		value.Encoding = "base64"
+	}
+	respondValue(w, value, entry.Value)
+}
+
+func (s *Server) setValue(w http.ResponseWriter, r *http.Request, token *Token, storeName, key string) {
+	if !s.checkKey(w, token, storeName, key, true) {
+		return
+	}
+	var request Value
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestSize))
+	if err == nil {
+		err = json.Unmarshal(body, &request)
+	}
+	crypto.Wipe(body)
+	if err != nil {
+		fail(w, http.StatusBadRequest, "could not read the value: "+err.Error(), 0)
+		return
+	}
+
+	value := []byte(request.Value)
+	switch request.Encoding {
+	case "":
+	case "base64":
+		if value, err = base64.StdEncoding.DecodeString(request.Value); err != nil {
+			fail(w, http.StatusBadRequest, "could not decode the value: "+err.Error(), 0)
+			return
+		}
+	default:
+		fail(w, http.StatusBadRequest, "unknown encoding '"+request.Encoding+"'", 0)
+		return
+	}
+	defer crypto.Wipe(value)
+
+	if _, err = store.CheckValue(storeName, key, value, s.Breaches); err == nil {
+		err = store.SetMapBytes(storeName, key, value, s.secret)
+	}
+	if err != nil {
+		failWith(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) clearValue(w http.ResponseWriter, token *Token, storeName, key string) {
+	if !s.checkKey(w, token, storeName, key, true) {
+		return
+	}
+	if err := store.ClearMapValue(storeName, key, s.secret); err != nil {
+		failWith(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkStore refuses store names that would leave the store directory and stores the token does
+// not cover, which are reported as absent so their names are not revealed
+func (s *Server) checkStore(w http.ResponseWriter, token *Token, storeName string) bool {
+	if !validStoreName(storeName) {
+		fail(w, http.StatusBadRequest, "invalid store name '"+storeName+"'", 0)
+		return false
+	}
+	if !token.AllowsStore(storeName) {
+		fail(w, http.StatusNotFound, "no such store", 0)
+		return false
+	}
+	return true
+}
+
+// checkKey refuses keys the token does not cover, or may not change when writing
+func (s *Server) checkKey(w http.ResponseWriter, token *Token, storeName, key string, write bool) bool {
+	if !s.checkStore(w, token, storeName) {
+		return false
+	}
+	if !token.Allows(storeName, key, write) {
+		fail(w, http.StatusForbidden, "the token does not cover this key", 0)
+		return false
+	}
+	return true
+}
+
+// validStoreName refuses store names that would leave the store directory
+func validStoreName(storeName string) bool {
+	return len(storeName) > 0 && storeName != "." && storeName != ".." && !strings.ContainsAny(storeName, `/\`)
+}
+
+func respond(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// valuePlaceholder is the empty value a Value is encoded with, the first field able to hold it
+// unescaped as the store and key before it are strings
+var valuePlaceholder = []byte(`"value":""`)
+
+// respondValue writes the value's JSON with the secret spliced in through a buffer that is wiped,
+// so no string copy of it is left, in base64 when the value says so
+func respondValue(w http.ResponseWriter, value Value, secret []byte) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		fail(w, http.StatusInternalServerError, err.Error(), 0)
+		return
+	}
+	at := bytes.Index(encoded, valuePlaceholder) + len(valuePlaceholder) - 1
+
+	length := escapeJSON(nil, secret)
+	if value.Encoding == "base64" {
+		length = base64.StdEncoding.EncodedLen(len(secret))
+	}
+	body, err := crypto.NewBuffer(len(encoded) + length + 1)
+	if err != nil {
+		fail(w, http.StatusInternalServerError, err.Error(), 0)
+		return
+	}
+	defer body.Destroy()
+
+	n := copy(body.Bytes(), encoded[:at])
+	if value.Encoding == "base64" {
+		base64.StdEncoding.Encode(body.Bytes()[n:], secret)
+	} else {
+		escapeJSON(body.Bytes()[n:], secret)
+	}
+	n += length
+	n += copy(body.Bytes()[n:], encoded[at:])
+	body.Bytes()[n] = '\n'
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(body.Bytes()[:n+1])
+}
+
+// escapeJSON writes the UTF-8 value escaped as the inside of a JSON string into out, giving its
+// length, only the length is counted when out is nil
+func escapeJSON(out []byte, value []byte) (length int) {
+	const hex = "0123456789abcdef"
+	write := func(escaped ...byte) {
+		if out != nil {
+			copy(out[length:], escaped)
+		}
+		length += len(escaped)
+	}
+	for _, c := range value {
+		switch {
+		case c == '"' || c == '\\':
+			write('\\', c)
+		case c == '\n':
+			write('\\', 'n')
+		case c == '\r':
+			write('\\', 'r')
+		case c == '\t':
+			write('\\', 't')
+		case c < 0x20:
+			write('\\', 'u', '0', '0', hex[c>>4], hex[c&0xf])
+		default:
+			write(c)
+		}
+	}
+	return length
+}
+
+func fail(w http.ResponseWriter, status int, message string, code int) {
+	respond(w, status, Failure{Error: message, Code: code})
+}
+
+// failWith reports a store error with the status closest to its code
+func failWith(w http.ResponseWriter, err error) {
+	if os.IsNotExist(err) {
+		fail(w, http.StatusNotFound, "no such store", 0)
+		return
+	}
+	if errors.Is(err, syscall.ENOSPC) {
+		fail(w, http.StatusInsufficientStorage, err.Error(), 0)
+		return
+	}
+	state, ok := err.(*store.State)
+	if !ok {
+		fail(w, http.StatusInternalServerError, err.Error(), 0)
+		return
+	}
+	status := http.StatusInternalServerError
+	switch state.Code() {
+	case store.ValueAbsentState.Code():
+		status = http.StatusNotFound
+	case store.InvalidFormatError("").Code(), store.ValueTooLargeError(0).Code():
+		status = http.StatusBadRequest
+	case store.ExpiredError("", time.Time{}).Code():
+		status = http.StatusGone
+	case store.WeakValueError("", "").Code():
+		status = http.StatusUnprocessableEntity
+	}
+	fail(w, status, state.Error(), state.Code())
+}
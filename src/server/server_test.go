@@ -0,0 +1,181 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"keepo/src/crypto"
+	"keepo/src/data/store"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestServe(t *testing.T) {
+
+	storeName := "server-test"
+	cleanup(storeName)
+	defer cleanup(storeName)
+	dir, err := ioutil.TempDir("", "keepo-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	secret := func() *store.Secret {
+		passphrase, _ := crypto.NewBufferFrom([]byte("password01"))
+		return &store.Secret{Passphrase: passphrase}
+	}
+	for key, value := range map[string]string{"db/password": "correct horse battery staple", "api/key": "k3y-Ba77ery-Staple-42"} {
+		if err := store.SetMapValue(storeName, key, value, secret()); err != nil {
+			t.Fatalf("could not set map value '%q'", err)
+		}
+	}
+
+	tokensPath := filepath.Join(dir, TokensFile)
+	reader, err := AddToken(tokensPath, "reader", []string{storeName + ":db/*"}, false)
+	if err != nil {
+		t.Fatalf("could not add token '%q'", err)
+	}
+	writer, err := AddToken(tokensPath, "writer", []string{"server-*:*"}, true)
+	if err != nil {
+		t.Fatalf("could not add token '%q'", err)
+	}
+	if _, err = AddToken(tokensPath, "reader", []string{"*"}, false); err == nil {
+		t.Errorf("expected a second token named %q to be refused", "reader")
+	}
+	tokens, err := LoadTokens(tokensPath)
+	if err != nil || len(tokens) != 2 {
+		t.Fatalf("could not load tokens %v '%q'", tokens, err)
+	}
+
+	server := httptest.NewServer(New(secret(), tokens))
+	defer server.Close()
+
+	request := func(method, path string, token *crypto.Buffer, body string) (int, string) {
+		r, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if token != nil {
+			r.Header.Set("Authorization", "Bearer "+string(token.Bytes()))
+		}
+		response, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		contents, _ := ioutil.ReadAll(response.Body)
+		return response.StatusCode, string(contents)
+	}
+
+	fmt.Println("test requests without a valid token are refused")
+	if status, _ := request("GET", "/v1/stores", nil, ""); status != http.StatusUnauthorized {
+		t.Errorf("Expected %d, received %d", http.StatusUnauthorized, status)
+	}
+	if status, _ := request("GET", "/v1/stores", &crypto.Buffer{}, ""); status != http.StatusUnauthorized {
+		t.Errorf("Expected %d, received %d", http.StatusUnauthorized, status)
+	}
+
+	fmt.Println("test a token sees the keys it covers alone")
+	status, body := request("GET", "/v1/stores/"+storeName+"/keys", reader, "")
+	var keys KeyList
+	if err := json.Unmarshal([]byte(body), &keys); status != http.StatusOK || err != nil || len(keys.Keys) != 1 || keys.Keys[0] != "db/password" {
+		t.Errorf("Expected %q, received %d %s", "db/password", status, body)
+	}
+	status, body = request("GET", "/v1/stores/"+storeName+"/keys/db/password", reader, "")
+	var value Value
+	if err := json.Unmarshal([]byte(body), &value); status != http.StatusOK || err != nil || value.Value != "correct horse battery staple" {
+		t.Errorf("Expected %q, received %d %s", "correct horse battery staple", status, body)
+	}
+	if status, _ = request("GET", "/v1/stores/"+storeName+"/keys/api/key", reader, ""); status != http.StatusForbidden {
+		t.Errorf("Expected %d, received %d", http.StatusForbidden, status)
+	}
+	if status, _ = request("PUT", "/v1/stores/"+storeName+"/keys/db/password", reader, `{"value": "x"}`); status != http.StatusForbidden {
+		t.Errorf("Expected %d, received %d", http.StatusForbidden, status)
+	}
+	if status, _ = request("GET", "/v1/stores/../keys", reader, ""); status == http.StatusOK {
+		t.Errorf("Expected a store outside the store directory to be refused, received %d", status)
+	}
+
+	fmt.Println("test a writing token sets and clears values")
+	if status, body = request("PUT", "/v1/stores/"+storeName+"/keys/bin", writer, `{"value": "AAEC/w==", "encoding": "base64"}`); status != http.StatusNoContent {
+		t.Errorf("Expected %d, received %d %s", http.StatusNoContent, status, body)
+	}
+	if got, err := store.GetMapValue(storeName, "bin", secret()); err != nil || string(got) != "\x00\x01\x02\xff" {
+		t.Errorf("Expected %q, received %q '%q'", "\x00\x01\x02\xff", got, err)
+	}
+	status, body = request("GET", "/v1/stores/"+storeName+"/keys/bin", writer, "")
+	if err := json.Unmarshal([]byte(body), &value); status != http.StatusOK || err != nil || value.Encoding != "base64" || value.Value != "AAEC/w==" {
+		t.Errorf("Expected %q in base64, received %d %s", "AAEC/w==", status, body)
+	}
+	quoted := "say \"hi\"\n\\ \x01 \u00e9"
+	if err := store.SetMapValue(storeName, "quoted", quoted, secret()); err != nil {
+		t.Fatalf("could not set map value '%q'", err)
+	}
+	status, body = request("GET", "/v1/stores/"+storeName+"/keys/quoted", writer, "")
+	value = Value{}
+	if err := json.Unmarshal([]byte(body), &value); status != http.StatusOK || err != nil || value.Encoding != "" || value.Value != quoted {
+		t.Errorf("Expected %q, received %d %s", quoted, status, body)
+	}
+	if status, _ = request("DELETE", "/v1/stores/"+storeName+"/keys/bin", writer, ""); status != http.StatusNoContent {
+		t.Errorf("Expected %d, received %d", http.StatusNoContent, status)
+	}
+	if status, _ = request("DELETE", "/v1/stores/"+storeName+"/keys/bin", writer, ""); status != http.StatusNotFound {
+		t.Errorf("Expected %d, received %d", http.StatusNotFound, status)
+	}
+
+	fmt.Println("test the OpenAPI description is served without a token")
+	status, body = request("GET", "/v1/openapi.json", nil, "")
+	var description map[string]interface{}
+	if err := json.Unmarshal([]byte(body), &description); status != http.StatusOK || err != nil || description["openapi"] == nil {
+		t.Errorf("Expected an OpenAPI description, received %d '%q'", status, err)
+	}
+
+	fmt.Println("test a removed token is forgotten")
+	if err := RemoveToken(tokensPath, "writer"); err != nil {
+		t.Errorf("could not remove token '%q'", err)
+	}
+	if tokens, err = LoadTokens(tokensPath); err != nil || len(tokens) != 1 || tokens[0].Name != "reader" {
+		t.Errorf("Expected only %q, received %v '%q'", "reader", tokens, err)
+	}
+}
+
+func TestListen(t *testing.T) {
+
+	fmt.Println("test TCP beyond loopback needs TLS")
+	if _, err := Listen("0.0.0.0:0", false); err == nil {
+		t.Errorf("expected listening on every address without TLS to be refused")
+	}
+	listener, err := Listen("127.0.0.1:0", false)
+	if err != nil {
+		t.Fatalf("could not listen on loopback '%q'", err)
+	}
+	_ = listener.Close()
+
+	fmt.Println("test sockets are readable by their owner alone")
+	dir, err := ioutil.TempDir("", "keepo-socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	listener, err = Listen(UnixPrefix+filepath.Join(dir, "keepo.sock"), false)
+	if err != nil {
+		t.Fatalf("could not listen on socket '%q'", err)
+	}
+	defer listener.Close()
+	if info, err := os.Stat(filepath.Join(dir, "keepo.sock")); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Expected %v, received %v '%q'", os.FileMode(0600), info.Mode().Perm(), err)
+	}
+}
+
+func cleanup(storeName string) {
+	storePath := store.GetStorePath(storeName)
+	_ = os.Remove(storePath)
+	backups := filepath.Join(filepath.Dir(storePath), store.BackupDirectory)
+	copies, _ := filepath.Glob(filepath.Join(backups, storeName+"-*"+store.Extension))
+	for _, path := range copies {
+		_ = os.Remove(path)
+	}
+	_ = os.Remove(backups)
+}
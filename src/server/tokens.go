@@ -0,0 +1,190 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"keepo/src/crypto"
+	"keepo/src/data/store"
+	"os"
+	"strings"
+)
+
+/**
+ * API tokens are kept in a JSON file beside the stores, by their SHA-256 alone, so the file
+ * authenticates tokens without holding them. Each token is scoped to '[store:]glob' patterns,
+ * a glob in the store part as well matching stores by name, and reads unless it may write.
+ */
+
+// TokenPrefix starts every API token, telling them from grant tokens
+const TokenPrefix = "KEEPO-API-"
+
+// TokensFile is the file beside the stores that API tokens are kept in
+const TokensFile = "tokens.json"
+
+var tokenEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Token is an API token's scope, the token itself is only shown when it is added
+type Token struct {
+	Name  string   `json:"name"`
+	Hash  string   `json:"sha256"`
+	Keys  []string `json:"keys"`
+	Write bool     `json:"write"`
+}
+
+// LoadTokens reads the tokens file, a file yet to be written holds no tokens
+func LoadTokens(path string) (tokens []Token, err error) {
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(contents, &tokens); err != nil {
+		return nil, store.InvalidFormatError("could not read tokens file: " + err.Error())
+	}
+	for _, token := range tokens {
+		if err = checkPatterns(token.Keys); err != nil {
+			return nil, err
+		}
+	}
+	return tokens, nil
+}
+
+// AddToken generates a token for the key patterns and adds its hash to the tokens file, returning
+// the token in a buffer the caller destroys
+func AddToken(path, name string, keys []string, write bool) (token *crypto.Buffer, err error) {
+	if len(keys) == 0 {
+		return nil, store.InvalidFormatError("a token needs at least one key pattern")
+	}
+	if err = checkPatterns(keys); err != nil {
+		return nil, err
+	}
+	tokens, err := LoadTokens(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, existing := range tokens {
+		if existing.Name == name {
+			return nil, store.InvalidFormatError("there is already a token named '" + name + "'")
+		}
+	}
+
+	random := crypto.GenerateSecretBuffer()
+	defer random.Destroy()
+	token, err = crypto.NewBufferFrom([]byte(TokenPrefix + tokenEncoding.EncodeToString(random.Bytes())))
+	if err != nil {
+		return nil, err
+	}
+
+	tokens = append(tokens, Token{Name: name, Hash: hashToken(token.Bytes()), Keys: keys, Write: write})
+	if err = writeTokens(path, tokens); err != nil {
+		token.Destroy()
+		return nil, err
+	}
+	return token, nil
+}
+
+// RemoveToken removes the named token from the tokens file
+func RemoveToken(path, name string) error {
+	tokens, err := LoadTokens(path)
+	if err != nil {
+		return err
+	}
+	kept := tokens[:0]
+	for _, token := range tokens {
+		if token.Name != name {
+			kept = append(kept, token)
+		}
+	}
+	if len(kept) == len(tokens) {
+		return store.InvalidFormatError("there is no token named '" + name + "'")
+	}
+	return writeTokens(path, kept)
+}
+
+// authenticate finds the token presented among those known, comparing hashes in constant time
+func authenticate(tokens []Token, presented []byte) (*Token, bool) {
+	if !strings.HasPrefix(string(presented), TokenPrefix) {
+		return nil, false
+	}
+	hash := []byte(hashToken(presented))
+	var found *Token
+	for index := range tokens {
+		if subtle.ConstantTimeCompare(hash, []byte(tokens[index].Hash)) == 1 {
+			found = &tokens[index]
+		}
+	}
+	return found, found != nil
+}
+
+// AllowsStore reports whether any of the token's patterns can match keys of the store
+func (t *Token) AllowsStore(storeName string) bool {
+	for _, pattern := range t.Keys {
+		storeGlob, _ := store.SplitAddress(pattern)
+		if matchGlob(storeGlob, storeName) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows reports whether the token covers the key, and may change it when write is asked for
+func (t *Token) Allows(storeName, key string, write bool) bool {
+	if write && !t.Write {
+		return false
+	}
+	for _, pattern := range t.Keys {
+		storeGlob, keyGlob := store.SplitAddress(pattern)
+		if matchGlob(storeGlob, storeName) && matchGlob(keyGlob, key) {
+			return true
+		}
+	}
+	return false
+}
+
+func checkPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		storeGlob, keyGlob := store.SplitAddress(pattern)
+		for _, glob := range []string{storeGlob, keyGlob} {
+			if _, err := store.GlobPattern(glob); err != nil {
+				return store.InvalidFormatError("could not read key pattern '" + pattern + "'")
+			}
+		}
+	}
+	return nil
+}
+
+func matchGlob(glob, name string) bool {
+	expression, err := store.GlobPattern(glob)
+	return err == nil && expression.MatchString(name)
+}
+
+func hashToken(token []byte) string {
+	hash := sha256.Sum256(token)
+	return hex.EncodeToString(hash[:])
+}
+
+// writeTokens replaces the tokens file, readable by its owner alone
+func writeTokens(path string, tokens []Token) error {
+	if tokens == nil {
+		tokens = []Token{}
+	}
+	contents, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	temporaryPath := path + ".tmp"
+	if err = ioutil.WriteFile(temporaryPath, append(contents, '\n'), 0600); err != nil {
+		return err
+	}
+	if err = os.Rename(temporaryPath, path); err != nil {
+		_ = os.Remove(temporaryPath)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package strength
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"keepo/src/crypto"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+/**
+ * Breach datasets are the SHA-1 password hashes Have I Been Pwned publishes, kept on disk so
+ * nothing about a value leaves the machine. Either form is read:
+ *
+ * range directory		- a file per 5 hex digit hash prefix, named by the prefix with or without
+ *						  .txt, of SUFFIX:COUNT lines as the range API serves them
+ * ordered file			- one file of HASH:COUNT lines ordered by hash, which is searched in place
+ */
+
+const prefixLength = 5
+
+// BreachCount gives how often the password appears in the dataset, 0 when it does not
+func BreachCount(dataset string, password []byte) (int, error) {
+	sum := sha1.Sum(password)
+	hash := bytes.ToUpper([]byte(hex.EncodeToString(sum[:])))
+	defer crypto.Wipe(hash)
+
+	info, err := os.Stat(dataset)
+	if err != nil {
+		return 0, err
+	}
+	if info.IsDir() {
+		return rangeCount(dataset, hash)
+	}
+	return orderedCount(dataset, info.Size(), hash)
+}
+
+// rangeCount reads the suffixes of the hash's range, a missing range file means the dataset holds
+// no hashes with the prefix
+func rangeCount(dataset string, hash []byte) (int, error) {
+	prefix := string(hash[:prefixLength])
+	fi, err := os.Open(filepath.Join(dataset, prefix+".txt"))
+	if os.IsNotExist(err) {
+		fi, err = os.Open(filepath.Join(dataset, prefix))
+	}
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := fi.Close(); err != nil {
+			panic(err)
+		}
+	}()
+
+	scanner := bufio.NewScanner(fi)
+	for scanner.Scan() {
+		if count, ok, err := hashLine(scanner.Bytes(), hash[prefixLength:]); ok || err != nil {
+			return count, err
+		}
+	}
+	return 0, scanner.Err()
+}
+
+// orderedCount binary searches the file by offset, each probe reading the first whole line after
+// it, then scans forward the few lines to the hash
+func orderedCount(dataset string, size int64, hash []byte) (int, error) {
+	fi, err := os.Open(dataset)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := fi.Close(); err != nil {
+			panic(err)
+		}
+	}()
+
+	low, high := int64(0), size
+	for high-low > 4096 {
+		middle := low + (high-low)/2
+		line, _, err := lineAfter(fi, middle)
+		if err != nil {
+			return 0, err
+		}
+		if line == nil || bytes.Compare(lineHash(line), hash) >= 0 {
+			high = middle
+		} else {
+			low = middle
+		}
+	}
+
+	_, start, err := lineAfter(fi, low)
+	if low == 0 {
+		start = 0
+	}
+	if err != nil {
+		return 0, err
+	}
+	if _, err = fi.Seek(start, io.SeekStart); err != nil {
+		return 0, err
+	}
+	scanner := bufio.NewScanner(fi)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if count, ok, err := hashLine(line, hash); ok || err != nil {
+			return count, err
+		}
+		if bytes.Compare(lineHash(line), hash) > 0 {
+			break
+		}
+	}
+	return 0, scanner.Err()
+}
+
+// lineAfter reads the first line starting after the offset, nil at the end of the file
+func lineAfter(fi *os.File, offset int64) (line []byte, start int64, err error) {
+	if _, err = fi.Seek(offset, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+	reader := bufio.NewReader(fi)
+	skipped, err := reader.ReadBytes('\n')
+	if err == io.EOF {
+		return nil, offset, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	start = offset + int64(len(skipped))
+	line, err = reader.ReadBytes('\n')
+	if err == io.EOF && len(line) > 0 {
+		err = nil
+	}
+	if err == io.EOF {
+		return nil, start, nil
+	}
+	return bytes.TrimRight(line, "\r\n"), start, err
+}
+
+func lineHash(line []byte) []byte {
+	if index := bytes.IndexByte(line, ':'); index >= 0 {
+		return bytes.ToUpper(line[:index])
+	}
+	return bytes.ToUpper(line)
+}
+
+// hashLine reads the count of a HASH:COUNT line when its hash is the one given
+func hashLine(line, hash []byte) (count int, ok bool, err error) {
+	line = bytes.TrimRight(line, "\r")
+	if !bytes.Equal(lineHash(line), hash) {
+		return 0, false, nil
+	}
+	index := bytes.IndexByte(line, ':')
+	if index < 0 {
+		return 1, true, nil
+	}
+	count, err = strconv.Atoi(string(bytes.TrimSpace(line[index+1:])))
+	if err != nil {
+		return 0, true, fmt.Errorf("invalid breach count in '%s'", line)
+	}
+	return count, true, nil
+}
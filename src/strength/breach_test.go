@@ -0,0 +1,84 @@
+package strength
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// sha1 of "password" is 5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8
+const passwordHash = "5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8"
+
+func TestBreachCount(t *testing.T) {
+	dir, err := ioutil.TempDir("", "breach")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ranges := filepath.Join(dir, "ranges")
+	_ = os.Mkdir(ranges, 0700)
+	_ = ioutil.WriteFile(filepath.Join(ranges, passwordHash[:5]+".txt"),
+		[]byte("003D68EB55068C33ACE09247EE4C639306B:3\r\n"+passwordHash[5:]+":3861493\r\n"), 0600)
+
+	ordered := filepath.Join(dir, "ordered.txt")
+	lines := []byte{}
+	for _, hash := range []string{"000000005AD76BD555C1D6D771DE417A4B87E4B4", "0000000A0E3B9F25FF41DE4B5AC238C2D545C7A8",
+		"3BC15C8AAE3E4124DD409035F32EA2FD6835EFC9", passwordHash, "F2B14F68EB995FACB3A1C35287B778D5BD785511"} {
+		lines = append(lines, hash+":12\n"...)
+	}
+	_ = ioutil.WriteFile(ordered, lines, 0600)
+
+	cases := []struct {
+		dataset  string
+		password string
+		want     int
+	}{
+		{ranges, "password", 3861493},
+		{ranges, "not in the dataset", 0},
+		{ordered, "password", 12},
+		{ordered, "not in the dataset", 0},
+	}
+
+	for _, c := range cases {
+		got, err := BreachCount(c.dataset, []byte(c.password))
+		if err != nil {
+			t.Errorf("could not check breaches '%q'", err)
+		}
+		if got != c.want {
+			t.Errorf("Expected %d, received %d", c.want, got)
+		}
+	}
+}
+
+func TestBreachCountOrdered(t *testing.T) {
+	dir, err := ioutil.TempDir("", "breach")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// enough lines that the search probes the file rather than reading it through
+	ordered := filepath.Join(dir, "ordered.txt")
+	lines := []byte{}
+	for index := 0; index < 5000; index++ {
+		hash := []byte("0000000000000000000000000000000000000000")
+		for digit, value := len(hash)-1, index*2; value > 0; digit, value = digit-1, value/16 {
+			hash[digit] = "0123456789ABCDEF"[value%16]
+		}
+		lines = append(lines, string(hash)+":1\r\n"...)
+	}
+	_ = ioutil.WriteFile(ordered, lines, 0600)
+
+	for _, hash := range []string{"0000000000000000000000000000000000000000", "0000000000000000000000000000000000000FA0",
+		"0000000000000000000000000000000000002706"} {
+		count, err := orderedCount(ordered, int64(len(lines)), []byte(hash))
+		if err != nil || count != 1 {
+			t.Errorf("Expected %d, received %d for %s", 1, count, hash)
+		}
+	}
+	if count, _ := orderedCount(ordered, int64(len(lines)), []byte("0000000000000000000000000000000000000FA1")); count != 0 {
+		t.Errorf("Expected %d, received %d", 0, count)
+	}
+}
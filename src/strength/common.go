@@ -0,0 +1,60 @@
+package strength
+
+import (
+	"embed"
+	"strings"
+	"sync"
+)
+
+// dictionaryNames are the frequency ranked lists zxcvbn ships, see data/README: passwords from
+// breaches, English words and US census surnames and first names. Each is most common first, so
+// a word's rank is the guesses an attacker trying the list in order needs.
+var dictionaryNames = []string{"passwords", "english", "surnames", "male_names", "female_names"}
+
+//go:embed data/*.txt
+var dictionaryFiles embed.FS
+
+var (
+	loadDictionaries sync.Once
+	dictionaries     map[string]map[string]int
+)
+
+// rankedDictionaries ranks the words of each dictionary, once they are first needed
+func rankedDictionaries() map[string]map[string]int {
+	loadDictionaries.Do(func() {
+		dictionaries = make(map[string]map[string]int, len(dictionaryNames))
+		for _, name := range dictionaryNames {
+			words, err := dictionaryFiles.ReadFile("data/" + name + ".txt")
+			if err != nil {
+				panic(err)
+			}
+			dictionaries[name] = rankWords(string(words))
+		}
+	})
+	return dictionaries
+}
+
+// rankWords ranks whitespace separated words by their order, the first is rank 1
+func rankWords(words string) map[string]int {
+	ranked := make(map[string]int)
+	for index, word := range strings.Fields(words) {
+		if _, ok := ranked[word]; !ok {
+			ranked[word] = index + 1
+		}
+	}
+	return ranked
+}
+
+// keyboardRows are the rows of a qwerty keyboard, unshifted then shifted, each row offset half a
+// key to the right of the one above
+var keyboardRows = []string{
+	"`1234567890-=", "qwertyuiop[]\\", "asdfghjkl;'", "zxcvbnm,./",
+	"~!@#$%^&*()_+", "QWERTYUIOP{}|", "ASDFGHJKL:\"", "ZXCVBNM<>?",
+}
+
+// l33tSubstitutions maps symbols to the letters they commonly stand for
+var l33tSubstitutions = map[rune][]rune{
+	'4': {'a'}, '@': {'a'}, '8': {'b'}, '(': {'c'}, '3': {'e'}, '6': {'g'}, '9': {'g'},
+	'1': {'i', 'l'}, '!': {'i'}, '|': {'i', 'l'}, '0': {'o'}, '$': {'s'}, '5': {'s'},
+	'7': {'t'}, '+': {'t'}, '%': {'x'}, '2': {'z'},
+}
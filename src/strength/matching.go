@@ -0,0 +1,355 @@
+package strength
+
+import (
+	"math"
+	"regexp"
+	"strconv"
+	"unicode"
+)
+
+// minGuesses keeps a matched token from counting for less than guessing it character by character
+// would take an attacker who knew the pattern
+const (
+	minSingleGuesses = 10
+	minMultiGuesses  = 50
+)
+
+const referenceYear = 2020
+const minYearSpace = 20
+
+func newMatch(pattern string, runes []rune, i, j int, guesses float64) Match {
+	least := float64(minMultiGuesses)
+	if j-i == 1 {
+		least = minSingleGuesses
+	}
+	return Match{Pattern: pattern, Token: string(runes[i:j]), Guesses: math.Max(guesses, least), i: i, j: j}
+}
+
+// dictionaryMatches finds the ranked words in the password, ignoring case, read backwards and
+// with common l33t substitutions undone
+func dictionaryMatches(runes []rune, pattern string, ranked map[string]int) (matches []Match) {
+	if len(ranked) == 0 {
+		return nil
+	}
+	lower := make([]rune, len(runes))
+	for index, r := range runes {
+		lower[index] = unicode.ToLower(r)
+	}
+
+	for i := range lower {
+		for j := i + 1; j <= len(lower); j++ {
+			token := lower[i:j]
+			variations := uppercaseVariations(runes[i:j])
+
+			if rank, ok := ranked[string(token)]; ok {
+				matches = append(matches, newMatch(pattern, runes, i, j, float64(rank)*variations))
+			}
+			if rank, ok := ranked[reverse(token)]; ok && j-i > 1 {
+				matches = append(matches, newMatch(pattern, runes, i, j, float64(rank)*variations*2))
+			}
+			for _, unsubstituted := range unl33t(token) {
+				if rank, ok := ranked[string(unsubstituted.word)]; ok {
+					l33t := math.Pow(2, float64(unsubstituted.substitutions))
+					matches = append(matches, newMatch(pattern, runes, i, j, float64(rank)*variations*l33t))
+				}
+			}
+		}
+	}
+	return matches
+}
+
+// uppercaseVariations counts the ways of capitalising a word an attacker tries to reach this one,
+// all lowercase, a capital first or last letter and all capitals are the first few tried
+func uppercaseVariations(word []rune) float64 {
+	upper, lower := 0, 0
+	for _, r := range word {
+		if unicode.IsUpper(r) {
+			upper++
+		} else if unicode.IsLower(r) {
+			lower++
+		}
+	}
+	if upper == 0 {
+		return 1
+	}
+	if lower == 0 || (upper == 1 && (unicode.IsUpper(word[0]) || unicode.IsUpper(word[len(word)-1]))) {
+		return 2
+	}
+
+	variations := 0.0
+	for k := 1; k <= upper && k <= lower; k++ {
+		variations += binomial(upper+lower, k)
+	}
+	return variations
+}
+
+type unsubstitution struct {
+	word          []rune
+	substitutions int
+}
+
+// unl33t gives the word with every combination of l33t substitutions undone, none when it has
+// no substituted characters
+func unl33t(word []rune) (words []unsubstitution) {
+	words = []unsubstitution{{}}
+	for _, r := range word {
+		letters, ok := l33tSubstitutions[r]
+		if !ok {
+			for index := range words {
+				words[index].word = append(words[index].word, r)
+			}
+			continue
+		}
+
+		var extended []unsubstitution
+		for _, partial := range words {
+			for _, letter := range letters {
+				next := append(append([]rune{}, partial.word...), letter)
+				extended = append(extended, unsubstitution{next, partial.substitutions + 1})
+			}
+		}
+		if len(extended) > 16 {
+			extended = extended[:16]
+		}
+		words = extended
+	}
+
+	if words[0].substitutions == 0 {
+		return nil
+	}
+	return words
+}
+
+// sequenceMatches finds runs of at least three characters a constant step apart, like abc or 9753
+func sequenceMatches(runes []rune) (matches []Match) {
+	for i := 0; i+2 < len(runes); {
+		delta := runes[i+1] - runes[i]
+		j := i + 1
+		for j+1 < len(runes) && runes[j+1]-runes[j] == delta {
+			j++
+		}
+
+		if length := j - i + 1; length >= 3 && delta != 0 && delta >= -5 && delta <= 5 {
+			base := 26.0
+			switch first := runes[i]; {
+			case first == 'a' || first == 'A' || first == 'z' || first == 'Z' || first == '0' || first == '1' || first == '9':
+				base = 4
+			case unicode.IsDigit(first):
+				base = 10
+			}
+			if delta < 0 {
+				base *= 2
+			}
+			matches = append(matches, newMatch("sequence", runes, i, j+1, base*float64(length)))
+			i = j + 1
+			continue
+		}
+		i++
+	}
+	return matches
+}
+
+// repeatMatches finds a unit repeated at least twice, like aaa or abcabc, which takes as many
+// guesses as the unit times the repeats
+func repeatMatches(runes []rune) (matches []Match) {
+	for i := range runes {
+		bestLength, bestUnit := 0, 0
+		for unit := 1; i+2*unit <= len(runes); unit++ {
+			repeats := 1
+			for i+(repeats+1)*unit <= len(runes) && string(runes[i+repeats*unit:i+(repeats+1)*unit]) == string(runes[i:i+unit]) {
+				repeats++
+			}
+			if length := repeats * unit; repeats >= 2 && length >= 3 && length > bestLength {
+				bestLength, bestUnit = length, unit
+			}
+		}
+		if bestLength == 0 {
+			continue
+		}
+
+		unitGuesses := Estimate(string(runes[i : i+bestUnit])).Guesses
+		matches = append(matches, newMatch("repeat", runes, i, i+bestLength, unitGuesses*float64(bestLength/bestUnit)))
+	}
+	return matches
+}
+
+type keyPosition struct {
+	row, column int
+}
+
+var keyPositions = func() map[rune]keyPosition {
+	positions := make(map[rune]keyPosition)
+	for row, keys := range keyboardRows {
+		for column, key := range []rune(keys) {
+			positions[key] = keyPosition{row % 4, column}
+		}
+	}
+	return positions
+}()
+
+// adjacentKeys tells whether b neighbours a on the keyboard, each row sitting half a key to the
+// right of the one above
+func adjacentKeys(a, b rune) bool {
+	from, ok := keyPositions[a]
+	to, ok2 := keyPositions[b]
+	if !ok || !ok2 || a == b {
+		return false
+	}
+	switch to.row - from.row {
+	case 0:
+		return to.column-from.column == 1 || to.column-from.column == -1
+	case 1:
+		return to.column == from.column || to.column == from.column-1
+	case -1:
+		return to.column == from.column || to.column == from.column+1
+	}
+	return false
+}
+
+// spatialMatches finds runs of at least three neighbouring keys, like qwerty or zaq1
+func spatialMatches(runes []rune) (matches []Match) {
+	const startingPositions, averageDegree = 47.0, 4.6
+
+	for i := 0; i+2 < len(runes); {
+		j, turns, direction := i, 0, keyPosition{}
+		for j+1 < len(runes) && adjacentKeys(runes[j], runes[j+1]) {
+			from, to := keyPositions[runes[j]], keyPositions[runes[j+1]]
+			step := keyPosition{to.row - from.row, to.column - from.column}
+			if j == i || step != direction {
+				turns++
+			}
+			direction = step
+			j++
+		}
+
+		if length := j - i + 1; length >= 3 {
+			guesses := 0.0
+			for k := 2; k <= length; k++ {
+				for t := 1; t <= turns && t <= k-1; t++ {
+					guesses += binomial(k-1, t-1) * startingPositions * math.Pow(averageDegree, float64(t))
+				}
+			}
+			for _, r := range runes[i : j+1] {
+				if isShifted(r) {
+					guesses *= 2
+					break
+				}
+			}
+			matches = append(matches, newMatch("spatial", runes, i, j+1, guesses))
+			i = j + 1
+			continue
+		}
+		i++
+	}
+	return matches
+}
+
+func isShifted(r rune) bool {
+	for _, row := range keyboardRows[4:] {
+		for _, key := range row {
+			if key == r {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var separatedDate = regexp.MustCompile(`^(\d{1,4})[\s/\\_.-](\d{1,2})[\s/\\_.-](\d{1,4})$`)
+
+// dateMatches finds years and dates, with or without separators, in day, month and year orders
+func dateMatches(runes []rune) (matches []Match) {
+	for i := range runes {
+		for j := i + 4; j <= len(runes) && j-i <= 10; j++ {
+			token := string(runes[i:j])
+
+			if j-i == 4 {
+				if year, err := strconv.Atoi(token); err == nil && year >= 1900 && year <= 2049 {
+					matches = append(matches, newMatch("date", runes, i, j, yearSpace(year)))
+					continue
+				}
+			}
+			if year, ok := dateYear(token); ok {
+				matches = append(matches, newMatch("date", runes, i, j, 365*yearSpace(year)))
+			}
+		}
+	}
+	return matches
+}
+
+// dateYear reads the token as a date, giving its year
+func dateYear(token string) (int, bool) {
+	if groups := separatedDate.FindStringSubmatch(token); groups != nil {
+		return validDate(groups[1:])
+	}
+	if !allDigits(token) {
+		return 0, false
+	}
+
+	// two digit years at either end of six digits, four at either end of eight
+	switch len(token) {
+	case 6:
+		return validDate([]string{token[:2], token[2:4], token[4:]})
+	case 8:
+		if year, ok := validDate([]string{token[:2], token[2:4], token[4:]}); ok {
+			return year, true
+		}
+		return validDate([]string{token[:4], token[4:6], token[6:]})
+	}
+	return 0, false
+}
+
+// validDate accepts day and month in either order with the year first or last
+func validDate(parts []string) (int, bool) {
+	numbers := make([]int, 3)
+	for index, part := range parts {
+		numbers[index], _ = strconv.Atoi(part)
+	}
+
+	for _, order := range [][3]int{{0, 1, 2}, {2, 1, 0}, {2, 0, 1}} {
+		first, second, year := numbers[order[0]], numbers[order[1]], numbers[order[2]]
+		if len(parts[order[2]]) == 2 {
+			if year < 50 {
+				year += 2000
+			} else {
+				year += 1900
+			}
+		}
+		if year < 1000 || year > 2050 {
+			continue
+		}
+		if (first >= 1 && first <= 31 && second >= 1 && second <= 12) || (second >= 1 && second <= 31 && first >= 1 && first <= 12) {
+			return year, true
+		}
+	}
+	return 0, false
+}
+
+func yearSpace(year int) float64 {
+	return math.Max(math.Abs(float64(year-referenceYear)), minYearSpace)
+}
+
+func allDigits(token string) bool {
+	for _, r := range token {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return len(token) > 0
+}
+
+func binomial(n, k int) float64 {
+	result := 1.0
+	for i := 1; i <= k; i++ {
+		result = result * float64(n-k+i) / float64(i)
+	}
+	return result
+}
+
+func reverse(runes []rune) string {
+	reversed := make([]rune, len(runes))
+	for index, r := range runes {
+		reversed[len(runes)-1-index] = r
+	}
+	return string(reversed)
+}
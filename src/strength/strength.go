@@ -0,0 +1,208 @@
+package strength
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+// Scores run from 0, guessed at once, to 4, out of reach of an offline attack on a slow hash
+const (
+	MinScore = 0
+	MaxScore = 4
+)
+
+// maxLength bounds the runes estimated, those beyond it only make a password stronger
+const maxLength = 100
+
+// bruteforceCardinality is the guesses per character not covered by a pattern
+const bruteforceCardinality = 10
+
+// Match is a part of the password found by one of the matchers, i to j the runes it covers
+type Match struct {
+	Pattern string  `json:"pattern"`
+	Token   string  `json:"token"`
+	Guesses float64 `json:"guesses"`
+	// the list a dictionary match was found in
+	Dictionary string `json:"dictionary,omitempty"`
+	i, j       int
+}
+
+// Result estimates how many guesses find a password, from the cheapest sequence of patterns
+// that makes it up, in the manner of zxcvbn
+type Result struct {
+	Guesses  float64 `json:"guesses"`
+	Score    int     `json:"score"`
+	Warning  string  `json:"warning,omitempty"`
+	Sequence []Match `json:"sequence"`
+}
+
+// Estimate scores the password, words of the user inputs such as the key name count as common
+func Estimate(password string, userInputs ...string) Result {
+	runes := []rune(password)
+	if len(runes) > maxLength {
+		runes = runes[:maxLength]
+	}
+
+	inputs := make(map[string]int)
+	for _, input := range userInputs {
+		for _, word := range strings.FieldsFunc(strings.ToLower(input), isSeparator) {
+			if _, ok := inputs[word]; !ok && len([]rune(word)) > 1 {
+				inputs[word] = len(inputs) + 1
+			}
+		}
+	}
+
+	result := Result{Sequence: []Match{}}
+	if len(runes) == 0 {
+		result.Guesses = 1
+		result.Warning = "an empty value is guessed at once"
+		return result
+	}
+
+	var matches []Match
+	for _, name := range dictionaryNames {
+		for _, match := range dictionaryMatches(runes, "dictionary", rankedDictionaries()[name]) {
+			match.Dictionary = name
+			matches = append(matches, match)
+		}
+	}
+	matches = append(matches, dictionaryMatches(runes, "user input", inputs)...)
+	matches = append(matches, sequenceMatches(runes)...)
+	matches = append(matches, repeatMatches(runes)...)
+	matches = append(matches, spatialMatches(runes)...)
+	matches = append(matches, dateMatches(runes)...)
+
+	logGuesses, sequence := mostGuessable(runes, matches)
+	result.Guesses = math.Pow(10, logGuesses)
+	result.Score = score(logGuesses)
+	result.Sequence = sequence
+	result.Warning = warning(result, len(runes))
+	return result
+}
+
+// mostGuessable finds the sequence of non overlapping matches, with bruteforce between them,
+// needing the fewest guesses: the product of their guesses times the factorial of their count,
+// plus a penalty for each further match. Sums of base 10 logarithms stand in for products.
+func mostGuessable(runes []rune, matches []Match) (float64, []Match) {
+	n := len(runes)
+	for i := 0; i < n; i++ {
+		for j := i + 1; j <= n; j++ {
+			matches = append(matches, Match{Pattern: "bruteforce", Token: string(runes[i:j]),
+				Guesses: math.Pow(bruteforceCardinality, float64(j-i)), i: i, j: j})
+		}
+	}
+
+	ending := make([][]int, n+1)
+	for index, match := range matches {
+		ending[match.j] = append(ending[match.j], index)
+	}
+
+	// best[k][l] is the least log guesses covering the first k runes with l matches
+	best := make([][]float64, n+1)
+	previous := make([][]int, n+1)
+	for k := range best {
+		best[k] = make([]float64, n+1)
+		previous[k] = make([]int, n+1)
+		for l := range best[k] {
+			best[k][l] = math.Inf(1)
+		}
+	}
+	best[0][0] = 0
+
+	for k := 1; k <= n; k++ {
+		for _, index := range ending[k] {
+			match := matches[index]
+			cost := math.Log10(match.Guesses)
+			for l := 1; l <= k; l++ {
+				if candidate := best[match.i][l-1] + cost; candidate < best[k][l] {
+					best[k][l] = candidate
+					previous[k][l] = index
+				}
+			}
+		}
+	}
+
+	least, count := math.Inf(1), 0
+	for l := 1; l <= n; l++ {
+		if math.IsInf(best[n][l], 1) {
+			continue
+		}
+		logFactorial, _ := math.Lgamma(float64(l + 1))
+		product := best[n][l] + logFactorial/math.Ln10
+		total := math.Log10(math.Pow(10, product) + math.Pow(10, 4*float64(l-1)))
+		if math.IsInf(total, 1) {
+			total = math.Max(product, 4*float64(l-1))
+		}
+		if total < least {
+			least, count = total, l
+		}
+	}
+
+	sequence := make([]Match, count)
+	for k, l := n, count; l > 0; l-- {
+		sequence[l-1] = matches[previous[k][l]]
+		k = sequence[l-1].i
+	}
+	return least, sequence
+}
+
+// score follows zxcvbn's thresholds, from 10^3 to 10^10 guesses
+func score(logGuesses float64) int {
+	for index, threshold := range []float64{3, 6, 8, 10} {
+		if logGuesses < threshold+0.001 {
+			return index
+		}
+	}
+	return MaxScore
+}
+
+// warning names the longest pattern in a weak password
+func warning(result Result, length int) string {
+	if result.Score >= 3 {
+		return ""
+	}
+
+	var longest *Match
+	for index := range result.Sequence {
+		match := &result.Sequence[index]
+		if match.Pattern != "bruteforce" && (longest == nil || match.j-match.i > longest.j-longest.i) {
+			longest = match
+		}
+	}
+	if longest == nil {
+		if length < 10 {
+			return "short values are guessed quickly, use a longer one"
+		}
+		return "add more characters, or words that are not common"
+	}
+
+	switch longest.Pattern {
+	case "dictionary":
+		password, whole := longest.Dictionary == "passwords", longest.j-longest.i == length
+		switch {
+		case password && whole:
+			return "this is a commonly used password"
+		case password:
+			return "it is built on a commonly used password"
+		case whole:
+			return "a single common word or name is easy to guess"
+		}
+		return "common words and names are easy to guess, joined or not"
+	case "user input":
+		return "it repeats the key or store name"
+	case "sequence":
+		return "sequences like abc or 6543 are easy to guess"
+	case "repeat":
+		return "repeats like aaa or abcabc are easy to guess"
+	case "spatial":
+		return "keyboard patterns like qwerty are easy to guess"
+	case "date":
+		return "dates and years are easy to guess"
+	}
+	return ""
+}
+
+func isSeparator(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+}
@@ -0,0 +1,64 @@
+package strength
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestEstimate(t *testing.T) {
+	cases := []struct {
+		in      string
+		inputs  []string
+		want    int
+		pattern string
+	}{
+		{"password", nil, 0, "dictionary"},
+		{"P@ssw0rd", nil, 0, "dictionary"},
+		{"friendship", nil, 1, "dictionary"},
+		{"beautifulgarden", nil, 1, "dictionary"},
+		{"B34ut1fulG4rden", nil, 2, "dictionary"},
+		{"johnson1985", nil, 1, "dictionary"},
+		{"abcdef", nil, 0, "sequence"},
+		{"aaaaaa", nil, 0, "repeat"},
+		{"zxcvfdsa", nil, 1, "spatial"},
+		{"19850412", nil, 1, "date"},
+		{"github2020", []string{"github"}, 1, "user input"},
+		{"correct horse battery staple", nil, 4, ""},
+		{"x7$Kq!9zLm#2", nil, 4, ""},
+	}
+
+	for _, c := range cases {
+		got := Estimate(c.in, c.inputs...)
+		fmt.Printf("Received score %d for %q with %q\n", got.Score, c.in, got.Warning)
+
+		if got.Score != c.want {
+			t.Errorf("Expected %d, received %d for %q", c.want, got.Score, c.in)
+		}
+		if c.pattern != "" && !hasPattern(got, c.pattern) {
+			t.Errorf("Expected %q, received %v for %q", c.pattern, got.Sequence, c.in)
+		}
+		if (got.Score < 3) != (got.Warning != "") {
+			t.Errorf("Expected a warning only for weak values, received %q for %q", got.Warning, c.in)
+		}
+	}
+}
+
+func TestEstimateLength(t *testing.T) {
+	got := Estimate(strings.Repeat("x7$Kq!9zLm#2", 50))
+	if got.Score != 3 && got.Score != MaxScore {
+		t.Errorf("Expected a strong score, received %d", got.Score)
+	}
+	if got := Estimate(""); got.Score != MinScore {
+		t.Errorf("Expected %d, received %d", MinScore, got.Score)
+	}
+}
+
+func hasPattern(result Result, pattern string) bool {
+	for _, match := range result.Sequence {
+		if match.Pattern == pattern {
+			return true
+		}
+	}
+	return false
+}
@@ -1,28 +1,85 @@
 package util
 
 import (
+	"keepo/src/data/output"
 	"log"
 	"os"
 )
 
+const (
+	// FailureCode is reported for errors that do not carry a code of their own
+	FailureCode = 1
+	// StateCode is reported when a CheckState expectation does not hold
+	StateCode = 2
+	// UsageCode is reported when the command line could not be understood
+	UsageCode = 3
+)
+
+var errorFormat = output.Text
+
+// cleanups are run by Fail before it exits, deferred calls are not
+var cleanups []func()
+
+type failure struct {
+	Error failureDetail `json:"error"`
+}
+
+type failureDetail struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// SetErrorFormat selects how failures are reported on stderr
+func SetErrorFormat(format output.Format) {
+	errorFormat = format
+}
+
 func CheckState(expression bool, message string) {
 	if !expression {
-		_, err := os.Stderr.Write([]byte("\033[1;31m" + message + "\033[0m\n"))
-		if err != nil {
-			log.Println("could not write state message: " + err.Error())
-			os.Exit(2)
-		}
-		os.Exit(1)
+		Fail(StateCode, message)
 	}
 }
 
 func CheckError(err error, message string) {
 	if err != nil {
-		_, err := os.Stderr.Write([]byte("\033[1;31m" + message + " (" + err.Error() + ")\033[0m\n"))
-		if err != nil {
-			log.Println("could not write error message: " + err.Error())
-			os.Exit(2)
-		}
-		os.Exit(1)
+		Fail(ErrorCode(err), message+" ("+err.Error()+")")
+	}
+}
+
+// ErrorCode gives the stable numeric code of an error, errors with a Code method report their own
+func ErrorCode(err error) int {
+	if coded, ok := err.(interface{ Code() int }); ok {
+		return coded.Code()
+	}
+	return FailureCode
+}
+
+// OnFail has Fail run cleanup before it exits, for what deferred calls would otherwise leave
+// behind, such as temporary files
+func OnFail(cleanup func()) {
+	cleanups = append(cleanups, cleanup)
+}
+
+// Fail reports the message in the selected error format and exits with the code, so scripts can
+// tell failures apart
+func Fail(code int, message string) {
+	for index := len(cleanups) - 1; index >= 0; index-- {
+		cleanups[index]()
+	}
+
+	var err error
+	if errorFormat.Structured() {
+		err = output.Encode(os.Stderr, errorFormat, failure{failureDetail{code, message}})
+	} else {
+		_, err = os.Stderr.Write([]byte(errorText(message) + "\n"))
+	}
+
+	if err != nil {
+		log.Println("could not write error message: " + err.Error())
+		os.Exit(2)
+	}
+	if code <= 0 || code > 255 {
+		code = FailureCode
 	}
+	os.Exit(code)
 }
@@ -0,0 +1,43 @@
+package util
+
+import "os"
+
+const (
+	boldOpen   = "\033[1m"
+	redOpen    = "\033[1;31m"
+	styleClose = "\033[0m"
+)
+
+// colour is only written to terminals and is disabled entirely by a non-empty NO_COLOR
+func colourEnabled(file *os.File) bool {
+	if len(os.Getenv("NO_COLOR")) > 0 {
+		return false
+	}
+
+	fi, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+func Bold(text string) string {
+	if colourEnabled(os.Stdout) {
+		return boldOpen + text + styleClose
+	}
+	return text
+}
+
+func Red(text string) string {
+	if colourEnabled(os.Stdout) {
+		return redOpen + text + styleClose
+	}
+	return text
+}
+
+func errorText(text string) string {
+	if colourEnabled(os.Stderr) {
+		return redOpen + text + styleClose
+	}
+	return text
+}